@@ -1,27 +1,39 @@
 package bios
 
 import (
-	"bufio"
 	"fmt"
-	"os"
 	"time"
 
+	"door86.org/ivdoor/console"
 	"door86.org/ivdoor/cpu"
+	"door86.org/ivdoor/video"
 	"github.com/golang/glog"
 	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
 
 type Bios struct {
-	mu  uc.Unicorn
-	in  *bufio.Reader
-	out *bufio.Writer
+	mu     uc.Unicorn
+	con    *console.Console
+	screen *video.Screen
+	// Sends the caller what INT 10h draws, may be nil
+	renderer *video.Renderer
+	// The COM ports' registers, nil unless they are emulated
+	uart *uart
+	// The clock the program sees
+	Now func() time.Time
 }
 
-func NewBios(mu uc.Unicorn, start, end cpu.Seg) *Bios {
+// NewBios creates the BIOS services.  screen must be receiving the console
+// output.
+func NewBios(mu uc.Unicorn, start, end cpu.Seg, con *console.Console, screen *video.Screen) *Bios {
 	b := &Bios{
-		mu:  mu,
-		in:  bufio.NewReader(os.Stdin),
-		out: bufio.NewWriter(os.Stdout),
+		mu:     mu,
+		con:    con,
+		screen: screen,
+		Now:    time.Now,
+	}
+	if err := b.attachScreen(); err != nil {
+		glog.Warningf("Error attaching video memory: '%s'", err)
 	}
 
 	return b
@@ -29,24 +41,12 @@ func NewBios(mu uc.Unicorn, start, end cpu.Seg) *Bios {
 
 func (bios Bios) Int1A(mu uc.Unicorn, intrNum uint32) error {
 	ah := cpu.Reg8(mu, uc.X86_REG_AH)
-	//	bx := cpu.Reg16(mu, uc.X86_REG_BX)
-	//	cx := cpu.Reg16(mu, uc.X86_REG_CX)
-	//	dx := cpu.Reg16(mu, uc.X86_REG_DX)
-	cs := cpu.SReg16(mu, uc.X86_REG_CS)
-	ds := cpu.SReg16(mu, uc.X86_REG_DS)
-	es := cpu.SReg16(mu, uc.X86_REG_ES)
-	ss := cpu.SReg16(mu, uc.X86_REG_SS)
-	ip := cpu.SReg16(mu, uc.X86_REG_IP)
-	sp := cpu.SReg16(mu, uc.X86_REG_SP)
-
-	glog.V(1).Infof("Int1A: CS: 0x%04X DS: 0x%04X ES: 0x%04X SS: 0x%04X IP: 0x%04X SP: 0x%04X\n",
-		cs, ds, es, ss, ip, sp)
 
 	switch ah {
 	case 0x00: // Read System Clock Counter
-		loc, _ := time.LoadLocation("America/New_York")
-		now := time.Now().In(loc)
-		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		// Midnight in the time zone of the door's clock
+		now := bios.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
 		// Ticks are 18.206 per second and Seconds returns a float with nanos
 		d := uint64(now.Sub(midnight).Seconds() * 18.206)
 
@@ -59,10 +59,3 @@ func (bios Bios) Int1A(mu uc.Unicorn, intrNum uint32) error {
 	}
 	return nil
 }
-
-/*
-loc, _ := time.LoadLocation("America/New_York")
-now := time.Now().In(loc)
-midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
-d := now.Sub(midnight)
-*/
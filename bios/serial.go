@@ -0,0 +1,170 @@
+package bios
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"door86.org/ivdoor/cpu"
+	"github.com/golang/glog"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Line status, returned in AH
+const (
+	lineDataReady = 0x01
+	lineTxEmpty   = 0x20 // transmit holding register empty
+	lineTxIdle    = 0x40 // transmit shift register empty
+	lineTimeout   = 0x80
+)
+
+// Modem status, returned in AL
+const (
+	// FOSSIL drivers always set this bit so doors can tell them apart
+	modemAlways = 0x08
+	modemDCD    = 0x80
+)
+
+const (
+	fossilSignature   = 0x1954
+	fossilRevision    = 5
+	fossilMaxFunction = 0x1B
+	// Size reported for the FOSSIL input and output buffers
+	fossilBufferSize = 4096
+)
+
+// Returns the port status for AX: line status in AH and modem status in
+// AL.  DCD follows the caller's carrier.
+func (b *Bios) serialStatus() uint16 {
+	line := uint16(lineTxEmpty | lineTxIdle)
+	if _, ok := b.con.Peek(); ok {
+		line |= lineDataReady
+	}
+	modem := uint16(modemAlways)
+	if b.con.Carrier() {
+		modem |= modemDCD
+	}
+	return line<<8 | modem
+}
+
+// Int14 is the BIOS serial port service along with the FOSSIL extensions
+// doors use to talk to the caller.  Every port is the caller's connection.
+func (b *Bios) Int14(mu uc.Unicorn, intrNum uint32) error {
+	ah := cpu.Reg8(mu, uc.X86_REG_AH)
+	al := cpu.Reg8(mu, uc.X86_REG_AL)
+	cx := cpu.Reg16(mu, uc.X86_REG_CX)
+	dx := cpu.Reg16(mu, uc.X86_REG_DX)
+	es := cpu.SReg16(mu, uc.X86_REG_ES)
+	di := cpu.Reg16(mu, uc.X86_REG_DI)
+
+	glog.V(2).Infof("Int14: AH: 0x%02X AL: 0x%02X port: %d", ah, al, dx)
+
+	switch ah {
+	case 0x00: // Initialize Port
+		mu.RegWrite(uc.X86_REG_AX, uint64(b.serialStatus()))
+
+	case 0x01: // Transmit Character
+		b.con.Write([]byte{al})
+		mu.RegWrite(uc.X86_REG_AX, uint64(b.serialStatus()))
+
+	case 0x02: // Receive Character, waiting for one
+		c, err := b.con.ReadByte()
+		if err != nil {
+			mu.RegWrite(uc.X86_REG_AX, lineTimeout<<8)
+			return nil
+		}
+		mu.RegWrite(uc.X86_REG_AX, uint64(c))
+
+	case 0x03: // Get Port Status
+		mu.RegWrite(uc.X86_REG_AX, uint64(b.serialStatus()))
+
+	case 0x04: // Initialize FOSSIL Driver
+		mu.RegWrite(uc.X86_REG_AX, fossilSignature)
+		mu.RegWrite(uc.X86_REG_BX, fossilRevision<<8|fossilMaxFunction)
+
+	case 0x05: // Deinitialize FOSSIL Driver
+
+	case 0x06: // Raise/Lower DTR
+		// Dropping DTR is how a door hangs up on the caller
+		if al == 0 {
+			glog.Infoln("Int14: DTR lowered, hanging up")
+			b.con.Hangup()
+		}
+
+	case 0x08: // Flush Output Buffer
+	case 0x09: // Purge Output Buffer
+
+	case 0x0a: // Purge Input Buffer
+		b.con.Discard()
+
+	case 0x0b: // Transmit Without Waiting
+		sent := 0
+		if b.con.Carrier() {
+			b.con.Write([]byte{al})
+			sent = 1
+		}
+		mu.RegWrite(uc.X86_REG_AX, uint64(sent))
+
+	case 0x0c: // Peek Ahead Input Buffer
+		c, ok := b.con.Peek()
+		if !ok {
+			mu.RegWrite(uc.X86_REG_AX, 0xFFFF)
+			return nil
+		}
+		mu.RegWrite(uc.X86_REG_AX, uint64(c))
+
+	case 0x0d: // Keyboard Peek, there's no local keyboard
+		mu.RegWrite(uc.X86_REG_AX, 0xFFFF)
+
+	case 0x0f: // Enable/Disable Flow Control
+
+	case 0x18: // Read Block, without waiting
+		n := 0
+		for n < int(cx) {
+			if _, ok := b.con.Peek(); !ok {
+				break
+			}
+			c, err := b.con.ReadByte()
+			if err != nil {
+				break
+			}
+			mu.MemWrite(cpu.Addr(es, di+uint16(n)), []byte{c})
+			n++
+		}
+		mu.RegWrite(uc.X86_REG_AX, uint64(n))
+
+	case 0x19: // Write Block
+		buf, err := cpu.Mem(mu, es, di, uint64(cx))
+		if err != nil {
+			return err
+		}
+		n := 0
+		if b.con.Carrier() {
+			n, _ = b.con.Write(buf)
+		}
+		mu.RegWrite(uc.X86_REG_AX, uint64(n))
+
+	case 0x1b: // Get Driver Information
+		info := make([]byte, 19)
+		binary.LittleEndian.PutUint16(info[0:], uint16(len(info)))
+		info[2] = fossilRevision
+		// 3 is the driver revision and 4-7 the far pointer to its name,
+		// both left zero
+		binary.LittleEndian.PutUint16(info[8:], fossilBufferSize)
+		binary.LittleEndian.PutUint16(info[10:], uint16(fossilBufferSize-b.con.Buffered()))
+		binary.LittleEndian.PutUint16(info[12:], fossilBufferSize)
+		binary.LittleEndian.PutUint16(info[14:], fossilBufferSize)
+		info[16] = 80
+		info[17] = 25
+		// 38400 baud, 8N1
+		info[18] = 0x23
+		if int(cx) < len(info) {
+			info = info[:cx]
+		}
+		mu.MemWrite(cpu.Addr(es, di), info)
+		mu.RegWrite(uc.X86_REG_AX, uint64(len(info)))
+
+	default:
+		return fmt.Errorf("unhandled Interrupt 14 subfunction: 0x%02X", ah)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package bios
+
+import (
+	"github.com/golang/glog"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Base I/O ports of COM1-4.  Like INT 14h, every port is the caller's
+// connection.
+var uartPorts = []uint32{0x3F8, 0x2F8, 0x3E8, 0x2E8}
+
+// 8250 registers, as offsets from the base port
+const (
+	uartData        = 0 // RBR when read, THR when written
+	uartIntEnable   = 1
+	uartIntIdent    = 2 // IIR when read, FCR when written
+	uartLineControl = 3
+	uartModemCtrl   = 4
+	uartLineStatus  = 5
+	uartModemStatus = 6
+	uartScratch     = 7
+)
+
+const (
+	// Line control bit switching registers 0 and 1 to the baud divisor
+	lineDLAB = 0x80
+	// Modem control bits
+	modemCtrlDTR  = 0x01
+	modemCtrlRTS  = 0x02
+	modemCtrlOUT2 = 0x08
+	// Modem status bits, besides DCD
+	modemDeltaDCD = 0x08
+	modemCTS      = 0x10
+	modemDSR      = 0x20
+	// No interrupt pending, they are never raised
+	intIdentNone = 0x01
+)
+
+// The registers the door can write and read back.
+type uart struct {
+	intEnable   byte
+	lineControl byte
+	modemCtrl   byte
+	scratch     byte
+	divisor     uint16
+	// Carrier when the modem status was last read, for the delta bit
+	carrier bool
+}
+
+// AttachUART emulates the 8250 UART registers of the COM ports for doors
+// that talk to the serial port directly instead of through a FOSSIL.  DCD
+// in the modem status follows the caller's carrier.  Interrupts aren't
+// raised, so it only suits doors that poll the line status.
+func (b *Bios) AttachUART() error {
+	// The BBS left the port open with the modem raised
+	b.uart = &uart{lineControl: 0x03, modemCtrl: modemCtrlDTR | modemCtrlRTS | modemCtrlOUT2, divisor: 3, carrier: true}
+	if _, err := b.mu.HookAdd(uc.HOOK_INSN, func(mu uc.Unicorn, port, size uint32) uint32 {
+		if reg, ok := uartRegister(port); ok {
+			return uint32(b.uartIn(reg))
+		}
+		return 0
+	}, 1, 0, uc.X86_INS_IN); err != nil {
+		return err
+	}
+	_, err := b.mu.HookAdd(uc.HOOK_INSN, func(mu uc.Unicorn, port, size, value uint32) {
+		if reg, ok := uartRegister(port); ok {
+			b.uartOut(reg, byte(value))
+		}
+	}, 1, 0, uc.X86_INS_OUT)
+	return err
+}
+
+// Returns the register of a COM port that port addresses.
+func uartRegister(port uint32) (uint32, bool) {
+	for _, base := range uartPorts {
+		if port >= base && port < base+8 {
+			return port - base, true
+		}
+	}
+	return 0, false
+}
+
+func (b *Bios) uartIn(reg uint32) byte {
+	u := b.uart
+	dlab := u.lineControl&lineDLAB != 0
+	switch reg {
+	case uartData:
+		if dlab {
+			return byte(u.divisor)
+		}
+		if _, ok := b.con.Peek(); !ok {
+			return 0
+		}
+		c, err := b.con.ReadByte()
+		if err != nil {
+			return 0
+		}
+		return c
+	case uartIntEnable:
+		if dlab {
+			return byte(u.divisor >> 8)
+		}
+		return u.intEnable
+	case uartIntIdent:
+		return intIdentNone
+	case uartLineControl:
+		return u.lineControl
+	case uartModemCtrl:
+		return u.modemCtrl
+	case uartLineStatus:
+		return byte(b.serialStatus() >> 8)
+	case uartModemStatus:
+		carrier := b.con.Carrier()
+		status := byte(modemCTS | modemDSR)
+		if carrier {
+			status |= modemDCD
+		}
+		if carrier != u.carrier {
+			status |= modemDeltaDCD
+			u.carrier = carrier
+		}
+		return status
+	case uartScratch:
+		return u.scratch
+	}
+	return 0
+}
+
+func (b *Bios) uartOut(reg uint32, value byte) {
+	u := b.uart
+	dlab := u.lineControl&lineDLAB != 0
+	switch reg {
+	case uartData:
+		if dlab {
+			u.divisor = u.divisor&0xFF00 | uint16(value)
+		} else if b.con.Carrier() {
+			b.con.Write([]byte{value})
+		}
+	case uartIntEnable:
+		if dlab {
+			u.divisor = u.divisor&0x00FF | uint16(value)<<8
+		} else {
+			u.intEnable = value
+		}
+	case uartLineControl:
+		u.lineControl = value
+	case uartModemCtrl:
+		// Dropping DTR is how a door hangs up on the caller
+		if u.modemCtrl&modemCtrlDTR != 0 && value&modemCtrlDTR == 0 {
+			glog.Infoln("UART: DTR lowered, hanging up")
+			b.con.Hangup()
+		}
+		u.modemCtrl = value
+	case uartScratch:
+		u.scratch = value
+	}
+}
@@ -0,0 +1,103 @@
+package bios
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/record"
+)
+
+func TestUART(t *testing.T) {
+	in, w := io.Pipe()
+	defer w.Close()
+	b := &Bios{con: console.NewRemote(in, io.Discard)}
+	b.uart = &uart{modemCtrl: modemCtrlDTR | modemCtrlRTS | modemCtrlOUT2, carrier: true}
+	reg := func(port uint32) uint32 {
+		r, ok := uartRegister(port)
+		if !ok {
+			t.Fatalf("%Xh isn't a UART register", port)
+		}
+		return r
+	}
+
+	if got := b.uartIn(reg(0x3FE)); got != modemDCD|modemDSR|modemCTS {
+		t.Errorf("COM1 modem status %02X", got)
+	}
+	if got := b.uartIn(reg(0x2FD)); got != lineTxEmpty|lineTxIdle {
+		t.Errorf("COM2 line status %02X", got)
+	}
+	if _, ok := uartRegister(0x378); ok {
+		t.Error("the printer port is a UART")
+	}
+
+	// Dropping DTR hangs up, which DCD then shows, with its delta bit
+	// set only on the first read
+	b.uartOut(reg(0x3FC), modemCtrlRTS|modemCtrlOUT2)
+	if b.con.Carrier() {
+		t.Fatal("carrier after DTR was dropped")
+	}
+	if got := b.uartIn(reg(0x3FE)); got != modemDeltaDCD|modemDSR|modemCTS {
+		t.Errorf("modem status after hang up %02X", got)
+	}
+	if got := b.uartIn(reg(0x3FE)); got != modemDSR|modemCTS {
+		t.Errorf("modem status read again %02X", got)
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// A door polling the line status raises no interrupts to let the held
+// input of a recorded session through, so polling has to.
+func TestUARTRecording(t *testing.T) {
+	in, w := io.Pipe()
+	defer w.Close()
+	con := console.NewRemote(in, io.Discard)
+	var recording bytes.Buffer
+	rec, err := record.NewRecorder(nopCloser{&recording}, record.Header{Program: "DOOR.EXE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Attach(con, func() uint64 { return 7 })
+	b := &Bios{con: con}
+	b.uart = &uart{modemCtrl: modemCtrlDTR | modemCtrlRTS | modemCtrlOUT2, carrier: true}
+
+	go w.Write([]byte("x"))
+	for deadline := time.Now().Add(5 * time.Second); b.uartIn(uartLineStatus)&lineDataReady == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("data ready never set")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := b.uartIn(uartData); got != 'x' {
+		t.Errorf("read %q", got)
+	}
+	if err := rec.End(0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is recorded where the door polled for it
+	var got []record.Event
+	lines := bufio.NewScanner(&recording)
+	lines.Scan()
+	for lines.Scan() {
+		var e record.Event
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Kind == record.Input {
+			got = append(got, e)
+		}
+	}
+	if len(got) != 1 || string(got[0].Data) != "x" || got[0].Seq != 7 {
+		t.Errorf("recorded input %+v", got)
+	}
+}
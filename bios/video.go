@@ -0,0 +1,191 @@
+package bios
+
+import (
+	"door86.org/ivdoor/cpu"
+	"door86.org/ivdoor/video"
+	"github.com/golang/glog"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// BIOS data area fields describing the display.
+const (
+	bdaVideoMode   = 0x449
+	bdaColumns     = 0x44A
+	bdaPageSize    = 0x44C
+	bdaCursorPos   = 0x450
+	bdaCursorShape = 0x460
+	bdaActivePage  = 0x462
+	bdaCRTPort     = 0x463
+	bdaRows        = 0x484
+)
+
+const (
+	// 80x25 colour text
+	videoMode   = 0x03
+	cursorShape = 0x0607
+)
+
+// Links the emulated screen to video memory and the BIOS data area.  Guest
+// writes to video memory are copied back to the screen so it always shows
+// what the guest sees, and changes to the screen are copied to video memory
+// by SyncScreen.
+func (b *Bios) attachScreen() error {
+	mu := b.mu
+	base := uint64(cpu.Addr(video.Segment, 0))
+	mu.MemWrite(bdaVideoMode, []byte{videoMode})
+	cpu.PutMem16(mu, bdaColumns, video.Width)
+	cpu.PutMem16(mu, bdaPageSize, video.Size)
+	cpu.PutMem16(mu, bdaCursorShape, cursorShape)
+	mu.MemWrite(bdaActivePage, []byte{0})
+	cpu.PutMem16(mu, bdaCRTPort, 0x3D4)
+	mu.MemWrite(bdaRows, []byte{video.Height - 1})
+
+	b.screen.SetSync(func(offset int, data []byte) {
+		mu.MemWrite(base+uint64(offset), data)
+	}, func(x, y int) {
+		mu.MemWrite(bdaCursorPos, []byte{byte(x), byte(y)})
+	})
+	b.screen.Sync()
+	_, err := mu.HookAdd(uc.HOOK_MEM_WRITE, func(mu uc.Unicorn, access int, addr uint64, size int, value int64) {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(value >> (8 * i))
+		}
+		b.screen.Poke(int(addr-base), data)
+	}, base, base+video.Size-1)
+	return err
+}
+
+// SyncScreen copies what changed on the screen since it was last called
+// into video memory.  Unicorn's memory may only be written on the
+// emulator's thread, so this is called after each interrupt rather than as
+// the console, chat and the like change the screen.
+func (b *Bios) SyncScreen() {
+	b.screen.Sync()
+}
+
+// SetRenderer sets the renderer that sends the caller what INT 10h draws
+// on the screen directly.  Without one the caller only sees the console
+// output.
+func (b *Bios) SetRenderer(r *video.Renderer) {
+	b.renderer = r
+}
+
+// Sends the caller what was just drawn so it isn't overtaken by console
+// output.
+func (b *Bios) render() {
+	if b.renderer == nil {
+		return
+	}
+	if err := b.renderer.Flush(); err != nil {
+		glog.Warningf("Error rendering screen: '%s'", err)
+	}
+}
+
+// Int10 is the BIOS video service, working on the emulated screen.  Cursor
+// movement and teletype output are sent through the console like any other
+// output, so the caller and the screen stay the same, while characters
+// drawn at a position and scrolled windows are sent by the renderer.
+func (b *Bios) Int10(mu uc.Unicorn, intrNum uint32) error {
+	ah := cpu.Reg8(mu, uc.X86_REG_AH)
+	al := cpu.Reg8(mu, uc.X86_REG_AL)
+	bh := cpu.Reg8(mu, uc.X86_REG_BH)
+	bl := cpu.Reg8(mu, uc.X86_REG_BL)
+	cx := cpu.Reg16(mu, uc.X86_REG_CX)
+	dx := cpu.Reg16(mu, uc.X86_REG_DX)
+
+	glog.V(2).Infof("Int10: AH: 0x%02X AL: 0x%02X BX: 0x%02X%02X CX: 0x%04X DX: 0x%04X", ah, al, bh, bl, cx, dx)
+
+	s := b.screen
+	x, y := s.Cursor()
+	switch ah {
+	case 0x00: // Set Video Mode
+		// Only 80x25 text is supported, setting a mode clears the screen
+		b.con.Write([]byte(video.SGR(video.DefaultAttr) + "\x1b[2J"))
+
+	case 0x01: // Set Cursor Shape
+
+	case 0x02: // Set Cursor Position
+		b.con.Write([]byte(video.CUP(int(dx&0xff), int(dx>>8))))
+
+	case 0x03: // Get Cursor Position and Shape
+		mu.RegWrite(uc.X86_REG_DX, uint64(y<<8|x))
+		mu.RegWrite(uc.X86_REG_CX, cursorShape)
+
+	case 0x05: // Select Active Display Page
+
+	case 0x06, 0x07: // Scroll Window Up/Down
+		top, left := int(cx>>8), int(cx&0xff)
+		bottom, right := int(dx>>8), int(dx&0xff)
+		n := int(al)
+		if ah == 0x07 {
+			n = -n
+		}
+		if n == 0 && top == 0 && left == 0 && bottom >= video.Height-1 && right >= video.Width-1 {
+			// Clearing the screen, which the caller can do themselves
+			b.con.Write([]byte(video.SGR(bh) + "\x1b[2J" + video.SGR(s.Attr()) + video.CUP(x, y)))
+			return nil
+		}
+		s.Scroll(top, left, bottom, right, n, bh)
+		b.render()
+
+	case 0x08: // Read Character and Attribute at Cursor
+		ch, attr := s.Cell(x, y)
+		mu.RegWrite(uc.X86_REG_AX, uint64(attr)<<8|uint64(ch))
+
+	case 0x09: // Write Character and Attribute at Cursor
+		s.SetCells(x, y, int(cx), al, bl)
+		b.render()
+
+	case 0x0a: // Write Character at Cursor
+		s.SetChars(x, y, int(cx), al)
+		b.render()
+
+	case 0x0e: // Teletype Output
+		b.con.Write([]byte{al})
+
+	case 0x0f: // Get Video Mode
+		mu.RegWrite(uc.X86_REG_AX, video.Width<<8|videoMode)
+		mu.RegWrite(uc.X86_REG_BH, 0)
+
+	case 0x13: // Write String
+		es := cpu.SReg16(mu, uc.X86_REG_ES)
+		bp := cpu.Reg16(mu, uc.X86_REG_BP)
+		attrs := al&0x02 != 0
+		n := uint64(cx)
+		if attrs {
+			n *= 2
+		}
+		str, err := cpu.Mem(mu, es, bp, n)
+		if err != nil {
+			return err
+		}
+		out := []byte(video.CUP(int(dx&0xff), int(dx>>8)))
+		attr, last := bl, -1
+		for i := 0; i < len(str); i++ {
+			if attrs {
+				attr = str[i+1]
+			}
+			if int(attr) != last {
+				out = append(out, video.SGR(attr)...)
+				last = int(attr)
+			}
+			out = append(out, str[i])
+			if attrs {
+				i++
+			}
+		}
+		out = append(out, video.SGR(s.Attr())...)
+		// Bit 0 of AL says whether the cursor moves
+		if al&0x01 == 0 {
+			out = append(out, video.CUP(x, y)...)
+		}
+		b.con.Write(out)
+
+	default:
+		// As the BIOS does, unknown functions return without changing
+		// anything
+		glog.Warningf("Int10: unhandled subfunction 0x%02X", ah)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Package cast saves what the caller sees as a terminal recording with
+// timing, in the asciicast v2 format used by asciinema or as ttyrec, so it
+// can be played back later on a web page or a terminal.
+package cast
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Format int
+
+const (
+	Asciicast Format = iota
+	Ttyrec
+)
+
+func (f Format) String() string {
+	switch f {
+	case Asciicast:
+		return "asciicast"
+	case Ttyrec:
+		return "ttyrec"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ParseFormat parses a format name, asciicast or ttyrec.  An empty name
+// picks the format from the extension of path, asciicast unless it is
+// .ttyrec or .tty.
+func ParseFormat(name, path string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "asciicast", "cast":
+		return Asciicast, nil
+	case "ttyrec":
+		return Ttyrec, nil
+	case "":
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".ttyrec", ".tty":
+			return Ttyrec, nil
+		}
+		return Asciicast, nil
+	}
+	return Asciicast, fmt.Errorf("unknown recording format: '%s'", name)
+}
+
+// Writer records output written to it.  For asciicast the output has to
+// be UTF-8.
+type Writer struct {
+	format Format
+	start  time.Time
+	// Returns the time, for tests
+	now func() time.Time
+
+	mu  sync.Mutex
+	w   io.WriteCloser
+	err error
+}
+
+// Info describes the recorded terminal.
+type Info struct {
+	Width, Height int
+	Title         string
+	// Terminal type, for asciicast
+	Term string
+}
+
+// New starts a recording on w in format f.  w is closed by Close.
+func New(w io.WriteCloser, f Format, info Info) (*Writer, error) {
+	return newWriter(w, f, info, time.Now)
+}
+
+func newWriter(w io.WriteCloser, f Format, info Info, now func() time.Time) (*Writer, error) {
+	c := &Writer{format: f, start: now(), now: now, w: w}
+	switch f {
+	case Asciicast:
+		header := struct {
+			Version   int               `json:"version"`
+			Width     int               `json:"width"`
+			Height    int               `json:"height"`
+			Timestamp int64             `json:"timestamp"`
+			Title     string            `json:"title,omitempty"`
+			Env       map[string]string `json:"env,omitempty"`
+		}{2, info.Width, info.Height, c.start.Unix(), info.Title, nil}
+		if info.Term != "" {
+			header.Env = map[string]string{"TERM": info.Term}
+		}
+		if err := json.NewEncoder(w).Encode(header); err != nil {
+			return nil, err
+		}
+	case Ttyrec:
+		// ttyrec has no header, players that understand it resize the
+		// terminal from the xterm sequence instead
+		c.Write([]byte(fmt.Sprintf("\x1b[8;%d;%dt", info.Height, info.Width)))
+		if c.err != nil {
+			return nil, c.err
+		}
+	default:
+		return nil, fmt.Errorf("unknown recording format: %s", f)
+	}
+	return c, nil
+}
+
+// Write records p as output at the current time.  Errors writing the
+// recording are kept for Close, so that a failing recording doesn't end
+// the session it is recording.
+func (c *Writer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || len(p) == 0 {
+		return len(p), nil
+	}
+	now := c.now()
+	switch c.format {
+	case Asciicast:
+		// [seconds, "o", data]
+		var line []byte
+		line, c.err = json.Marshal([]interface{}{now.Sub(c.start).Seconds(), "o", string(p)})
+		if c.err == nil {
+			_, c.err = c.w.Write(append(line, '\n'))
+		}
+	case Ttyrec:
+		// Seconds and microseconds of the wall clock, and the length
+		var header [12]byte
+		binary.LittleEndian.PutUint32(header[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(header[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(p)))
+		if _, c.err = c.w.Write(header[:]); c.err == nil {
+			_, c.err = c.w.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Close ends the recording.
+func (c *Writer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.w.Close()
+	if c.err != nil {
+		return c.err
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package cast
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+type buffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *buffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+// Returns a clock starting at start and moving on by step each call.
+func clock(start time.Time, step time.Duration) func() time.Time {
+	t := start.Add(-step)
+	return func() time.Time {
+		t = t.Add(step)
+		return t
+	}
+}
+
+func TestAsciicast(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	var b buffer
+	c, err := newWriter(&b, Asciicast, Info{Width: 80, Height: 25, Title: "door", Term: "ansi"}, clock(start, 500*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("\x1b[1;33mHi ░\r\n"))
+	if err := c.Close(); err != nil || !b.closed {
+		t.Fatalf("close: %v, closed %v", err, b.closed)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines: %q", lines)
+	}
+	var header map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header["version"] != 2.0 || header["width"] != 80.0 || header["height"] != 25.0 || header["timestamp"] != 1700000000.0 {
+		t.Errorf("header: %v", header)
+	}
+	var event []interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if len(event) != 3 || event[0] != 0.5 || event[1] != "o" || event[2] != "\x1b[1;33mHi ░\r\n" {
+		t.Errorf("event: %q", event)
+	}
+}
+
+func TestTtyrec(t *testing.T) {
+	start := time.Unix(1700000000, 250000000)
+	var b buffer
+	c, err := newWriter(&b, Ttyrec, Info{Width: 80, Height: 25}, clock(start, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("abc"))
+
+	var frames []string
+	var times []uint32
+	data := b.Bytes()
+	for len(data) >= 12 {
+		n := binary.LittleEndian.Uint32(data[8:])
+		times = append(times, binary.LittleEndian.Uint32(data))
+		if usec := binary.LittleEndian.Uint32(data[4:]); usec != 250000 {
+			t.Errorf("usec = %d", usec)
+		}
+		frames = append(frames, string(data[12:12+n]))
+		data = data[12+n:]
+	}
+	if len(frames) != 2 || frames[0] != "\x1b[8;25;80t" || frames[1] != "abc" {
+		t.Errorf("frames: %q", frames)
+	}
+	if len(times) == 2 && times[1]-times[0] != 1 {
+		t.Errorf("times: %v", times)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, c := range []struct {
+		name, path string
+		want       Format
+	}{
+		{"", "demo.cast", Asciicast},
+		{"", "demo.ttyrec", Ttyrec},
+		{"ttyrec", "demo.cast", Ttyrec},
+		{"asciicast", "", Asciicast},
+	} {
+		if got, err := ParseFormat(c.name, c.path); err != nil || got != c.want {
+			t.Errorf("ParseFormat(%q, %q) = %v, %v", c.name, c.path, got, err)
+		}
+	}
+	if _, err := ParseFormat("gif", ""); err == nil {
+		t.Error("expected an error for gif")
+	}
+}
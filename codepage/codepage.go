@@ -0,0 +1,226 @@
+// Package codepage translates between the IBM PC character set, code page
+// 437, that doors write and what the caller's terminal expects.
+//
+// Only bytes 80h-FFh are translated.  Control characters are left alone
+// as terminals act on them rather than drawing the CP437 glyphs, which also
+// keeps ANSI escape sequences intact.
+package codepage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+type Encoding int
+
+const (
+	// CP437 bytes are passed through unchanged
+	CP437 Encoding = iota
+	UTF8
+	// 7-bit ASCII, with look-alikes for the line drawing and accented
+	// characters
+	ASCII
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case CP437:
+		return "cp437"
+	case UTF8:
+		return "utf8"
+	case ASCII:
+		return "ascii"
+	}
+	return fmt.Sprintf("Encoding(%d)", int(e))
+}
+
+// ParseEncoding parses an encoding name: cp437 (or raw), utf8 or ascii.
+func ParseEncoding(name string) (Encoding, error) {
+	switch strings.ToLower(name) {
+	case "cp437", "raw", "":
+		return CP437, nil
+	case "utf8", "utf-8":
+		return UTF8, nil
+	case "ascii":
+		return ASCII, nil
+	}
+	return CP437, fmt.Errorf("unknown encoding: '%s'", name)
+}
+
+// Unicode for CP437 80h-FFh, the last is a no-break space.
+var high = []rune("ÇüéâäàåçêëèïîìÄÅ" +
+	"ÉæÆôöòûùÿÖÜ¢£¥₧ƒ" +
+	"áíóúñÑªº¿⌐¬½¼¡«»" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+	"└┴┬├─┼╞╟╚╔╩╦╠═╬╧" +
+	"╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩" +
+	"≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00A0")
+
+// ASCII look-alikes for CP437 80h-FFh.
+const asciiHigh = "CueaaaaceeeiiiAA" +
+	"EaAooouuyOUcLYPf" +
+	"aiounNao?--42!<>" +
+	"###|++++++|+++++" +
+	"++++-++++++++-++" +
+	"+++++++++++#####" +
+	"aBGpSsutFTOd8fen" +
+	"=+><()/~o..vn2# "
+
+// CP437 bytes by Unicode, for input.
+var fromUnicode = func() map[rune]byte {
+	m := make(map[rune]byte, len(high))
+	for i, r := range high {
+		m[r] = byte(0x80 + i)
+	}
+	return m
+}()
+
+// ToUnicode returns the Unicode character for the CP437 byte b.
+func ToUnicode(b byte) rune {
+	if b < 0x80 {
+		return rune(b)
+	}
+	return high[b-0x80]
+}
+
+// FromUnicode returns the CP437 byte for r, and false when there is none.
+func FromUnicode(r rune) (byte, bool) {
+	if r < 0x80 {
+		return byte(r), true
+	}
+	b, ok := fromUnicode[r]
+	return b, ok
+}
+
+// States of an escape sequence in the output
+const (
+	escNone = iota
+	// Seen ESC
+	escStart
+	// Inside a CSI sequence, ESC [
+	escCSI
+)
+
+type writer struct {
+	w   io.Writer
+	enc Encoding
+	esc int
+	buf []byte
+}
+
+// NewWriter returns a writer translating the CP437 written to it into enc.
+// Escape sequences are passed through untouched.
+func NewWriter(w io.Writer, enc Encoding) io.Writer {
+	if enc == CP437 {
+		return w
+	}
+	return &writer{w: w, enc: enc}
+}
+
+// Write returns len(p) on success, regardless of how many bytes the
+// translation produced.
+func (w *writer) Write(p []byte) (int, error) {
+	w.buf = w.buf[:0]
+	for _, b := range p {
+		switch w.esc {
+		case escStart:
+			w.esc = escNone
+			if b == '[' {
+				w.esc = escCSI
+			}
+			w.buf = append(w.buf, b)
+			continue
+		case escCSI:
+			// Parameters and intermediates until the final byte
+			if b >= 0x40 && b <= 0x7E {
+				w.esc = escNone
+			}
+			w.buf = append(w.buf, b)
+			continue
+		}
+		switch {
+		case b == 0x1B:
+			w.esc = escStart
+			w.buf = append(w.buf, b)
+		case b < 0x80:
+			w.buf = append(w.buf, b)
+		case w.enc == ASCII:
+			w.buf = append(w.buf, asciiHigh[b-0x80])
+		default:
+			w.buf = utf8.AppendRune(w.buf, high[b-0x80])
+		}
+	}
+	if _, err := w.w.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type reader struct {
+	r io.Reader
+	// Input not decoded yet, the start of a UTF-8 sequence
+	pending []byte
+	// Decoded CP437 not returned yet
+	out []byte
+	err error
+}
+
+// NewReader returns a reader folding the UTF-8 read from r into CP437.
+// Characters with no CP437 equivalent become '?' and bytes that aren't
+// valid UTF-8 are assumed to already be CP437.  For the other encodings r
+// is returned as is.
+func NewReader(r io.Reader, enc Encoding) io.Reader {
+	if enc != UTF8 {
+		return r
+	}
+	return &reader{r: r}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, len(p))
+	for len(r.out) == 0 && r.err == nil {
+		n, err := r.r.Read(buf)
+		r.pending = append(r.pending, buf[:n]...)
+		r.err = err
+		r.decode(err != nil)
+	}
+	if len(r.out) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// Decodes pending into out, leaving an incomplete sequence at the end
+// unless the input has ended.
+func (r *reader) decode(final bool) {
+	for len(r.pending) > 0 {
+		b := r.pending[0]
+		if b < 0x80 {
+			r.out = append(r.out, b)
+			r.pending = r.pending[1:]
+			continue
+		}
+		if !final && !utf8.FullRune(r.pending) {
+			return
+		}
+		c, size := utf8.DecodeRune(r.pending)
+		r.pending = r.pending[size:]
+		if c == utf8.RuneError && size == 1 {
+			r.out = append(r.out, b)
+			continue
+		}
+		cp, ok := FromUnicode(c)
+		if !ok {
+			cp = '?'
+		}
+		r.out = append(r.out, cp)
+	}
+}
@@ -0,0 +1,69 @@
+package codepage
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestTables(t *testing.T) {
+	if len(asciiHigh) != 128 {
+		t.Fatalf("asciiHigh has %d entries", len(asciiHigh))
+	}
+	for i := 0x80; i <= 0xFF; i++ {
+		b, ok := FromUnicode(ToUnicode(byte(i)))
+		if !ok || b != byte(i) {
+			t.Errorf("0x%02X doesn't round trip, got 0x%02X", i, b)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	// A box corner in bright blue, an e acute and a full block
+	in := []byte("\x1b[1;34m\xC9\xCD\xBB\x1b[0m caf\x82 \xDB\r\n")
+	tests := []struct {
+		enc  Encoding
+		want string
+	}{
+		{CP437, string(in)},
+		{UTF8, "\x1b[1;34m╔═╗\x1b[0m café █\r\n"},
+		{ASCII, "\x1b[1;34m+-+\x1b[0m cafe #\r\n"},
+	}
+	for _, tc := range tests {
+		var out bytes.Buffer
+		w := NewWriter(&out, tc.enc)
+		// One byte at a time so escape sequences are split across writes
+		for _, b := range in {
+			if n, err := w.Write([]byte{b}); n != 1 || err != nil {
+				t.Fatalf("%s: Write = %d, %v", tc.enc, n, err)
+			}
+		}
+		if out.String() != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.enc, out.String(), tc.want)
+		}
+	}
+}
+
+func TestWriterLeavesEscapesAlone(t *testing.T) {
+	// A high byte inside a CSI sequence is not a character
+	var out bytes.Buffer
+	NewWriter(&out, UTF8).Write([]byte("\x1b[\x82m\x82"))
+	if want := "\x1b[\x82mé"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestReader(t *testing.T) {
+	in := "café ♥ \x82\x1b[A"
+	r := NewReader(iotest.OneByteReader(strings.NewReader(in)), UTF8)
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ♥ is 03h in CP437 but that is a control character, not input
+	if want := "caf\x82 ? \x82\x1b[A"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,452 @@
+// Package config reads the settings for running doors from an INI file.
+//
+// The file has a section for each part of the machine the door sees:
+//
+//	; Lines starting with ; or # are comments
+//	[dos]
+//	version = 6.22
+//	memory = 640          ; KB of conventional memory
+//	remote = auto         ; network drives, or letters like C,D, or none
+//	timezone = America/New_York ; the host's if not set
+//
+//	[drives]
+//	C = .
+//	D = /bbs/doors
+//
+//	[env]
+//	PATH = C:\;D:\
+//	PROMPT = "$P$G"       ; quotes keep spaces
+//	TZ = %TZ%             ; passed through from the host
+//
+//	[devices]
+//	fossil = on
+//
+//	[console]
+//	encoding = cp437
+//
+//	[limits]
+//	time = 60             ; minutes
+//	warn = 2              ; minutes
+//	idle = 5m
+//	grace = 10s
+//
+//	[log]
+//	verbose = 0
+//
+// A section followed by a profile name, such as [drives lord], only
+// applies when running that profile, and its settings override the
+// plain section's.  This lets one file describe every door on a system.
+// In [drives] and [env] an empty value removes the drive or variable.
+// Values in [env] may use %NAME% for the host's variables, and %% for %.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Devices are the hardware and drivers the door can use.
+type Devices struct {
+	// INT 14h serial port and FOSSIL driver, talking to the caller
+	FOSSIL bool
+	// 8250 UART registers on the COM ports
+	UART bool
+	// Expanded memory (INT 67h)
+	EMS bool
+	// Extended memory (INT 2Fh 43h)
+	XMS bool
+}
+
+// Limits are the defaults for how long a caller may stay in the door.
+type Limits struct {
+	// Minutes the caller has
+	Time int
+	// Minutes left at which the caller is warned
+	Warn int
+	// Time without a keystroke before the door is ended, 0 for no limit
+	Idle time.Duration
+	// Time the door has to exit after the caller hangs up
+	Grace time.Duration
+}
+
+// Config is everything about how a door is run.
+type Config struct {
+	// DOS version reported to the door, major version in the high byte
+	DosVersion uint16
+	// Conventional memory in KB, 0 for as much as there is
+	Memory int
+	// Host directory for each drive letter
+	Drives map[byte]string
+	// Drives reported to the door as network drives, or nil for those on
+	// the host's network file systems, which are only detected on Linux
+	Remote map[byte]bool
+	// Environment variables, NAME=value, in order.  Values may refer to
+	// the host's variables, see Environment.
+	Env     []string
+	Devices Devices
+	// Character set of the caller's terminal
+	Encoding string
+	Limits   Limits
+	// glog verbosity, and directory for the log files
+	Verbose int
+	LogDir  string
+	// Time zone of the door's clock, empty for the host's
+	Timezone string
+
+	// Settings given in the file, as section.key
+	given map[string]bool
+}
+
+// Default returns the settings used without a config file.
+func Default() *Config {
+	return &Config{
+		DosVersion: 0x0500,
+		Drives:     map[byte]string{'C': "."},
+		Env: []string{
+			"COMSPEC=C:\\COMMAND.COM",
+			"PATH=C:\\",
+			"PROMPT=$P$G",
+			"TEMP=C:\\",
+		},
+		Devices:  Devices{FOSSIL: true},
+		Encoding: "cp437",
+		Limits: Limits{
+			Time:  60,
+			Warn:  2,
+			Grace: 10 * time.Second,
+		},
+		given: make(map[string]bool),
+	}
+}
+
+// Given reports whether the setting key, as section.key, was in the file.
+// Settings that weren't keep their defaults, which a command may have its
+// own idea of.
+func (c *Config) Given(key string) bool {
+	return c.given[key]
+}
+
+// Location returns the time zone of the door's clock.
+func (c *Config) Location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("timezone: %w", err)
+	}
+	return loc, nil
+}
+
+// Load reads the config file path for profile, which may be empty for
+// just the plain sections.
+func Load(path, profile string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, path, profile)
+}
+
+type setting struct {
+	section, key, value string
+	line                int
+}
+
+// Parse reads a config file from r, using name in errors.
+func Parse(r io.Reader, name, profile string) (*Config, error) {
+	var plain, profiled []setting
+	section := ""
+	// The section applies to the profile being run, or to all of them
+	applies, forProfile := true, false
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: section has no closing ']'", name, n)
+			}
+			fields := strings.Fields(line[1 : len(line)-1])
+			if len(fields) < 1 || len(fields) > 2 {
+				return nil, fmt.Errorf("%s:%d: bad section '%s'", name, n, line)
+			}
+			section = strings.ToLower(fields[0])
+			if _, ok := sections[section]; !ok {
+				return nil, fmt.Errorf("%s:%d: unknown section [%s]", name, n, section)
+			}
+			forProfile = len(fields) == 2
+			applies = !forProfile || strings.EqualFold(fields[1], profile)
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", name, n)
+		}
+		if section == "" {
+			return nil, fmt.Errorf("%s:%d: setting outside of a section", name, n)
+		}
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			v, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: bad quoted value %s", name, n, value)
+			}
+			value = v
+		}
+		s := setting{section, strings.TrimSpace(key), value, n}
+		switch {
+		case !applies:
+			// Still checked, so a mistake in one door's profile is found
+			// when running any of them
+			if err := Default().set(s); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+		case forProfile:
+			profiled = append(profiled, s)
+		default:
+			plain = append(plain, s)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	c := Default()
+	for _, s := range append(plain, profiled...) {
+		if err := c.set(s); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, s.line, err)
+		}
+	}
+	return c, nil
+}
+
+// Removes a comment from line.  Comments start with ; or # at the start of
+// the line or after a space, so PATH = C:\;D:\ keeps its separator, and
+// not inside quotes.
+func stripComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"' && (i == 0 || line[i-1] != '\\'):
+			quoted = !quoted
+		case (c == ';' || c == '#') && !quoted && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Settings in each section, handled by set.  [drives] and [env] take any
+// key.
+var sections = map[string][]string{
+	"dos":     {"version", "memory", "remote", "timezone"},
+	"drives":  nil,
+	"env":     nil,
+	"devices": {"fossil", "uart", "ems", "xms"},
+	"console": {"encoding"},
+	"limits":  {"time", "warn", "idle", "grace"},
+	"log":     {"verbose", "dir"},
+}
+
+func (c *Config) set(s setting) error {
+	key := strings.ToLower(s.key)
+	if keys := sections[s.section]; keys != nil {
+		known := false
+		for _, k := range keys {
+			known = known || k == key
+		}
+		if !known {
+			return fmt.Errorf("unknown setting '%s' in [%s]", s.key, s.section)
+		}
+	}
+	var err error
+	switch s.section {
+	case "dos":
+		switch key {
+		case "version":
+			c.DosVersion, err = parseVersion(s.value)
+		case "memory":
+			c.Memory, err = strconv.Atoi(s.value)
+			if err == nil && (c.Memory < 64 || c.Memory > 640) {
+				err = fmt.Errorf("memory must be from 64 to 640 KB, not %d", c.Memory)
+			}
+		case "remote":
+			c.Remote, err = parseDrives(s.value)
+		case "timezone":
+			c.Timezone = s.value
+			_, err = time.LoadLocation(s.value)
+		}
+	case "drives":
+		if len(s.key) != 1 || !isLetter(s.key[0]) {
+			return fmt.Errorf("bad drive letter '%s'", s.key)
+		}
+		letter := strings.ToUpper(s.key)[0]
+		if s.value == "" {
+			delete(c.Drives, letter)
+		} else {
+			c.Drives[letter] = s.value
+		}
+	case "env":
+		c.setEnv(strings.ToUpper(s.key), s.value)
+	case "devices":
+		var on bool
+		on, err = parseBool(s.value)
+		switch key {
+		case "fossil":
+			c.Devices.FOSSIL = on
+		case "uart":
+			c.Devices.UART = on
+		case "ems":
+			c.Devices.EMS = on
+		case "xms":
+			c.Devices.XMS = on
+		}
+	case "console":
+		c.Encoding = s.value
+	case "limits":
+		switch key {
+		case "time":
+			c.Limits.Time, err = strconv.Atoi(s.value)
+		case "warn":
+			c.Limits.Warn, err = strconv.Atoi(s.value)
+		case "idle":
+			c.Limits.Idle, err = time.ParseDuration(s.value)
+		case "grace":
+			c.Limits.Grace, err = time.ParseDuration(s.value)
+		}
+	case "log":
+		switch key {
+		case "verbose":
+			c.Verbose, err = strconv.Atoi(s.value)
+		case "dir":
+			c.LogDir = s.value
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	c.given[s.section+"."+key] = true
+	return nil
+}
+
+// Sets, replaces or with an empty value removes an environment variable.
+func (c *Config) setEnv(name, value string) {
+	for i, v := range c.Env {
+		if strings.HasPrefix(v, name+"=") {
+			if value == "" {
+				c.Env = append(c.Env[:i], c.Env[i+1:]...)
+			} else {
+				c.Env[i] = name + "=" + value
+			}
+			return
+		}
+	}
+	if value != "" {
+		c.Env = append(c.Env, name+"="+value)
+	}
+}
+
+// Environment returns Env with %NAME% replaced by the host's variables,
+// looked up with getenv, and %% by %.  Variables left empty are dropped.
+func (c *Config) Environment(getenv func(string) string) []string {
+	var env []string
+	for _, v := range c.Env {
+		name, value, _ := strings.Cut(v, "=")
+		var b strings.Builder
+		for {
+			start := strings.IndexByte(value, '%')
+			if start < 0 {
+				break
+			}
+			end := strings.IndexByte(value[start+1:], '%')
+			if end < 0 {
+				break
+			}
+			b.WriteString(value[:start])
+			if host := value[start+1 : start+1+end]; host == "" {
+				b.WriteByte('%')
+			} else {
+				b.WriteString(getenv(host))
+			}
+			value = value[start+end+2:]
+		}
+		b.WriteString(value)
+		if b.Len() > 0 {
+			env = append(env, name+"="+b.String())
+		}
+	}
+	return env
+}
+
+// DriveLetters returns the configured drives in order.
+func (c *Config) DriveLetters() []byte {
+	letters := make([]byte, 0, len(c.Drives))
+	for l := range c.Drives {
+		letters = append(letters, l)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return letters
+}
+
+// Parses the remote drives, a list of letters such as "C,D", "none" or
+// "auto" for nil.
+func parseDrives(v string) (map[byte]bool, error) {
+	switch strings.ToLower(v) {
+	case "auto":
+		return nil, nil
+	case "none":
+		return map[byte]bool{}, nil
+	}
+	drives := make(map[byte]bool)
+	for _, f := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if len(f) != 1 || !isLetter(f[0]) {
+			return nil, fmt.Errorf("bad drive letter '%s'", f)
+		}
+		drives[strings.ToUpper(f)[0]] = true
+	}
+	return drives, nil
+}
+
+// Parses a DOS version such as 6.22 or 5.0.  A single minor digit is
+// tenths, as DOS reports 3.3 as 3.30.
+func parseVersion(v string) (uint16, error) {
+	major, minor, _ := strings.Cut(v, ".")
+	if len(minor) == 1 {
+		minor += "0"
+	}
+	if minor == "" {
+		minor = "0"
+	}
+	ma, err := strconv.ParseUint(major, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("bad DOS version '%s'", v)
+	}
+	mi, err := strconv.ParseUint(minor, 10, 8)
+	if err != nil || mi > 99 {
+		return 0, fmt.Errorf("bad DOS version '%s'", v)
+	}
+	return uint16(ma<<8 | mi), nil
+}
+
+func parseBool(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "on", "yes", "true", "1":
+		return true, nil
+	case "off", "no", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, not '%s'", v)
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+; Shared by every door
+[dos]
+version = 6.22
+
+[drives]
+D = /bbs/doors   ; comment
+
+[env]
+PATH = C:\;D:\
+PROMPT = "$P$G ; not a comment"
+
+[limits]
+idle = 5m
+
+[dos lord]
+memory = 512
+remote = d, e
+timezone = America/Chicago
+
+[drives LORD]
+C =
+E = /bbs/lord
+
+[env lord]
+path = E:\
+temp =
+
+[limits other]
+idle = 1m
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(testConfig), "test.ini", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DosVersion != 0x0616 || c.Memory != 0 || c.Remote != nil {
+		t.Errorf("dos: version %04X memory %d remote %v", c.DosVersion, c.Memory, c.Remote)
+	}
+	if string(c.DriveLetters()) != "CD" || c.Drives['D'] != "/bbs/doors" {
+		t.Errorf("drives: %q", c.Drives)
+	}
+	if strings.Join(c.Env, "|") != `COMSPEC=C:\COMMAND.COM|PATH=C:\;D:\|PROMPT=$P$G ; not a comment|TEMP=C:\` {
+		t.Errorf("env: %q", c.Env)
+	}
+	if c.Limits.Idle != 5*time.Minute || !c.Given("limits.idle") || c.Given("limits.time") {
+		t.Errorf("limits: %+v", c.Limits)
+	}
+	if loc, err := c.Location(); !c.Devices.FOSSIL || c.Encoding != "cp437" || loc != time.Local || err != nil {
+		t.Errorf("defaults: %+v %s, clock in %v %v", c.Devices, c.Encoding, loc, err)
+	}
+
+	// The profile's sections override the plain ones, wherever they are
+	c, err = Parse(strings.NewReader(testConfig), "test.ini", "Lord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DosVersion != 0x0616 || c.Memory != 512 || !c.Remote['D'] || !c.Remote['E'] || c.Remote['C'] {
+		t.Errorf("lord dos: version %04X memory %d remote %v", c.DosVersion, c.Memory, c.Remote)
+	}
+	if loc, err := c.Location(); err != nil || loc.String() != "America/Chicago" {
+		t.Errorf("lord clock in %v %v", loc, err)
+	}
+	if string(c.DriveLetters()) != "DE" {
+		t.Errorf("lord drives: %q", c.Drives)
+	}
+	if strings.Join(c.Env, "|") != `COMSPEC=C:\COMMAND.COM|PATH=E:\|PROMPT=$P$G ; not a comment` || c.Limits.Idle != 5*time.Minute {
+		t.Errorf("lord: env %q idle %s", c.Env, c.Limits.Idle)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	c := Default()
+	c.Env = []string{`PATH=C:\;%DOORS%`, "TZ=%TZ%", "PROMPT=100%% $P$G", "ODD=50%"}
+	host := map[string]string{"DOORS": `D:\`}
+	got := strings.Join(c.Environment(func(name string) string { return host[name] }), "|")
+	if want := `PATH=C:\;D:\|PROMPT=100% $P$G|ODD=50%`; got != want {
+		t.Errorf("Environment = %q, want %q", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		config, err string
+	}{
+		{"[dos]\nversion = six", "test.ini:2: version: bad DOS version 'six'"},
+		{"[dos]\nmemory = 1024", "test.ini:2: memory: memory must be from 64 to 640 KB, not 1024"},
+		{"[sound]\n", "test.ini:1: unknown section [sound]"},
+		{"[devices]\nmouse = on", "test.ini:2: unknown setting 'mouse' in [devices]"},
+		{"[devices]\nems = maybe", "test.ini:2: ems: expected on or off, not 'maybe'"},
+		{"version = 5", "test.ini:1: setting outside of a section"},
+		{"[drives]\nCD = .", "test.ini:2: bad drive letter 'CD'"},
+		{"[dos]\nremote = C:", "test.ini:2: remote: bad drive letter 'C:'"},
+		{"[dos]\ntimezone = Mars/Base", "test.ini:2: timezone: unknown time zone Mars/Base"},
+		{"[log]\ntimezone = UTC", "test.ini:2: unknown setting 'timezone' in [log]"},
+		// Mistakes in other doors' profiles are found too
+		{"[limits other]\nidle = soon", `test.ini:2: idle: time: invalid duration "soon"`},
+	} {
+		_, err := Parse(strings.NewReader(tc.config), "test.ini", "lord")
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("%q: got %v, want %s", tc.config, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package console
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrCarrierLost is returned by reads once the caller has hung up.
+var ErrCarrierLost = errors.New("carrier lost")
+
+// Console is the caller's terminal.  Keystrokes arrive on the input stream
+// and are queued by a background reader so that the emulator can poll for
+// them without blocking; everything the door displays is written to the
+// output stream.
+//
+// The console also tracks the connection: the caller is considered gone,
+// and carrier lost, once a write to the output stream fails and, for
+// callers connected over the network, once the input stream ends.  The
+// input of a local console ending is just the end of its input.
+type Console struct {
+	out io.Writer
+	// Serializes writes to out
+	wmu sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	// Set once the input stream returns an error, usually io.EOF
+	err error
+	// When the last keystroke arrived, or when the console was created
+	lastInput time.Time
+
+	// Takes the caller's input instead of the door while set
+	divert func([]byte)
+
+	// Input kept from the door until it is admitted, see Hold
+	hold    func(b []byte, err error)
+	held    []byte
+	heldErr error
+
+	// The input ending drops carrier
+	remote bool
+	// Closed when carrier is lost
+	lost     chan struct{}
+	lostOnce sync.Once
+}
+
+// New creates a console reading keystrokes from in and displaying on out.
+func New(in io.Reader, out io.Writer) *Console {
+	return newConsole(in, out, false)
+}
+
+// NewRemote creates a console for a caller connected over the network,
+// who has hung up once in ends.
+func NewRemote(in io.Reader, out io.Writer) *Console {
+	return newConsole(in, out, true)
+}
+
+func newConsole(in io.Reader, out io.Writer, remote bool) *Console {
+	c := &Console{out: out, lastInput: time.Now(), remote: remote, lost: make(chan struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	go c.pump(in)
+	return c
+}
+
+func (c *Console) pump(in io.Reader) {
+	b := make([]byte, 256)
+	for {
+		n, err := in.Read(b)
+		c.mu.Lock()
+		stopped := c.err != nil || c.heldErr != nil
+		divert, hold := c.divert, c.hold != nil
+		if !stopped {
+			switch {
+			case divert != nil:
+			case hold:
+				c.held = append(c.held, b[:n]...)
+			default:
+				c.buf = append(c.buf, b[:n]...)
+			}
+			if n > 0 {
+				c.lastInput = time.Now()
+			}
+			if hold {
+				c.heldErr = err
+			} else {
+				c.err = err
+			}
+			c.cond.Broadcast()
+		}
+		c.mu.Unlock()
+		if !stopped && divert != nil && n > 0 {
+			divert(append([]byte(nil), b[:n]...))
+		}
+		if err != nil && !hold && c.remote {
+			c.dropCarrier()
+		}
+		if err != nil || stopped {
+			return
+		}
+	}
+}
+
+func (c *Console) dropCarrier() {
+	c.lostOnce.Do(func() { close(c.lost) })
+}
+
+// Carrier reports whether the caller is still connected.
+func (c *Console) Carrier() bool {
+	select {
+	case <-c.lost:
+		return false
+	default:
+		return true
+	}
+}
+
+// Lost returns a channel that is closed when carrier is lost.
+func (c *Console) Lost() <-chan struct{} {
+	return c.lost
+}
+
+// Hangup disconnects the caller.  Input still queued is discarded and reads
+// fail with ErrCarrierLost.
+func (c *Console) Hangup() {
+	c.mu.Lock()
+	if c.err == nil {
+		c.buf = nil
+		c.err = ErrCarrierLost
+		c.cond.Broadcast()
+	}
+	c.mu.Unlock()
+	c.dropCarrier()
+}
+
+// Inject queues b as if the caller had typed it, for keystrokes from
+// someone else at the keyboard.  It doesn't count as caller activity.
+func (c *Console) Inject(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	if c.hold != nil {
+		c.held = append(c.held, b...)
+	} else {
+		c.buf = append(c.buf, b...)
+	}
+	c.cond.Broadcast()
+}
+
+// Divert sends the caller's input to f instead of queuing it for the door,
+// until called again with nil.
+func (c *Console) Divert(f func([]byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.divert = f
+}
+
+// Hold keeps arriving input, and the end of the input stream, from the
+// door until Admit is called or the door waits or looks for input.  f is called
+// with the input, and the error the stream ended with, as they are let
+// through.  Recording a session uses it so that input only arrives at
+// points in the door's run that can be found again.
+func (c *Console) Hold(f func(b []byte, err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hold = f
+}
+
+// Admit lets through the input held since it was last called.
+func (c *Console) Admit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.admit()
+}
+
+func (c *Console) admit() {
+	if c.hold == nil || (len(c.held) == 0 && c.heldErr == nil) {
+		return
+	}
+	held, err := c.held, c.heldErr
+	c.held, c.heldErr = nil, nil
+	if c.err == nil {
+		c.buf = append(c.buf, held...)
+		c.err = err
+	}
+	c.hold(held, err)
+	if err != nil && c.remote {
+		c.dropCarrier()
+	}
+	c.cond.Broadcast()
+}
+
+// Read blocks until there is input and returns as much of it as fits.
+// Once the input stream has ended and been drained it returns its error.
+func (c *Console) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.buf) == 0 && c.err == nil {
+		if c.hold != nil && (len(c.held) > 0 || c.heldErr != nil) {
+			c.admit()
+			continue
+		}
+		c.cond.Wait()
+	}
+	if len(c.buf) == 0 {
+		return 0, c.err
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// ReadByte blocks until a keystroke is available.
+func (c *Console) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := c.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Peek returns the next keystroke without removing it, and false when
+// there is none waiting.  Like Read, it lets through held input, as a door
+// polling the serial port may never wait.
+func (c *Console) Peek() (byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.buf) == 0 && c.err == nil {
+		c.admit()
+	}
+	if len(c.buf) == 0 {
+		return 0, false
+	}
+	return c.buf[0], true
+}
+
+// Discard throws away input that has arrived but not been read.
+func (c *Console) Discard() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = nil
+}
+
+// Buffered returns the number of bytes of input waiting to be read.
+func (c *Console) Buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.buf)
+}
+
+// EOF reports whether the input stream has ended and every byte from it
+// has been read.
+func (c *Console) EOF() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.buf) == 0 && c.err != nil
+}
+
+// LastInput returns when the last keystroke arrived.
+func (c *Console) LastInput() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastInput
+}
+
+// Stop discards any queued input and makes waiting and future reads fail
+// with err, so a door blocked on the keyboard can be ended.
+func (c *Console) Stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = nil
+	c.err = err
+	c.cond.Broadcast()
+}
+
+// Locked runs f holding the write lock, so that f can write to the caller
+// without its output being interleaved with the console's.
+func (c *Console) Locked(f func()) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	f()
+}
+
+func (c *Console) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n, err := c.out.Write(p)
+	if err != nil {
+		c.Hangup()
+	}
+	return n, err
+}
@@ -0,0 +1,151 @@
+package console
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadUntilEOF(t *testing.T) {
+	var out bytes.Buffer
+	c := New(strings.NewReader("abc"), &out)
+	b := make([]byte, 2)
+	var got []byte
+	for {
+		n, err := c.Read(b)
+		got = append(got, b[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(got) != "abc" {
+		t.Errorf("read %q, want %q", got, "abc")
+	}
+	if !c.EOF() {
+		t.Error("expected EOF once drained")
+	}
+	c.Write([]byte("hi"))
+	if out.String() != "hi" {
+		t.Errorf("wrote %q", out.String())
+	}
+}
+
+func TestStopWakesReader(t *testing.T) {
+	in, w := io.Pipe()
+	defer w.Close()
+	c := New(in, io.Discard)
+	stop := errors.New("time limit reached")
+	done := make(chan error)
+	go func() {
+		_, err := c.ReadByte()
+		done <- err
+	}()
+	c.Stop(stop)
+	if err := <-done; err != stop {
+		t.Errorf("blocked read returned %v, want %v", err, stop)
+	}
+	w.Write([]byte("x"))
+	if _, err := c.ReadByte(); err != stop {
+		t.Errorf("read after stop returned %v", err)
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestCarrier(t *testing.T) {
+	c := NewRemote(strings.NewReader("x"), io.Discard)
+	<-c.Lost()
+	if c.Carrier() {
+		t.Error("carrier after input ended")
+	}
+	// Input that arrived before the hang up can still be read
+	if b, err := c.ReadByte(); err != nil || b != 'x' {
+		t.Errorf("ReadByte = %q, %v", b, err)
+	}
+
+	in, w := io.Pipe()
+	defer w.Close()
+	c = New(in, failWriter{})
+	if !c.Carrier() {
+		t.Fatal("no carrier on a new console")
+	}
+	c.Write([]byte("hello"))
+	if c.Carrier() {
+		t.Error("carrier after a failed write")
+	}
+	if _, err := c.ReadByte(); err != ErrCarrierLost {
+		t.Errorf("read after hang up returned %v", err)
+	}
+}
+
+// Running a door locally with its input from a file or a pipe, it reads
+// the end of the input without anyone having hung up.
+func TestLocalEOF(t *testing.T) {
+	c := New(strings.NewReader("x"), io.Discard)
+	if b, err := c.ReadByte(); err != nil || b != 'x' {
+		t.Fatalf("ReadByte = %q, %v", b, err)
+	}
+	if _, err := c.ReadByte(); err != io.EOF {
+		t.Errorf("read at end of input returned %v", err)
+	}
+	select {
+	case <-c.Lost():
+		t.Error("carrier lost at end of input")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !c.Carrier() {
+		t.Error("no carrier at end of input")
+	}
+}
+
+func TestHold(t *testing.T) {
+	in, w := io.Pipe()
+	c := NewRemote(in, io.Discard)
+	var admitted []string
+	var end error
+	c.Hold(func(b []byte, err error) {
+		admitted = append(admitted, string(b))
+		end = err
+	})
+	// Waits for the console to have taken the input
+	before := c.LastInput()
+	w.Write([]byte("ab"))
+	for c.LastInput().Equal(before) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Inject([]byte("c"))
+	if n := c.Buffered(); n != 0 {
+		t.Errorf("%d bytes readable before Admit", n)
+	}
+	c.Admit()
+	if n := c.Buffered(); n != 3 {
+		t.Errorf("%d bytes readable after Admit, want 3", n)
+	}
+	c.Discard()
+
+	// A read waiting for input lets it through itself
+	go w.Write([]byte("d"))
+	if b, err := c.ReadByte(); b != 'd' || err != nil {
+		t.Errorf("read %q, %v", b, err)
+	}
+	w.Close()
+	if _, err := c.ReadByte(); err != io.EOF {
+		t.Errorf("read after close: %v", err)
+	}
+	if strings.Join(admitted, ",") != "abc,d," || end != io.EOF {
+		t.Errorf("admitted %q, ending with %v", admitted, end)
+	}
+	if c.Carrier() {
+		t.Error("carrier still up after the end was admitted")
+	}
+}
@@ -0,0 +1,384 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"door86.org/ivdoor/cpu"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// StopReason says why the emulator stopped running the program.
+type StopReason int
+
+const (
+	// Stopped by the host, which is how DOS ends a program
+	StopHalted StopReason = iota
+	// At a breakpoint, before running its instruction
+	StopBreakpoint
+	// At an INT instruction matching an interrupt breakpoint
+	StopInterrupt
+	// After an instruction accessed memory being watched
+	StopWatch
+	// After a single step, or a step over
+	StopStep
+	// Paused from another goroutine
+	StopPaused
+	// At an instruction the CPU can't run
+	StopInvalid
+	// Unicorn failed, such as on a fetch from unmapped memory
+	StopError
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopHalted:
+		return "halted"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopInterrupt:
+		return "interrupt"
+	case StopWatch:
+		return "watchpoint"
+	case StopStep:
+		return "step"
+	case StopPaused:
+		return "paused"
+	case StopInvalid:
+		return "invalid instruction"
+	case StopError:
+		return "error"
+	}
+	return fmt.Sprintf("StopReason(%d)", int(r))
+}
+
+// Stop is where and why the emulator stopped.
+type Stop struct {
+	Reason StopReason
+	// CS:IP when it stopped
+	At cpu.SegOffset
+	// The interrupt breakpoint hit, for StopInterrupt
+	Int IntBreak
+	// The access, the linear address of its first byte in the watched
+	// range and the instruction making it, for StopWatch
+	Access Access
+	Addr   uint64
+	By     cpu.SegOffset
+	// Unicorn's error, for StopInvalid and StopError
+	Err error
+}
+
+func (s Stop) String() string {
+	switch s.Reason {
+	case StopInterrupt:
+		return fmt.Sprintf("%s %s at %04X:%04X", s.Reason, s.Int, s.At.Seg, s.At.Off)
+	case StopWatch:
+		return fmt.Sprintf("%s, %s of L%05X by %04X:%04X, at %04X:%04X", s.Reason, s.Access, s.Addr, s.By.Seg, s.By.Off, s.At.Seg, s.At.Off)
+	case StopInvalid, StopError:
+		return fmt.Sprintf("%s at %04X:%04X: %s", s.Reason, s.At.Seg, s.At.Off, s.Err)
+	}
+	return fmt.Sprintf("%s at %04X:%04X", s.Reason, s.At.Seg, s.At.Off)
+}
+
+// AnyFunction matches every value of AH or AL in an IntBreak.
+const AnyFunction = -1
+
+// IntBreak stops the program at an INT instruction for interrupt Num with
+// the function in AH, and subfunction in AL, or AnyFunction.
+type IntBreak struct {
+	Num    uint8
+	AH, AL int
+}
+
+func (b IntBreak) String() string {
+	s := fmt.Sprintf("INT %02Xh", b.Num)
+	if b.AH != AnyFunction {
+		s += fmt.Sprintf(" AH=%02Xh", b.AH)
+	}
+	if b.AL != AnyFunction {
+		s += fmt.Sprintf(" AL=%02Xh", b.AL)
+	}
+	return s
+}
+
+func (b IntBreak) matches(num uint8, ax uint16) bool {
+	return b.Num == num &&
+		(b.AH == AnyFunction || b.AH == int(ax>>8)) &&
+		(b.AL == AnyFunction || b.AL == int(ax&0xFF))
+}
+
+// Breakpoints and the state of the run in progress.  The code hook checking
+// them is only added once a debugger asks for it, as it runs for every
+// instruction.
+type debugState struct {
+	mu     sync.Mutex
+	hooked bool
+	// Linear addresses
+	breaks    map[uint64]bool
+	intBreaks []IntBreak
+	// Where a step over ends
+	until uint64
+	// The first instruction of a run is at a breakpoint already reported
+	first bool
+	// Why the run was stopped from a hook, or by Pause
+	stop *Stop
+	// Pause was called, which stops the run at its next instruction when
+	// it came before the run started and Unicorn ignored it
+	pause bool
+	// Watchpoints by their number, and the last one hit, which stops the
+	// program before its next instruction
+	watches   map[int]*watch
+	lastWatch int
+	hit       *Stop
+}
+
+// No step over in progress, outside of the 1MB address space
+const noAddress = ^uint64(0)
+
+func (em *Emulator) debugger() *debugState {
+	d := em.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.hooked {
+		em.mu.HookAdd(uc.HOOK_CODE, func(mu uc.Unicorn, addr uint64, size uint32) {
+			d.onCode(mu, addr)
+		}, 1, 0)
+		d.hooked = true
+	}
+	return d
+}
+
+// Stops the program before the instruction at addr when it is at a
+// breakpoint.
+func (d *debugState) onCode(mu uc.Unicorn, addr uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stop := func(s Stop) {
+		s.At = cpu.SegOffset{Seg: cpu.SReg16(mu, uc.X86_REG_CS), Off: uint16(addr - uint64(cpu.Reg16(mu, uc.X86_REG_CS))*0x10)}
+		d.stop = &s
+		mu.Stop()
+	}
+	if d.pause {
+		d.pause = false
+		stop(Stop{Reason: StopPaused})
+		return
+	}
+	if d.hit != nil {
+		// Memory hooks can't stop the CPU right after their instruction,
+		// so it's done here
+		hit := *d.hit
+		d.hit = nil
+		stop(hit)
+		return
+	}
+	if d.first {
+		d.first = false
+		return
+	}
+	switch {
+	case addr == d.until:
+		stop(Stop{Reason: StopStep})
+		return
+	case d.breaks[addr]:
+		stop(Stop{Reason: StopBreakpoint})
+		return
+	}
+	if len(d.intBreaks) == 0 {
+		return
+	}
+	op, err := mu.MemRead(addr, 2)
+	if err != nil || op[0] != 0xCD {
+		return
+	}
+	ax := cpu.Reg16(mu, uc.X86_REG_AX)
+	for _, b := range d.intBreaks {
+		if b.matches(op[1], ax) {
+			stop(Stop{Reason: StopInterrupt, Int: b})
+			return
+		}
+	}
+}
+
+// SetBreakpoint stops the program before it runs the instruction at the
+// linear address addr.
+func (em *Emulator) SetBreakpoint(addr uint64) {
+	d := em.debugger()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breaks[addr] = true
+}
+
+// ClearBreakpoint removes the breakpoint at addr, returning whether there
+// was one.
+func (em *Emulator) ClearBreakpoint(addr uint64) bool {
+	d := em.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	set := d.breaks[addr]
+	delete(d.breaks, addr)
+	return set
+}
+
+// Breakpoints returns the addresses of the breakpoints in order.
+func (em *Emulator) Breakpoints() []uint64 {
+	d := em.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	addrs := make([]uint64, 0, len(d.breaks))
+	for a := range d.breaks {
+		addrs = append(addrs, a)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
+
+// BreakOnInterrupt stops the program at INT instructions matching b, with
+// the registers as the handler will see them.
+func (em *Emulator) BreakOnInterrupt(b IntBreak) {
+	d := em.debugger()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, o := range d.intBreaks {
+		if o == b {
+			return
+		}
+	}
+	d.intBreaks = append(d.intBreaks, b)
+}
+
+// ClearInterruptBreak removes b, returning whether it was set.
+func (em *Emulator) ClearInterruptBreak(b IntBreak) bool {
+	d := em.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, o := range d.intBreaks {
+		if o == b {
+			d.intBreaks = append(d.intBreaks[:i], d.intBreaks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// InterruptBreaks returns the interrupt breakpoints in the order they were
+// set.
+func (em *Emulator) InterruptBreaks() []IntBreak {
+	d := em.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]IntBreak(nil), d.intBreaks...)
+}
+
+// Pause stops the running program, from another goroutine.  Called just
+// before it runs, it stops at its first instruction.
+func (em *Emulator) Pause() {
+	d := em.debugger()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop == nil {
+		d.stop = &Stop{Reason: StopPaused}
+	}
+	d.pause = true
+	em.mu.Stop()
+}
+
+// Continue runs the program from CS:IP until a breakpoint or until it is
+// stopped.  A breakpoint at CS:IP itself doesn't stop it again.
+func (em *Emulator) Continue() Stop {
+	return em.resume(noAddress, 0)
+}
+
+// Step runs the one instruction at CS:IP.  A software interrupt handled by
+// the host runs as part of its INT instruction.
+func (em *Emulator) Step() Stop {
+	return em.resume(noAddress, 1)
+}
+
+// StepOver runs the instruction at CS:IP like Step, but runs a CALL or INT
+// through until it returns to the next instruction.
+func (em *Emulator) StepOver() Stop {
+	cs := cpu.SReg16(em.mu, uc.X86_REG_CS)
+	ip := cpu.Reg16(em.mu, uc.X86_REG_IP)
+	mem, err := em.mu.MemRead(cpu.Addr(cs, ip), 15)
+	if err != nil {
+		return em.stopped(StopError, err)
+	}
+	inst, err := x86asm.Decode(mem, 16)
+	if err != nil {
+		return em.Step()
+	}
+	if !returns(inst) {
+		return em.Step()
+	}
+	return em.resume(cpu.Addr(cs, ip+uint16(inst.Len)), 0)
+}
+
+// Whether inst comes back to the next instruction after running other
+// code, or itself, a number of times.
+func returns(inst x86asm.Inst) bool {
+	switch inst.Op {
+	case x86asm.CALL, x86asm.LCALL, x86asm.INT, x86asm.INTO,
+		x86asm.LOOP, x86asm.LOOPE, x86asm.LOOPNE:
+		return true
+	}
+	for _, p := range inst.Prefix {
+		if p == 0 {
+			break
+		}
+		if p&0xFF == x86asm.PrefixREP || p&0xFF == x86asm.PrefixREPN {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs from CS:IP for count instructions, or until stopped when count is
+// 0, and says why it stopped.
+func (em *Emulator) resume(until uint64, count uint64) Stop {
+	d := em.debugger()
+	d.mu.Lock()
+	d.until, d.first, d.hit = until, true, nil
+	if !d.pause {
+		d.stop = nil
+	}
+	d.mu.Unlock()
+
+	cs := cpu.SReg16(em.mu, uc.X86_REG_CS)
+	ip := cpu.Reg16(em.mu, uc.X86_REG_IP)
+	err := em.mu.StartWithOptions(cpu.Addr(cs, ip), 0xffffffff, &uc.UcOptions{Count: count})
+
+	d.mu.Lock()
+	stop := d.stop
+	if stop == nil && d.hit != nil {
+		// The run ended right after the access
+		stop = d.hit
+		stop.At = cpu.SegOffset{Seg: cpu.SReg16(em.mu, uc.X86_REG_CS), Off: cpu.Reg16(em.mu, uc.X86_REG_IP)}
+	}
+	d.until, d.first, d.stop, d.hit, d.pause = noAddress, false, nil, nil, false
+	d.mu.Unlock()
+	switch {
+	case err != nil:
+		reason := StopError
+		var ucErr uc.UcError
+		if errors.As(err, &ucErr) && ucErr == uc.ERR_INSN_INVALID {
+			reason = StopInvalid
+		}
+		return em.stopped(reason, err)
+	case stop != nil:
+		return *stop
+	case count > 0:
+		return em.stopped(StopStep, nil)
+	}
+	return em.stopped(StopHalted, nil)
+}
+
+func (em *Emulator) stopped(reason StopReason, err error) Stop {
+	return Stop{
+		Reason: reason,
+		At:     cpu.SegOffset{Seg: cpu.SReg16(em.mu, uc.X86_REG_CS), Off: cpu.Reg16(em.mu, uc.X86_REG_IP)},
+		Err:    err,
+	}
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"testing"
+
+	"door86.org/ivdoor/cpu/cputest"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// An emulator on the fake CPU, with the instructions of code at 0100:0000
+// running as script says, data at 0200:0000 and AX=0042.
+func testEmulator(t *testing.T, code []byte, script map[uint16]cputest.Instr) (*Emulator, *cputest.CPU) {
+	t.Helper()
+	mu := cputest.New()
+	emu, err := NewEmulator(mu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(mu.Mem[0x1000:], code)
+	for off, in := range script {
+		mu.Code[0x1000+uint64(off)] = in
+	}
+	mu.SetRegs(map[int]uint64{uc.X86_REG_CS: 0x0100, uc.X86_REG_DS: 0x0200, uc.X86_REG_AX: 0x0042})
+	return emu, mu
+}
+
+// Writing AL, 42h, to DS:off, and reading it
+func writeAL(off uint64) []cputest.Access {
+	return []cputest.Access{{Type: uc.MEM_WRITE, Addr: 0x2000 + off, Size: 1, Value: 0x42}}
+}
+
+func readAL(off uint64) []cputest.Access {
+	return []cputest.Access{{Type: uc.MEM_READ, Addr: 0x2000 + off, Size: 1}}
+}
+
+// NOP; NOP; MOV [0010],AL; NOP; HLT, which here is the program exiting
+var (
+	testCode   = []byte{0x90, 0x90, 0xA2, 0x10, 0x00, 0x90, 0xF4}
+	testScript = map[uint16]cputest.Instr{
+		0: {Size: 1}, 1: {Size: 1}, 2: {Size: 3, Mem: writeAL(0x10)}, 5: {Size: 1}, 6: {Size: 1, Exit: true},
+	}
+)
+
+func TestIntBreak(t *testing.T) {
+	open := IntBreak{Num: 0x21, AH: 0x3D, AL: AnyFunction}
+	if !open.matches(0x21, 0x3D02) || open.matches(0x21, 0x3E00) || open.matches(0x16, 0x3D00) {
+		t.Error("INT 21h AH=3Dh matches wrongly")
+	}
+	any := IntBreak{Num: 0x10, AH: AnyFunction, AL: AnyFunction}
+	if !any.matches(0x10, 0x1234) || any.String() != "INT 10h" {
+		t.Errorf("%s matches wrongly", any)
+	}
+	if s := (IntBreak{Num: 0x21, AH: 0x44, AL: 0x00}).String(); s != "INT 21h AH=44h AL=00h" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestDebugOnCode(t *testing.T) {
+	mu := cputest.New()
+	mu.RegWrite(uc.X86_REG_CS, 0x0010)
+	mu.RegWrite(uc.X86_REG_AX, 0x3D00)
+	// MOV AH,3Dh; INT 21h; NOP
+	copy(mu.Mem[0x100:], []byte{0xB4, 0x3D, 0xCD, 0x21, 0x90})
+	d := &debugState{breaks: map[uint64]bool{0x104: true}, until: noAddress}
+	d.intBreaks = []IntBreak{{Num: 0x21, AH: 0x3D, AL: AnyFunction}}
+
+	for _, tc := range []struct {
+		addr   uint64
+		first  bool
+		reason StopReason
+		off    uint16
+	}{
+		{0x100, false, -1, 0},
+		{0x102, false, StopInterrupt, 0x0002},
+		// Continuing from the interrupt runs it
+		{0x102, true, -1, 0},
+		{0x104, false, StopBreakpoint, 0x0004},
+	} {
+		d.first, d.stop = tc.first, nil
+		stops := mu.Stops()
+		d.onCode(mu, tc.addr)
+		switch {
+		case tc.reason < 0 && (d.stop != nil || mu.Stops() != stops):
+			t.Errorf("%X: stopped with %v", tc.addr, d.stop)
+		case tc.reason >= 0 && (d.stop == nil || mu.Stops() != stops+1):
+			t.Errorf("%X: didn't stop", tc.addr)
+		case tc.reason >= 0 && (d.stop.Reason != tc.reason || d.stop.At.Seg != 0x10 || d.stop.At.Off != tc.off):
+			t.Errorf("%X: stopped %s", tc.addr, d.stop)
+		}
+	}
+
+	// A step over ends at the next instruction
+	d.until, d.stop = 0x104, nil
+	d.breaks = map[uint64]bool{}
+	d.onCode(mu, 0x104)
+	if d.stop == nil || d.stop.Reason != StopStep {
+		t.Errorf("step over stopped with %v", d.stop)
+	}
+}
+
+func TestDebugRun(t *testing.T) {
+	emu, mu := testEmulator(t, testCode, testScript)
+	emu.SetBreakpoint(0x1001)
+	if s := emu.Continue(); s.Reason != StopBreakpoint || s.At.Off != 1 {
+		t.Fatalf("continue: %s", s)
+	}
+	// Not stopped again by the breakpoint it's at
+	if s := emu.Step(); s.Reason != StopStep || s.At.Off != 2 {
+		t.Fatalf("step: %s", s)
+	}
+	id, err := emu.Watch(AccessWrite, 0x2010, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := emu.Continue(); s.Reason != StopWatch || s.Addr != 0x2010 || s.By.Off != 2 || s.At.Off != 5 || mu.Mem[0x2010] != 0x42 {
+		t.Fatalf("watch: %s", s)
+	}
+	if err := emu.Unwatch(id); err != nil {
+		t.Fatal(err)
+	}
+	if s := emu.Continue(); s.Reason != StopHalted || !mu.Exited {
+		t.Fatalf("exit: %s", s)
+	}
+
+	// UD2, which the CPU can't run
+	emu, _ = testEmulator(t, []byte{0x0F, 0x0B}, nil)
+	if s := emu.Continue(); s.Reason != StopInvalid || s.At.Off != 0 {
+		t.Errorf("invalid: %s", s)
+	}
+}
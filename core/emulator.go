@@ -3,6 +3,7 @@ package core
 import (
 	"encoding/hex"
 	"fmt"
+	"io"
 
 	"door86.org/ivdoor/cpu"
 	"github.com/golang/glog"
@@ -35,6 +36,21 @@ type Emulator struct {
 	mu      uc.Unicorn
 	intrs   map[uint32]InterruptHandler
 	Verbose int
+	// Number of interrupts raised so far
+	count uint64
+	// Called before each interrupt is handled, once it has been counted.
+	// Returning an error stops the emulator without handling it.
+	OnInterrupt func(intrNum uint32) error
+	// Handles each interrupt by calling handle when set, so that it can
+	// trace the call.
+	TraceInterrupt func(intrNum uint32, handle func() error) error
+	// Called after each interrupt is handled, on the emulator's thread
+	AfterInterrupt func()
+	// Where watchpoints with WatchLog write the accesses they match, the
+	// INFO log when nil
+	WatchLog io.Writer
+	// Breakpoints, see debug.go
+	debug *debugState
 }
 
 func hook_insn_invalid(mu uc.Unicorn) bool {
@@ -73,7 +89,7 @@ func addDefaultHooks(mu uc.Unicorn) error {
 			return
 		}
 		// do we need to fix IP?
-		csBase := uint64(cpu.Reg16(mu, uc.X86_REG_CS) * 0x10)
+		csBase := uint64(cpu.Reg16(mu, uc.X86_REG_CS)) * 0x10
 		ip := cpu.Reg(mu, uc.X86_REG_EIP)
 		eip := cpu.Reg(mu, uc.X86_REG_EIP)
 		glog.V(3).Infof("IP: 0x%04X EIP: 0x%04X", ip, eip)
@@ -106,14 +122,6 @@ func addDefaultHooks(mu uc.Unicorn) error {
 
 	}, 1, 0)
 
-	mu.HookAdd(uc.HOOK_MEM_READ|uc.HOOK_MEM_WRITE, func(mu uc.Unicorn, access int, addr uint64, size int, value int64) {
-		atype := "read"
-		if access == uc.MEM_WRITE {
-			atype = "write"
-		}
-		glog.V(3).Infof("Mem %s: @0x%x, 0x%x = 0x%x\n", atype, addr, size, value)
-	}, 1, 0)
-
 	invalid := uc.HOOK_MEM_READ_INVALID | uc.HOOK_MEM_WRITE_INVALID | uc.HOOK_MEM_FETCH_INVALID | uc.HOOK_MEM_UNMAPPED
 	mu.HookAdd(invalid, func(mu uc.Unicorn, access int, addr uint64, size int, value int64) bool {
 		atype := "unknown memory error"
@@ -136,8 +144,9 @@ func addDefaultHooks(mu uc.Unicorn) error {
 
 func allocEmulatorMemory(em Emulator, mu uc.Unicorn) error {
 	//IVDOOR_MEMORY_MAIN_START, IVDOOR_MEMORY_MAIN_SIZE
-	// Map 1M
-	if err := mu.MemMap(0, 0x100000); err != nil {
+	// Map 1M, and the HMA above it that real mode addresses past FFFF:000F
+	// reach with A20 on, which Unicorn has
+	if err := mu.MemMap(0, 0x110000); err != nil {
 		return err
 	}
 	// start emulation
@@ -146,19 +155,42 @@ func allocEmulatorMemory(em Emulator, mu uc.Unicorn) error {
 
 func NewEmulator(mu uc.Unicorn) (*Emulator, error) {
 	e := Emulator{mu: mu, intrs: make(map[uint32]InterruptHandler), Verbose: 0}
+	e.debug = &debugState{breaks: make(map[uint64]bool), until: noAddress, watches: make(map[int]*watch)}
 	addDefaultHooks(mu)
 	if err := allocEmulatorMemory(e, mu); err != nil {
 		return nil, err
 	}
 	mu.HookAdd(uc.HOOK_INTR, func(mu uc.Unicorn, intno uint32) {
 		ah, _ := mu.RegRead(uc.X86_REG_AH)
-		if err := e.Handle(mu, intno); err != nil {
+		e.count++
+		if e.OnInterrupt != nil {
+			if err := e.OnInterrupt(intno); err != nil {
+				glog.Infof("Stopping at interrupt %d: %s", e.count, err)
+				mu.Stop()
+				return
+			}
+		}
+		handle := func() error { return e.Handle(mu, intno) }
+		if e.TraceInterrupt != nil {
+			h := handle
+			handle = func() error { return e.TraceInterrupt(intno, h) }
+		}
+		if err := handle(); err != nil {
 			glog.Warningf("Error executing Hook: 0x%x/%x: \nDetails: '%s'\n", intno, ah, err)
 		}
+		if e.AfterInterrupt != nil {
+			e.AfterInterrupt()
+		}
 	}, 1, 0)
 	return &e, nil
 }
 
+// Interrupts returns the number of interrupts raised so far, which
+// identifies a point in the program's run.
+func (intr *Emulator) Interrupts() uint64 {
+	return intr.count
+}
+
 func (intr *Emulator) Register(num uint32, handler InterruptHandler) error {
 	intr.intrs[num] = handler
 	return nil
@@ -0,0 +1,538 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// GDBServer lets gdb, or another debugger speaking its remote serial
+// protocol, debug the program.  Connect with:
+//
+//	(gdb) set architecture i8086
+//	(gdb) target remote localhost:1234
+//
+// gdb knows nothing of segments: memory addresses, breakpoints and
+// watchpoints are linear, and so is $eip, which is CS*16+IP.
+type GDBServer struct {
+	emu *Emulator
+	// Reports whether the program has ended and its return code, may be
+	// nil
+	Exited func() (uint8, bool)
+
+	// Set by QStartNoAckMode, read by the goroutine reading packets
+	noAck atomic.Bool
+	// gdb understands swbreak in stop replies
+	swbreak bool
+	// Watchpoints set by gdb, by their packet's type, address and length
+	watches map[string]int
+	killed  bool
+}
+
+// NewGDBServer creates a server debugging the program in emu, which should
+// be loaded and stopped at its entry point.
+func NewGDBServer(emu *Emulator) *GDBServer {
+	return &GDBServer{emu: emu, watches: make(map[string]int)}
+}
+
+// Registers in the order of gdb's i386 'g' packet, each 32 bits.  EIP is
+// the linear PC.
+var gdbRegs = []int{
+	uc.X86_REG_EAX, uc.X86_REG_ECX, uc.X86_REG_EDX, uc.X86_REG_EBX,
+	uc.X86_REG_ESP, uc.X86_REG_EBP, uc.X86_REG_ESI, uc.X86_REG_EDI,
+	uc.X86_REG_EIP, uc.X86_REG_EFLAGS,
+	uc.X86_REG_CS, uc.X86_REG_SS, uc.X86_REG_DS, uc.X86_REG_ES,
+	uc.X86_REG_FS, uc.X86_REG_GS,
+}
+
+// EIP's number in the 'g' packet
+const gdbPC = 8
+
+// Unix signal numbers gdb expects in stop replies
+const (
+	sigINT  = 2
+	sigILL  = 4
+	sigTRAP = 5
+	sigSEGV = 11
+)
+
+// ErrGDBKilled is returned when the debugger kills the program.  When it
+// detaches or goes away, the program is left to run by itself.
+var ErrGDBKilled = errors.New("killed by gdb")
+
+// ListenAndServe waits for a debugger on the TCP address addr and serves
+// it until it detaches or kills the program.
+func (s *GDBServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	glog.Infof("Waiting for gdb on %s", l.Addr())
+	return s.Serve(l)
+}
+
+// Serve accepts one connection from l and serves it.
+func (s *GDBServer) Serve(l net.Listener) error {
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.ServeConn(conn)
+}
+
+// What comes from the debugger: a packet, or a ^C to stop the program
+type gdbInput struct {
+	packet string
+	brk    bool
+	err    error
+}
+
+// Reads packets from r, acknowledging them on w until told not to, and
+// sends them to in until quit is closed.
+func (s *GDBServer) readPackets(r *bufio.Reader, w io.Writer, in chan<- gdbInput, quit <-chan struct{}) {
+	defer close(in)
+	send := func(i gdbInput) bool {
+		select {
+		case in <- i:
+			return true
+		case <-quit:
+			return false
+		}
+	}
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			send(gdbInput{err: err})
+			return
+		}
+		switch c {
+		case 0x03:
+			if !send(gdbInput{brk: true}) {
+				return
+			}
+			continue
+		case '$':
+		default:
+			// Acks, and noise between packets
+			continue
+		}
+		data, err := r.ReadString('#')
+		if err != nil {
+			send(gdbInput{err: err})
+			return
+		}
+		data = data[:len(data)-1]
+		var sum [2]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			send(gdbInput{err: err})
+			return
+		}
+		if !s.noAck.Load() {
+			if want, err := strconv.ParseUint(string(sum[:]), 16, 8); err != nil || byte(want) != checksum(data) {
+				w.Write([]byte("-"))
+				continue
+			}
+			w.Write([]byte("+"))
+		}
+		if !send(gdbInput{packet: data}) {
+			return
+		}
+	}
+}
+
+func checksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+func writePacket(w io.Writer, data string) error {
+	_, err := fmt.Fprintf(w, "$%s#%02x", data, checksum(data))
+	return err
+}
+
+// ServeConn debugs the program for the debugger on conn, until it detaches
+// or kills the program or the connection is closed.
+func (s *GDBServer) ServeConn(conn io.ReadWriter) error {
+	in, quit := make(chan gdbInput), make(chan struct{})
+	defer close(quit)
+	go s.readPackets(bufio.NewReader(conn), conn, in, quit)
+	for input := range in {
+		if input.err != nil {
+			if errors.Is(input.err, io.EOF) {
+				return nil
+			}
+			return input.err
+		}
+		if input.brk {
+			// The program is already stopped
+			continue
+		}
+		glog.V(2).Infof("gdb: %s", input.packet)
+		reply, run, done := s.handle(input.packet)
+		if run != nil {
+			reply = s.run(run, in)
+		}
+		if s.killed {
+			// gdb doesn't wait for a reply
+			return ErrGDBKilled
+		}
+		if err := writePacket(conn, reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Runs the program with run, pausing it for a ^C from the debugger, and
+// returns the stop reply.
+func (s *GDBServer) run(run func() Stop, in <-chan gdbInput) string {
+	done := make(chan Stop)
+	go func() { done <- run() }()
+	for {
+		select {
+		case stop := <-done:
+			return s.stopReply(stop)
+		case input, ok := <-in:
+			if !ok || input.err != nil || input.brk {
+				s.emu.Pause()
+			}
+			if !ok {
+				// Nothing more will come, wait for the program to stop
+				in = nil
+			}
+		}
+	}
+}
+
+func (s *GDBServer) stopReply(stop Stop) string {
+	if s.Exited != nil {
+		if code, ok := s.Exited(); ok {
+			return fmt.Sprintf("W%02x", code)
+		}
+	}
+	// With the PC, so gdb needn't ask for it
+	reply := func(sig int, info string) string {
+		return fmt.Sprintf("T%02x%02x:%s;%s", sig, gdbPC, hexWord(uint32(s.pc())), info)
+	}
+	switch stop.Reason {
+	case StopBreakpoint:
+		if s.swbreak {
+			return reply(sigTRAP, "swbreak:;")
+		}
+	case StopWatch:
+		kind := "watch"
+		if w := stop.Access; w == AccessRead {
+			kind = "rwatch"
+		} else if w == AccessRead|AccessWrite {
+			kind = "awatch"
+		}
+		return reply(sigTRAP, fmt.Sprintf("%s:%x;", kind, stop.Addr))
+	case StopPaused:
+		return reply(sigINT, "")
+	case StopInvalid:
+		return reply(sigILL, "")
+	case StopError:
+		return reply(sigSEGV, "")
+	}
+	return reply(sigTRAP, "")
+}
+
+// Handles a packet, returning the reply, or what to run to get it, and
+// whether the session is over.
+func (s *GDBServer) handle(packet string) (reply string, run func() Stop, done bool) {
+	if packet == "" {
+		return "", nil, false
+	}
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		// Stopped, as after a step
+		return s.stopReply(Stop{Reason: StopStep}), nil, false
+	case 'g':
+		return s.readRegisters(), nil, false
+	case 'G':
+		return s.writeRegisters(args), nil, false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || int(n) >= len(gdbRegs) {
+			return "E01", nil, false
+		}
+		return hexWord(s.readRegister(gdbRegs[n])), nil, false
+	case 'P':
+		reg, value, _ := strings.Cut(args, "=")
+		n, err := strconv.ParseUint(reg, 16, 8)
+		v, verr := parseHexWord(value)
+		if err != nil || verr != nil || int(n) >= len(gdbRegs) {
+			return "E01", nil, false
+		}
+		if err := s.writeRegister(gdbRegs[n], v); err != nil {
+			return "E01", nil, false
+		}
+		return "OK", nil, false
+	case 'm':
+		addr, size, ok := addrLen(args)
+		if !ok {
+			return "E01", nil, false
+		}
+		b, err := s.emu.mu.MemRead(addr, size)
+		if err != nil {
+			return "E14", nil, false
+		}
+		return hex.EncodeToString(b), nil, false
+	case 'M':
+		where, data, _ := strings.Cut(args, ":")
+		addr, size, ok := addrLen(where)
+		b, err := hex.DecodeString(data)
+		if !ok || err != nil || uint64(len(b)) != size {
+			return "E01", nil, false
+		}
+		if err := s.emu.mu.MemWrite(addr, b); err != nil {
+			return "E14", nil, false
+		}
+		return "OK", nil, false
+	case 'Z', 'z':
+		return s.breakpoint(packet[0] == 'Z', args), nil, false
+	case 'c':
+		if !s.jump(args) {
+			return "E01", nil, false
+		}
+		return "", s.emu.Continue, false
+	case 's':
+		if !s.jump(args) {
+			return "E01", nil, false
+		}
+		return "", s.emu.Step, false
+	case 'H':
+		// One thread, whichever is asked for
+		return "OK", nil, false
+	case 'T':
+		return "OK", nil, false
+	case 'D':
+		return "OK", nil, true
+	case 'k':
+		s.killed = true
+		return "", nil, true
+	case 'q':
+		return s.query(args), nil, false
+	case 'Q':
+		if args == "StartNoAckMode" {
+			// Takes effect after this packet's ack
+			s.noAck.Store(true)
+			return "OK", nil, false
+		}
+	case 'v':
+		if strings.HasPrefix(args, "MustReplyEmpty") {
+			return "", nil, false
+		}
+	}
+	// Not supported, which gdb understands from an empty reply
+	return "", nil, false
+}
+
+func (s *GDBServer) query(q string) string {
+	name, args, _ := strings.Cut(q, ":")
+	switch name {
+	case "Supported":
+		features := "PacketSize=1000;QStartNoAckMode+"
+		for _, f := range strings.Split(args, ";") {
+			if f == "swbreak+" {
+				s.swbreak = true
+				features += ";swbreak+"
+			}
+		}
+		return features
+	case "Attached":
+		return "1"
+	case "C":
+		return "QC1"
+	case "fThreadInfo":
+		return "m1"
+	case "sThreadInfo":
+		return "l"
+	case "Symbol":
+		return "OK"
+	}
+	return ""
+}
+
+// Moves to the address a c or s packet gives, if any.
+func (s *GDBServer) jump(addr string) bool {
+	if addr == "" {
+		return true
+	}
+	a, err := strconv.ParseUint(addr, 16, 32)
+	if err != nil {
+		return false
+	}
+	return s.setPC(a) == nil
+}
+
+// The linear address of the next instruction.
+func (s *GDBServer) pc() uint64 {
+	cs, _ := s.emu.mu.RegRead(uc.X86_REG_CS)
+	ip, _ := s.emu.mu.RegRead(uc.X86_REG_IP)
+	return cs*0x10 + ip
+}
+
+// Moves to the linear address a, within the current code segment when it
+// can be.
+func (s *GDBServer) setPC(a uint64) error {
+	cs, _ := s.emu.mu.RegRead(uc.X86_REG_CS)
+	if a >= cs*0x10 && a-cs*0x10 <= 0xFFFF {
+		return s.emu.mu.RegWrite(uc.X86_REG_IP, a-cs*0x10)
+	}
+	if err := s.emu.mu.RegWrite(uc.X86_REG_CS, a>>4); err != nil {
+		return err
+	}
+	return s.emu.mu.RegWrite(uc.X86_REG_IP, a&0xF)
+}
+
+// Sets or clears a breakpoint or watchpoint from a Z or z packet:
+// type,addr,kind.
+func (s *GDBServer) breakpoint(set bool, args string) string {
+	parts := strings.Split(args, ",")
+	if len(parts) < 3 {
+		return "E01"
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 32)
+	size, serr := strconv.ParseUint(parts[2], 16, 16)
+	if err != nil || serr != nil {
+		return "E01"
+	}
+	var access Access
+	switch parts[0] {
+	case "0", "1":
+		// Software and hardware breakpoints are the same here
+		if set {
+			s.emu.SetBreakpoint(addr)
+		} else {
+			s.emu.ClearBreakpoint(addr)
+		}
+		return "OK"
+	case "2":
+		access = AccessWrite
+	case "3":
+		access = AccessRead
+	case "4":
+		access = AccessRead | AccessWrite
+	default:
+		return ""
+	}
+	key := strings.Join(parts[:3], ",")
+	if !set {
+		if id, ok := s.watches[key]; ok {
+			delete(s.watches, key)
+			if err := s.emu.Unwatch(id); err != nil {
+				return "E01"
+			}
+		}
+		return "OK"
+	}
+	if _, ok := s.watches[key]; ok {
+		return "OK"
+	}
+	id, err := s.emu.Watch(access, addr, int(size))
+	if err != nil {
+		return "E01"
+	}
+	s.watches[key] = id
+	return "OK"
+}
+
+func (s *GDBServer) readRegisters() string {
+	var b strings.Builder
+	for _, reg := range gdbRegs {
+		b.WriteString(hexWord(s.readRegister(reg)))
+	}
+	return b.String()
+}
+
+// Reads a register, EIP being the linear PC.
+func (s *GDBServer) readRegister(reg int) uint32 {
+	if reg == uc.X86_REG_EIP {
+		return uint32(s.pc())
+	}
+	v, _ := s.emu.mu.RegRead(reg)
+	return uint32(v)
+}
+
+func (s *GDBServer) writeRegisters(data string) string {
+	// EIP goes last, as where the PC lands depends on the packet's CS
+	order := make([]int, 0, len(gdbRegs))
+	for i := range gdbRegs {
+		if i != gdbPC {
+			order = append(order, i)
+		}
+	}
+	for _, i := range append(order, gdbPC) {
+		if len(data) < (i+1)*8 {
+			continue
+		}
+		v, err := parseHexWord(data[i*8 : (i+1)*8])
+		if err != nil {
+			return "E01"
+		}
+		if err := s.writeRegister(gdbRegs[i], v); err != nil {
+			return "E01"
+		}
+	}
+	return "OK"
+}
+
+// Writes a register, segments being 16 bits.  EIP is the linear PC, like
+// the one read, and moves CS:IP there: IP alone when the address is in the
+// current code segment, as gdb's writing back what it read leaves it, or
+// else CS too with IP under 10h.  The high 16 bits of EIP are never set.
+func (s *GDBServer) writeRegister(reg int, v uint32) error {
+	switch reg {
+	case uc.X86_REG_CS, uc.X86_REG_SS, uc.X86_REG_DS, uc.X86_REG_ES, uc.X86_REG_FS, uc.X86_REG_GS:
+		v &= 0xFFFF
+	case uc.X86_REG_EIP:
+		return s.setPC(uint64(v))
+	}
+	return s.emu.mu.RegWrite(reg, uint64(v))
+}
+
+// Registers go in target byte order, little endian
+func hexWord(v uint32) string {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return hex.EncodeToString(b[:])
+}
+
+func parseHexWord(s string) (uint32, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, fmt.Errorf("bad register value '%s'", s)
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// Parses addr,length, which must be within the first MB.
+func addrLen(s string) (uint64, uint64, bool) {
+	a, l, ok := strings.Cut(s, ",")
+	addr, err := strconv.ParseUint(a, 16, 32)
+	size, lerr := strconv.ParseUint(l, 16, 32)
+	if !ok || err != nil || lerr != nil || addr+size > 0x100000 {
+		return 0, 0, false
+	}
+	return addr, size, true
+}
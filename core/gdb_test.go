@@ -0,0 +1,203 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"door86.org/ivdoor/cpu/cputest"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// A gdb client speaking the remote serial protocol.
+type gdbClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Sends a packet and returns the reply.
+func (c *gdbClient) send(packet string) string {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "$%s#%02x", packet, checksum(packet))
+	if ack, err := c.r.ReadByte(); err != nil || ack != '+' {
+		c.t.Fatalf("%s: ack %q %v", packet, ack, err)
+	}
+	return c.reply()
+}
+
+func (c *gdbClient) reply() string {
+	c.t.Helper()
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data = strings.TrimSuffix(data, "#")
+	var sum [2]byte
+	if _, err := c.r.Read(sum[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if fmt.Sprintf("%02x", checksum(data)) != string(sum[:]) {
+		c.t.Fatalf("reply %q has checksum %s", data, sum)
+	}
+	c.conn.Write([]byte("+"))
+	return data
+}
+
+func (c *gdbClient) expect(packet, want string) {
+	c.t.Helper()
+	if got := c.send(packet); got != want {
+		c.t.Errorf("%s: got %q, want %q", packet, got, want)
+	}
+}
+
+func startGDB(t *testing.T, emu *Emulator, mu *cputest.CPU) (*gdbClient, chan error) {
+	s := NewGDBServer(emu)
+	s.Exited = func() (uint8, bool) { return 3, mu.Exited }
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+		l.Close()
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &gdbClient{t: t, conn: conn, r: bufio.NewReader(conn)}, done
+}
+
+func TestGDBServer(t *testing.T) {
+	emu, mu := testEmulator(t, testCode, testScript)
+	c, done := startGDB(t, emu, mu)
+
+	if got := c.send("qSupported:multiprocess+;swbreak+"); !strings.Contains(got, "swbreak+") {
+		t.Errorf("qSupported: %q", got)
+	}
+	// Stop replies have the PC, which is linear
+	c.expect("?", "T0508:00100000;")
+	regs := c.send("g")
+	// EAX, then EIP, and CS with the segments after EFLAGS
+	if len(regs) != 16*8 || regs[:8] != "42000000" || regs[8*8:9*8] != "00100000" || regs[10*8:11*8] != "00010000" {
+		t.Errorf("g: %s", regs)
+	}
+	c.expect("m1000,3", "9090a2")
+	c.expect("m100000,1", "E01")
+
+	c.expect("Z0,1001,1", "OK")
+	c.expect("c", "T0508:01100000;swbreak:;")
+	c.expect("p8", "01100000")
+	c.expect("z0,1001,1", "OK")
+
+	c.expect("Z2,2010,1", "OK")
+	c.expect("c", "T0508:05100000;watch:2010;")
+	// Stopped after the instruction writing it
+	c.expect("p8", "05100000")
+	c.expect("m2010,1", "42")
+	c.expect("z2,2010,1", "OK")
+	c.expect("M2010,2:9999", "OK")
+	c.expect("m2010,2", "9999")
+
+	c.expect("P0=78563412", "OK")
+	c.expect("p0", "78563412")
+	c.expect("s", "T0508:06100000;")
+	c.expect("p8", "06100000")
+	// The program exits with HLT
+	c.expect("c", "W03")
+	c.expect("D", "OK")
+	if err := <-done; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+func TestGDBServerStops(t *testing.T) {
+	// JMP $
+	emu, mu := testEmulator(t, []byte{0xEB, 0xFE}, map[uint16]cputest.Instr{0: {Size: 2, Jumps: true, Jump: 0}})
+	c, done := startGDB(t, emu, mu)
+	c.expect("QStartNoAckMode", "OK")
+	// No acks from here on
+	fmt.Fprintf(c.conn, "$c#%02x", checksum("c"))
+	c.conn.Write([]byte{0x03})
+	if got := c.reply(); got != "T0208:00100000;" {
+		t.Errorf("^C: got %q", got)
+	}
+	// Bad instructions are SIGILL
+	delete(mu.Code, 0x1000)
+	fmt.Fprintf(c.conn, "$c#%02x", checksum("c"))
+	if got := c.reply(); got != "T0408:00100000;" {
+		t.Errorf("invalid instruction: got %q", got)
+	}
+	fmt.Fprintf(c.conn, "$k#%02x", checksum("k"))
+	if err := <-done; err != ErrGDBKilled {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+func TestGDBBadChecksum(t *testing.T) {
+	emu, mu := testEmulator(t, []byte{0x90}, nil)
+	c, _ := startGDB(t, emu, mu)
+	c.conn.Write([]byte("$g#00"))
+	if nak, err := c.r.ReadByte(); err != nil || nak != '-' {
+		t.Errorf("got %q %v", nak, err)
+	}
+	c.expect("?", "T0508:00100000;")
+}
+
+func TestGDBServerPC(t *testing.T) {
+	emu, mu := testEmulator(t, testCode, testScript)
+	c, _ := startGDB(t, emu, mu)
+	// Without swbreak from gdb, breakpoints are just SIGTRAP
+	if got := c.send("qSupported:multiprocess+"); strings.Contains(got, "swbreak") {
+		t.Errorf("qSupported: %q", got)
+	}
+	c.expect("Z0,1005,1", "OK")
+	c.expect("c", "T0508:05100000;")
+
+	// $eip is written as it's read, moving CS too outside this segment
+	for _, tc := range []struct {
+		pc     string
+		cs, ip uint64
+	}{
+		{"02100000", 0x0100, 0x0002},
+		{"34120200", 0x2123, 0x0004},
+		{"3a120200", 0x2123, 0x000A},
+		{"00100000", 0x0100, 0x0000},
+	} {
+		c.expect("P8="+tc.pc, "OK")
+		if cs, ip := mu.Reg(uc.X86_REG_CS), mu.Reg(uc.X86_REG_IP); cs != tc.cs || ip != tc.ip {
+			t.Errorf("P8=%s: at %04X:%04X", tc.pc, cs, ip)
+		}
+		c.expect("p8", tc.pc)
+	}
+	c.expect("c", "T0508:05100000;")
+
+	// G writes CS before the PC, whichever way either changes
+	regs := c.send("g")
+	for _, tc := range []struct {
+		cs, pc string
+		at     [2]uint64
+	}{
+		// The PC in another segment, with the CS read
+		{"00010000", "34120200", [2]uint64{0x2123, 0x0004}},
+		// Back, with the CS read there
+		{"23210000", "02100000", [2]uint64{0x0100, 0x0002}},
+		// A new CS with the PC in it
+		{"00200000", "05000200", [2]uint64{0x2000, 0x0005}},
+	} {
+		packet := regs[:8*8] + tc.pc + regs[9*8:10*8] + tc.cs + regs[11*8:]
+		c.expect("G"+packet, "OK")
+		if at := [2]uint64{mu.Reg(uc.X86_REG_CS), mu.Reg(uc.X86_REG_IP)}; at != tc.at {
+			t.Errorf("G with CS %s and PC %s: at %04X:%04X", tc.cs, tc.pc, at[0], at[1])
+		}
+		c.expect("p8", tc.pc)
+	}
+}
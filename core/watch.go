@@ -0,0 +1,274 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"door86.org/ivdoor/cpu"
+	"github.com/golang/glog"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Access is the kind of memory access a watchpoint matches.
+type Access int
+
+const (
+	AccessWrite Access = 1 << iota
+	AccessRead
+	// Running an instruction starting in the range
+	AccessExec
+)
+
+func (a Access) String() string {
+	var kinds []string
+	if a&AccessRead != 0 {
+		kinds = append(kinds, "read")
+	}
+	if a&AccessWrite != 0 {
+		kinds = append(kinds, "write")
+	}
+	if a&AccessExec != 0 {
+		kinds = append(kinds, "exec")
+	}
+	if len(kinds) == 0 {
+		return fmt.Sprintf("Access(%d)", int(a))
+	}
+	return strings.Join(kinds, "/")
+}
+
+// WatchAction is what happens when a watchpoint matches an access.
+type WatchAction int
+
+const (
+	// Stop the program after the instruction making the access
+	WatchBreak WatchAction = iota
+	// Log the access and carry on
+	WatchLog
+	// Just count it
+	WatchCount
+)
+
+func (a WatchAction) String() string {
+	switch a {
+	case WatchBreak:
+		return "break"
+	case WatchLog:
+		return "log"
+	case WatchCount:
+		return "count"
+	}
+	return fmt.Sprintf("WatchAction(%d)", int(a))
+}
+
+// AnyValue matches accesses of every value in a Watchpoint.
+const AnyValue = -1
+
+// Watchpoint matches accesses to the Size bytes at the linear address
+// Addr.
+type Watchpoint struct {
+	Access Access
+	Addr   uint64
+	Size   int
+	// Only reads or writes whose bytes in the range have this value, or
+	// AnyValue
+	Value int64
+	// Only accesses by code with CS from CSLow to CSHigh, unless CSHigh is
+	// 0
+	CSLow, CSHigh cpu.Seg
+	Action        WatchAction
+	// How many accesses it has matched
+	Hits uint64
+}
+
+func (w Watchpoint) String() string {
+	s := fmt.Sprintf("%s L%05X", w.Access, w.Addr)
+	if w.Size > 1 {
+		s += fmt.Sprintf("-L%05X", w.Addr+uint64(w.Size)-1)
+	}
+	if w.Value != AnyValue {
+		s += fmt.Sprintf(" =%X", w.Value)
+	}
+	if w.CSHigh != 0 {
+		s += fmt.Sprintf(" CS=%04X-%04X", w.CSLow, w.CSHigh)
+	}
+	return fmt.Sprintf("%s %s, %d hits", s, w.Action, w.Hits)
+}
+
+// A watchpoint with the Unicorn hooks covering just its range.
+type watch struct {
+	Watchpoint
+	hooks []uc.Hook
+}
+
+// Watch stops the program after any instruction making an access of the
+// kinds in access to the size bytes at the linear address addr.  It
+// returns a number for Unwatch.
+func (em *Emulator) Watch(access Access, addr uint64, size int) (int, error) {
+	return em.AddWatch(Watchpoint{Access: access, Addr: addr, Size: size, Value: AnyValue})
+}
+
+// AddWatch adds the watchpoint w, returning a number for Unwatch.  Only
+// memory in its range is hooked, so it costs little elsewhere.
+func (em *Emulator) AddWatch(w Watchpoint) (int, error) {
+	switch {
+	case w.Size < 1 || w.Access&(AccessRead|AccessWrite|AccessExec) == 0:
+		return 0, fmt.Errorf("bad watchpoint: %s of %d bytes", w.Access, w.Size)
+	case w.Value != AnyValue && (w.Value < 0 || w.Access&AccessExec != 0):
+		return 0, fmt.Errorf("bad watchpoint value %d for %s", w.Value, w.Access)
+	case w.CSHigh != 0 && w.CSLow > w.CSHigh:
+		return 0, fmt.Errorf("bad watchpoint CS range %04X-%04X", w.CSLow, w.CSHigh)
+	}
+	w.Hits = 0
+	d := em.debug
+	if w.Action == WatchBreak {
+		// Only the code hook can stop the program after the access
+		d = em.debugger()
+	}
+	d.mu.Lock()
+	d.lastWatch++
+	id := d.lastWatch
+	d.mu.Unlock()
+
+	wa := &watch{Watchpoint: w}
+	end := w.Addr + uint64(w.Size) - 1
+	// Unicorn only checks where an access starts, so the memory hooks
+	// start early enough for a dword running into the range
+	memBegin := w.Addr - 3
+	if w.Addr < 3 {
+		memBegin = 0
+	}
+	onMem := func(mu uc.Unicorn, kind int, addr uint64, size int, value int64) {
+		a := AccessRead
+		if kind == uc.MEM_WRITE {
+			a = AccessWrite
+		}
+		em.onWatch(mu, id, wa, a, addr, size, value)
+	}
+	for _, k := range []struct {
+		access Access
+		hook   int
+		cb     interface{}
+		begin  uint64
+	}{
+		{AccessRead, uc.HOOK_MEM_READ, onMem, memBegin},
+		{AccessWrite, uc.HOOK_MEM_WRITE, onMem, memBegin},
+		{AccessExec, uc.HOOK_CODE, func(mu uc.Unicorn, addr uint64, size uint32) {
+			em.onWatch(mu, id, wa, AccessExec, addr, int(size), 0)
+		}, w.Addr},
+	} {
+		if w.Access&k.access == 0 {
+			continue
+		}
+		h, err := em.mu.HookAdd(k.hook, k.cb, k.begin, end)
+		if err != nil {
+			em.removeHooks(wa)
+			return 0, err
+		}
+		wa.hooks = append(wa.hooks, h)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.watches[id] = wa
+	return id, nil
+}
+
+// Checks an access against the conditions of the watchpoint w, numbered
+// id, and acts on it when it matches.
+func (em *Emulator) onWatch(mu uc.Unicorn, id int, w *watch, a Access, addr uint64, size int, value int64) {
+	if a != AccessExec && (addr >= w.Addr+uint64(w.Size) || addr+uint64(size) <= w.Addr) {
+		// Before the range, from the hook's early start
+		return
+	}
+	cs := cpu.SReg16(mu, uc.X86_REG_CS)
+	if w.CSHigh != 0 && (cs < w.CSLow || cs > w.CSHigh) {
+		return
+	}
+	if a == AccessRead {
+		// Unicorn calls the hook before reading, without the value
+		if b, err := mu.MemRead(addr, uint64(size)); err == nil {
+			value = int64(littleEndian(b))
+		}
+	}
+	if a != AccessExec {
+		// Just the bytes in the range, of an access that may be wider
+		// or start before it
+		end := addr + uint64(size)
+		if addr < w.Addr {
+			value >>= 8 * (w.Addr - addr)
+			addr = w.Addr
+		}
+		if watchEnd := w.Addr + uint64(w.Size); end > watchEnd {
+			end = watchEnd
+		}
+		size = int(end - addr)
+	}
+	if size < 8 {
+		value &= 1<<(8*size) - 1
+	}
+	if w.Value != AnyValue && value != w.Value {
+		return
+	}
+	by := cpu.SegOffset{Seg: cs, Off: cpu.Reg16(mu, uc.X86_REG_IP)}
+	d := em.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w.Hits++
+	switch w.Action {
+	case WatchLog:
+		msg := fmt.Sprintf("Watch %d: %s of %d bytes at L%05X = 0x%X by %04X:%04X", id, a, size, addr, value, by.Seg, by.Off)
+		if a == AccessExec {
+			msg = fmt.Sprintf("Watch %d: exec at %04X:%04X", id, by.Seg, by.Off)
+		}
+		if em.WatchLog != nil {
+			fmt.Fprintln(em.WatchLog, msg)
+		} else {
+			glog.Info(msg)
+		}
+	case WatchBreak:
+		if d.hit == nil {
+			d.hit = &Stop{Reason: StopWatch, Access: a, Addr: addr, By: by}
+		}
+	}
+}
+
+func littleEndian(b []byte) uint64 {
+	var buf [8]byte
+	copy(buf[:], b)
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// Watches returns the watchpoints by their numbers, with their hits so far.
+func (em *Emulator) Watches() map[int]Watchpoint {
+	d := em.debug
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ws := make(map[int]Watchpoint, len(d.watches))
+	for id, w := range d.watches {
+		ws[id] = w.Watchpoint
+	}
+	return ws
+}
+
+// Unwatch removes the watchpoint numbered id.
+func (em *Emulator) Unwatch(id int) error {
+	d := em.debug
+	d.mu.Lock()
+	w, ok := d.watches[id]
+	delete(d.watches, id)
+	d.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no watchpoint %d", id)
+	}
+	return em.removeHooks(w)
+}
+
+func (em *Emulator) removeHooks(w *watch) error {
+	var err error
+	for _, h := range w.hooks {
+		if e := em.mu.HookDel(h); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
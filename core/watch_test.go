@@ -0,0 +1,143 @@
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"door86.org/ivdoor/cpu/cputest"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// MOV [0010],AL; MOV AL,[0010]; MOV [0011],AL; HLT
+var (
+	watchCode   = []byte{0xA2, 0x10, 0x00, 0xA0, 0x10, 0x00, 0xA2, 0x11, 0x00, 0xF4}
+	watchScript = map[uint16]cputest.Instr{
+		0: {Size: 3, Mem: writeAL(0x10)}, 3: {Size: 3, Mem: readAL(0x10)}, 6: {Size: 3, Mem: writeAL(0x11)}, 9: {Size: 1, Exit: true},
+	}
+)
+
+func TestWatchConditions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		w    Watchpoint
+		hits uint64
+	}{
+		{"any", Watchpoint{Access: AccessRead | AccessWrite, Addr: 0x2010, Size: 2, Value: AnyValue}, 3},
+		{"write", Watchpoint{Access: AccessWrite, Addr: 0x2010, Size: 2, Value: AnyValue}, 2},
+		{"range", Watchpoint{Access: AccessRead | AccessWrite, Addr: 0x2011, Size: 1, Value: AnyValue}, 1},
+		{"value", Watchpoint{Access: AccessRead | AccessWrite, Addr: 0x2010, Size: 2, Value: 0x42}, 3},
+		{"other value", Watchpoint{Access: AccessWrite, Addr: 0x2010, Size: 2, Value: 0x43}, 0},
+		{"cs", Watchpoint{Access: AccessWrite, Addr: 0x2010, Size: 2, Value: AnyValue, CSLow: 0x0100, CSHigh: 0x0100}, 2},
+		{"other cs", Watchpoint{Access: AccessWrite, Addr: 0x2010, Size: 2, Value: AnyValue, CSLow: 0x0200, CSHigh: 0x0300}, 0},
+		{"exec", Watchpoint{Access: AccessExec, Addr: 0x1003, Size: 6, Value: AnyValue}, 2},
+	} {
+		emu, mu := testEmulator(t, watchCode, watchScript)
+		tc.w.Action = WatchCount
+		id, err := emu.AddWatch(tc.w)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if s := emu.Continue(); s.Reason != StopHalted || !mu.Exited {
+			t.Errorf("%s: counting stopped %s", tc.name, s)
+		}
+		if w := emu.Watches()[id]; w.Hits != tc.hits {
+			t.Errorf("%s: %d hits, want %d", tc.name, w.Hits, tc.hits)
+		}
+	}
+}
+
+func TestWatchOverlap(t *testing.T) {
+	// MOV [000F],AX; MOV [0010],AX; MOV [0012],AX; HLT
+	code := []byte{0xA3, 0x0F, 0x00, 0xA3, 0x10, 0x00, 0xA3, 0x12, 0x00, 0xF4}
+	writeAX := func(off uint64) []cputest.Access {
+		return []cputest.Access{{Type: uc.MEM_WRITE, Addr: 0x2000 + off, Size: 2, Value: 0x0042}}
+	}
+	script := map[uint16]cputest.Instr{
+		0: {Size: 3, Mem: writeAX(0x0F)}, 3: {Size: 3, Mem: writeAX(0x10)}, 6: {Size: 3, Mem: writeAX(0x12)}, 9: {Size: 1, Exit: true},
+	}
+	emu, _ := testEmulator(t, code, script)
+	// Only the word starting a byte before it writes it, and the address
+	// is the watch's, which gdb matches to its watchpoints
+	if _, err := emu.Watch(AccessWrite, 0x2011, 1); err != nil {
+		t.Fatal(err)
+	}
+	if s := emu.Continue(); s.Reason != StopWatch || s.Addr != 0x2011 || s.By.Off != 3 || s.At.Off != 6 {
+		t.Errorf("stopped %s", s)
+	}
+	if s := emu.Continue(); s.Reason != StopHalted {
+		t.Errorf("stopped %s", s)
+	}
+}
+
+// A value is matched against the bytes of the access in the watch's range.
+func TestWatchOverlapValue(t *testing.T) {
+	write := func(off uint64, size int, value int64) []cputest.Access {
+		return []cputest.Access{{Type: uc.MEM_WRITE, Addr: 0x2000 + off, Size: size, Value: value}}
+	}
+	// MOV [0010],AX; MOV [0011],AX; MOV [0010],AX; MOV [000F],EAX; HLT
+	code := []byte{0xA3, 0x10, 0x00, 0xA3, 0x11, 0x00, 0xA3, 0x10, 0x00, 0x66, 0xA3, 0x0F, 0x00, 0xF4}
+	script := map[uint16]cputest.Instr{
+		0:  {Size: 3, Mem: write(0x10, 2, 0x0041)},
+		3:  {Size: 3, Mem: write(0x11, 2, 0x4241)},
+		6:  {Size: 3, Mem: write(0x10, 2, 0x4100)},
+		9:  {Size: 4, Mem: write(0x0F, 4, 0x00414100)},
+		13: {Size: 1, Exit: true},
+	}
+	for _, tc := range []struct {
+		name string
+		w    Watchpoint
+		hits uint64
+		log  string
+	}{
+		{"byte", Watchpoint{Access: AccessWrite, Addr: 0x2011, Size: 1, Value: 0x41}, 3, "Watch 1: write of 1 bytes at L02011 = 0x41 by 0100:0003\n"},
+		{"word", Watchpoint{Access: AccessWrite, Addr: 0x2011, Size: 2, Value: 0x0041}, 2, "Watch 1: write of 1 bytes at L02011 = 0x41 by 0100:0006\n"},
+		{"other byte", Watchpoint{Access: AccessWrite, Addr: 0x2010, Size: 1, Value: 0x41}, 2, "Watch 1: write of 1 bytes at L02010 = 0x41 by 0100:0000\n"},
+	} {
+		emu, _ := testEmulator(t, code, script)
+		var log strings.Builder
+		emu.WatchLog = &log
+		tc.w.Action = WatchLog
+		id, err := emu.AddWatch(tc.w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := emu.Continue(); s.Reason != StopHalted {
+			t.Errorf("%s: stopped %s", tc.name, s)
+		}
+		if w := emu.Watches()[id]; w.Hits != tc.hits {
+			t.Errorf("%s: %d hits, want %d", tc.name, w.Hits, tc.hits)
+		}
+		if first, _, _ := strings.Cut(log.String(), "\n"); first+"\n" != tc.log {
+			t.Errorf("%s: logged %q first, want %q", tc.name, log.String(), tc.log)
+		}
+	}
+}
+
+func TestWatchActions(t *testing.T) {
+	emu, _ := testEmulator(t, watchCode, watchScript)
+	var log strings.Builder
+	emu.WatchLog = &log
+	if _, err := emu.AddWatch(Watchpoint{Access: AccessRead, Addr: 0x2010, Size: 1, Value: AnyValue, Action: WatchLog}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := emu.AddWatch(Watchpoint{Access: AccessExec, Addr: 0x1006, Size: 1, Value: AnyValue}); err != nil {
+		t.Fatal(err)
+	}
+	// Stops after the instruction at 0100:0006 runs
+	if s := emu.Continue(); s.Reason != StopWatch || s.Access != AccessExec || s.By.Off != 6 || s.At.Off != 9 {
+		t.Errorf("exec watch stopped %s", s)
+	}
+	if want := "Watch 1: read of 1 bytes at L02010 = 0x42 by 0100:0003\n"; log.String() != want {
+		t.Errorf("logged %q, want %q", log.String(), want)
+	}
+
+	for _, w := range []Watchpoint{
+		{Access: AccessWrite, Addr: 0x2010, Size: 0, Value: AnyValue},
+		{Access: AccessExec, Addr: 0x1000, Size: 1, Value: 0x90},
+		{Access: AccessWrite, Addr: 0x2010, Size: 1, Value: AnyValue, CSLow: 0x0200, CSHigh: 0x0100},
+	} {
+		if _, err := emu.AddWatch(w); err == nil {
+			t.Errorf("added %s", w)
+		}
+	}
+}
@@ -55,9 +55,23 @@ func SetCarryFlag(mu uc.Unicorn, flag bool) error {
 	}
 
 	if flag {
+		f |= 1
+	} else {
 		f &^= 1
+	}
+	return mu.RegWrite(uc.X86_REG_FLAGS, f)
+}
+
+func SetZeroFlag(mu uc.Unicorn, flag bool) error {
+	f, err := mu.RegRead(uc.X86_REG_FLAGS)
+	if err != nil {
+		return err
+	}
+
+	if flag {
+		f |= 0x40
 	} else {
-		f |= 1
+		f &^= 0x40
 	}
 	return mu.RegWrite(uc.X86_REG_FLAGS, f)
 }
@@ -92,7 +106,7 @@ func PutMem8(mu uc.Unicorn, addr uint64, value uint8) error {
 }
 
 func Addr(seg Seg, off uint16) uint64 {
-	return uint64(seg*0x10) + uint64(off)
+	return uint64(seg)*0x10 + uint64(off)
 }
 
 func Mem(mu uc.Unicorn, seg Seg, off uint16, size uint64) ([]byte, error) {
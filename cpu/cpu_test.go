@@ -13,5 +13,10 @@ func TestAddr(t *testing.T) {
 	if a != 0x43 {
 		t.Errorf("expected 0x43, got %02x", a)
 	}
+	// Segments above 64K don't wrap
+	a = Addr(0x9F00, 0x0010)
+	if a != 0x9F010 {
+		t.Errorf("expected 0x9F010, got %02x", a)
+	}
 
 }
@@ -0,0 +1,230 @@
+// Package cputest has a fake CPU for testing the code that drives Unicorn,
+// such as the interrupt handlers and the debugger, without running any 8086
+// code.
+package cputest
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// CPU has a megabyte of memory, the HMA above it, the registers and hooks.
+// Instead of decoding instructions it runs the script in Code.  The rest of
+// uc.Unicorn panics.
+type CPU struct {
+	uc.Unicorn
+	Mem []byte
+	// What the instructions do, by their linear address.  Running one that
+	// isn't there is an invalid instruction.
+	Code map[uint64]Instr
+	// An Exit instruction ended the last run
+	Exited bool
+
+	regs     map[int]uint64
+	hooks    map[uc.Hook]hook
+	lastHook uc.Hook
+	stopping atomic.Bool
+	stops    atomic.Int32
+}
+
+// Instr is what an instruction does when the CPU runs it: it makes the
+// accesses in Mem, then goes on to the next instruction, or to the offset
+// Jump in CS when Jumps.
+type Instr struct {
+	Size  uint32
+	Mem   []Access
+	Jumps bool
+	Jump  uint16
+	// An INT instruction's interrupt, for the interrupt hooks, unless 0
+	Int uint32
+	// Ends the run, like the host stopping the CPU when the program exits
+	Exit bool
+}
+
+// Access is a read or write, uc.MEM_READ or uc.MEM_WRITE, of Size bytes at
+// the linear address Addr.  Writes store Value.
+type Access struct {
+	Type  int
+	Addr  uint64
+	Size  int
+	Value int64
+}
+
+type hook struct {
+	htype      int
+	cb         interface{}
+	begin, end uint64
+}
+
+func New() *CPU {
+	return &CPU{
+		Mem:   make([]byte, 0x110000),
+		Code:  make(map[uint64]Instr),
+		regs:  make(map[int]uint64),
+		hooks: make(map[uc.Hook]hook),
+	}
+}
+
+// The smaller registers, as part of a 32 bit one
+var aliases = map[int]struct {
+	reg   int
+	shift uint
+	mask  uint64
+}{
+	uc.X86_REG_AX: {uc.X86_REG_EAX, 0, 0xFFFF}, uc.X86_REG_AL: {uc.X86_REG_EAX, 0, 0xFF}, uc.X86_REG_AH: {uc.X86_REG_EAX, 8, 0xFF},
+	uc.X86_REG_BX: {uc.X86_REG_EBX, 0, 0xFFFF}, uc.X86_REG_BL: {uc.X86_REG_EBX, 0, 0xFF}, uc.X86_REG_BH: {uc.X86_REG_EBX, 8, 0xFF},
+	uc.X86_REG_CX: {uc.X86_REG_ECX, 0, 0xFFFF}, uc.X86_REG_CL: {uc.X86_REG_ECX, 0, 0xFF}, uc.X86_REG_CH: {uc.X86_REG_ECX, 8, 0xFF},
+	uc.X86_REG_DX: {uc.X86_REG_EDX, 0, 0xFFFF}, uc.X86_REG_DL: {uc.X86_REG_EDX, 0, 0xFF}, uc.X86_REG_DH: {uc.X86_REG_EDX, 8, 0xFF},
+	uc.X86_REG_SP: {uc.X86_REG_ESP, 0, 0xFFFF}, uc.X86_REG_BP: {uc.X86_REG_EBP, 0, 0xFFFF},
+	uc.X86_REG_SI: {uc.X86_REG_ESI, 0, 0xFFFF}, uc.X86_REG_DI: {uc.X86_REG_EDI, 0, 0xFFFF},
+	uc.X86_REG_IP: {uc.X86_REG_EIP, 0, 0xFFFF}, uc.X86_REG_FLAGS: {uc.X86_REG_EFLAGS, 0, 0xFFFF},
+}
+
+func (c *CPU) RegRead(reg int) (uint64, error) {
+	return c.Reg(reg), nil
+}
+
+func (c *CPU) RegWrite(reg int, value uint64) error {
+	if a, ok := aliases[reg]; ok {
+		c.regs[a.reg] = c.regs[a.reg]&^(a.mask<<a.shift) | (value&a.mask)<<a.shift
+		return nil
+	}
+	c.regs[reg] = value
+	return nil
+}
+
+// Reg returns a register.
+func (c *CPU) Reg(reg int) uint64 {
+	if a, ok := aliases[reg]; ok {
+		return c.regs[a.reg] >> a.shift & a.mask
+	}
+	return c.regs[reg]
+}
+
+// SetRegs sets the registers in regs.
+func (c *CPU) SetRegs(regs map[int]uint64) {
+	for reg, value := range regs {
+		c.RegWrite(reg, value)
+	}
+}
+
+// Carry returns the carry flag, which DOS calls set when they fail.
+func (c *CPU) Carry() bool {
+	return c.regs[uc.X86_REG_EFLAGS]&1 != 0
+}
+
+func (c *CPU) MemRead(addr, size uint64) ([]byte, error) {
+	if addr+size > uint64(len(c.Mem)) {
+		return nil, uc.UcError(uc.ERR_READ_UNMAPPED)
+	}
+	return append([]byte(nil), c.Mem[addr:addr+size]...), nil
+}
+
+func (c *CPU) MemWrite(addr uint64, data []byte) error {
+	if addr+uint64(len(data)) > uint64(len(c.Mem)) {
+		return uc.UcError(uc.ERR_WRITE_UNMAPPED)
+	}
+	copy(c.Mem[addr:], data)
+	return nil
+}
+
+// MemMap does nothing, all the memory is there.
+func (c *CPU) MemMap(addr, size uint64) error {
+	return nil
+}
+
+func (c *CPU) HookAdd(htype int, cb interface{}, begin, end uint64, extra ...int) (uc.Hook, error) {
+	c.lastHook++
+	c.hooks[c.lastHook] = hook{htype, cb, begin, end}
+	return c.lastHook, nil
+}
+
+func (c *CPU) HookDel(h uc.Hook) error {
+	delete(c.hooks, h)
+	return nil
+}
+
+func (c *CPU) Stop() error {
+	c.stops.Add(1)
+	c.stopping.Store(true)
+	return nil
+}
+
+// Stops returns how many times Stop was called.
+func (c *CPU) Stops() int {
+	return int(c.stops.Load())
+}
+
+// Calls the hooks of htype whose range has addr, in the order they were
+// added.  Like Unicorn, only the address an access starts at is checked.
+func (c *CPU) callHooks(htype int, addr uint64, call func(cb interface{})) {
+	for h := uc.Hook(1); h <= c.lastHook; h++ {
+		k, ok := c.hooks[h]
+		if ok && k.htype&htype != 0 && (k.begin > k.end || k.begin <= addr && addr <= k.end) {
+			call(k.cb)
+		}
+	}
+}
+
+func (c *CPU) Start(begin, until uint64) error {
+	return c.StartWithOptions(begin, until, &uc.UcOptions{})
+}
+
+// StartWithOptions runs the script in Code from CS:IP, calling the code
+// hooks before each instruction, then the memory hooks for its accesses and
+// the interrupt hooks after an INT.
+func (c *CPU) StartWithOptions(begin, until uint64, options *uc.UcOptions) error {
+	c.stopping.Store(false)
+	c.Exited = false
+	for n := uint64(0); options.Count == 0 || n < options.Count; n++ {
+		ip := c.Reg(uc.X86_REG_IP)
+		pc := c.Reg(uc.X86_REG_CS)*0x10 + ip
+		if pc == until {
+			return nil
+		}
+		in, ok := c.Code[pc]
+		if !ok {
+			return uc.UcError(uc.ERR_INSN_INVALID)
+		}
+		c.callHooks(uc.HOOK_CODE, pc, func(cb interface{}) {
+			cb.(func(uc.Unicorn, uint64, uint32))(c, pc, in.Size)
+		})
+		if c.stopping.Load() {
+			return nil
+		}
+		for _, a := range in.Mem {
+			htype := uc.HOOK_MEM_READ
+			if a.Type == uc.MEM_WRITE {
+				htype = uc.HOOK_MEM_WRITE
+			}
+			c.callHooks(htype, a.Addr, func(cb interface{}) {
+				cb.(func(uc.Unicorn, int, uint64, int, int64))(c, a.Type, a.Addr, a.Size, a.Value)
+			})
+			if a.Type == uc.MEM_WRITE {
+				var b [8]byte
+				binary.LittleEndian.PutUint64(b[:], uint64(a.Value))
+				c.MemWrite(a.Addr, b[:a.Size])
+			}
+		}
+		next := uint64(uint16(ip + uint64(in.Size)))
+		if in.Jumps {
+			next = uint64(in.Jump)
+		}
+		c.RegWrite(uc.X86_REG_IP, next)
+		if in.Int != 0 {
+			c.callHooks(uc.HOOK_INTR, pc, func(cb interface{}) {
+				cb.(func(uc.Unicorn, uint32))(c, in.Int)
+			})
+		}
+		if in.Exit {
+			c.Exited = true
+			return nil
+		}
+		if c.stopping.Load() {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,814 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"door86.org/ivdoor/codepage"
+	"door86.org/ivdoor/core"
+	"door86.org/ivdoor/cpu"
+	"door86.org/ivdoor/dos"
+	"door86.org/ivdoor/video"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+var (
+	cmdDebug = flag.NewFlagSet("debug", flag.ExitOnError)
+
+	debugConfig  = cmdDebug.String("config", "", "config file describing the machine the door runs on")
+	debugProfile = cmdDebug.String("profile", "", "profile in the config file (default the program's name)")
+	debugGDB     = cmdDebug.String("gdb", "", "serve gdb's remote protocol on this address, like :1234, instead of reading commands")
+)
+
+const debugHelp = `Commands, with numbers and addresses in hex:
+  g, continue             run until a breakpoint, ^C pauses
+  t, step [n]             run n instructions, into calls and interrupts
+  p, next [n]             run n instructions, over calls, interrupts,
+                          loops and repeated string instructions
+  b, break addr           stop before the instruction at addr
+  b, break int 21 [ah=3d] [al=00]
+                          stop at INT 21h with those functions
+  bc, clear addr|int ..|* remove breakpoints
+  bl, breaks              list breakpoints
+  w, watch [r|w|rw|x] addr [len] [=value] [cs=seg[-seg]] [log|count]
+                          stop after an instruction reads, writes or
+                          runs at addr, when it has that value or CS,
+                          or just log or count those accesses
+  wc, unwatch n|*         remove watchpoints
+  wl, watches             list watchpoints and their hits
+  r, regs [reg=value ..]  show or change registers
+  d, dump [addr] [len]    show memory
+  e, enter addr bytes..   change memory, bytes or "text"
+  u, unassemble [addr] [n]
+                          disassemble, around CS:IP without addr
+  map                     show the DOS memory blocks
+  handles                 show the open files
+  q, quit                 end the program
+Addresses are seg:off, either of which may be a register, an offset in
+the default segment, or a linear address with an L, like L12340.  An
+empty line repeats t or p.  Lines typed while the program runs are its
+input; a door waiting for a key only pauses once it has one.
+`
+
+// An interactive debugger, which the program runs under instead of
+// running freely.
+type debugger struct {
+	mu  uc.Unicorn
+	emu *core.Emulator
+	d   *dos.Dos
+	out io.Writer
+	// Lines typed while the program is stopped
+	lines chan string
+	// Lines typed while it runs go to the program
+	door    *io.PipeWriter
+	running atomic.Bool
+	exited  bool
+	// Where d and u carry on from
+	nextDump, nextCode cpu.SegOffset
+	// The command an empty line repeats
+	repeat string
+	// Where gdb connects to, instead of the debugger reading commands
+	gdb string
+}
+
+// Creates a debugger reading commands from in, returning it and what the
+// program reads.
+func newDebugger(in io.Reader, out io.Writer) (*debugger, io.Reader) {
+	r, w := io.Pipe()
+	g := &debugger{out: out, lines: make(chan string, 16), door: w}
+	go g.readInput(in)
+	return g, r
+}
+
+// Hands each line typed to the program while it runs, and to the debugger
+// while it's stopped.
+func (g *debugger) readInput(in io.Reader) {
+	r := bufio.NewReader(in)
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if g.running.Load() {
+			// Doors expect Enter to be a CR
+			g.door.Write([]byte(line + "\r"))
+		} else if err == nil || line != "" {
+			g.lines <- line
+		}
+		if err != nil {
+			close(g.lines)
+			g.door.Close()
+			return
+		}
+	}
+}
+
+// Debugs the program in file, which run calls back once it is loaded.
+func debugProgram(file string, args []string) error {
+	exe, err := dos.ReadExeFromFile(file)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(*debugConfig, *debugProfile, file)
+	if err != nil {
+		return err
+	}
+	encoding, err := codepage.ParseEncoding(cfg.Encoding)
+	if err != nil {
+		return err
+	}
+	g, input := newDebugger(os.Stdin, os.Stdout)
+	g.gdb = *debugGDB
+	opts := runOptions{
+		encoding:  encoding,
+		emulation: video.ANSI,
+		program:   file,
+		input:     input,
+		config:    cfg,
+		debug:     g,
+	}
+	_, err = run(exe, args, opts)
+	return err
+}
+
+// Runs the debugger on the loaded program, stopped at its entry point,
+// until it's told to quit.
+func (g *debugger) run(mu uc.Unicorn, emu *core.Emulator, d *dos.Dos) error {
+	g.mu, g.emu, g.d = mu, emu, d
+	if g.gdb != "" {
+		return g.serveGDB()
+	}
+	emu.WatchLog = g.out
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer func() {
+		signal.Stop(sig)
+		close(sig)
+	}()
+	go func() {
+		for range sig {
+			if g.running.Load() {
+				emu.Pause()
+			} else {
+				fmt.Fprintln(g.out, "^C (q quits)")
+			}
+		}
+	}()
+
+	g.where()
+	for {
+		fmt.Fprint(g.out, "-")
+		line, ok := <-g.lines
+		if !ok {
+			break
+		}
+		if strings.TrimSpace(line) == "" {
+			line = g.repeat
+		}
+		quit, err := g.command(line)
+		if err != nil {
+			fmt.Fprintln(g.out, err)
+		}
+		if quit {
+			break
+		}
+	}
+	if !g.exited {
+		d.Terminate(0)
+	}
+	return nil
+}
+
+// Lets gdb debug the program, which runs freely once it detaches.
+func (g *debugger) serveGDB() error {
+	s := core.NewGDBServer(g.emu)
+	s.Exited = g.d.ReturnCode
+	// Everything typed is the program's input
+	g.running.Store(true)
+	fmt.Fprintf(g.out, "Waiting for gdb on %s\n", g.gdb)
+	err := s.ListenAndServe(g.gdb)
+	if errors.Is(err, core.ErrGDBKilled) {
+		g.d.Terminate(0)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, exited := g.d.ReturnCode(); exited {
+		return nil
+	}
+	// gdb may have gone without removing them
+	for _, addr := range g.emu.Breakpoints() {
+		g.emu.ClearBreakpoint(addr)
+	}
+	return g.emu.Start()
+}
+
+var errExited = errors.New("the program has exited")
+
+// Runs a command, returning whether the debugger should quit.
+func (g *debugger) command(line string) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	cmd, args := strings.ToLower(fields[0]), fields[1:]
+	g.repeat = ""
+	switch cmd {
+	case "?", "h", "help":
+		fmt.Fprint(g.out, debugHelp)
+	case "q", "quit":
+		return true, nil
+	case "g", "c", "continue":
+		return false, g.resume(g.emu.Continue, 1)
+	case "t", "s", "step", "p", "n", "next":
+		n, err := count(args, 1)
+		if err != nil {
+			return false, err
+		}
+		run := g.emu.Step
+		if cmd == "p" || cmd == "n" || cmd == "next" {
+			run = g.emu.StepOver
+		}
+		g.repeat = cmd
+		return false, g.resume(run, n)
+	case "b", "break":
+		return false, g.setBreak(args)
+	case "bc", "clear":
+		return false, g.clearBreak(args)
+	case "bl", "breaks":
+		g.listBreaks()
+	case "w", "watch":
+		return false, g.watch(args)
+	case "wc", "unwatch":
+		return false, g.unwatch(args)
+	case "wl", "watches":
+		g.listWatches()
+	case "r", "regs":
+		return false, g.regs(args)
+	case "d", "dump":
+		return false, g.dump(args)
+	case "e", "enter":
+		return false, g.enter(args)
+	case "u", "unassemble":
+		return false, g.unassemble(args)
+	case "map":
+		g.memoryMap()
+	case "handles":
+		g.handles()
+	default:
+		return false, fmt.Errorf("unknown command '%s', ? lists them", fields[0])
+	}
+	return false, nil
+}
+
+// Parses an optional count of steps.
+func count(args []string, def int) (int, error) {
+	if len(args) == 0 {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimSuffix(strings.ToLower(args[0]), "h"), 16, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("bad count '%s'", args[0])
+	}
+	return int(n), nil
+}
+
+// Runs the program with run n times, stopping early for anything other
+// than finishing a step, then shows where it stopped.
+func (g *debugger) resume(run func() core.Stop, n int) error {
+	if g.exited {
+		return errExited
+	}
+	var stop core.Stop
+	for i := 0; i < n; i++ {
+		g.running.Store(true)
+		stop = run()
+		g.running.Store(false)
+		if code, done := g.d.ReturnCode(); done {
+			g.exited = true
+			fmt.Fprintf(g.out, "Program exited with code %d\n", code)
+			return nil
+		}
+		if stop.Reason != core.StopStep {
+			break
+		}
+	}
+	if stop.Reason != core.StopStep {
+		fmt.Fprintf(g.out, "Stopped: %s\n", stop)
+	}
+	g.where()
+	return nil
+}
+
+// Shows the registers and the next instruction, as DEBUG's r does.
+func (g *debugger) where() {
+	g.showRegs()
+	cs, ip := cpu.SReg16(g.mu, uc.X86_REG_CS), cpu.Reg16(g.mu, uc.X86_REG_IP)
+	g.disassemble(cpu.SegOffset{Seg: cs, Off: ip}, 1, ip)
+	// u shows the code around here next
+	g.nextCode = cpu.SegOffset{}
+}
+
+var debugRegs = []struct {
+	name string
+	reg  int
+}{
+	{"AX", uc.X86_REG_AX}, {"BX", uc.X86_REG_BX}, {"CX", uc.X86_REG_CX}, {"DX", uc.X86_REG_DX},
+	{"SP", uc.X86_REG_SP}, {"BP", uc.X86_REG_BP}, {"SI", uc.X86_REG_SI}, {"DI", uc.X86_REG_DI},
+	{"DS", uc.X86_REG_DS}, {"ES", uc.X86_REG_ES}, {"SS", uc.X86_REG_SS}, {"CS", uc.X86_REG_CS},
+	{"IP", uc.X86_REG_IP}, {"FLAGS", uc.X86_REG_FLAGS},
+	{"AL", uc.X86_REG_AL}, {"AH", uc.X86_REG_AH}, {"BL", uc.X86_REG_BL}, {"BH", uc.X86_REG_BH},
+	{"CL", uc.X86_REG_CL}, {"CH", uc.X86_REG_CH}, {"DL", uc.X86_REG_DL}, {"DH", uc.X86_REG_DH},
+}
+
+func registerNamed(name string) (int, bool) {
+	for _, r := range debugRegs {
+		if strings.EqualFold(r.name, name) {
+			return r.reg, true
+		}
+	}
+	return 0, false
+}
+
+// Flag bits with the names DEBUG shows when they are set and clear
+var debugFlags = []struct {
+	bit       uint16
+	set, zero string
+}{
+	{0x0800, "OV", "NV"}, {0x0400, "DN", "UP"}, {0x0200, "EI", "DI"}, {0x0080, "NG", "PL"},
+	{0x0040, "ZR", "NZ"}, {0x0010, "AC", "NA"}, {0x0004, "PE", "PO"}, {0x0001, "CY", "NC"},
+}
+
+func (g *debugger) showRegs() {
+	for i, r := range debugRegs[:13] {
+		fmt.Fprintf(g.out, "%s=%04X", r.name, cpu.Reg16(g.mu, r.reg))
+		if i == 7 || i == 12 {
+			fmt.Fprint(g.out, "\n")
+		} else {
+			fmt.Fprint(g.out, "  ")
+		}
+	}
+	flags := cpu.Reg16(g.mu, uc.X86_REG_FLAGS)
+	var names []string
+	for _, f := range debugFlags {
+		if flags&f.bit != 0 {
+			names = append(names, f.set)
+		} else {
+			names = append(names, f.zero)
+		}
+	}
+	fmt.Fprintln(g.out, strings.Join(names, " "))
+}
+
+// Shows the registers, or sets those given as reg=value.
+func (g *debugger) regs(args []string) error {
+	if len(args) == 0 {
+		g.where()
+		return nil
+	}
+	for _, a := range args {
+		name, value, ok := strings.Cut(a, "=")
+		reg, known := registerNamed(name)
+		if !ok || !known {
+			return fmt.Errorf("expected a register=value, not '%s'", a)
+		}
+		v, err := g.value(value)
+		if err != nil {
+			return err
+		}
+		if err := g.mu.RegWrite(reg, uint64(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses a register name or a hex number.
+func (g *debugger) value(s string) (uint16, error) {
+	if reg, ok := registerNamed(s); ok {
+		return cpu.Reg16(g.mu, reg), nil
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(s), "0x"), "h")
+	v, err := strconv.ParseUint(s, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad value '%s'", s)
+	}
+	return uint16(v), nil
+}
+
+// Parses an address, seg:off, an offset in the segment in the register
+// def or a linear address such as L12340.
+func (g *debugger) address(s string, def int) (cpu.SegOffset, error) {
+	if strings.HasPrefix(s, "L") || strings.HasPrefix(s, "l") {
+		linear, err := strconv.ParseUint(strings.TrimSuffix(strings.ToLower(s[1:]), "h"), 16, 20)
+		if err != nil {
+			return cpu.SegOffset{}, fmt.Errorf("bad linear address '%s'", s)
+		}
+		return cpu.SegOffset{Seg: cpu.Seg(linear >> 4), Off: uint16(linear & 0xF)}, nil
+	}
+	seg := cpu.Reg16(g.mu, def)
+	off := s
+	if before, after, ok := strings.Cut(s, ":"); ok {
+		v, err := g.value(before)
+		if err != nil {
+			return cpu.SegOffset{}, err
+		}
+		seg, off = v, after
+	}
+	o, err := g.value(off)
+	if err != nil {
+		return cpu.SegOffset{}, err
+	}
+	return cpu.SegOffset{Seg: cpu.Seg(seg), Off: o}, nil
+}
+
+// Parses the interrupt breakpoint in args, after "int".
+func intBreak(args []string) (core.IntBreak, error) {
+	b := core.IntBreak{AH: core.AnyFunction, AL: core.AnyFunction}
+	if len(args) == 0 {
+		return b, errors.New("expected an interrupt number")
+	}
+	num, err := strconv.ParseUint(strings.TrimSuffix(strings.ToLower(args[0]), "h"), 16, 8)
+	if err != nil {
+		return b, fmt.Errorf("bad interrupt '%s'", args[0])
+	}
+	b.Num = uint8(num)
+	for _, a := range args[1:] {
+		name, value, _ := strings.Cut(strings.ToLower(a), "=")
+		v, err := strconv.ParseUint(strings.TrimSuffix(value, "h"), 16, 8)
+		if err != nil {
+			return b, fmt.Errorf("bad function '%s'", a)
+		}
+		switch name {
+		case "ah":
+			b.AH = int(v)
+		case "al":
+			b.AL = int(v)
+		default:
+			return b, fmt.Errorf("expected ah= or al=, not '%s'", a)
+		}
+	}
+	return b, nil
+}
+
+func (g *debugger) setBreak(args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected an address, or int and its number")
+	}
+	if strings.EqualFold(args[0], "int") {
+		b, err := intBreak(args[1:])
+		if err != nil {
+			return err
+		}
+		g.emu.BreakOnInterrupt(b)
+		return nil
+	}
+	at, err := g.address(args[0], uc.X86_REG_CS)
+	if err != nil {
+		return err
+	}
+	g.emu.SetBreakpoint(cpu.Addr(at.Seg, at.Off))
+	return nil
+}
+
+func (g *debugger) clearBreak(args []string) error {
+	switch {
+	case len(args) == 0:
+		return errors.New("expected an address, int and its number, or *")
+	case args[0] == "*":
+		for _, a := range g.emu.Breakpoints() {
+			g.emu.ClearBreakpoint(a)
+		}
+		for _, b := range g.emu.InterruptBreaks() {
+			g.emu.ClearInterruptBreak(b)
+		}
+		return nil
+	case strings.EqualFold(args[0], "int"):
+		b, err := intBreak(args[1:])
+		if err != nil {
+			return err
+		}
+		if !g.emu.ClearInterruptBreak(b) {
+			return fmt.Errorf("no breakpoint on %s", b)
+		}
+		return nil
+	}
+	at, err := g.address(args[0], uc.X86_REG_CS)
+	if err != nil {
+		return err
+	}
+	if !g.emu.ClearBreakpoint(cpu.Addr(at.Seg, at.Off)) {
+		return fmt.Errorf("no breakpoint at %04X:%04X", at.Seg, at.Off)
+	}
+	return nil
+}
+
+func (g *debugger) listBreaks() {
+	for _, a := range g.emu.Breakpoints() {
+		fmt.Fprintf(g.out, "L%05X\n", a)
+	}
+	for _, b := range g.emu.InterruptBreaks() {
+		fmt.Fprintln(g.out, b)
+	}
+}
+
+// Parses a watchpoint from args and adds it.
+func (g *debugger) watch(args []string) error {
+	w := core.Watchpoint{Access: core.AccessWrite, Size: 1, Value: core.AnyValue}
+	if len(args) > 0 {
+		kinds := map[string]core.Access{
+			"r": core.AccessRead, "w": core.AccessWrite, "x": core.AccessExec,
+			"rw": core.AccessRead | core.AccessWrite, "wr": core.AccessRead | core.AccessWrite,
+		}
+		if a, ok := kinds[strings.ToLower(args[0])]; ok {
+			w.Access, args = a, args[1:]
+		}
+	}
+	if len(args) == 0 {
+		return errors.New("expected an address")
+	}
+	def := uc.X86_REG_DS
+	if w.Access == core.AccessExec {
+		def = uc.X86_REG_CS
+	}
+	at, err := g.address(args[0], def)
+	if err != nil {
+		return err
+	}
+	w.Addr = cpu.Addr(at.Seg, at.Off)
+	args = args[1:]
+	if len(args) > 0 && !strings.Contains(args[0], "=") && !isWatchAction(args[0]) {
+		if w.Size, err = count(args[:1], 1); err != nil {
+			return err
+		}
+		args = args[1:]
+	}
+	for _, a := range args {
+		lower := strings.ToLower(a)
+		switch {
+		case strings.HasPrefix(a, "="):
+			v, err := g.value(a[1:])
+			if err != nil {
+				return err
+			}
+			w.Value = int64(v)
+		case strings.HasPrefix(lower, "cs="):
+			from, to, ranged := strings.Cut(a[3:], "-")
+			low, err := g.value(from)
+			if err != nil {
+				return err
+			}
+			high := low
+			if ranged {
+				if high, err = g.value(to); err != nil {
+					return err
+				}
+			}
+			w.CSLow, w.CSHigh = cpu.Seg(low), cpu.Seg(high)
+		case lower == "log":
+			w.Action = core.WatchLog
+		case lower == "count":
+			w.Action = core.WatchCount
+		case lower == "break":
+			w.Action = core.WatchBreak
+		default:
+			return fmt.Errorf("expected =value, cs=, log or count, not '%s'", a)
+		}
+	}
+	id, err := g.emu.AddWatch(w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(g.out, "Watch %d: %s\n", id, w)
+	return nil
+}
+
+func isWatchAction(s string) bool {
+	switch strings.ToLower(s) {
+	case "log", "count", "break":
+		return true
+	}
+	return false
+}
+
+func (g *debugger) unwatch(args []string) error {
+	switch {
+	case len(args) == 0:
+		return errors.New("expected a watchpoint number, or *")
+	case args[0] == "*":
+		for id := range g.emu.Watches() {
+			g.emu.Unwatch(id)
+		}
+		return nil
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("bad watchpoint number '%s'", args[0])
+	}
+	return g.emu.Unwatch(id)
+}
+
+func (g *debugger) listWatches() {
+	ws := g.emu.Watches()
+	ids := make([]int, 0, len(ws))
+	for id := range ws {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fmt.Fprintf(g.out, "%d: %s\n", id, ws[id])
+	}
+}
+
+// Shows memory as DEBUG's d does, 16 bytes to a line.
+func (g *debugger) dump(args []string) error {
+	at := g.nextDump
+	if at == (cpu.SegOffset{}) {
+		at.Seg = cpu.SReg16(g.mu, uc.X86_REG_DS)
+	}
+	var err error
+	if len(args) > 0 {
+		if at, err = g.address(args[0], uc.X86_REG_DS); err != nil {
+			return err
+		}
+	}
+	n := 0x80
+	if len(args) > 1 {
+		if n, err = count(args[1:], n); err != nil {
+			return err
+		}
+	}
+	for n > 0 {
+		line := 16 - int(at.Off&0xF)
+		if line > n {
+			line = n
+		}
+		b, err := cpu.Mem(g.mu, at.Seg, at.Off, uint64(line))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(g.out, "%04X:%04X  %*s", at.Seg, at.Off, int(at.Off&0xF)*3, "")
+		text := strings.Repeat(" ", int(at.Off&0xF))
+		for i, c := range b {
+			sep := " "
+			if (int(at.Off)+i)&0xF == 7 {
+				sep = "-"
+			}
+			fmt.Fprintf(g.out, "%02X%s", c, sep)
+			if c >= ' ' && c < 0x7F {
+				text += string(rune(c))
+			} else {
+				text += "."
+			}
+		}
+		fmt.Fprintf(g.out, "%*s %s\n", (16-line-int(at.Off&0xF))*3, "", text)
+		at.Off += uint16(line)
+		n -= line
+	}
+	g.nextDump = at
+	return nil
+}
+
+// Writes the bytes, in hex or quoted text, to memory.
+func (g *debugger) enter(args []string) error {
+	if len(args) < 2 {
+		return errors.New("expected an address and bytes")
+	}
+	at, err := g.address(args[0], uc.X86_REG_DS)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	rest := strings.TrimSpace(strings.SplitN(strings.Join(args, " "), " ", 2)[1])
+	for rest != "" {
+		if rest[0] == '"' || rest[0] == '\'' {
+			end := strings.IndexByte(rest[1:], rest[0])
+			if end < 0 {
+				return errors.New("text isn't closed")
+			}
+			b = append(b, rest[1:end+1]...)
+			rest = strings.TrimSpace(rest[end+2:])
+			continue
+		}
+		field, after, _ := strings.Cut(rest, " ")
+		v, err := hex.DecodeString(fmt.Sprintf("%02s", strings.TrimSuffix(strings.ToLower(field), "h")))
+		if err != nil || len(v) != 1 {
+			return fmt.Errorf("bad byte '%s'", field)
+		}
+		b = append(b, v...)
+		rest = strings.TrimSpace(after)
+	}
+	return g.mu.MemWrite(cpu.Addr(at.Seg, at.Off), b)
+}
+
+// Disassembles n instructions from at, marking the one at mark, and
+// returns where the next one is.
+func (g *debugger) disassemble(at cpu.SegOffset, n int, mark uint16) cpu.SegOffset {
+	for ; n > 0; n-- {
+		mem, err := cpu.Mem(g.mu, at.Seg, at.Off, 15)
+		if err != nil {
+			fmt.Fprintln(g.out, err)
+			return at
+		}
+		text := "???"
+		size := 1
+		if inst, err := x86asm.Decode(mem, 16); err == nil {
+			text = x86asm.IntelSyntax(inst, uint64(at.Off), nil)
+			size = inst.Len
+		}
+		cursor := " "
+		if at.Off == mark && at.Seg == cpu.SReg16(g.mu, uc.X86_REG_CS) {
+			cursor = ">"
+		}
+		fmt.Fprintf(g.out, "%s%04X:%04X %-14X %s\n", cursor, at.Seg, at.Off, mem[:size], text)
+		at.Off += uint16(size)
+	}
+	return at
+}
+
+// Finds where to start disassembling so a few instructions before ip are
+// shown.  x86 code can't be decoded backwards, so this takes the furthest
+// start whose instructions lead to ip, if any do.
+func (g *debugger) before(cs cpu.Seg, ip uint16, want int) (uint16, int) {
+	for back := uint16(16); back > 0; back-- {
+		if back > ip {
+			continue
+		}
+		mem, err := cpu.Mem(g.mu, cs, ip-back, uint64(back))
+		if err != nil {
+			return ip, 0
+		}
+		var starts []uint16
+		pos := 0
+		for pos < len(mem) {
+			inst, err := x86asm.Decode(mem[pos:], 16)
+			if err != nil {
+				break
+			}
+			starts = append(starts, ip-back+uint16(pos))
+			pos += inst.Len
+		}
+		if pos == len(mem) && len(starts) > 0 {
+			if len(starts) > want {
+				starts = starts[len(starts)-want:]
+			}
+			return starts[0], len(starts)
+		}
+	}
+	return ip, 0
+}
+
+func (g *debugger) unassemble(args []string) error {
+	cs, ip := cpu.SReg16(g.mu, uc.X86_REG_CS), cpu.Reg16(g.mu, uc.X86_REG_IP)
+	n := 10
+	var at cpu.SegOffset
+	var err error
+	switch {
+	case len(args) > 0:
+		if at, err = g.address(args[0], uc.X86_REG_CS); err != nil {
+			return err
+		}
+		if n, err = count(args[1:], n); err != nil {
+			return err
+		}
+	case g.nextCode != (cpu.SegOffset{}):
+		at = g.nextCode
+	default:
+		start, prior := g.before(cs, ip, 3)
+		at, n = cpu.SegOffset{Seg: cs, Off: start}, n+prior
+	}
+	g.nextCode = g.disassemble(at, n, ip)
+	return nil
+}
+
+// Shows the DOS memory blocks, as MEM /D might.
+func (g *debugger) memoryMap() {
+	fmt.Fprintln(g.out, "Segment  Size   Owner  Name")
+	for _, b := range g.d.Mem.Blocks {
+		name := b.ProgramName
+		switch {
+		case b.Avail:
+			name = "(free)"
+		case cpu.Seg(b.Start) == g.d.EnvSeg():
+			name = "(environment)"
+		}
+		fmt.Fprintf(g.out, "%04X     %05X  %04X   %s\n", b.Start, b.Size()*0x10, b.Owner, name)
+	}
+}
+
+func (g *debugger) handles() {
+	for _, h := range g.d.Handles() {
+		f, _ := g.d.File(h)
+		fmt.Fprintf(g.out, "%2d  %s\n", h, f)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/core"
+	"door86.org/ivdoor/cpu"
+	"door86.org/ivdoor/cpu/cputest"
+	"door86.org/ivdoor/dos"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// A debugger on the fake CPU, stopped at 0100:0000 with DS=0200 and
+// ES=0300, with code from there.
+func testDebugger(t *testing.T, code ...byte) (*debugger, *cputest.CPU, *strings.Builder) {
+	t.Helper()
+	mu := cputest.New()
+	emu, err := core.NewEmulator(mu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := dos.NewDos(mu, 0x400, 0x9F00, console.New(strings.NewReader(""), io.Discard))
+	emu.Register(0x21, d.Int21)
+	copy(mu.Mem[0x1000:], code)
+	mu.SetRegs(map[int]uint64{
+		uc.X86_REG_CS: 0x0100, uc.X86_REG_DS: 0x0200, uc.X86_REG_ES: 0x0300,
+		uc.X86_REG_AX: 0x0042, uc.X86_REG_BX: 0x0010,
+	})
+	out := &strings.Builder{}
+	return &debugger{mu: mu, emu: emu, d: d, out: out}, mu, out
+}
+
+func TestDebugAddress(t *testing.T) {
+	g, _, _ := testDebugger(t)
+	for _, tc := range []struct {
+		s    string
+		def  int
+		want cpu.SegOffset
+		err  string
+	}{
+		{"10", uc.X86_REG_DS, cpu.SegOffset{Seg: 0x0200, Off: 0x0010}, ""},
+		{"10h", uc.X86_REG_CS, cpu.SegOffset{Seg: 0x0100, Off: 0x0010}, ""},
+		{"0x1F", uc.X86_REG_DS, cpu.SegOffset{Seg: 0x0200, Off: 0x001F}, ""},
+		{"bx", uc.X86_REG_DS, cpu.SegOffset{Seg: 0x0200, Off: 0x0010}, ""},
+		{"es:bx", uc.X86_REG_DS, cpu.SegOffset{Seg: 0x0300, Off: 0x0010}, ""},
+		{"1234:5678", uc.X86_REG_DS, cpu.SegOffset{Seg: 0x1234, Off: 0x5678}, ""},
+		{"CS:FFFFh", uc.X86_REG_DS, cpu.SegOffset{Seg: 0x0100, Off: 0xFFFF}, ""},
+		{"L12345", uc.X86_REG_DS, cpu.SegOffset{Seg: 0x1234, Off: 0x0005}, ""},
+		{"l2010h", uc.X86_REG_CS, cpu.SegOffset{Seg: 0x0201, Off: 0x0000}, ""},
+		{"L", uc.X86_REG_DS, cpu.SegOffset{}, "bad linear address 'L'"},
+		{"L100000", uc.X86_REG_DS, cpu.SegOffset{}, "bad linear address 'L100000'"},
+		{"10000", uc.X86_REG_DS, cpu.SegOffset{}, "bad value '10000'"},
+		{"XY", uc.X86_REG_DS, cpu.SegOffset{}, "bad value 'xy'"},
+		{"fs:10", uc.X86_REG_DS, cpu.SegOffset{}, "bad value 'fs'"},
+		{"es:", uc.X86_REG_DS, cpu.SegOffset{}, "bad value ''"},
+	} {
+		got, err := g.address(tc.s, tc.def)
+		switch {
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("%s: got %v, want error %q", tc.s, err, tc.err)
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: %s", tc.s, err)
+		case tc.err == "" && got != tc.want:
+			t.Errorf("%s: got %04X:%04X, want %04X:%04X", tc.s, got.Seg, got.Off, tc.want.Seg, tc.want.Off)
+		}
+	}
+}
+
+func TestDebugIntBreak(t *testing.T) {
+	for _, tc := range []struct {
+		args string
+		want core.IntBreak
+		err  string
+	}{
+		{"21", core.IntBreak{Num: 0x21, AH: core.AnyFunction, AL: core.AnyFunction}, ""},
+		{"21h ah=3d", core.IntBreak{Num: 0x21, AH: 0x3D, AL: core.AnyFunction}, ""},
+		{"21 AH=44h AL=00", core.IntBreak{Num: 0x21, AH: 0x44, AL: 0x00}, ""},
+		{"10 al=3", core.IntBreak{Num: 0x10, AH: core.AnyFunction, AL: 0x03}, ""},
+		{"", core.IntBreak{}, "expected an interrupt number"},
+		{"zz", core.IntBreak{}, "bad interrupt 'zz'"},
+		{"100", core.IntBreak{}, "bad interrupt '100'"},
+		{"21 ah=3g", core.IntBreak{}, "bad function 'ah=3g'"},
+		{"21 ah", core.IntBreak{}, "bad function 'ah'"},
+		{"21 ah=100", core.IntBreak{}, "bad function 'ah=100'"},
+		{"21 bx=1", core.IntBreak{}, "expected ah= or al=, not 'bx=1'"},
+	} {
+		got, err := intBreak(strings.Fields(tc.args))
+		switch {
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("%q: got %v, want error %q", tc.args, err, tc.err)
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: %s", tc.args, err)
+		case tc.err == "" && got != tc.want:
+			t.Errorf("%q: got %s, want %s", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestDebugWatch(t *testing.T) {
+	all := core.AccessRead | core.AccessWrite
+	for _, tc := range []struct {
+		args string
+		want core.Watchpoint
+		err  string
+	}{
+		{"10", core.Watchpoint{Access: core.AccessWrite, Addr: 0x2010, Size: 1, Value: core.AnyValue}, ""},
+		{"r es:0 2", core.Watchpoint{Access: core.AccessRead, Addr: 0x3000, Size: 2, Value: core.AnyValue}, ""},
+		{"RW bx =41", core.Watchpoint{Access: all, Addr: 0x2010, Size: 1, Value: 0x41}, ""},
+		{"wr 10 =ax", core.Watchpoint{Access: all, Addr: 0x2010, Size: 1, Value: 0x42}, ""},
+		{"x 5", core.Watchpoint{Access: core.AccessExec, Addr: 0x1005, Size: 1, Value: core.AnyValue}, ""},
+		{"w L20010 10 cs=0100-0180 log", core.Watchpoint{Access: core.AccessWrite, Addr: 0x20010, Size: 0x10, Value: core.AnyValue, CSLow: 0x0100, CSHigh: 0x0180, Action: core.WatchLog}, ""},
+		{"10 cs=cs count", core.Watchpoint{Access: core.AccessWrite, Addr: 0x2010, Size: 1, Value: core.AnyValue, CSLow: 0x0100, CSHigh: 0x0100, Action: core.WatchCount}, ""},
+		{"10 LOG", core.Watchpoint{Access: core.AccessWrite, Addr: 0x2010, Size: 1, Value: core.AnyValue, Action: core.WatchLog}, ""},
+		{"10 2 break", core.Watchpoint{Access: core.AccessWrite, Addr: 0x2010, Size: 2, Value: core.AnyValue}, ""},
+		{"", core.Watchpoint{}, "expected an address"},
+		{"r", core.Watchpoint{}, "expected an address"},
+		{"q:10", core.Watchpoint{}, "bad value 'q'"},
+		{"10 0", core.Watchpoint{}, "bad count '0'"},
+		{"10 loud", core.Watchpoint{}, "bad count 'loud'"},
+		{"10 2 loud", core.Watchpoint{}, "expected =value, cs=, log or count, not 'loud'"},
+		{"10 =zz", core.Watchpoint{}, "bad value 'zz'"},
+		{"10 cs=100-zz", core.Watchpoint{}, "bad value 'zz'"},
+		{"10 cs=0200-0100", core.Watchpoint{}, "bad watchpoint CS range 0200-0100"},
+		{"x 5 =90", core.Watchpoint{}, "bad watchpoint value 144 for exec"},
+	} {
+		g, _, out := testDebugger(t)
+		err := g.watch(strings.Fields(tc.args))
+		switch {
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("%q: got %v, want error %q", tc.args, err, tc.err)
+		case tc.err == "" && err != nil:
+			t.Errorf("%q: %s", tc.args, err)
+		case tc.err == "":
+			if got := g.emu.Watches()[1]; got != tc.want {
+				t.Errorf("%q: got %s, want %s", tc.args, got, tc.want)
+			}
+			if want := "Watch 1: " + tc.want.String() + "\n"; out.String() != want {
+				t.Errorf("%q: printed %q, want %q", tc.args, out.String(), want)
+			}
+		}
+	}
+}
+
+func TestDebugCommandErrors(t *testing.T) {
+	g, _, _ := testDebugger(t)
+	for _, tc := range []struct{ line, err string }{
+		{"frob", "unknown command 'frob', ? lists them"},
+		{"t 0", "bad count '0'"},
+		{"p zz", "bad count 'zz'"},
+		{"b", "expected an address, or int and its number"},
+		{"b int", "expected an interrupt number"},
+		{"b 1:zz", "bad value 'zz'"},
+		{"bc", "expected an address, int and its number, or *"},
+		{"bc 10", "no breakpoint at 0100:0010"},
+		{"bc int 21", "no breakpoint on INT 21h"},
+		{"wc", "expected a watchpoint number, or *"},
+		{"wc one", "bad watchpoint number 'one'"},
+		{"wc 1", "no watchpoint 1"},
+		{"r ax", "expected a register=value, not 'ax'"},
+		{"r ip=zz", "bad value 'zz'"},
+		{"e 10", "expected an address and bytes"},
+		{"e 10 'abc", "text isn't closed"},
+		{"e 10 123", "bad byte '123'"},
+	} {
+		if _, err := g.command(tc.line); err == nil || err.Error() != tc.err {
+			t.Errorf("%s: got %v, want %q", tc.line, err, tc.err)
+		}
+	}
+}
+
+func TestDebugBreakAndStep(t *testing.T) {
+	// 0000 NOP
+	// 0001 NOP
+	// 0002 MOV [0010],AL
+	// 0005 CALL 000D
+	// 0008 NOP
+	// 0009 INT 21h
+	// 000B NOP
+	// 000C NOP
+	// 000D RET
+	g, mu, out := testDebugger(t, 0x90, 0x90, 0xA2, 0x10, 0x00, 0xE8, 0x05, 0x00, 0x90, 0xCD, 0x21, 0x90, 0x90, 0xC3)
+	mu.Code = map[uint64]cputest.Instr{
+		0x1000: {Size: 1},
+		0x1001: {Size: 1},
+		0x1002: {Size: 3, Mem: []cputest.Access{{Type: uc.MEM_WRITE, Addr: 0x2010, Size: 1, Value: 0x42}}},
+		0x1005: {Size: 3, Jumps: true, Jump: 0x000D},
+		0x1008: {Size: 1},
+		0x1009: {Size: 2, Int: 0x21},
+		0x100B: {Size: 1},
+		0x100D: {Size: 1, Jumps: true, Jump: 0x0008},
+	}
+
+	for _, tc := range []struct {
+		line string
+		// What it prints first, and where it leaves IP
+		out string
+		ip  uint16
+	}{
+		{"r ax=4c03", "", 0x0000},
+		{"b 1", "", 0x0000},
+		{"b int 21 ah=4c", "", 0x0000},
+		{"bl", "L01001\nINT 21h AH=4Ch\n", 0x0000},
+		{"g", "Stopped: breakpoint at 0100:0001\n", 0x0001},
+		// Not stopped again by the breakpoint it's at, and a step shows
+		// just the registers
+		{"t", "AX=4C03  BX=0010", 0x0002},
+		{"w 10", "Watch 1: write L02010 break, 0 hits\n", 0x0002},
+		{"g", "Stopped: watchpoint, write of L02010 by 0100:0002, at 0100:0005\n", 0x0005},
+		{"wl", "1: write L02010 break, 1 hits\n", 0x0005},
+		{"wc *", "", 0x0005},
+		// Over the call, stopping after it returns
+		{"p", "AX=4C03  BX=0010", 0x0008},
+		{"bc 1", "", 0x0008},
+		{"g", "Stopped: interrupt INT 21h AH=4Ch at 0100:0009\n", 0x0009},
+		{"p", "Program exited with code 3\n", 0x000B},
+	} {
+		out.Reset()
+		if _, err := g.command(tc.line); err != nil {
+			t.Fatalf("%s: %s", tc.line, err)
+		}
+		if !strings.HasPrefix(out.String(), tc.out) {
+			t.Errorf("%s: printed %q, want %q first", tc.line, out.String(), tc.out)
+		}
+		if ip := mu.Reg(uc.X86_REG_IP); ip != uint64(tc.ip) {
+			t.Errorf("%s: IP=%04X, want %04X", tc.line, ip, tc.ip)
+		}
+	}
+	if mu.Mem[0x2010] != 0x42 || len(g.emu.Breakpoints()) != 0 || len(g.emu.Watches()) != 0 {
+		t.Errorf("memory %02X, breakpoints %v, watches %v", mu.Mem[0x2010], g.emu.Breakpoints(), g.emu.Watches())
+	}
+	if _, err := g.command("g"); err != errExited {
+		t.Errorf("after exiting: %v", err)
+	}
+}
@@ -0,0 +1,405 @@
+package dos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"door86.org/ivdoor/console"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Device is what a DOS handle refers to, either a file on the host or one
+// of the character devices.
+type Device interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	// Info returns the IOCTL device information word (INT 21h 4400h)
+	Info() uint16
+	// SetInfo changes the device information word (INT 21h 4401h)
+	SetInfo(info uint16) error
+	// InputReady reports whether a read would return data without
+	// waiting (INT 21h 4406h)
+	InputReady() bool
+	// OutputReady reports whether the device can accept output (INT 21h
+	// 4407h)
+	OutputReady() bool
+}
+
+// Bits of the IOCTL device information word.
+const (
+	// Character devices
+	devConsoleIn  = 0x0001
+	devConsoleOut = 0x0002
+	devNul        = 0x0004
+	devClock      = 0x0008
+	devSpecial    = 0x0010 // supports INT 29h output
+	devRaw        = 0x0020 // binary mode, no ^C/^S/^P/^Z handling
+	devNotEOF     = 0x0040
+	devChar       = 0x0080
+	devUntilBusy  = 0x2000
+	// Files
+	fileDriveMask  = 0x003F
+	fileNotWritten = 0x0040
+	fileRemote     = 0x8000
+)
+
+var errNotSettable = &dosError{errInvalidFunction, errors.New("device information can't be set on files")}
+
+// Tap sees the calls programs make to host files: opening, reading and
+// writing them, asking about them, and loading overlays.  Recording a
+// session keeps what each call returned, and replaying one gives the
+// program the recorded results without touching the host.
+type Tap interface {
+	// HostCall is called with a call to the host, which changes the
+	// registers and memory through the Unicorn it is passed and returns
+	// the call's error.  HostCall may run it on mu, or change mu as it
+	// would have instead.
+	HostCall(mu uc.Unicorn, call func(mu uc.Unicorn) error) error
+}
+
+// The host file behind a handle opened in a replay.  Every call on it is
+// replayed too, so it is never read or written.
+type replayedFile struct {
+	NullFile
+}
+
+// HostFile is a DOS file backed by a file on the host.
+type HostFile struct {
+	*os.File
+	// DOS drive number the file was opened on, 0 == A:
+	drive int
+	// The drive is reported as a network drive
+	remote  bool
+	written bool
+}
+
+func NewHostFile(f *os.File, drive int, remote bool) *HostFile {
+	return &HostFile{File: f, drive: drive, remote: remote}
+}
+
+func (f *HostFile) Write(p []byte) (int, error) {
+	f.written = true
+	return f.File.Write(p)
+}
+
+func (f *HostFile) Info() uint16 {
+	info := uint16(f.drive) & fileDriveMask
+	if !f.written {
+		info |= fileNotWritten
+	}
+	if f.remote {
+		info |= fileRemote
+	}
+	return info
+}
+
+func (f *HostFile) SetInfo(info uint16) error {
+	return errNotSettable
+}
+
+// Files have input until the position reaches the end of the file.
+func (f *HostFile) InputReady() bool {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return pos < fi.Size()
+}
+
+func (f *HostFile) OutputReady() bool {
+	return true
+}
+
+// charDevice is the common part of the character devices: they are never
+// positioned and stay open for as long as DOS runs.
+type charDevice struct {
+	mu   sync.Mutex
+	info uint16
+}
+
+func (c *charDevice) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (c *charDevice) Close() error {
+	return nil
+}
+
+func (c *charDevice) Info() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// Only the raw bit can be changed, and DH must be zero.
+func (c *charDevice) SetInfo(info uint16) error {
+	if info&0xFF00 != 0 {
+		return &dosError{errInvalidParameter, fmt.Errorf("invalid device information: 0x%04X", info)}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info = c.info&^devRaw | info&devRaw
+	return nil
+}
+
+func (c *charDevice) InputReady() bool {
+	return false
+}
+
+func (c *charDevice) OutputReady() bool {
+	return true
+}
+
+func (c *charDevice) raw() bool {
+	return c.Info()&devRaw != 0
+}
+
+// conDevice is CON, the caller's terminal.  In cooked mode reads return a
+// whole line ending in CR LF, as DOS does.
+type conDevice struct {
+	charDevice
+	con *console.Console
+	// Rest of a cooked line that didn't fit in the last read
+	pending []byte
+	// The last line ended in CR, so drop an LF or NUL following it
+	skipLF bool
+}
+
+func newConDevice(con *console.Console) *conDevice {
+	return &conDevice{
+		charDevice: charDevice{info: devChar | devConsoleIn | devConsoleOut | devSpecial | devNotEOF},
+		con:        con,
+	}
+}
+
+// Once the caller has hung up reads return io.EOF, which handle reads
+// report as 0 bytes read, the same as the end of redirected input.
+func (c *conDevice) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c.raw() {
+		n, err := c.con.Read(p)
+		if err != nil {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if len(c.pending) == 0 {
+		line, err := c.readLine()
+		if err != nil && len(line) == 0 {
+			return 0, io.EOF
+		}
+		c.pending = line
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Reads up to CR or LF, swallowing the LF of a CR LF pair.
+func (c *conDevice) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		b, err := c.con.ReadByte()
+		if err != nil {
+			return line, err
+		}
+		skip := c.skipLF && len(line) == 0 && (b == '\n' || b == 0)
+		c.skipLF = false
+		if skip {
+			continue
+		}
+		switch b {
+		case '\n':
+			return append(line, '\r', '\n'), nil
+		case '\r':
+			c.skipLF = true
+			return append(line, '\r', '\n'), nil
+		case 0x1A: // ^Z is end of file in cooked mode
+			return line, io.EOF
+		}
+		line = append(line, b)
+	}
+}
+
+func (c *conDevice) InputReady() bool {
+	return len(c.pending) > 0 || c.con.Buffered() > 0
+}
+
+func (c *conDevice) Write(p []byte) (int, error) {
+	return c.con.Write(p)
+}
+
+// spoolDevice is a printer (PRN, LPT1-3).  Output is appended to a spool
+// file named after the port when a spool directory is set, and discarded
+// otherwise.
+type spoolDevice struct {
+	charDevice
+	name string
+	dir  string
+	f    *os.File
+}
+
+func newSpoolDevice(name string) *spoolDevice {
+	return &spoolDevice{
+		charDevice: charDevice{info: devChar | devNotEOF | devUntilBusy},
+		name:       name,
+	}
+}
+
+func (s *spoolDevice) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (s *spoolDevice) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir == "" {
+		return len(p), nil
+	}
+	if s.f == nil {
+		f, err := os.OpenFile(filepath.Join(s.dir, s.name+".PRN"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+	}
+	return s.f.Write(p)
+}
+
+// serialDevice is a serial port (AUX, COM1-4) attached to a host device or
+// file.  Without one there's nothing connected to the port.
+type serialDevice struct {
+	charDevice
+	name string
+	f    *os.File
+}
+
+func newSerialDevice(name string) *serialDevice {
+	return &serialDevice{
+		charDevice: charDevice{info: devChar | devNotEOF},
+		name:       name,
+	}
+}
+
+func (s *serialDevice) port() (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil, fmt.Errorf("nothing attached to %s", s.name)
+	}
+	return s.f, nil
+}
+
+// There's no portable way to poll a host port for input, so only output
+// status is reported: ready when something is attached.
+func (s *serialDevice) OutputReady() bool {
+	_, err := s.port()
+	return err == nil
+}
+
+func (s *serialDevice) Read(p []byte) (int, error) {
+	f, err := s.port()
+	if err != nil {
+		return 0, err
+	}
+	return f.Read(p)
+}
+
+func (s *serialDevice) Write(p []byte) (int, error) {
+	f, err := s.port()
+	if err != nil {
+		return 0, err
+	}
+	return f.Write(p)
+}
+
+// clockDevice is CLOCK$.  Reads return the 6 byte DOS clock record: days
+// since 1980-01-01, minutes, hours, hundredths and seconds.  Setting the
+// clock is ignored.
+type clockDevice struct {
+	charDevice
+	now func() time.Time
+}
+
+func newClockDevice(now func() time.Time) *clockDevice {
+	return &clockDevice{charDevice: charDevice{info: devChar | devClock | devNotEOF}, now: now}
+}
+
+func (c *clockDevice) Read(p []byte) (int, error) {
+	now := c.now()
+	epoch := time.Date(1980, time.January, 1, 0, 0, 0, 0, time.Local)
+	days := uint16(now.Sub(epoch).Hours() / 24)
+	rec := []byte{
+		byte(days), byte(days >> 8),
+		byte(now.Minute()), byte(now.Hour()),
+		byte(now.Nanosecond() / 10000000), byte(now.Second()),
+	}
+	return copy(p, rec), nil
+}
+
+func (c *clockDevice) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Creates the DOS character devices, AUX is another name for COM1 and PRN
+// for LPT1.  CLOCK$ reads the time from now.
+func newDevices(con *console.Console, now func() time.Time) map[string]Device {
+	devs := map[string]Device{
+		"CON":    newConDevice(con),
+		"NUL":    NewNullFile(),
+		"CLOCK$": newClockDevice(now),
+	}
+	for _, n := range []string{"COM1", "COM2", "COM3", "COM4"} {
+		devs[n] = newSerialDevice(n)
+	}
+	for _, n := range []string{"LPT1", "LPT2", "LPT3"} {
+		devs[n] = newSpoolDevice(n)
+	}
+	devs["AUX"] = devs["COM1"]
+	devs["PRN"] = devs["LPT1"]
+	return devs
+}
+
+// SpoolPrinters sends output for PRN and LPT1-3 to files in dir, which is
+// where a BBS expects to find printer output from doors.
+func (d *Dos) SpoolPrinters(dir string) {
+	for _, n := range []string{"LPT1", "LPT2", "LPT3"} {
+		s := d.devices[n].(*spoolDevice)
+		s.mu.Lock()
+		s.dir = dir
+		s.mu.Unlock()
+	}
+}
+
+// MapSerial attaches COMn (1-4) to a host serial device or file.
+func (d *Dos) MapSerial(port int, path string) error {
+	dev, ok := d.devices[fmt.Sprintf("COM%d", port)]
+	if !ok {
+		return fmt.Errorf("invalid serial port: %d", port)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	s := dev.(*serialDevice)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f = f
+	return nil
+}
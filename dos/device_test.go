@@ -0,0 +1,198 @@
+package dos
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/cpu/cputest"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+func TestConCookedRead(t *testing.T) {
+	con := newConDevice(console.New(strings.NewReader("one\r\ntwo\rthree\n"), io.Discard))
+	want := []string{"one\r\n", "two\r\n", "three\r\n"}
+	for _, w := range want {
+		b := make([]byte, 128)
+		n, err := con.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b[:n]); got != w {
+			t.Errorf("read %q, want %q", got, w)
+		}
+	}
+	if _, err := con.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestDeviceInfo(t *testing.T) {
+	devs := newDevices(console.New(strings.NewReader(""), io.Discard), time.Now)
+	tests := map[string]uint16{
+		"CON":    0x00D3,
+		"NUL":    0x0084,
+		"CLOCK$": 0x00C8,
+		"PRN":    0x20C0,
+		"AUX":    0x00C0,
+	}
+	for name, want := range tests {
+		if got := devs[name].Info(); got != want {
+			t.Errorf("%s info = 0x%04X, want 0x%04X", name, got, want)
+		}
+	}
+	if err := devs["CON"].SetInfo(0x00D3 | devRaw); err != nil {
+		t.Fatal(err)
+	}
+	if got := devs["CON"].Info(); got != 0x00F3 {
+		t.Errorf("CON raw info = 0x%04X", got)
+	}
+}
+
+func TestIoctl(t *testing.T) {
+	fs, root := newTestFileSystem(t)
+	net := t.TempDir()
+	if err := fs.Mount('D', net); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := fs.Drive(2)
+	c.Remote, c.Removable = false, false
+	dr, _ := fs.Drive(3)
+	dr.Remote, dr.Removable = true, true
+	for path, data := range map[string]string{
+		filepath.Join(root, "DATA.DAT"):  "x",
+		filepath.Join(root, "EMPTY.DAT"): "",
+		filepath.Join(net, "NODE.DAT"):   "",
+	} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu := cputest.New()
+	d := NewDos(mu, 0x100, 0x9F00, console.New(strings.NewReader(""), io.Discard))
+	d.FS = fs
+	open := func(name string) uint64 {
+		h, _, err := d.openFile(name, accessReadWrite|shareDenyNone, 0, ifExistsOpen, ifMissingFail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uint64(h)
+	}
+	data, empty, node := open(`C:\DATA.DAT`), open(`C:\EMPTY.DAT`), open(`D:\NODE.DAT`)
+
+	for _, tc := range []struct {
+		name   string
+		ax, bx uint64
+		carry  bool
+		// Results, unless negative
+		wantAX, wantDX int
+	}{
+		{"input ready", 0x4406, data, false, 0x44FF, -1},
+		{"input at end of file", 0x4406, empty, false, 0x4400, -1},
+		{"output ready", 0x4407, 1, false, 0x44FF, -1},
+		{"status of bad handle", 0x4406, 99, true, errInvalidHandle, -1},
+		{"fixed disk", 0x4408, 3, false, 1, -1},
+		{"removable disk", 0x4408, 4, false, 0, -1},
+		{"current drive fixed", 0x4408, 0, false, 1, -1},
+		{"removable of no drive", 0x4408, 10, true, errInvalidDrive, -1},
+		{"local drive", 0x4409, 3, false, -1, 0},
+		{"remote drive", 0x4409, 4, false, -1, 0x1000},
+		{"remote of no drive", 0x4409, 10, true, errInvalidDrive, -1},
+		{"local handle", 0x440A, data, false, -1, 0},
+		{"remote handle", 0x440A, node, false, -1, 0x8000},
+		{"remote of bad handle", 0x440A, 99, true, errInvalidHandle, -1},
+		{"drive map", 0x440E, 3, false, 0x4400, -1},
+		{"set drive map", 0x440F, 4, false, 0x4400, -1},
+		{"invalid function", 0x4420, 3, true, errInvalidFunction, -1},
+	} {
+		mu.RegWrite(uc.X86_REG_DX, 0xFFFF)
+		if carry := int21(t, d, mu, map[int]uint64{uc.X86_REG_AX: tc.ax, uc.X86_REG_BX: tc.bx}); carry != tc.carry {
+			t.Errorf("%s: carry %v", tc.name, carry)
+		}
+		if ax := mu.Reg(uc.X86_REG_AX); tc.wantAX >= 0 && ax != uint64(tc.wantAX) {
+			t.Errorf("%s: AX %04X, want %04X", tc.name, ax, tc.wantAX)
+		}
+		if dx := mu.Reg(uc.X86_REG_DX); tc.wantDX >= 0 && dx != uint64(tc.wantDX) {
+			t.Errorf("%s: DX %04X, want %04X", tc.name, dx, tc.wantDX)
+		}
+	}
+}
+
+// Keeps the host calls it sees, running them, or in a replay, answering
+// them with the registers in replay instead.
+type testTap struct {
+	calls  []uint64
+	replay []map[int]uint64
+}
+
+func (tt *testTap) HostCall(mu uc.Unicorn, call func(mu uc.Unicorn) error) error {
+	ax, _ := mu.RegRead(uc.X86_REG_AX)
+	tt.calls = append(tt.calls, ax)
+	if tt.replay == nil {
+		return call(mu)
+	}
+	for r, v := range tt.replay[0] {
+		mu.RegWrite(r, v)
+	}
+	tt.replay = tt.replay[1:]
+	return nil
+}
+
+func TestHostTap(t *testing.T) {
+	fs, root := newTestFileSystem(t)
+	if err := os.WriteFile(filepath.Join(root, "DATA.DAT"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mu := cputest.New()
+	call := func(d *Dos, ax, bx uint64, name string) bool {
+		copy(mu.Mem[0x20100:], name+"\x00")
+		return int21(t, d, mu, map[int]uint64{uc.X86_REG_AX: ax, uc.X86_REG_BX: bx, uc.X86_REG_CX: 4,
+			uc.X86_REG_DS: 0x2000, uc.X86_REG_DX: 0x100})
+	}
+
+	tap := &testTap{}
+	d := NewDos(mu, 0x100, 0x9F00, console.New(strings.NewReader(""), io.Discard))
+	d.FS, d.Tap = fs, tap
+	if call(d, 0x3D00, 0, `C:\DATA.DAT`) {
+		t.Fatal("open failed")
+	}
+	h := mu.Reg(uc.X86_REG_AX)
+	call(d, 0x3F00, h, "")
+	call(d, 0x4000, 1, "")
+	call(d, 0x3D00, 0, `C:\DOORS\NUL`)
+	call(d, 0x3E00, h, "")
+	if want := []uint64{0x3D00, 0x3F00, 0x3E00}; !reflect.DeepEqual(tap.calls, want) {
+		t.Errorf("host calls %04X, want %04X", tap.calls, want)
+	}
+
+	// A replay keeps track of the handles without the files being there
+	tap = &testTap{replay: []map[int]uint64{
+		{uc.X86_REG_AX: 7, uc.X86_REG_FLAGS: 0},
+		{uc.X86_REG_AX: 4, uc.X86_REG_FLAGS: 0},
+		{uc.X86_REG_AX: 0, uc.X86_REG_FLAGS: 0},
+	}}
+	d = NewDos(mu, 0x100, 0x9F00, console.New(strings.NewReader(""), io.Discard))
+	d.FS, d.Tap = fs, tap
+	if call(d, 0x3C00, 0, `C:\NEW.DAT`) || mu.Reg(uc.X86_REG_AX) != 7 {
+		t.Fatalf("replayed create: AX %04X", mu.Reg(uc.X86_REG_AX))
+	}
+	if f, ok := d.File(7); !ok || f.Name != `C:\NEW.DAT` {
+		t.Errorf("replayed handle: %v", f)
+	}
+	call(d, 0x4000, 7, "")
+	call(d, 0x3E00, 7, "")
+	if _, ok := d.File(7); ok {
+		t.Error("replayed handle still open after close")
+	}
+	if len(tap.replay) != 0 {
+		t.Errorf("%d replayed calls left", len(tap.replay))
+	}
+	if _, err := os.Stat(filepath.Join(root, "NEW.DAT")); !os.IsNotExist(err) {
+		t.Errorf("replay created the file: %v", err)
+	}
+}
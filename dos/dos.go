@@ -1,14 +1,17 @@
 package dos
 
 import (
-	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
+	"door86.org/ivdoor/console"
 	"door86.org/ivdoor/cpu"
 	"github.com/golang/glog"
 	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
@@ -17,71 +20,134 @@ import (
 type DosFile struct {
 	Name string
 	Dir  string
-	File *os.File
+	// Host path of the file, empty for devices
+	Path string
+	Dev  Device
+	// Date and time set with INT 21h 5701h, applied again on close since
+	// host writes after the call would otherwise update it.
+	modTime *time.Time
+	// Byte ranges locked with INT 21h 5C00h
+	locks []lockRange
+	// DOS access mode the handle was opened with
+	access uint8
+	// Handle isn't passed on to child processes
+	noInherit bool
+}
+
+// Reports whether the handle is a host file, or stands in for one in a
+// replay.
+func (f *DosFile) onHost() bool {
+	_, replayed := f.Dev.(*replayedFile)
+	return replayed || f.hostFile() != nil
+}
+
+// Returns the host file behind the handle, or nil for devices.
+func (f *DosFile) hostFile() *os.File {
+	if hf, ok := f.Dev.(*HostFile); ok {
+		return hf.File
+	}
+	return nil
+}
+
+func (f *DosFile) String() string {
+	s := f.Name
+	if f.Path != "" {
+		s += " (" + f.Path + ")"
+	}
+	switch f.access {
+	case accessRead:
+		s += ", read"
+	case accessWrite:
+		s += ", write"
+	case accessReadWrite:
+		s += ", read/write"
+	}
+	if hf := f.hostFile(); hf != nil {
+		if pos, err := hf.Seek(0, io.SeekCurrent); err == nil {
+			s += fmt.Sprintf(", at %d", pos)
+		}
+	}
+	return s
+}
+
+// Closes the handle, reapplying any DOS timestamp set on it.  Character
+// devices stay open for the other handles using them.
+func (f *DosFile) Close() error {
+	err := f.Dev.Close()
+	if f.modTime != nil && f.Path != "" {
+		if err := os.Chtimes(f.Path, time.Now(), *f.modTime); err != nil {
+			glog.Warningf("Error setting time on '%s': '%s'", f.Path, err)
+		}
+	}
+	return err
 }
 
 type Dos struct {
 	mu  uc.Unicorn
-	in  *bufio.Reader
-	out *bufio.Writer
+	con *console.Console
 
 	// DOS file handles
-	files   map[int]*DosFile
+	files map[int]*DosFile
+	// Character devices by name
+	devices map[string]Device
 	intrvec map[int]cpu.SegOffset
 	Mem     *DosMem
+	FS      *FileSystem
+	// The clock the program sees
+	Now func() time.Time
+	// Sees the calls to host files, may be nil
+	Tap Tap
+	// DOS version reported to the program, major version in the high byte
+	Version uint16
+	// Environment variables, NAME=value
+	Env []string
+	// Environment block of the running program
+	envSeg cpu.Seg
+
+	// Set once the program has terminated
+	terminated bool
+	returnCode uint8
 }
 
-func NewDos(mu uc.Unicorn, start, end cpu.Seg) *Dos {
+func NewDos(mu uc.Unicorn, start, end cpu.Seg, con *console.Console) *Dos {
 	d := &Dos{
 		mu:      mu,
-		in:      bufio.NewReader(os.Stdin),
-		out:     bufio.NewWriter(os.Stdout),
+		con:     con,
 		files:   make(map[int]*DosFile),
 		intrvec: make(map[int]cpu.SegOffset),
 		Mem:     NewDosMem(int(start), int(end)),
+		FS:      NewFileSystem(),
+		Now:     time.Now,
+		Version: 0x0500,
+	}
+	d.devices = newDevices(con, func() time.Time { return d.Now() })
+	// stdin, stdout and stderr are all CON, followed by stdaux and stdprn
+	for h, name := range []string{"CON", "CON", "CON", "AUX", "PRN"} {
+		d.files[h] = &DosFile{Name: name, Dir: "", Dev: d.devices[name], access: accessReadWrite}
 	}
-	d.files[0] = &DosFile{Name: "", Dir: "", File: os.Stdin}
-	d.files[1] = &DosFile{Name: "", Dir: "", File: os.Stdout}
-	d.files[2] = &DosFile{Name: "", Dir: "", File: os.Stderr}
 
 	return d
 }
 
-func CreatePsp(start_seg, end_seg, env_seg cpu.Seg, args []string) []byte {
-	psp := make([]byte, 0x100)
-	psp[0] = 0xcd
-	psp[1] = 0x20
-	// First paragraph following this segment.
-	binary.LittleEndian.PutUint16(psp[2:], uint16(end_seg+1))
-
-	psp[10] = 0x22 // int22 handler
-	psp[14] = 0x23 // int23 handler
-	psp[18] = 0x24 // int24 handler
-
-	// FFFE means no parent DOS process
-	binary.LittleEndian.PutUint16(psp[22:], 0xFFFE)
-	binary.LittleEndian.PutUint16(psp[44:], uint16(env_seg))
-	// TODO: Create rest
-
-	// Fill in command line
-	c := 0
-	for _, arg := range args {
-		psp[0x81+c] = ' '
-		c++
-		bs := []byte(string(arg))
-		for _, ch := range bs {
-			if c >= 0x7D {
-				break
-			}
-			psp[0x81+c] = ch
-			c++
-		}
+// Handles returns the open file handles in order.
+func (d *Dos) Handles() []int {
+	handles := make([]int, 0, len(d.files))
+	for h := range d.files {
+		handles = append(handles, h)
 	}
-	// Add trailing 0Dh
-	psp[c] = 0x0d
-	psp[0x80] = uint8(c & 0xff)
+	sort.Ints(handles)
+	return handles
+}
+
+// File returns the file open on handle h.
+func (d *Dos) File(h int) (*DosFile, bool) {
+	f, ok := d.files[h]
+	return f, ok
+}
 
-	return psp
+// EnvSeg returns the segment of the running program's environment.
+func (d *Dos) EnvSeg() cpu.Seg {
+	return d.envSeg
 }
 
 func ToSegOff(laddr uint32) (seg cpu.Seg, off uint16) {
@@ -126,9 +192,13 @@ func (dos *Dos) LoadImage(exe *Executable, seg_base *DosMemBlock) (seg uint16, e
 }
 
 func (dos *Dos) LoadExe(exe *Executable, seg_base *DosMemBlock, psp []byte) (seg uint16, err error) {
-	// DS is what we allocated, for EXE, CS is 0x100 past it since the PSP goes first
+	// DS is what we allocated, for EXE, CS is 0x100 past it since the PSP
+	// goes first, unless the program is loaded at the top of its memory
 	seg_start := uint16(seg_base.Start)
-	img_start := seg_start + 0x0010
+	img_start := seg_start + pspParagraphs
+	if exe.LoadsHigh() {
+		img_start = uint16(seg_base.End - exe.Hdr.loadParagraphs())
+	}
 	ds := seg_start
 	es := seg_start
 	cs := (img_start + exe.Hdr.CS) & 0xFFFF
@@ -142,49 +212,93 @@ func (dos *Dos) LoadExe(exe *Executable, seg_base *DosMemBlock, psp []byte) (seg
 	dos.mu.RegWrite(uc.X86_REG_BP, 0)
 	dos.mu.RegWrite(uc.X86_REG_IP, uint64(exe.Hdr.IP))
 
-	// Copy data into memory at CS from the binary read from disk.
-	// TODO - need to copy PSP?
+	// The PSP, then the load module, which CS:IP points into
 	dos.mu.MemWrite(cpu.Addr(cpu.Seg(ds), 0), psp)
-	dos.mu.MemWrite(cpu.Addr(cpu.Seg(cs), 0), exe.Data)
+	dos.mu.MemWrite(cpu.Addr(cpu.Seg(img_start), 0), exe.Data)
 
 	glog.V(1).Infof("EXE Values: CS: 0x%04X DS: 0x%04X ES: 0x%04X SS: 0x%04X IP: 0x%04X\n",
 		cs, ds, es, ss, exe.Hdr.IP)
 	glog.V(1).Infof("SP: 0x%04X BP: 0x%04X Paragraphs: %d\n", exe.Hdr.SP, 0, exe.Hdr.HeaderParagraphs)
 
-	// Fixup relos
+	dos.relocate(exe, img_start, img_start)
+
+	return seg_start, nil
+}
+
+// Applies the EXE's relocations to its load module at seg, adding factor
+// to each segment they point at.
+func (dos *Dos) relocate(exe *Executable, seg, factor uint16) {
 	for _, r := range exe.Hdr.Relos {
-		laddr := cpu.Addr(cpu.Seg(img_start+r.Segment), r.Offset)
+		laddr := cpu.Addr(cpu.Seg(seg+r.Segment), r.Offset)
 		m, err := cpu.Mem16(dos.mu, laddr)
 		if err != nil {
 			glog.Warningf("error reading memory: '%s'\n", err)
 			continue
 		}
-		if err := cpu.PutMem16(dos.mu, laddr, m+img_start); err != nil {
-			glog.Warningf("Error writing Relo: [0x%04X:0x%04X] += 0x%04X", r.Segment, r.Offset, img_start)
+		if err := cpu.PutMem16(dos.mu, laddr, m+factor); err != nil {
+			glog.Warningf("Error writing Relo: [0x%04X:0x%04X] += 0x%04X", r.Segment, r.Offset, factor)
 			continue
 		}
-		glog.Infof("Relo: [0x%04X:0x%04X] += 0x%04X", r.Segment, r.Offset, img_start)
+		glog.V(2).Infof("Relo: [0x%04X:0x%04X] += 0x%04X", r.Segment, r.Offset, factor)
 	}
+}
 
-	return seg_start, nil
+// Loads the program file dospath as an overlay for INT 21h 4B03h: the load
+// module of an EXE, relocated by factor, or the whole of any other file,
+// goes at seg.  No memory is allocated and no PSP made.
+func (d *Dos) loadOverlay(dospath string, seg, factor uint16) error {
+	path, err := d.FS.Resolve(dospath)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(b) < 2 {
+		return &dosError{errInvalidFormat, fmt.Errorf("'%s' is too short for a program", dospath)}
+	}
+	exe, err := ReadExe(b)
+	if err != nil {
+		return &dosError{errInvalidFormat, err}
+	}
+	if err := d.mu.MemWrite(cpu.Addr(cpu.Seg(seg), 0), exe.Data); err != nil {
+		return err
+	}
+	if exe.Etype == EXE {
+		d.relocate(exe, seg, factor)
+	}
+	glog.V(1).Infof("Overlay '%s' loaded at 0x%04X, relocated by 0x%04X", dospath, seg, factor)
+	return nil
 }
 
-func (dos *Dos) Load(exe *Executable, args []string) (seg uint16, err error) {
+// Load loads exe as the program at path, its fully qualified DOS path,
+// with an environment holding Env.  path may be empty when the program
+// isn't on a drive.
+func (dos *Dos) Load(exe *Executable, path string, args []string) (seg uint16, err error) {
 	if !exe.Exists || len(exe.Data) == 0 {
 		return 0, errors.New("executable not read")
 	}
-	// hack really look up environment
-	env_seg, err := dos.Mem.Allocate(10)
+	env, err := dos.writeEnv(dos.Env, path)
 	if err != nil {
 		return 0, err
 	}
-	env_laddr := cpu.Addr(cpu.Seg(env_seg.Start), 0)
-	env := []byte("PATH=Z:\\\n")
-	if err := dos.mu.MemWrite(env_laddr, env); err != nil {
-		return 0, err
-	}
+	// Allocating again may move the block
+	env_start := env.Start
+	dos.envSeg = cpu.Seg(env_start)
 
-	sn := exe.SegmentsNeeded()
+	// The program gets as much as it wants when there is that much, and
+	// won't run without what it needs
+	sn, largest := exe.SegmentsNeeded(), dos.Mem.Largest()
+	if largest < sn {
+		return 0, &dosError{errInsufficientMemory,
+			fmt.Errorf("%w: program needs %d paragraphs, %d are free", ErrInsufficientMemory, sn, largest)}
+	}
+	if want := exe.SegmentsWanted(); want < largest {
+		sn = want
+	} else {
+		sn = largest
+	}
 	seg_base, err := dos.Mem.Allocate(sn)
 	glog.V(2).Infof("DOS Allocated [%d segments %d bytes]", sn, sn*0x10)
 	if err != nil {
@@ -193,28 +307,142 @@ func (dos *Dos) Load(exe *Executable, args []string) (seg uint16, err error) {
 	// We own our own memory block.
 
 	seg_base.Owner = seg_base.Start
-	// TODO: Create PSP
+	seg_base.ProgramName = programName(path)
+	// So is the environment
+	if i, ok := dos.Mem.FindBlock(env_start); ok {
+		dos.Mem.Blocks[i].Owner = seg_base.Start
+	}
 
-	psp := CreatePsp(cpu.Seg(seg_base.Start), cpu.Seg(seg_base.End+1), cpu.Seg(env_seg.Start), args)
+	if exe.Etype == IMAGE {
+		return dos.LoadImage(exe, seg_base)
+	}
+	if err := installCall5(dos.mu); err != nil {
+		return 0, err
+	}
+	psp := &Psp{
+		Seg: cpu.Seg(seg_base.Start),
+		End: cpu.Seg(seg_base.End),
+		// Like COMMAND.COM, a program nothing started is its own parent,
+		// which ends walks up the chain
+		Parent:  cpu.Seg(seg_base.Start),
+		Env:     cpu.Seg(env_start),
+		Handles: dos.jft(),
+		Version: dos.Version,
+		Args:    args,
+	}
+	for _, v := range []struct {
+		intr int
+		p    *cpu.SegOffset
+	}{{0x22, &psp.Terminate}, {0x23, &psp.CtrlBreak}, {0x24, &psp.CritErr}} {
+		if *v.p, err = cpu.MemSegOff(dos.mu, 0, uint16(v.intr*4)); err != nil {
+			return 0, err
+		}
+	}
 	switch exe.Etype {
 	case EXE:
-		return dos.LoadExe(exe, seg_base, psp)
+		seg, err = dos.LoadExe(exe, seg_base, CreatePsp(psp))
 	case COM:
-		return dos.LoadCom(exe, seg_base, psp)
-	case IMAGE:
-		return dos.LoadImage(exe, seg_base)
+		seg, err = dos.LoadCom(exe, seg_base, CreatePsp(psp))
 	default:
 		panic("Unhandled Etype")
 	}
+	if err != nil {
+		return 0, err
+	}
+	// AL and AH say whether the drives in the FCBs are valid
+	var ax uint64
+	for i := 0; i < 2 && i < len(args); i++ {
+		if _, letter := parseFCB(args[i]); letter != 0 {
+			if _, ok := dos.FS.Drive(int(letter - 'A')); !ok {
+				ax |= 0xFF << (8 * i)
+			}
+		}
+	}
+	dos.mu.RegWrite(uc.X86_REG_AX, ax)
+	return seg, nil
+}
+
+// Returns the job file table for a new PSP from the open handles.  The
+// standard handles get the system file table entries DOS gives them, AUX
+// then CON then PRN; other handles aren't backed by a real table and get
+// their own number.
+func (d *Dos) jft() [jftSize]byte {
+	var jft [jftSize]byte
+	for h := range jft {
+		f, ok := d.files[h]
+		switch {
+		case !ok:
+			jft[h] = 0xFF
+		case f.Name == "AUX":
+			jft[h] = 0
+		case f.Name == "CON":
+			jft[h] = 1
+		case f.Name == "PRN":
+			jft[h] = 2
+		default:
+			jft[h] = byte(h)
+		}
+	}
+	return jft
 }
 
-func (dos Dos) Int20(mu uc.Unicorn, intrNum uint32) error {
+// The name DOS gives a program's memory block: its filename without the
+// extension, up to 8 characters.
+func programName(dospath string) string {
+	name := path.Base(strings.ReplaceAll(dospath, `\`, "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	name, _, _ = strings.Cut(name, ".")
+	if len(name) > 8 {
+		name = name[:8]
+	}
+	return strings.ToUpper(name)
+}
+
+func (d *Dos) Int20(mu uc.Unicorn, intrNum uint32) error {
 	glog.V(1).Infoln("Int20: Stop")
-	mu.Stop()
+	d.Terminate(0)
 	return nil
 }
 
-func getStringDollarSign(mu uc.Unicorn, seg cpu.Seg, offset uint16) (string, error) {
+// Terminate ends the program as INT 21h 4Ch does: every handle is closed,
+// the return code is kept and the emulator is stopped.  It is also how the
+// host ends a door that won't exit by itself, and may be called after the
+// emulator has stopped.  Only the first call has any effect.
+func (d *Dos) Terminate(code uint8) {
+	if d.terminated {
+		return
+	}
+	d.terminated = true
+	d.returnCode = code
+	for h, f := range d.files {
+		if err := f.Close(); err != nil {
+			glog.Warningf("Error closing handle %d on exit: '%s'", h, err)
+		}
+		delete(d.files, h)
+	}
+	d.mu.Stop()
+}
+
+// ReturnCode returns the code the program exited with, and whether it has
+// exited at all.
+func (d *Dos) ReturnCode() (uint8, bool) {
+	return d.returnCode, d.terminated
+}
+
+// Reads a keystroke for the character input functions.  Once the caller
+// has hung up there are no more, and ^Z is returned as DOS does at the end
+// of redirected input.
+func (d *Dos) readKey() byte {
+	c, err := d.con.ReadByte()
+	if err != nil {
+		return 0x1A
+	}
+	return c
+}
+
+func GetStringDollarSign(mu uc.Unicorn, seg cpu.Seg, offset uint16) (string, error) {
 	var count uint16 = 0
 	var buff strings.Builder
 	for {
@@ -287,7 +515,7 @@ func (d Dos) SuccessDX(dx uint64) error {
 }
 
 func (d Dos) GetNextFreeHandle() (int, error) {
-	for handle := 3; handle < 200; handle++ {
+	for handle := 5; handle < 200; handle++ {
 		if _, ok := d.files[handle]; !ok {
 			return handle, nil
 		}
@@ -295,75 +523,191 @@ func (d Dos) GetNextFreeHandle() (int, error) {
 	return 0, errors.New("no file handles available")
 }
 
-func dosFileModeToGo(ah uint8) (int, os.FileMode) {
-	mode := 0
-	switch mode & 0x3 {
-	case 0:
-		mode = os.O_RDONLY
-	case 1:
-		mode = os.O_WRONLY
-	case 2:
-		mode = os.O_RDWR
+// Renames oldname to newname, which may be in another directory on the
+// same drive.
+func (d *Dos) rename(oldname, newname string) error {
+	odrive, _, err := d.FS.FullPath(oldname)
+	if err != nil {
+		return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("rename failed: '%s'", oldname))
+	}
+	ndrive, _, err := d.FS.FullPath(newname)
+	if err != nil {
+		return d.SetDosError(dosErrno(err, errPathNotFound), fmt.Sprintf("rename failed: '%s'", newname))
+	}
+	if odrive != ndrive {
+		return d.SetDosError(errNotSameDevice, fmt.Sprintf("rename across drives: '%s' -> '%s'", oldname, newname))
+	}
+	opath, err := d.FS.Resolve(oldname)
+	if err != nil {
+		return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("rename failed: '%s'", oldname))
 	}
-	// mode = mode >> 4
-	// var perm os.FileMode = 0
-	// switch mode & 0x07 {}
-	// TODO - Implement sharing
-	return mode, 755
+	if _, err := os.Stat(opath); err != nil {
+		return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("rename failed: '%s'", oldname))
+	}
+	npath, err := d.FS.Resolve(newname)
+	if err != nil {
+		return d.SetDosError(dosErrno(err, errPathNotFound), fmt.Sprintf("rename failed: '%s'", newname))
+	}
+	// DOS never replaces an existing file, the caller has to delete it.
+	if _, err := os.Stat(npath); err == nil {
+		return d.SetDosError(errAccessDenied, fmt.Sprintf("rename target exists: '%s'", newname))
+	}
+	if err := os.Rename(opath, npath); err != nil {
+		return d.SetDosError(dosErrno(err, errFileNotFound), err.Error())
+	}
+	return d.ClearDosError(0)
 }
 
 // https://stanislavs.org/helppc/int_21.html
 func (d *Dos) Int21(mu uc.Unicorn, intrNum uint32) error {
+	if d.Tap != nil && d.hostCall(mu) {
+		return d.tapHost(mu, intrNum)
+	}
+	return d.int21(mu, intrNum)
+}
+
+// Reports whether the INT 21h call in mu's registers goes to the host's
+// files, so what it returns can't be known from the program's input.
+func (d *Dos) hostCall(mu uc.Unicorn) bool {
+	ah := cpu.Reg8(mu, uc.X86_REG_AH)
+	al := cpu.Reg8(mu, uc.X86_REG_AL)
+	bx := cpu.Reg16(mu, uc.X86_REG_BX)
+	onHost := func() bool {
+		file, ok := d.files[int(bx)]
+		return ok && file.onHost()
+	}
+	// Devices are found before the host is asked
+	named := func(reg int) bool {
+		filename, err := GetString(mu, cpu.SReg16(mu, uc.X86_REG_DS), cpu.Reg16(mu, reg))
+		if err != nil {
+			return false
+		}
+		_, dev := deviceName(filename)
+		return !dev
+	}
+	switch ah {
+	case 0x3c, 0x3d:
+		return named(uc.X86_REG_DX)
+	case 0x6c:
+		return named(uc.X86_REG_SI)
+	case 0x41, 0x43, 0x56:
+		return true
+	case 0x3E, 0x3F, 0x40, 0x42, 0x57, 0x5c:
+		return onHost()
+	case 0x44:
+		switch al {
+		case 0x00, 0x01, 0x06, 0x07, 0x0a:
+			return onHost()
+		case 0x08, 0x09:
+			// Drives are asked about on the host
+			return true
+		}
+	case 0x4b:
+		return al == 0x03
+	}
+	return false
+}
+
+// Runs a call to the host's files through the tap, which keeps what it
+// changed in the registers and memory, or in a replay, changes them as
+// they were without running the call.
+func (d *Dos) tapHost(mu uc.Unicorn, intrNum uint32) error {
+	ah := cpu.Reg8(mu, uc.X86_REG_AH)
+	bx := cpu.Reg16(mu, uc.X86_REG_BX)
+	live := d.mu
+	defer func() { d.mu = live }()
+	err := d.Tap.HostCall(mu, func(tapped uc.Unicorn) error {
+		d.mu = tapped
+		return d.int21(tapped, intrNum)
+	})
+	if err != nil {
+		return err
+	}
+	// A replay leaves the handles the call opened and closed to be kept
+	// track of here
+	switch ah {
+	case 0x3c, 0x3d, 0x6c:
+		h := int(cpu.Reg16(mu, uc.X86_REG_AX))
+		if _, ok := d.files[h]; !ok {
+			reg := uc.X86_REG_DX
+			if ah == 0x6c {
+				reg = uc.X86_REG_SI
+			}
+			name, _ := GetString(mu, cpu.SReg16(mu, uc.X86_REG_DS), cpu.Reg16(mu, reg))
+			d.files[h] = &DosFile{Name: strings.ToUpper(name), Dev: &replayedFile{}, access: accessReadWrite}
+		}
+	case 0x3E:
+		delete(d.files, int(bx))
+	}
+	return nil
+}
+
+func (d *Dos) int21(mu uc.Unicorn, intrNum uint32) error {
 
 	ah := cpu.Reg8(mu, uc.X86_REG_AH)
 	al := cpu.Reg8(mu, uc.X86_REG_AL)
 	bx := cpu.Reg16(mu, uc.X86_REG_BX)
 	cx := cpu.Reg16(mu, uc.X86_REG_CX)
 	dx := cpu.Reg16(mu, uc.X86_REG_DX)
-	cs := cpu.SReg16(mu, uc.X86_REG_CS)
 	ds := cpu.SReg16(mu, uc.X86_REG_DS)
 	es := cpu.SReg16(mu, uc.X86_REG_ES)
-	ss := cpu.SReg16(mu, uc.X86_REG_SS)
-	ip := cpu.Reg16(mu, uc.X86_REG_IP)
-	sp := cpu.SReg16(mu, uc.X86_REG_SP)
-
-	glog.V(1).Infof("Int21: CS: 0x%04X DS: 0x%04X ES: 0x%04X SS: 0x%04X IP: 0x%04X SP: 0x%04X\n",
-		cs, ds, es, ss, ip, sp)
 
+	// Calls are traced by the trace package, not logged here
 	switch ah {
 
 	case 0x00: // terminate process
-		glog.Infoln("Int21: 0x0 Stop")
-		mu.Stop()
+		d.Terminate(0)
 
 	case 0x01: // Keyboard Input with Echo
-		c, err := d.in.ReadByte()
-		if err != nil {
-			mu.RegWrite(uc.X86_REG_AH, uint64(c))
-		}
+		c := d.readKey()
+		d.con.Write([]byte{c})
+		mu.RegWrite(uc.X86_REG_AL, uint64(c))
 
 	case 0x02: // Display Output
-		d.out.WriteByte(byte(dx & 0xff))
-		d.out.Flush()
+		d.con.Write([]byte{byte(dx & 0xff)})
+
+	case 0x06: // Direct Console I/O
+		if dl := byte(dx & 0xff); dl != 0xFF {
+			d.con.Write([]byte{dl})
+			return nil
+		}
+		if d.con.Buffered() == 0 && d.con.Carrier() {
+			mu.RegWrite(uc.X86_REG_AL, 0)
+			return cpu.SetZeroFlag(mu, true)
+		}
+		mu.RegWrite(uc.X86_REG_AL, uint64(d.readKey()))
+		return cpu.SetZeroFlag(mu, false)
+
+	case 0x07, 0x08: // Direct/Console Input Without Echo
+		mu.RegWrite(uc.X86_REG_AL, uint64(d.readKey()))
+
+	case 0x0b: // Check Standard Input Status
+		// After a hang up there's always "input", the ^Z from readKey
+		status := 0x00
+		if d.con.Buffered() > 0 || !d.con.Carrier() {
+			status = 0xFF
+		}
+		mu.RegWrite(uc.X86_REG_AL, uint64(status))
+
 	case 0x09: // Print $ terminated string.
-		if s, err := getStringDollarSign(mu, ds, dx); err == nil {
-			glog.V(1).Infof("getStringDollarSign: '%s'\n", s)
-			d.out.WriteString(s)
-			d.out.Flush()
+		if s, err := GetStringDollarSign(mu, ds, dx); err == nil {
+			d.con.Write([]byte(s))
 		}
 	case 0x0a: // Buffered Keyboard Input
-		reader := bufio.NewReader(d.in)
 		bmax, _ := mu.MemRead(cpu.Addr(ds, dx), 1)
 		max := int(bmax[0])
-		message, _ := reader.ReadString('\n')
+		if max == 0 {
+			return nil
+		}
+		line, _ := d.devices["CON"].(*conDevice).readLine()
+		message := strings.TrimRight(string(line), "\r\n")
 		if len(message) >= max {
 			message = message[:max-1]
 		}
 		mu.MemWrite(cpu.Addr(ds, dx), []byte{bmax[0], byte(len(message))})
-		mu.MemWrite(cpu.Addr(ds, dx)+2, []byte(message))
+		mu.MemWrite(cpu.Addr(ds, dx)+2, append([]byte(message), '\r'))
 
 	case 0x25: // Set Interrupt Vector
-		glog.Infof("Set vector: %02X = [%04X:%04X]\n", al, ds, dx)
 		if ds == 0 && dx == 0 {
 			// Remove the key
 			delete(d.intrvec, int(al))
@@ -377,16 +721,26 @@ func (d *Dos) Int21(mu uc.Unicorn, intrNum uint32) error {
 		cpu.PutMem16(mu, addr, dx)
 		cpu.PutMem16(mu, addr+2, uint16(ds))
 
+	case 0x2a: // Get Date
+		now := d.Now()
+		mu.RegWrite(uc.X86_REG_CX, uint64(now.Year()))
+		mu.RegWrite(uc.X86_REG_DX, uint64(now.Month())<<8|uint64(now.Day()))
+		mu.RegWrite(uc.X86_REG_AL, uint64(now.Weekday()))
+
+	case 0x2c: // Get Time
+		now := d.Now()
+		mu.RegWrite(uc.X86_REG_CX, uint64(now.Hour())<<8|uint64(now.Minute()))
+		mu.RegWrite(uc.X86_REG_DX, uint64(now.Second())<<8|uint64(now.Nanosecond()/10000000))
+
 	case 0x30: // Get DOS Version Number
-		mu.RegWrite(uc.X86_REG_AX, 0x05)
+		// Major version in AL, minor in AH
+		mu.RegWrite(uc.X86_REG_AX, uint64(d.Version>>8|d.Version<<8))
 
 	case 0x35: // Get Interrupt Vector
 		if v, ok := d.intrvec[int(al)]; ok {
-			glog.Infof("Get vector: %02X [%04X:%04X]\n", al, uint16(v.Seg), v.Off)
 			mu.RegWrite(uc.X86_REG_DS, uint64(v.Seg))
 			mu.RegWrite(uc.X86_REG_DX, uint64(v.Off))
 		} else {
-			glog.Infof("Get vector: %02X [UNUSED]\n", al)
 			mu.RegWrite(uc.X86_REG_DS, 0)
 			mu.RegWrite(uc.X86_REG_DX, 0)
 		}
@@ -394,106 +748,89 @@ func (d *Dos) Int21(mu uc.Unicorn, intrNum uint32) error {
 	case 0x3c: // Create File Using Handle
 		filename, err := GetString(mu, ds, dx)
 		if err != nil {
-			// 	57  Invalid parameter
-			return d.SetDosError(0x57, "filename missing")
-		}
-		handle, err := d.GetNextFreeHandle()
-		if err != nil {
-			// Set error to 04  Too many open files (no handles left)
-			return d.SetDosError(0x04, "unable to allocate file handle")
+			return d.SetDosError(errInvalidParameter, "filename missing")
 		}
-		f, err := os.Create(filename)
+		handle, _, err := d.openFile(filename, accessReadWrite|shareCompat, cx, ifExistsReplace, ifMissingCreate)
 		if err != nil {
-			return d.SetDosError(0x1F, "create file failed")
-		}
-		// Success
-		d.files[handle] = &DosFile{
-			Name: filename,
-			Dir:  "",
-			File: f,
+			return d.SetDosError(dosErrno(err, errPathNotFound), fmt.Sprintf("create file failed: '%s': %s", filename, err))
 		}
 		return d.ClearDosError(uint64(handle))
 
 	case 0x3d: // Open File Using Handle
 		filename, err := GetString(mu, ds, dx)
 		if err != nil {
-			// 	57  Invalid parameter
-			return d.SetDosError(0x57, "filename missing")
-		}
-
-		handle, err := d.GetNextFreeHandle()
-		if err != nil {
-			// Set error to 04  Too many open files (no handles left)
-			return d.SetDosError(0x04, "unable to allocate file handle")
-		}
-
-		var f *os.File
-		switch strings.ToLower(filename) {
-		case "con":
-			f = os.Stdout
-		case "nul":
-			f, err = os.Open(os.DevNull)
-		default:
-			flag, perm := dosFileModeToGo(al)
-			f, err = os.OpenFile(filename, flag, perm)
+			return d.SetDosError(errInvalidParameter, "filename missing")
 		}
+		handle, _, err := d.openFile(filename, al, 0, ifExistsOpen, ifMissingFail)
 		if err != nil {
-			return d.SetDosError(0x02, fmt.Sprintf("open file failed: '%s'", filename))
-		}
-
-		// Success
-		d.files[handle] = &DosFile{
-			Name: filename,
-			Dir:  "",
-			File: f,
+			return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("open file failed: '%s': %s", filename, err))
 		}
 		return d.ClearDosError(uint64(handle))
 
 	case 0x3E: // Close File Using Handle
 		file, ok := d.files[int(bx)]
 		if !ok {
-			return d.SetDosError(0x06, fmt.Sprintf("Invalid handle: %d", bx))
+			return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
 		}
-		if err := file.File.Close(); err != nil {
+		if err := file.Close(); err != nil {
 			glog.Warningf("Error closing file handle %d: '%s'", bx, err)
 		}
 		delete(d.files, int(bx))
-		return nil
+		return d.ClearDosError(0)
 
 	case 0x3F: // Read From File or Device Using Handle
 		file, ok := d.files[int(bx)]
 		if !ok {
-			return d.SetDosError(0x06, fmt.Sprintf("Invalid handle: %d", bx))
+			return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
+		}
+		if file.access == accessWrite {
+			return d.SetDosError(errAccessDenied, fmt.Sprintf("handle %d not open for reading", bx))
+		}
+		if err := file.checkLocked(false, int64(cx)); err != nil {
+			return d.SetDosError(dosErrno(err, errAccessDenied), err.Error())
 		}
 		bytes := make([]byte, cx)
-		numRead, err := file.File.Read(bytes)
-		if err != nil {
-			return d.SetDosError(0x1E, "Read fault")
+		numRead, err := file.Dev.Read(bytes)
+		if err != nil && err != io.EOF {
+			return d.SetDosError(errReadFault, fmt.Sprintf("Read fault: %s", err))
 		}
-		mu.MemWrite(cpu.Addr(ds, dx), bytes)
+		mu.MemWrite(cpu.Addr(ds, dx), bytes[:numRead])
 		return d.ClearDosError(uint64(numRead))
 
 	case 0x40: // Write To File or Device Using Handle
 		file, ok := d.files[int(bx)]
 		if !ok {
-			return d.SetDosError(0x06, fmt.Sprintf("Invalid handle: %d", bx))
+			return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
+		}
+		if file.access == accessRead {
+			return d.SetDosError(errAccessDenied, fmt.Sprintf("handle %d not open for writing", bx))
 		}
 		if cx == 0 {
 			// CX = number of bytes to write, a zero value truncates/extends
 			// the file to the current file position
-			pos, err := file.File.Seek(0, io.SeekCurrent)
+			f := file.hostFile()
+			if f == nil {
+				return d.ClearDosError(0)
+			}
+			pos, err := f.Seek(0, io.SeekCurrent)
 			if err != nil {
-				return d.SetDosError(0x19, "Seek failure")
+				return d.SetDosError(errSeek, "Seek failure")
+			}
+			if err := f.Truncate(pos); err != nil {
+				return d.SetDosError(dosErrno(err, errAccessDenied), err.Error())
 			}
-			return file.File.Truncate(pos)
+			return d.ClearDosError(0)
+		}
+		if err := file.checkLocked(true, int64(cx)); err != nil {
+			return d.SetDosError(dosErrno(err, errAccessDenied), err.Error())
 		}
 		mem, err := cpu.Mem(mu, ds, dx, uint64(cx))
 		if err != nil {
-			return d.SetDosError(0x1f, "General failure")
+			return d.SetDosError(errGeneralFailure, "General failure")
 		}
-		numWritten, err := file.File.Write(mem)
+		numWritten, err := file.Dev.Write(mem)
 		if err != nil {
-			return d.SetDosError(0x1D, "write fault")
+			return d.SetDosError(errWriteFault, "write fault")
 		}
 		return d.ClearDosError(uint64(numWritten))
 
@@ -501,20 +838,26 @@ func (d *Dos) Int21(mu uc.Unicorn, intrNum uint32) error {
 		filename, err := GetString(mu, ds, dx)
 		if err != nil {
 			// 	57  Invalid parameter
-			return d.SetDosError(0x57, "filename missing")
+			return d.SetDosError(errInvalidParameter, "filename missing")
 		}
-		if _, err := os.Stat(filename); err != nil {
-			return d.SetDosError(2, "File not found")
+		path, err := d.FS.Resolve(filename)
+		if err != nil {
+			return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("delete failed: '%s'", filename))
 		}
-		if err := os.Remove(filename); err != nil {
-			return d.SetDosError(0x1f, "???")
+		if fi, err := os.Stat(path); err != nil {
+			return d.SetDosError(dosErrno(err, errFileNotFound), "File not found")
+		} else if fi.IsDir() || fi.Mode().Perm()&0200 == 0 {
+			return d.SetDosError(errAccessDenied, fmt.Sprintf("delete failed: '%s'", filename))
+		}
+		if err := os.Remove(path); err != nil {
+			return d.SetDosError(dosErrno(err, errFileNotFound), err.Error())
 		}
 		return d.ClearDosError(0)
 
 	case 0x42: // Move File Pointer Using Handle
 		file, ok := d.files[int(bx)]
 		if !ok {
-			return d.SetDosError(0x06, fmt.Sprintf("Invalid handle: %d", bx))
+			return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
 		}
 		whence := io.SeekCurrent
 		switch al {
@@ -525,13 +868,42 @@ func (d *Dos) Int21(mu uc.Unicorn, intrNum uint32) error {
 		case 2:
 			whence = io.SeekEnd
 		}
-		num := int64(cx)<<8 | int64(dx)
-		pos, err := file.File.Seek(num, whence)
+		// CX:DX is signed when moving relative to the current position
+		// or the end of the file.
+		num := int64(int32(uint32(cx)<<16 | uint32(dx)))
+		pos, err := file.Dev.Seek(num, whence)
 		if err != nil {
-			return d.SetDosError(0x19, "Seek failure")
+			return d.SetDosError(errSeek, "Seek failure")
+		}
+		mu.RegWrite(uc.X86_REG_DX, uint64(pos>>16)&0xFFFF)
+		return d.ClearDosError(uint64(pos) & 0xFFFF)
+
+	case 0x43: // Get/Set File Attributes
+		filename, err := GetString(mu, ds, dx)
+		if err != nil {
+			return d.SetDosError(errInvalidParameter, "filename missing")
+		}
+		path, err := d.FS.Resolve(filename)
+		if err != nil {
+			return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("attributes failed: '%s'", filename))
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("attributes failed: '%s'", filename))
+		}
+		switch al {
+		case 0:
+			attr := fileAttributes(fi)
+			mu.RegWrite(uc.X86_REG_CX, uint64(attr))
+			return d.ClearDosError(uint64(attr))
+		case 1:
+			if err := setFileAttributes(path, fi, cx); err != nil {
+				return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("set attributes failed: '%s'", filename))
+			}
+			return d.ClearDosError(0)
+		default:
+			return d.SetDosError(errInvalidFunction, fmt.Sprintf("invalid attribute function: 0x%02X", al))
 		}
-		mu.RegWrite(uc.X86_REG_DX, uint64(pos)>>8)
-		return d.ClearDosError(uint64(pos))
 
 	case 0x44: // I/O Control for Devices (IOCTL)
 		/*
@@ -540,23 +912,71 @@ func (d *Dos) Int21(mu uc.Unicorn, intrNum uint32) error {
 			BL = logical device number (0=default, 1=A:, 2=B:, 3=C:, ...)
 			CX = number of bytes to read or write
 		*/
-		if al == 0 {
-			switch bx {
-			case 0:
-				return d.SuccessDX(0x81)
-			case 1:
-				return d.SuccessDX(0x82)
-			case 2:
-				return d.SuccessDX(0x82)
-			default:
-				// C drive, nothing else.
-				return d.SuccessDX(0x02)
+		switch al {
+		case 0x00: // Get Device Information
+			file, ok := d.files[int(bx)]
+			if !ok {
+				return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
+			}
+			return d.SuccessDX(uint64(file.Dev.Info()))
+		case 0x01: // Set Device Information
+			file, ok := d.files[int(bx)]
+			if !ok {
+				return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
 			}
+			if err := file.Dev.SetInfo(dx); err != nil {
+				return d.SetDosError(dosErrno(err, errInvalidFunction), err.Error())
+			}
+			return d.ClearDosError(0)
+		case 0x06, 0x07: // Get Input/Output Status
+			file, ok := d.files[int(bx)]
+			if !ok {
+				return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
+			}
+			ready := file.Dev.OutputReady()
+			if al == 0x06 {
+				ready = file.Dev.InputReady()
+			}
+			if ready {
+				return d.ClearDosError(0x44FF)
+			}
+			return d.ClearDosError(0x4400)
+		case 0x08: // Is Block Device Removable
+			drive, err := d.FS.ioctlDrive(uint8(bx))
+			if err != nil {
+				return d.SetDosError(errInvalidDrive, err.Error())
+			}
+			if drive.Removable {
+				return d.ClearDosError(0)
+			}
+			return d.ClearDosError(1)
+		case 0x09: // Is Drive Remote
+			drive, err := d.FS.ioctlDrive(uint8(bx))
+			if err != nil {
+				return d.SetDosError(errInvalidDrive, err.Error())
+			}
+			if drive.Remote {
+				return d.SuccessDX(0x1000)
+			}
+			return d.SuccessDX(0)
+		case 0x0a: // Is Handle Remote
+			file, ok := d.files[int(bx)]
+			if !ok {
+				return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
+			}
+			return d.SuccessDX(uint64(file.Dev.Info() & fileRemote))
+		case 0x0e, 0x0f: // Get/Set Logical Drive Map
+			// Every drive has exactly one letter, so there's no map to
+			// report or change.
+			if _, err := d.FS.ioctlDrive(uint8(bx)); err != nil {
+				return d.SetDosError(errInvalidDrive, err.Error())
+			}
+			return d.ClearDosError(0x4400)
 		}
 		glog.Warningf("IOCTL AL:%02X, BX:%04X, BL:%02X, CX:%02X\n", al, bx, bx&0xff, cx)
+		return d.SetDosError(errInvalidFunction, fmt.Sprintf("unhandled IOCTL function: 0x%02X", al))
 
 	case 0x4a: // Modify Allocated Memory Block (SETBLOCK)
-		glog.Infof("[BLOCK: 0x%04X, SIZE: %d paragraphs, %d bytes]", es, bx, bx*16)
 		newsize, err := d.Mem.Resize(int(es), int(bx))
 		// TODO - need to check max size if it's < bx and return that in BX on error.
 		if err != nil {
@@ -565,9 +985,114 @@ func (d *Dos) Int21(mu uc.Unicorn, intrNum uint32) error {
 		mu.RegWrite(uc.X86_REG_BX, uint64(newsize))
 		return d.ClearDosError(0)
 
+	case 0x4b: // EXEC
+		filename, err := GetString(mu, ds, dx)
+		if err != nil {
+			return d.SetDosError(errInvalidParameter, "filename missing")
+		}
+		switch al {
+		case 0x03: // Load Overlay
+			// ES:BX has the segment to load at and the relocation factor
+			params, err := cpu.Mem(mu, es, bx, 4)
+			if err != nil {
+				return d.SetDosError(errInvalidParameter, err.Error())
+			}
+			seg, factor := binary.LittleEndian.Uint16(params), binary.LittleEndian.Uint16(params[2:])
+			if err := d.loadOverlay(filename, seg, factor); err != nil {
+				return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("load overlay '%s': %s", filename, err))
+			}
+			return d.ClearDosError(0)
+		}
+		return d.SetDosError(errInvalidFunction, fmt.Sprintf("EXEC mode %d of '%s' isn't supported", al, filename))
+
 	case 0x4c: // Terminate process with return code
-		glog.V(1).Infoln("Int21: 0x0 Stop")
-		mu.Stop()
+		d.Terminate(al)
+
+	case 0x56: // Rename File
+		di := cpu.Reg16(mu, uc.X86_REG_DI)
+		oldname, err := GetString(mu, ds, dx)
+		if err != nil {
+			return d.SetDosError(errInvalidParameter, "filename missing")
+		}
+		newname, err := GetString(mu, es, di)
+		if err != nil {
+			return d.SetDosError(errInvalidParameter, "filename missing")
+		}
+		return d.rename(oldname, newname)
+
+	case 0x57: // Get/Set File Date and Time Using Handle
+		file, ok := d.files[int(bx)]
+		if !ok {
+			return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
+		}
+		switch al {
+		case 0:
+			t := time.Now()
+			if file.modTime != nil {
+				t = *file.modTime
+			} else if f := file.hostFile(); f != nil {
+				if fi, err := f.Stat(); err == nil {
+					t = fi.ModTime()
+				}
+			}
+			date, tm := PackDosTime(t)
+			mu.RegWrite(uc.X86_REG_CX, uint64(tm))
+			return d.SuccessDX(uint64(date))
+		case 1:
+			t := UnpackDosTime(dx, cx)
+			if file.Path != "" {
+				if err := os.Chtimes(file.Path, time.Now(), t); err != nil {
+					return d.SetDosError(dosErrno(err, errFileNotFound), err.Error())
+				}
+			}
+			file.modTime = &t
+			return d.ClearDosError(0)
+		default:
+			return d.SetDosError(errInvalidFunction, fmt.Sprintf("invalid date/time function: 0x%02X", al))
+		}
+
+	case 0x5c: // Lock/Unlock File Access
+		file, ok := d.files[int(bx)]
+		if !ok {
+			return d.SetDosError(errInvalidHandle, fmt.Sprintf("Invalid handle: %d", bx))
+		}
+		si := cpu.Reg16(mu, uc.X86_REG_SI)
+		di := cpu.Reg16(mu, uc.X86_REG_DI)
+		offset := int64(cx)<<16 | int64(dx)
+		length := int64(si)<<16 | int64(di)
+		var err error
+		switch al {
+		case 0:
+			err = file.Lock(offset, length)
+		case 1:
+			err = file.Unlock(offset, length)
+		default:
+			return d.SetDosError(errInvalidFunction, fmt.Sprintf("invalid lock function: 0x%02X", al))
+		}
+		if err != nil {
+			return d.SetDosError(dosErrno(err, errInvalidHandle), fmt.Sprintf("lock [%d, +%d] on handle %d: %s", offset, length, bx, err))
+		}
+		return d.ClearDosError(0)
+
+	case 0x6c: // Extended Open/Create
+		si := cpu.Reg16(mu, uc.X86_REG_SI)
+		filename, err := GetString(mu, ds, si)
+		if err != nil {
+			return d.SetDosError(errInvalidParameter, "filename missing")
+		}
+		if al != 0 {
+			return d.SetDosError(errInvalidFunction, fmt.Sprintf("invalid extended open function: 0x%02X", al))
+		}
+		ifExists, ifMissing := uint8(dx&0x0F), uint8(dx>>4&0x0F)
+		if ifExists > ifExistsReplace || ifMissing > ifMissingCreate {
+			return d.SetDosError(errInvalidParameter, fmt.Sprintf("invalid open action: 0x%02X", dx))
+		}
+		handle, action, err := d.openFile(filename, uint8(bx), cx, ifExists, ifMissing)
+		if err != nil {
+			return d.SetDosError(dosErrno(err, errFileNotFound), fmt.Sprintf("extended open failed: '%s': %s", filename, err))
+		}
+		mu.RegWrite(uc.X86_REG_CX, uint64(action))
+		return d.ClearDosError(uint64(handle))
 
 	default:
 		glog.Errorf("Int21: Unhandled instrction: 0x%02X; AH=0x%02X\n", intrNum, ah)
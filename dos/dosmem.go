@@ -34,6 +34,8 @@ const (
 
 const allowedSlackSpace = 512 // 512 * 16 == 8k
 
+var ErrInsufficientMemory = errors.New("insufficient memory")
+
 type DosMem struct {
 	StartSeg int
 	EndSeg   int
@@ -183,7 +185,8 @@ func (m *DosMem) AllocateLast(size int) (*DosMemBlock, error) {
 	return nil, errors.New("unable to allocate memory")
 }
 
-func (m *DosMem) Allocate(size int) (*DosMemBlock, error) {
+// Starts with all of memory free.
+func (m *DosMem) init() {
 	if len(m.Blocks) == 0 {
 		m.Blocks = append(m.Blocks, DosMemBlock{
 			Avail: true,
@@ -191,6 +194,22 @@ func (m *DosMem) Allocate(size int) (*DosMemBlock, error) {
 			End:   m.EndSeg,
 		})
 	}
+}
+
+// Largest returns the size in paragraphs of the largest free block.
+func (m *DosMem) Largest() int {
+	m.init()
+	largest := 0
+	for _, b := range m.Blocks {
+		if b.Avail && b.Size() > largest {
+			largest = b.Size()
+		}
+	}
+	return largest
+}
+
+func (m *DosMem) Allocate(size int) (*DosMemBlock, error) {
+	m.init()
 	switch m.Fit {
 	case Best:
 		return nil, errors.New("best fit not implemented")
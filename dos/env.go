@@ -0,0 +1,103 @@
+package dos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"door86.org/ivdoor/cpu"
+)
+
+// Largest environment DOS allows
+const maxEnvSize = 32 * 1024
+
+// Builds an environment block: each NAME=value NUL terminated, a NUL after
+// the last, then a word holding the number of strings that follow and the
+// program's fully qualified path.  C runtimes find argv[0] there.  program
+// may be empty, leaving the count 0.
+func buildEnv(vars []string, program string) ([]byte, error) {
+	var env []byte
+	for _, v := range vars {
+		if i := strings.IndexByte(v, '='); i < 1 || strings.IndexByte(v, 0) >= 0 {
+			return nil, fmt.Errorf("bad environment variable '%s'", v)
+		}
+		env = append(append(env, v...), 0)
+	}
+	if len(vars) == 0 {
+		// Empty environments still end with the double NUL
+		env = append(env, 0)
+	}
+	env = append(env, 0)
+	if program == "" {
+		env = append(env, 0, 0)
+	} else {
+		env = append(append(append(env, 1, 0), program...), 0)
+	}
+	if len(env) > maxEnvSize {
+		return nil, fmt.Errorf("environment is %d bytes, DOS allows %d", len(env), maxEnvSize)
+	}
+	return env, nil
+}
+
+// Reads the variables from an environment block, up to the double NUL.
+func parseEnv(b []byte) ([]string, error) {
+	var vars []string
+	for len(b) > 0 && b[0] != 0 {
+		end := bytes.IndexByte(b, 0)
+		if end < 0 {
+			return nil, errors.New("environment isn't terminated")
+		}
+		vars = append(vars, string(b[:end]))
+		b = b[end+1:]
+	}
+	if len(b) == 0 {
+		return nil, errors.New("environment isn't terminated")
+	}
+	return vars, nil
+}
+
+// Allocates and writes an environment block for program with vars,
+// returning its segment.
+func (d *Dos) writeEnv(vars []string, program string) (*DosMemBlock, error) {
+	env, err := buildEnv(vars, program)
+	if err != nil {
+		return nil, err
+	}
+	block, err := d.Mem.Allocate((len(env) + 15) / 16)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.mu.MemWrite(cpu.Addr(cpu.Seg(block.Start), 0), env); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Reads the variables of the environment block at seg.
+func (d *Dos) readEnv(seg cpu.Seg) ([]string, error) {
+	addr := uint64(cpu.Addr(seg, 0))
+	size := uint64(maxEnvSize)
+	if addr+size > 0x100000 {
+		size = 0x100000 - addr
+	}
+	b, err := d.mu.MemRead(addr, size)
+	if err != nil {
+		return nil, err
+	}
+	return parseEnv(b)
+}
+
+// CopyEnv makes the environment for a child process, program being its
+// fully qualified DOS path.  The variables come from the block at from,
+// which EXEC callers may supply, or the current program's when from is 0.
+func (d *Dos) CopyEnv(from cpu.Seg, program string) (*DosMemBlock, error) {
+	if from == 0 {
+		from = d.envSeg
+	}
+	vars, err := d.readEnv(from)
+	if err != nil {
+		return nil, err
+	}
+	return d.writeEnv(vars, program)
+}
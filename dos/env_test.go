@@ -0,0 +1,41 @@
+package dos
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildEnv(t *testing.T) {
+	env, err := buildEnv([]string{`COMSPEC=C:\COMMAND.COM`, `PATH=C:\`}, `C:\DOORS\LORD.EXE`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "COMSPEC=C:\\COMMAND.COM\x00PATH=C:\\\x00\x00\x01\x00C:\\DOORS\\LORD.EXE\x00"
+	if string(env) != want {
+		t.Errorf("buildEnv = %q, want %q", env, want)
+	}
+	vars, err := parseEnv(env)
+	if err != nil || strings.Join(vars, "|") != `COMSPEC=C:\COMMAND.COM|PATH=C:\` {
+		t.Errorf("parseEnv = %q, %v", vars, err)
+	}
+
+	// An empty environment still has its double NUL, and no program path
+	// leaves the count 0
+	env, _ = buildEnv(nil, "")
+	if string(env) != "\x00\x00\x00\x00" {
+		t.Errorf("empty environment = %q", env)
+	}
+	if vars, err := parseEnv(env); err != nil || len(vars) != 0 {
+		t.Errorf("parseEnv(empty) = %q, %v", vars, err)
+	}
+
+	if _, err := buildEnv([]string{"NOVALUE"}, ""); err == nil {
+		t.Error("expected an error for a variable without =")
+	}
+	if _, err := buildEnv([]string{"BIG=" + strings.Repeat("x", maxEnvSize)}, ""); err == nil {
+		t.Error("expected an error for an environment over 32K")
+	}
+	if _, err := parseEnv([]byte("PATH=C:\\")); err == nil {
+		t.Error("expected an error for an unterminated environment")
+	}
+}
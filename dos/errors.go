@@ -0,0 +1,106 @@
+package dos
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// DOS error codes returned in AX when the carry flag is set.
+// See https://stanislavs.org/helppc/dos_error_codes.html
+const (
+	errInvalidFunction    = 0x01
+	errFileNotFound       = 0x02
+	errPathNotFound       = 0x03
+	errTooManyOpenFiles   = 0x04
+	errAccessDenied       = 0x05
+	errInvalidHandle      = 0x06
+	errInsufficientMemory = 0x08
+	errInvalidFormat      = 0x0B
+	errInvalidAccessCode  = 0x0C
+	errInvalidDrive       = 0x0F
+	errNotSameDevice      = 0x11
+	errSeek               = 0x19
+	errWriteFault         = 0x1D
+	errReadFault          = 0x1E
+	errGeneralFailure     = 0x1F
+	errSharingViolation   = 0x20
+	errLockViolation      = 0x21
+	errFileExists         = 0x50
+	errInvalidParameter   = 0x57
+)
+
+var errorNames = map[uint16]string{
+	errInvalidFunction:    "invalid function",
+	errFileNotFound:       "file not found",
+	errPathNotFound:       "path not found",
+	errTooManyOpenFiles:   "too many open files",
+	errAccessDenied:       "access denied",
+	errInvalidHandle:      "invalid handle",
+	errInsufficientMemory: "insufficient memory",
+	errInvalidFormat:      "invalid format",
+	errInvalidAccessCode:  "invalid access code",
+	errInvalidDrive:       "invalid drive",
+	errNotSameDevice:      "not same device",
+	errSeek:               "seek error",
+	errWriteFault:         "write fault",
+	errReadFault:          "read fault",
+	errGeneralFailure:     "general failure",
+	errSharingViolation:   "sharing violation",
+	errLockViolation:      "lock violation",
+	errFileExists:         "file exists",
+	errInvalidParameter:   "invalid parameter",
+}
+
+// ErrorName returns the name of a DOS error code, as returned in AX with
+// the carry flag set.
+func ErrorName(code uint16) string {
+	if name, ok := errorNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("error %02Xh", code)
+}
+
+// An error that knows which DOS error code it should be reported as.
+type dosError struct {
+	code uint64
+	err  error
+}
+
+func (e *dosError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dosError) Unwrap() error {
+	return e.err
+}
+
+// Maps an error from the host file system or the path-resolution layer to
+// the closest DOS error code.  notFound is returned for missing files since
+// DOS reports either 02h or 03h depending on the call.
+func dosErrno(err error, notFound uint64) uint64 {
+	var de *dosError
+	if errors.As(err, &de) {
+		return de.code
+	}
+	switch {
+	case errors.Is(err, ErrSharingViolation):
+		return errSharingViolation
+	case errors.Is(err, ErrLockViolation):
+		return errLockViolation
+	case errors.Is(err, ErrInvalidDrive):
+		return errInvalidDrive
+	case errors.Is(err, ErrInsufficientMemory):
+		return errInsufficientMemory
+	case errors.Is(err, ErrPathNotFound), errors.Is(err, syscall.ENOTDIR):
+		return errPathNotFound
+	case errors.Is(err, os.ErrNotExist):
+		return notFound
+	case errors.Is(err, os.ErrExist):
+		return errFileExists
+	case errors.Is(err, os.ErrPermission):
+		return errAccessDenied
+	}
+	return errGeneralFailure
+}
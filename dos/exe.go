@@ -3,6 +3,7 @@ package dos
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 )
@@ -15,21 +16,21 @@ type exeReloEntry struct {
 }
 
 type ExeHeader struct {
-	Signature          uint16
-	BytesInLastBlock   uint16
-	BlocksInFile       uint16
-	NumRelos           uint16
-	HeaderParagraphs   uint16
-	MinExtraParagraphs uint16
-	MaxExtraParagraphs uint16
-	SS                 uint16
-	SP                 uint16
-	Checksum           uint16
-	IP                 uint16
-	CS                 uint16
-	ReloTableOffset    uint16
-	OverlayNumber      uint16
-	Relos              []exeReloEntry
+	Signature          uint16         `json:"signature"`
+	BytesInLastBlock   uint16         `json:"bytes_in_last_block"`
+	BlocksInFile       uint16         `json:"blocks_in_file"`
+	NumRelos           uint16         `json:"num_relos"`
+	HeaderParagraphs   uint16         `json:"header_paragraphs"`
+	MinExtraParagraphs uint16         `json:"min_extra_paragraphs"`
+	MaxExtraParagraphs uint16         `json:"max_extra_paragraphs"`
+	SS                 uint16         `json:"ss"`
+	SP                 uint16         `json:"sp"`
+	Checksum           uint16         `json:"checksum"`
+	IP                 uint16         `json:"ip"`
+	CS                 uint16         `json:"cs"`
+	ReloTableOffset    uint16         `json:"relo_table_offset"`
+	OverlayNumber      uint16         `json:"overlay_number"`
+	Relos              []exeReloEntry `json:"-"`
 }
 
 type ExeType int
@@ -46,14 +47,41 @@ type Executable struct {
 	Exists bool
 	Hdr    ExeHeader
 	Data   []byte
+	// What follows the load module in an EXE file, which overlay managers
+	// read by opening the EXE again
+	Overlay []byte
 }
 
-// How many segments are needed to load this executable.  For EXEs we look
-// at the header, for COM files it's just 64k
+// Size of the PSP in paragraphs
+const pspParagraphs = 0x10
+
+// LoadSize returns the size in bytes of the load module: the file size
+// the header declares less the header itself.  Anything after it in the
+// file, such as overlays, isn't loaded.
+func (h *ExeHeader) LoadSize() int {
+	size := int(h.BlocksInFile) * 512
+	if h.BytesInLastBlock > 0 && h.BytesInLastBlock < 512 {
+		size -= 512 - int(h.BytesInLastBlock)
+	}
+	size -= int(h.HeaderParagraphs) * 0x10
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// Paragraphs taken by the load module.
+func (h *ExeHeader) loadParagraphs() int {
+	return (h.LoadSize() + 0xF) / 0x10
+}
+
+// How many segments are needed to load this executable.  For EXEs this is
+// the PSP, the load module and the extra memory the header asks for at
+// least, for COM files it's just 64k
 func (exe *Executable) SegmentsNeeded() int {
 	switch exe.Etype {
 	case EXE:
-		return int((exe.Hdr.BlocksInFile*512/32)+exe.Hdr.MinExtraParagraphs) + 1
+		return pspParagraphs + exe.Hdr.loadParagraphs() + int(exe.Hdr.MinExtraParagraphs)
 	case COM, IMAGE:
 		return 0x1000 // 64K
 	default:
@@ -61,6 +89,25 @@ func (exe *Executable) SegmentsNeeded() int {
 	}
 }
 
+// SegmentsWanted returns the most memory the executable would use, DOS
+// gives it this much when it is free.
+func (exe *Executable) SegmentsWanted() int {
+	if exe.Etype != EXE {
+		return exe.SegmentsNeeded()
+	}
+	if exe.LoadsHigh() {
+		// As much as there is
+		return 0x10000
+	}
+	return pspParagraphs + exe.Hdr.loadParagraphs() + int(exe.Hdr.MaxExtraParagraphs)
+}
+
+// LoadsHigh reports whether the EXE asks to be loaded at the top of its
+// memory, which a header with no extra memory at all does.
+func (exe *Executable) LoadsHigh() bool {
+	return exe.Etype == EXE && exe.Hdr.MinExtraParagraphs == 0 && exe.Hdr.MaxExtraParagraphs == 0
+}
+
 func ReadExeFromFile(filename string) (*Executable, error) {
 	file, err := os.Open(filename)
 	if err != nil {
@@ -79,14 +126,23 @@ func ReadExeFromFile(filename string) (*Executable, error) {
 	return ReadExe(b)
 }
 
+// Size of the fixed part of the EXE header, up to the overlay number
+const exeHeaderSize = 0x1C
+
+// ErrBadExe is returned for EXE files whose header doesn't fit the file.
+var ErrBadExe = errors.New("bad EXE file")
+
 func ReadExe(bs []byte) (*Executable, error) {
 
 	exe := &Executable{Etype: EXE, Exists: true}
-	if bs[0] != 'M' || bs[1] != 'Z' {
+	if len(bs) < 2 || bs[0] != 'M' || bs[1] != 'Z' {
 		exe.Etype = COM
 		exe.Data = bs
 		return exe, nil
 	}
+	if len(bs) < exeHeaderSize {
+		return nil, fmt.Errorf("%w: header is cut off at %d bytes", ErrBadExe, len(bs))
+	}
 	exe.Hdr.Signature = binary.LittleEndian.Uint16(bs)
 	exe.Hdr.BytesInLastBlock = binary.LittleEndian.Uint16(bs[2:])
 	exe.Hdr.BlocksInFile = binary.LittleEndian.Uint16(bs[4:])
@@ -102,19 +158,37 @@ func ReadExe(bs []byte) (*Executable, error) {
 	exe.Hdr.ReloTableOffset = binary.LittleEndian.Uint16(bs[24:])
 	exe.Hdr.OverlayNumber = binary.LittleEndian.Uint16(bs[26:])
 
+	start := int(exe.Hdr.HeaderParagraphs) * 0x10
+	if start > len(bs) {
+		return nil, fmt.Errorf("%w: header of %d bytes is longer than the file", ErrBadExe, start)
+	}
+
 	// Seek to relo table
 	pos := int(exe.Hdr.ReloTableOffset)
+	if end := pos + int(exe.Hdr.NumRelos)*4; exe.Hdr.NumRelos > 0 && end > len(bs) {
+		return nil, fmt.Errorf("%w: %d relocations at 0x%X run past the end of the file", ErrBadExe, exe.Hdr.NumRelos, pos)
+	}
 
+	loadSize := exe.Hdr.LoadSize()
 	for i := 0; i < int(exe.Hdr.NumRelos); i++ {
 		var nr exeReloEntry
 		offoff := pos + (i * 4)
 		segoff := offoff + 2
 		nr.Offset = binary.LittleEndian.Uint16(bs[offoff:])
 		nr.Segment = binary.LittleEndian.Uint16(bs[segoff:])
+		// Each patches a word of the load module
+		if int(nr.Segment)*0x10+int(nr.Offset)+2 > loadSize {
+			return nil, fmt.Errorf("%w: relocation %d at %04X:%04X is outside the load module", ErrBadExe, i, nr.Segment, nr.Offset)
+		}
 		exe.Hdr.Relos = append(exe.Hdr.Relos, nr)
 	}
 
-	bin := bs[(exe.Hdr.HeaderParagraphs * 0x10):]
-	exe.Data = bin
+	// The load module ends where the header says the file does
+	end := start + loadSize
+	if end > len(bs) {
+		end = len(bs)
+	}
+	exe.Data = bs[start:end]
+	exe.Overlay = bs[end:]
 	return exe, nil
 }
@@ -0,0 +1,164 @@
+package dos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/cpu/cputest"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Builds an EXE with a 32 byte header, a load module of size bytes and
+// extra bytes after it.
+func testExe(size, extra int, minAlloc, maxAlloc uint16) []byte {
+	b := make([]byte, 32+size+extra)
+	copy(b, "MZ")
+	total := 32 + size
+	binary.LittleEndian.PutUint16(b[2:], uint16(total%512))
+	binary.LittleEndian.PutUint16(b[4:], uint16((total+511)/512))
+	binary.LittleEndian.PutUint16(b[8:], 2)
+	binary.LittleEndian.PutUint16(b[10:], minAlloc)
+	binary.LittleEndian.PutUint16(b[12:], maxAlloc)
+	binary.LittleEndian.PutUint16(b[24:], 0x1C)
+	for i := 32 + size; i < len(b); i++ {
+		b[i] = 0xEE
+	}
+	return b
+}
+
+func TestExeLoadSize(t *testing.T) {
+	exe, err := ReadExe(testExe(1000, 300, 0x100, 0xFFFF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe.Hdr.LoadSize() != 1000 || len(exe.Data) != 1000 {
+		t.Errorf("load size %d, data %d bytes, want 1000", exe.Hdr.LoadSize(), len(exe.Data))
+	}
+	// PSP, 63 paragraphs of program and the minimum extra
+	if got := exe.SegmentsNeeded(); got != 0x10+63+0x100 {
+		t.Errorf("SegmentsNeeded = %d", got)
+	}
+	if got := exe.SegmentsWanted(); got != 0x10+63+0xFFFF {
+		t.Errorf("SegmentsWanted = %d", got)
+	}
+	if exe.LoadsHigh() {
+		t.Error("loads high with extra memory")
+	}
+
+	// A last block of 0 means the whole of it is used
+	exe, _ = ReadExe(testExe(512-32, 0, 0, 0))
+	if exe.Hdr.BytesInLastBlock != 0 || exe.Hdr.LoadSize() != 480 {
+		t.Errorf("full last block: load size %d", exe.Hdr.LoadSize())
+	}
+	if !exe.LoadsHigh() || exe.SegmentsWanted() != 0x10000 {
+		t.Errorf("no extra memory: loads high %t, wants %d", exe.LoadsHigh(), exe.SegmentsWanted())
+	}
+
+	// A header claiming more than the file has loads what there is
+	b := testExe(100, 0, 0, 0)
+	binary.LittleEndian.PutUint16(b[4:], 10)
+	exe, _ = ReadExe(b)
+	if len(exe.Data) != 100 {
+		t.Errorf("short file: data %d bytes", len(exe.Data))
+	}
+}
+
+func TestReadExeBounds(t *testing.T) {
+	withRelos := func(n uint16, relos ...uint16) []byte {
+		b := testExe(0x40, 0, 0, 0xFFFF)
+		binary.LittleEndian.PutUint16(b[6:], n)
+		for i, v := range relos {
+			binary.LittleEndian.PutUint16(b[0x1C+i*2:], v)
+		}
+		return b
+	}
+	longHeader := testExe(0x40, 0, 0, 0xFFFF)
+	binary.LittleEndian.PutUint16(longHeader[8:], 0x100)
+	for _, tc := range []struct {
+		name string
+		b    []byte
+	}{
+		{"header cut off", []byte("MZ\x10\x00")},
+		{"header past the end", longHeader},
+		{"table past the end", withRelos(0x100)},
+		{"relocation past the load module", withRelos(1, 0x003F, 0)},
+		{"relocation segment past the load module", withRelos(1, 0, 0x0100)},
+	} {
+		if _, err := ReadExe(tc.b); !errors.Is(err, ErrBadExe) {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+	exe, err := ReadExe(withRelos(1, 0x003E, 0))
+	if err != nil || len(exe.Hdr.Relos) != 1 {
+		t.Errorf("last word: %v %v", exe, err)
+	}
+	// Too short to be an EXE, so a COM file
+	if exe, err := ReadExe([]byte("M")); err != nil || exe.Etype != COM {
+		t.Errorf("one byte: %v %v", exe, err)
+	}
+}
+
+func TestDosMemLargest(t *testing.T) {
+	m := NewDosMem(0x100, 0x1100)
+	if got := m.Largest(); got != 0x1000 {
+		t.Errorf("Largest = %04X, want 1000", got)
+	}
+	if _, err := m.Allocate(0x400); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Largest(); got != 0xC00 {
+		t.Errorf("Largest after allocating = %04X, want C00", got)
+	}
+}
+
+func loadTestExe(t *testing.T, b []byte) (*cputest.CPU, *Dos, uint16, error) {
+	t.Helper()
+	exe, err := ReadExe(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu := cputest.New()
+	d := NewDos(mu, 0x100, 0x9F00, console.New(strings.NewReader(""), io.Discard))
+	seg, err := d.Load(exe, `C:\DOOR.EXE`, nil)
+	return mu, d, seg, err
+}
+
+// With no extra memory asked for at all, the load module goes at the top
+// of the program's block.
+func TestLoadHigh(t *testing.T) {
+	b := testExe(100, 0, 0, 0)
+	for i := 32; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+	binary.LittleEndian.PutUint16(b[14:], 2) // SS
+	binary.LittleEndian.PutUint16(b[22:], 1) // CS
+	mu, d, seg, err := loadTestExe(t, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, ok := d.Mem.FindBlock(int(seg))
+	if !ok {
+		t.Fatalf("no block at %04X", seg)
+	}
+	// 100 bytes take 7 paragraphs
+	top := uint64(d.Mem.Blocks[i].End - 7)
+	if cs, ss, ds := mu.Reg(uc.X86_REG_CS), mu.Reg(uc.X86_REG_SS), mu.Reg(uc.X86_REG_DS); cs != top+1 || ss != top+2 || ds != uint64(seg) {
+		t.Errorf("CS=%04X SS=%04X DS=%04X, want CS=%04X SS=%04X DS=%04X", cs, ss, ds, top+1, top+2, seg)
+	}
+	if got := mu.Mem[top*16 : top*16+100]; !bytes.Equal(got, b[32:]) {
+		t.Errorf("load module at %04X:0000 is % X", top, got)
+	}
+}
+
+func TestLoadInsufficientMemory(t *testing.T) {
+	// More than the 9E00h paragraphs there are
+	_, _, _, err := loadTestExe(t, testExe(100, 0, 0xF000, 0xFFFF))
+	if !errors.Is(err, ErrInsufficientMemory) || dosErrno(err, 0) != errInsufficientMemory {
+		t.Errorf("got %v, DOS error %02Xh", err, dosErrno(err, 0))
+	}
+}
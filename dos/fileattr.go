@@ -0,0 +1,81 @@
+package dos
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// DOS file attribute bits.
+const (
+	AttrReadOnly  = 0x01
+	AttrHidden    = 0x02
+	AttrSystem    = 0x04
+	AttrVolume    = 0x08
+	AttrDirectory = 0x10
+	AttrArchive   = 0x20
+)
+
+// Returns the DOS attributes for a host file.  Read-only comes from the
+// owner write bit and dot files are reported as hidden.  Hosts don't track
+// the archive bit, so every regular file claims to need backing up.
+func fileAttributes(fi os.FileInfo) uint16 {
+	var attr uint16
+	if fi.IsDir() {
+		attr |= AttrDirectory
+	} else {
+		attr |= AttrArchive
+	}
+	if fi.Mode().Perm()&0200 == 0 {
+		attr |= AttrReadOnly
+	}
+	if strings.HasPrefix(fi.Name(), ".") {
+		attr |= AttrHidden
+	}
+	return attr
+}
+
+// Applies DOS attributes to a host file.  Only read-only maps onto the
+// host permissions; hidden, system and archive are accepted and dropped.
+func setFileAttributes(path string, fi os.FileInfo, attr uint16) error {
+	if attr&(AttrVolume|AttrDirectory) != 0 || fi.IsDir() {
+		return os.ErrPermission
+	}
+	perm := fi.Mode().Perm()
+	if attr&AttrReadOnly != 0 {
+		perm &^= 0222
+	} else {
+		perm |= 0200
+	}
+	if perm == fi.Mode().Perm() {
+		return nil
+	}
+	return os.Chmod(path, perm)
+}
+
+// PackDosTime converts t to the packed DOS date and time words.  DOS keeps
+// local time with two second resolution for years 1980 through 2107, times
+// outside of that range are clamped.
+//
+//	date: bits 15-9 year-1980, 8-5 month, 4-0 day
+//	time: bits 15-11 hour, 10-5 minute, 4-0 seconds/2
+func PackDosTime(t time.Time) (date, tm uint16) {
+	t = t.Local()
+	year := t.Year()
+	switch {
+	case year < 1980:
+		return 0<<9 | 1<<5 | 1, 0
+	case year > 2107:
+		return 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29
+	}
+	date = uint16(year-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+// UnpackDosTime converts packed DOS date and time words to a local time.
+func UnpackDosTime(date, tm uint16) time.Time {
+	return time.Date(
+		int(date>>9)+1980, time.Month((date>>5)&0x0F), int(date&0x1F),
+		int(tm>>11), int((tm>>5)&0x3F), int(tm&0x1F)*2, 0, time.Local)
+}
@@ -0,0 +1,238 @@
+package dos
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalidDrive = errors.New("invalid drive")
+	ErrPathNotFound = errors.New("path not found")
+)
+
+// A Drive maps a DOS drive letter onto a directory on the host.
+type Drive struct {
+	Root string
+	// Current directory on this drive, DOS style without the drive or
+	// leading backslash, e.g. `DOORS\LORD`
+	Cwd string
+	// Reported to the guest as a network drive.  Multi-node doors check
+	// this before turning on record locking.
+	Remote bool
+	// Reported to the guest as removable media
+	Removable bool
+}
+
+// FileSystem resolves DOS paths against the mounted drives.  Every call
+// that takes a filename from the guest goes through here so that the
+// guest never sees host paths.
+type FileSystem struct {
+	drives [26]*Drive
+	// Current drive number, 0 == A:
+	Current int
+}
+
+func NewFileSystem() *FileSystem {
+	return &FileSystem{Current: 2}
+}
+
+func driveNumber(letter byte) (int, bool) {
+	if letter >= 'a' && letter <= 'z' {
+		letter -= 'a' - 'A'
+	}
+	if letter < 'A' || letter > 'Z' {
+		return -1, false
+	}
+	return int(letter - 'A'), true
+}
+
+// Mounts the host directory root as the drive letter.
+func (fs *FileSystem) Mount(letter byte, root string) error {
+	n, ok := driveNumber(letter)
+	if !ok {
+		return fmt.Errorf("invalid drive letter: '%c'", letter)
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("not a directory: '%s'", abs)
+	}
+	fs.drives[n] = &Drive{Root: abs, Remote: isRemote(abs)}
+	return nil
+}
+
+// Returns the drive for drive number n (0 == A:) if it is mounted.
+func (fs *FileSystem) Drive(n int) (*Drive, bool) {
+	if n < 0 || n >= len(fs.drives) || fs.drives[n] == nil {
+		return nil, false
+	}
+	return fs.drives[n], true
+}
+
+// Returns the drive for an IOCTL drive number, where 0 is the current drive
+// and 1 is A:.
+func (fs *FileSystem) ioctlDrive(bl uint8) (*Drive, error) {
+	n := fs.Current
+	if bl != 0 {
+		n = int(bl) - 1
+	}
+	d, ok := fs.Drive(n)
+	if !ok {
+		return nil, ErrInvalidDrive
+	}
+	return d, nil
+}
+
+// FullPath splits a DOS path into its drive number and the components
+// from the root of that drive.  Relative paths are made absolute using the
+// current directory of the drive, and "." and ".." are resolved without
+// ever going above the root.
+func (fs *FileSystem) FullPath(dospath string) (int, []string, error) {
+	p := strings.ReplaceAll(dospath, "/", `\`)
+	drive := fs.Current
+	if len(p) >= 2 && p[1] == ':' {
+		n, ok := driveNumber(p[0])
+		if !ok {
+			return 0, nil, ErrInvalidDrive
+		}
+		drive = n
+		p = p[2:]
+	}
+	d, ok := fs.Drive(drive)
+	if !ok {
+		return 0, nil, ErrInvalidDrive
+	}
+	var parts []string
+	if !strings.HasPrefix(p, `\`) {
+		p = d.Cwd + `\` + p
+	}
+	for _, c := range strings.Split(p, `\`) {
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(parts) > 0 {
+				parts = parts[:len(parts)-1]
+			}
+		default:
+			parts = append(parts, c)
+		}
+	}
+	return drive, parts, nil
+}
+
+// Canonical returns the fully qualified, upper cased DOS form of dospath,
+// e.g. `C:\DOORS\LORD.EXE`.
+func (fs *FileSystem) Canonical(dospath string) (string, error) {
+	drive, parts, err := fs.FullPath(dospath)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(fmt.Sprintf("%c:\\%s", 'A'+drive, strings.Join(parts, `\`))), nil
+}
+
+// DosPath maps a host path to the fully qualified DOS path it is seen as,
+// using the drive with the most specific root when drives overlap.
+// Returns ErrPathNotFound when no drive holds it.
+func (fs *FileSystem) DosPath(host string) (string, error) {
+	abs, err := filepath.Abs(host)
+	if err != nil {
+		return "", err
+	}
+	best, rel := -1, ""
+	for n, d := range fs.drives {
+		if d == nil || (best >= 0 && len(d.Root) <= len(fs.drives[best].Root)) {
+			continue
+		}
+		r, err := filepath.Rel(d.Root, abs)
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			continue
+		}
+		best, rel = n, r
+	}
+	if best < 0 {
+		return "", ErrPathNotFound
+	}
+	if rel == "." {
+		rel = ""
+	}
+	return strings.ToUpper(fmt.Sprintf("%c:\\%s", 'A'+best, strings.ReplaceAll(rel, string(filepath.Separator), `\`))), nil
+}
+
+// ProgramPath returns the DOS path of the program at host, mounting its
+// directory on the first free drive from D: when no drive holds it.  Doors
+// open their own EXE to read overlays and data appended to it.
+func (fs *FileSystem) ProgramPath(host string) (string, error) {
+	if p, err := fs.DosPath(host); err == nil {
+		return p, nil
+	}
+	for letter := byte('D'); letter <= 'Z'; letter++ {
+		if _, ok := fs.Drive(int(letter - 'A')); ok {
+			continue
+		}
+		if err := fs.Mount(letter, filepath.Dir(host)); err != nil {
+			return "", err
+		}
+		return fs.DosPath(host)
+	}
+	return "", fmt.Errorf("no free drive for '%s'", host)
+}
+
+// Resolve maps a DOS path to a host path.  Every directory leading up to
+// the last component must exist, otherwise ErrPathNotFound is returned.
+// Components are matched case-insensitively against the host; a last
+// component that does not exist yet is used as given so it may be created.
+func (fs *FileSystem) Resolve(dospath string) (string, error) {
+	drive, parts, err := fs.FullPath(dospath)
+	if err != nil {
+		return "", err
+	}
+	host := fs.drives[drive].Root
+	for i, part := range parts {
+		last := i == len(parts)-1
+		name, err := lookupName(host, part)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+			if !last {
+				return "", ErrPathNotFound
+			}
+			name = part
+		}
+		host = filepath.Join(host, name)
+		if !last {
+			if fi, err := os.Stat(host); err != nil || !fi.IsDir() {
+				return "", ErrPathNotFound
+			}
+		}
+	}
+	return host, nil
+}
+
+// Finds the entry in the host directory dir matching name ignoring case,
+// preferring an exact match.
+func lookupName(dir, name string) (string, error) {
+	if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+		return name, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), name) {
+			return e.Name(), nil
+		}
+	}
+	return "", os.ErrNotExist
+}
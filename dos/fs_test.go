@@ -0,0 +1,139 @@
+package dos
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFileSystem(t *testing.T) (*FileSystem, string) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "Doors", "lord"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "Doors", "lord", "Lord.Dat"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFileSystem()
+	if err := fs.Mount('C', root); err != nil {
+		t.Fatal(err)
+	}
+	return fs, root
+}
+
+func TestResolve(t *testing.T) {
+	fs, root := newTestFileSystem(t)
+	fs.drives[2].Cwd = `DOORS`
+
+	tests := []struct {
+		dos  string
+		host string
+	}{
+		{`C:\DOORS\LORD\LORD.DAT`, filepath.Join(root, "Doors", "lord", "Lord.Dat")},
+		{`c:/doors/lord/lord.dat`, filepath.Join(root, "Doors", "lord", "Lord.Dat")},
+		{`LORD\LORD.DAT`, filepath.Join(root, "Doors", "lord", "Lord.Dat")},
+		{`\DOORS\LORD\NEW.DAT`, filepath.Join(root, "Doors", "lord", "NEW.DAT")},
+		{`..\..\..\DOORS\.\LORD`, filepath.Join(root, "Doors", "lord")},
+	}
+	for _, tc := range tests {
+		got, err := fs.Resolve(tc.dos)
+		if err != nil {
+			t.Errorf("Resolve(%q): %v", tc.dos, err)
+			continue
+		}
+		if got != tc.host {
+			t.Errorf("Resolve(%q) = %q, want %q", tc.dos, got, tc.host)
+		}
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	fs, _ := newTestFileSystem(t)
+	if _, err := fs.Resolve(`C:\MISSING\LORD.DAT`); !errors.Is(err, ErrPathNotFound) {
+		t.Errorf("expected ErrPathNotFound, got %v", err)
+	}
+	if _, err := fs.Resolve(`C:\DOORS\LORD\LORD.DAT\X`); !errors.Is(err, ErrPathNotFound) {
+		t.Errorf("expected ErrPathNotFound through a file, got %v", err)
+	}
+	if _, err := fs.Resolve(`Q:\LORD.DAT`); !errors.Is(err, ErrInvalidDrive) {
+		t.Errorf("expected ErrInvalidDrive, got %v", err)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	fs, _ := newTestFileSystem(t)
+	fs.drives[2].Cwd = `DOORS`
+	got, err := fs.Canonical(`lord\..\lord.exe`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `C:\DOORS\LORD.EXE`; got != want {
+		t.Errorf("Canonical = %q, want %q", got, want)
+	}
+}
+
+func TestDosPath(t *testing.T) {
+	fs, root := newTestFileSystem(t)
+	if err := fs.Mount('D', filepath.Join(root, "Doors")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		host, dos string
+	}{
+		{root, `C:\`},
+		{filepath.Join(root, "Top.exe"), `C:\TOP.EXE`},
+		// The most specific drive wins
+		{filepath.Join(root, "Doors", "lord", "Lord.exe"), `D:\LORD\LORD.EXE`},
+	} {
+		got, err := fs.DosPath(tc.host)
+		if err != nil || got != tc.dos {
+			t.Errorf("DosPath(%q) = %q, %v, want %q", tc.host, got, err, tc.dos)
+		}
+	}
+	if _, err := fs.DosPath(filepath.Dir(root)); !errors.Is(err, ErrPathNotFound) {
+		t.Errorf("expected ErrPathNotFound outside the drives, got %v", err)
+	}
+}
+
+func TestDosTimeRoundTrip(t *testing.T) {
+	want := time.Date(1994, time.March, 17, 23, 41, 58, 0, time.Local)
+	date, tm := PackDosTime(want)
+	if date != (14<<9 | 3<<5 | 17) {
+		t.Errorf("date = 0x%04X", date)
+	}
+	if tm != (23<<11 | 41<<5 | 29) {
+		t.Errorf("time = 0x%04X", tm)
+	}
+	if got := UnpackDosTime(date, tm); !got.Equal(want) {
+		t.Errorf("UnpackDosTime = %v, want %v", got, want)
+	}
+	// Odd seconds are rounded down to the two second resolution.
+	if _, tm := PackDosTime(want.Add(time.Second)); tm&0x1F != 29 {
+		t.Errorf("seconds = %d", tm&0x1F)
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	tests := []struct {
+		path string
+		dev  string
+	}{
+		{`CON`, "CON"},
+		{`nul.txt`, "NUL"},
+		{`C:\TEMP\NUL`, "NUL"},
+		{`c:lpt1`, "LPT1"},
+		{`COM4.`, "COM4"},
+		{`clock$`, "CLOCK$"},
+		{`CONFIG.SYS`, ""},
+		{`COM5`, ""},
+		{`C:\NUL\FILE.TXT`, ""},
+	}
+	for _, tc := range tests {
+		dev, ok := deviceName(tc.path)
+		if ok != (tc.dev != "") || dev != tc.dev {
+			t.Errorf("deviceName(%q) = %q, %t; want %q", tc.path, dev, ok, tc.dev)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package dos
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Compiler is the language runtime a program was built with, found by the
+// copyright and error strings its library leaves in the load module.
+type Compiler struct {
+	Name string `json:"name"`
+	// The string it was found by, which often has the version or year
+	Marker string `json:"marker"`
+}
+
+// Strings each runtime's library carries, in the order they're tried.
+// QuickBASIC programs also carry Microsoft's C runtime, so come first.
+var compilerMarkers = []struct {
+	name    string
+	markers []string
+}{
+	{"QuickBASIC", []string{"QuickBASIC", "BRUN45.EXE", "BRUN40.EXE", "BRUN30.EXE"}},
+	{"Turbo Pascal", []string{"Portions Copyright (c) 1983"}},
+	{"Borland C", []string{"Borland C++ - Copyright", "Turbo C++ - Copyright", "Turbo-C - Copyright", "Turbo C - Copyright"}},
+	{"Microsoft C", []string{"MS Run-Time Library - Copyright", "Microsoft C"}},
+}
+
+// DetectCompiler looks for the runtime library of a known compiler in the
+// load module image.  The Name is empty when none is found.
+func DetectCompiler(image []byte) Compiler {
+	for _, c := range compilerMarkers {
+		for _, m := range c.markers {
+			if i := bytes.Index(image, []byte(m)); i >= 0 {
+				return Compiler{Name: c.name, Marker: printableAt(image, i)}
+			}
+		}
+	}
+	return Compiler{}
+}
+
+// Returns the printable text starting at i, up to 80 characters.
+func printableAt(b []byte, i int) string {
+	end := i
+	for end < len(b) && end-i < 80 && b[end] >= ' ' && b[end] < 0x7F {
+		end++
+	}
+	return string(b[i:end])
+}
+
+// ExeInfo describes an executable file, for looking into why a door
+// fails.  Sizes are in bytes, memory in paragraphs.
+type ExeInfo struct {
+	Type     string `json:"type"`
+	FileSize int    `json:"file_size"`
+	// The MZ header, for EXE files
+	Header      *ExeHeader `json:"header,omitempty"`
+	HeaderSize  int        `json:"header_size"`
+	LoadSize    int        `json:"load_size"`
+	OverlaySize int        `json:"overlay_size"`
+	// Relocations as SSSS:OOOO, relative to the load module
+	Relocations []string `json:"relocations,omitempty"`
+	// CS:IP and SS:SP, relative to the load module, or the PSP for COM
+	// files
+	Entry string `json:"entry"`
+	Stack string `json:"stack"`
+	// Memory DOS gives the program, with its PSP: at least MemoryNeeded
+	// and up to MemoryWanted when there is that much free
+	MemoryNeeded int      `json:"memory_needed"`
+	MemoryWanted int      `json:"memory_wanted"`
+	LoadsHigh    bool     `json:"loads_high"`
+	Packer       string   `json:"packer,omitempty"`
+	Compiler     Compiler `json:"compiler"`
+	// Whether the compiler was found by unpacking the program first
+	Unpacked bool `json:"unpacked,omitempty"`
+}
+
+// DescribeExe reads the executable file b, unpacking it to find its
+// compiler when it is packed with LZEXE or PKLITE.
+func DescribeExe(b []byte) (*ExeInfo, error) {
+	exe, err := ReadExe(b)
+	if err != nil {
+		return nil, err
+	}
+	info := &ExeInfo{
+		Type:         "COM",
+		FileSize:     len(b),
+		LoadSize:     len(exe.Data),
+		Entry:        "PSP:0100",
+		Stack:        "PSP:FFFE",
+		MemoryNeeded: exe.SegmentsNeeded(),
+		MemoryWanted: exe.SegmentsWanted(),
+	}
+	if exe.Etype == EXE {
+		h := exe.Hdr
+		info.Type = "EXE"
+		info.Header = &h
+		info.HeaderSize = int(h.HeaderParagraphs) * 0x10
+		info.LoadSize = h.LoadSize()
+		info.OverlaySize = len(exe.Overlay)
+		for _, r := range h.Relos {
+			info.Relocations = append(info.Relocations, fmt.Sprintf("%04X:%04X", r.Segment, r.Offset))
+		}
+		info.Entry = fmt.Sprintf("%04X:%04X", h.CS, h.IP)
+		info.Stack = fmt.Sprintf("%04X:%04X", h.SS, h.SP)
+		info.LoadsHigh = exe.LoadsHigh()
+	}
+	image := exe.Data
+	if pack := DetectPacker(b); pack.Packer != NotPacked {
+		info.Packer = pack.String()
+		if unpacked, _, err := Unpack(b); err == nil {
+			if orig, err := ReadExe(unpacked); err == nil {
+				image = orig.Data
+				info.Unpacked = true
+			}
+		}
+	}
+	info.Compiler = DetectCompiler(image)
+	return info, nil
+}
@@ -0,0 +1,50 @@
+package dos
+
+import (
+	"testing"
+)
+
+func TestDetectCompiler(t *testing.T) {
+	for _, tc := range []struct {
+		image, name, marker string
+	}{
+		{"\x00Portions Copyright (c) 1983,92 Borland\x00Runtime error ", "Turbo Pascal", "Portions Copyright (c) 1983,92 Borland"},
+		{"\x90Borland C++ - Copyright 1991 Borland Intl.\x00", "Borland C", "Borland C++ - Copyright 1991 Borland Intl."},
+		{"MS Run-Time Library - Copyright (c) 1988, Microsoft Corp\x00", "Microsoft C", "MS Run-Time Library - Copyright (c) 1988, Microsoft Corp"},
+		{"MS Run-Time Library - Copyright\x00BRUN45.EXE\x00", "QuickBASIC", "BRUN45.EXE"},
+		{"\xb4\x4c\xcd\x21", "", ""},
+	} {
+		if c := DetectCompiler([]byte(tc.image)); c.Name != tc.name || c.Marker != tc.marker {
+			t.Errorf("%q: got %+v", tc.image, c)
+		}
+	}
+}
+
+func TestDescribeExe(t *testing.T) {
+	image := append(testImage(), "Turbo C++ - Copyright 1990 Borland Intl."...)
+	relocs := []exeReloEntry{{Offset: 0x0003, Segment: 0x0010}}
+	packed := lzexePack(image, relocs, ExeHeader{SS: 0x0500, SP: 0x0400, CS: 0x0002, IP: 0x0010}, "LZ91")
+	info, err := DescribeExe(append(packed, "overlay"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != "EXE" || info.Packer != "LZEXE 0.91" || info.OverlaySize != 7 {
+		t.Errorf("got %+v", info)
+	}
+	// The compiler is found in the unpacked program, the rest describes
+	// the file as it is
+	if info.Compiler.Name != "Borland C" || !info.Unpacked {
+		t.Errorf("compiler %+v, unpacked %v", info.Compiler, info.Unpacked)
+	}
+	if info.Entry == "0002:0010" || len(info.Relocations) != 0 {
+		t.Errorf("entry %s, relocations %v", info.Entry, info.Relocations)
+	}
+
+	info, err = DescribeExe(testExe(0x100, 0, 0x20, 0x40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LoadSize != 0x100 || info.MemoryNeeded != 0x10+0x10+0x20 || info.MemoryWanted != 0x10+0x10+0x40 || info.Compiler.Name != "" {
+		t.Errorf("got %+v", info)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build unix && !linux
+
+package dos
+
+import "syscall"
+
+// Classic fcntl locks belong to the process, so they only coordinate
+// between separate ivdoor processes.
+const (
+	fcntlGetLock     = syscall.F_GETLK
+	fcntlSetLock     = syscall.F_SETLK
+	fcntlSetLockWait = syscall.F_SETLKW
+)
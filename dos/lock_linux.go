@@ -0,0 +1,11 @@
+package dos
+
+// Linux has open file description locks, which conflict between two
+// handles on the same file inside one process and aren't dropped when an
+// unrelated descriptor for the file is closed.  That makes handles behave
+// the same whether the other node is this process or another ivdoor.
+const (
+	fcntlGetLock     = 36 // F_OFD_GETLK
+	fcntlSetLock     = 37 // F_OFD_SETLK
+	fcntlSetLockWait = 38 // F_OFD_SETLKW
+)
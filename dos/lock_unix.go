@@ -0,0 +1,69 @@
+//go:build unix
+
+package dos
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+type lockType int16
+
+const (
+	lockShared    = lockType(syscall.F_RDLCK)
+	lockExclusive = lockType(syscall.F_WRLCK)
+	lockNone      = lockType(syscall.F_UNLCK)
+)
+
+// Places a non-blocking advisory lock on a byte range of f, returning
+// ErrLockViolation if another handle holds a conflicting lock.  An
+// exclusive lock needs a writable descriptor and fails with errNotWritable
+// on files the host only lets us read, and a shared lock fails with
+// errNotReadable on files it only lets us write.
+func setLock(f *os.File, typ lockType, start, length int64) error {
+	return fcntlLock(f, fcntlSetLock, typ, start, length)
+}
+
+// Like setLock, but waits for conflicting locks to be released.
+func waitLock(f *os.File, typ lockType, start, length int64) error {
+	return fcntlLock(f, fcntlSetLockWait, typ, start, length)
+}
+
+func fcntlLock(f *os.File, cmd int, typ lockType, start, length int64) error {
+	lk := syscall.Flock_t{
+		Type:   int16(typ),
+		Whence: io.SeekStart,
+		Start:  start,
+		Len:    length,
+	}
+	err := syscall.FcntlFlock(f.Fd(), cmd, &lk)
+	switch {
+	case errors.Is(err, syscall.EBADF) && typ == lockExclusive:
+		return &dosError{errAccessDenied, errNotWritable}
+	case errors.Is(err, syscall.EBADF) && typ == lockShared:
+		return &dosError{errAccessDenied, errNotReadable}
+	case errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES):
+		return ErrLockViolation
+	}
+	return err
+}
+
+// Reports whether another handle holds a lock on the byte range that
+// conflicts with reading, or with writing when write is set.
+func testLock(f *os.File, write bool, start, length int64) (bool, error) {
+	lk := syscall.Flock_t{
+		Type:   int16(lockShared),
+		Whence: io.SeekStart,
+		Start:  start,
+		Len:    length,
+	}
+	if write {
+		lk.Type = int16(lockExclusive)
+	}
+	if err := syscall.FcntlFlock(f.Fd(), fcntlGetLock, &lk); err != nil {
+		return false, err
+	}
+	return lk.Type != int16(lockNone), nil
+}
@@ -5,6 +5,8 @@ import (
 	"time"
 )
 
+// NullFile is the NUL device, which discards output and is always at end
+// of file.
 type NullFile struct {
 }
 
@@ -62,9 +64,25 @@ func (m fileInfo) Sys() interface{} {
 }
 
 func (m *NullFile) Write(p []byte) (n int, err error) {
-	return 0, nil
+	return len(p), nil
 }
 
 func (m *NullFile) Truncate(size int64) error {
 	return nil
 }
+
+func (m *NullFile) Info() uint16 {
+	return devChar | devNul
+}
+
+func (m *NullFile) SetInfo(info uint16) error {
+	return nil
+}
+
+func (m *NullFile) InputReady() bool {
+	return false
+}
+
+func (m *NullFile) OutputReady() bool {
+	return true
+}
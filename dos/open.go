@@ -0,0 +1,173 @@
+package dos
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// What INT 21h 6Ch does when the file exists (low nibble of DL) or is
+// missing (high nibble).  3Ch and 3Dh are expressed with the same values.
+const (
+	ifExistsFail    = 0x00
+	ifExistsOpen    = 0x01
+	ifExistsReplace = 0x02
+	ifMissingFail   = 0x00
+	ifMissingCreate = 0x01
+)
+
+// Action taken by INT 21h 6Ch, returned in CX.
+const (
+	actionOpened   = 1
+	actionCreated  = 2
+	actionReplaced = 3
+)
+
+// Set in the open mode when the handle is private to this process.
+const openNoInherit = 0x80
+
+// Reserved DOS device names.
+var dosDevices = []string{
+	"CON", "NUL", "PRN", "AUX", "CLOCK$",
+	"COM1", "COM2", "COM3", "COM4",
+	"LPT1", "LPT2", "LPT3",
+}
+
+// Returns the device named by the last component of a DOS path.  DOS finds
+// devices in every directory and ignores any extension, so `C:\TEMP\NUL`
+// and `NUL.TXT` are both NUL.
+func deviceName(dospath string) (string, bool) {
+	p := dospath
+	if i := strings.LastIndexAny(p, `\/:`); i >= 0 {
+		p = p[i+1:]
+	}
+	if i := strings.IndexByte(p, '.'); i >= 0 {
+		p = p[:i]
+	}
+	p = strings.ToUpper(strings.TrimRight(p, " "))
+	for _, dev := range dosDevices {
+		if p == dev {
+			return dev, true
+		}
+	}
+	return "", false
+}
+
+// Returns the host flags matching the DOS access mode, which files are
+// opened with when the host won't open them read/write.
+func dosFileModeToGo(access uint8) (int, os.FileMode) {
+	switch access {
+	case accessRead:
+		return os.O_RDONLY, 0644
+	case accessWrite:
+		return os.O_WRONLY, 0644
+	default:
+		return os.O_RDWR, 0644
+	}
+}
+
+// Opens or creates filename with the DOS open mode for INT 21h 3Ch, 3Dh
+// and 6Ch and returns the new handle along with the action taken.  attr is
+// applied to files that get created.
+func (d *Dos) openFile(filename string, mode uint8, attr uint16, ifExists, ifMissing uint8) (int, int, error) {
+	access := mode & 0x07
+	if access > accessReadWrite {
+		return 0, 0, &dosError{errInvalidAccessCode, fmt.Errorf("invalid access mode: 0x%02X", mode)}
+	}
+	handle, err := d.GetNextFreeHandle()
+	if err != nil {
+		return 0, 0, &dosError{errTooManyOpenFiles, err}
+	}
+	// Resolve even for devices, `IF EXIST C:\DIR\NUL` relies on a missing
+	// directory failing.
+	path, err := d.FS.Resolve(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	noInherit := mode&openNoInherit != 0
+
+	if name, ok := deviceName(filename); ok {
+		d.files[handle] = &DosFile{Name: name, Dev: d.devices[name], access: access, noInherit: noInherit}
+		return handle, actionOpened, nil
+	}
+
+	action := actionOpened
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if fi.IsDir() {
+			return 0, 0, &dosError{errAccessDenied, fmt.Errorf("'%s' is a directory", filename)}
+		}
+		switch ifExists {
+		case ifExistsOpen:
+		case ifExistsReplace:
+			action = actionReplaced
+		default:
+			return 0, 0, &dosError{errFileExists, fmt.Errorf("'%s' exists", filename)}
+		}
+		// Checked here rather than left to the host, which lets root
+		// write anything.
+		if (access != accessRead || action == actionReplaced) && fi.Mode().Perm()&0200 == 0 {
+			return 0, 0, &dosError{errAccessDenied, fmt.Errorf("'%s' is read-only", filename)}
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if ifMissing != ifMissingCreate {
+			return 0, 0, &dosError{errFileNotFound, fmt.Errorf("'%s' not found", filename)}
+		}
+		if attr&(AttrVolume|AttrDirectory) != 0 {
+			return 0, 0, &dosError{errAccessDenied, fmt.Errorf("can't create with attributes 0x%02X", attr)}
+		}
+		action = actionCreated
+	default:
+		return 0, 0, err
+	}
+
+	flag, perm := dosFileModeToGo(access)
+	if action == actionCreated {
+		flag |= os.O_CREATE
+	}
+	// Files are opened read/write when the host allows it so that exclusive
+	// locks can be placed on them; the handle still refuses reads or writes
+	// its access mode doesn't allow.
+	f, err := os.OpenFile(path, flag&^(os.O_RDONLY|os.O_WRONLY)|os.O_RDWR, perm)
+	if err != nil && access != accessReadWrite && !errors.Is(err, os.ErrNotExist) {
+		f, err = os.OpenFile(path, flag, perm)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	// Truncate only once we know no other node denies writing.
+	if err := acquireShare(f, access, dosShareMode(mode)); err != nil {
+		f.Close()
+		return 0, 0, err
+	}
+	if action == actionReplaced {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return 0, 0, err
+		}
+	}
+	if action == actionCreated && attr&AttrReadOnly != 0 {
+		// The handle stays writable, only later opens see the attribute.
+		if fi, err := f.Stat(); err == nil {
+			if err := setFileAttributes(path, fi, attr); err != nil {
+				glog.Warningf("Error setting attributes on '%s': '%s'", path, err)
+			}
+		}
+	}
+
+	drive, _, _ := d.FS.FullPath(filename)
+	dr, _ := d.FS.Drive(drive)
+	d.files[handle] = &DosFile{
+		Name:      filename,
+		Dir:       "",
+		Path:      path,
+		Dev:       NewHostFile(f, drive, dr.Remote),
+		access:    access,
+		noInherit: noInherit,
+	}
+	return handle, action, nil
+}
@@ -0,0 +1,173 @@
+package dos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/cpu"
+	"door86.org/ivdoor/cpu/cputest"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Calls INT 21h with the registers set, returning whether it failed.
+func int21(t *testing.T, d *Dos, mu *cputest.CPU, regs map[int]uint64) bool {
+	t.Helper()
+	mu.SetRegs(regs)
+	d.Int21(mu, 0x21)
+	return mu.Carry()
+}
+
+func TestReadExeOverlay(t *testing.T) {
+	exe, err := ReadExe(testExe(100, 50, 0, 0xFFFF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exe.Data) != 100 || !bytes.Equal(exe.Overlay, bytes.Repeat([]byte{0xEE}, 50)) {
+		t.Errorf("data %d bytes, overlay %q", len(exe.Data), exe.Overlay)
+	}
+}
+
+func TestProgramPath(t *testing.T) {
+	fs, root := newTestFileSystem(t)
+	if p, err := fs.ProgramPath(filepath.Join(root, "Doors", "lord", "Lord.exe")); err != nil || p != `C:\DOORS\LORD\LORD.EXE` {
+		t.Errorf("on C: got %q, %v", p, err)
+	}
+	// Programs elsewhere get a drive of their own
+	other := t.TempDir()
+	if p, err := fs.ProgramPath(filepath.Join(other, "Door.exe")); err != nil || p != `D:\DOOR.EXE` {
+		t.Errorf("elsewhere got %q, %v", p, err)
+	}
+}
+
+// A door in the style of a Borland overlay manager: it finds its own EXE,
+// reads the overlay appended to it, then has DOS load a separate overlay
+// file with INT 21h 4B03h.
+func TestOverlays(t *testing.T) {
+	fs, root := newTestFileSystem(t)
+	appended := []byte("FBOV overlay data")
+	door := append(testExe(64, 0, 0, 0xFFFF), appended...)
+	if err := os.WriteFile(filepath.Join(root, "Door.exe"), door, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// JMP FAR 0005:0000 with the segment relocated, followed by data in
+	// the file past the load module which isn't loaded
+	ovl := testExe(5, 0, 0, 0)
+	copy(ovl[32:], "\xEA\x00\x00\x05\x00")
+	binary.LittleEndian.PutUint16(ovl[6:], 1)
+	binary.LittleEndian.PutUint16(ovl[0x1C:], 3)
+	ovl = append(ovl, "not loaded"...)
+	if err := os.WriteFile(filepath.Join(root, "DOOR.OVL"), ovl, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mu := cputest.New()
+	d := NewDos(mu, 0x100, 0x9F00, console.New(strings.NewReader(""), io.Discard))
+	d.FS = fs
+	self, err := fs.ProgramPath(filepath.Join(root, "Door.exe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Open itself, seek past the load module and read the overlay
+	const ds = 0x1000
+	copy(mu.Mem[ds*16:], self+"\x00")
+	if int21(t, d, mu, map[int]uint64{uc.X86_REG_AX: 0x3D00, uc.X86_REG_DS: ds, uc.X86_REG_DX: 0}) {
+		t.Fatalf("opening '%s' failed: %02X", self, mu.Reg(uc.X86_REG_AX))
+	}
+	handle := mu.Reg(uc.X86_REG_AX)
+	if int21(t, d, mu, map[int]uint64{uc.X86_REG_AX: 0x4200, uc.X86_REG_BX: handle, uc.X86_REG_CX: 0, uc.X86_REG_DX: 32 + 64}) {
+		t.Fatal("seek failed")
+	}
+	if int21(t, d, mu, map[int]uint64{uc.X86_REG_AX: 0x3F00, uc.X86_REG_BX: handle, uc.X86_REG_CX: 100, uc.X86_REG_DS: ds, uc.X86_REG_DX: 0x100}) {
+		t.Fatal("read failed")
+	}
+	if n := mu.Reg(uc.X86_REG_AX); string(mu.Mem[ds*16+0x100:ds*16+0x100+n]) != string(appended) {
+		t.Errorf("read %q from its own EXE", mu.Mem[ds*16+0x100:ds*16+0x100+n])
+	}
+
+	// Load the overlay file at 2000h relocated for 3000h
+	copy(mu.Mem[ds*16:], "DOOR.OVL\x00")
+	binary.LittleEndian.PutUint16(mu.Mem[ds*16+0x20:], 0x2000)
+	binary.LittleEndian.PutUint16(mu.Mem[ds*16+0x22:], 0x3000)
+	if int21(t, d, mu, map[int]uint64{uc.X86_REG_AX: 0x4B03, uc.X86_REG_DS: ds, uc.X86_REG_DX: 0, uc.X86_REG_ES: ds, uc.X86_REG_BX: 0x20}) {
+		t.Fatalf("load overlay failed: %02X", mu.Reg(uc.X86_REG_AX))
+	}
+	if got := mu.Mem[0x20000 : 0x20000+16]; string(got) != "\xEA\x00\x00\x05\x30"+strings.Repeat("\x00", 11) {
+		t.Errorf("overlay in memory: % X", got)
+	}
+
+	// An MZ header that is cut off isn't a program
+	if err := os.WriteFile(filepath.Join(root, "CUT.OVL"), ovl[:20], 0644); err != nil {
+		t.Fatal(err)
+	}
+	copy(mu.Mem[ds*16:], "CUT.OVL\x00")
+	if !int21(t, d, mu, map[int]uint64{uc.X86_REG_AX: 0x4B03, uc.X86_REG_DS: ds, uc.X86_REG_DX: 0, uc.X86_REG_ES: ds, uc.X86_REG_BX: 0x20}) ||
+		mu.Reg(uc.X86_REG_AX) != errInvalidFormat {
+		t.Errorf("cut off overlay: AX %02X", mu.Reg(uc.X86_REG_AX))
+	}
+
+	// Missing overlays fail with file not found
+	copy(mu.Mem[ds*16:], "NONE.OVL\x00")
+	if !int21(t, d, mu, map[int]uint64{uc.X86_REG_AX: 0x4B03, uc.X86_REG_DS: ds, uc.X86_REG_DX: 0, uc.X86_REG_ES: ds, uc.X86_REG_BX: 0x20}) ||
+		mu.Reg(uc.X86_REG_AX) != errFileNotFound {
+		t.Errorf("missing overlay: AX %02X", mu.Reg(uc.X86_REG_AX))
+	}
+}
+
+// An EXE that loads an overlay 1000h past its code with 4B03h, relocated
+// for there, and calls it.  The overlay returns its relocated segment.
+func TestOverlayProgram(t *testing.T) {
+	fs, root := newTestFileSystem(t)
+	code := []byte{
+		0x0E, 0x1F, // PUSH CS; POP DS
+		0x8C, 0xC8, // MOV AX,CS
+		0x05, 0x00, 0x01, // ADD AX,100h
+		0xA3, 0x24, 0x00, // MOV [24h],AX: segment to load at
+		0xA3, 0x26, 0x00, // MOV [26h],AX: relocation factor
+		0xA3, 0x2A, 0x00, // MOV [2Ah],AX: segment to call
+		0x0E, 0x07, // PUSH CS; POP ES
+		0xBA, 0x2C, 0x00, // MOV DX,2Ch
+		0xBB, 0x24, 0x00, // MOV BX,24h
+		0xB8, 0x03, 0x4B, // MOV AX,4B03h
+		0xCD, 0x21, // INT 21h
+		0x72, 0x04, // JC +4
+		0xFF, 0x1E, 0x28, 0x00, // CALL FAR [28h]
+	}
+	end := uint16(len(code))
+	code = append(code, make([]byte, 8)...)
+	code = append(code, "DOOR.OVL\x00"...)
+	door := testExe(len(code), 0, 0, 0xFFFF)
+	copy(door[32:], code)
+	binary.LittleEndian.PutUint16(door[16:], 0x400)
+	// MOV AX,0000h with the segment relocated; RETF
+	ovl := testExe(4, 0, 0, 0)
+	copy(ovl[32:], "\xB8\x00\x00\xCB")
+	binary.LittleEndian.PutUint16(ovl[6:], 1)
+	binary.LittleEndian.PutUint16(ovl[0x1C:], 1)
+	if err := os.WriteFile(filepath.Join(root, "DOOR.OVL"), ovl, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mu, d := unicornDos(t, io.Discard)
+	d.FS = fs
+	exe, err := ReadExe(door)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Load(exe, `C:\DOOR.EXE`, nil); err != nil {
+		t.Fatal(err)
+	}
+	cs := cpu.SReg16(mu, uc.X86_REG_CS)
+	if err := mu.Start(cpu.Addr(cs, 0), cpu.Addr(cs, end)); err != nil {
+		t.Fatal(err)
+	}
+	if ip, ax := cpu.Reg16(mu, uc.X86_REG_IP), cpu.Reg16(mu, uc.X86_REG_AX); ip != end || ax != uint16(cs)+0x100 {
+		t.Errorf("ended at %04X:%04X with AX=%04X, want AX=%04X", cs, ip, ax, uint16(cs)+0x100)
+	}
+}
@@ -0,0 +1,190 @@
+package dos
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"door86.org/ivdoor/cpu"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Offsets into the PSP
+const (
+	pspExit       = 0x00 // INT 20h
+	pspMemEnd     = 0x02
+	pspCall5      = 0x05 // far call to DOS
+	pspTerminate  = 0x0A
+	pspCtrlBreak  = 0x0E
+	pspCritErr    = 0x12
+	pspParent     = 0x16
+	pspJFT        = 0x18
+	pspEnv        = 0x2C
+	pspJFTSize    = 0x32
+	pspJFTPointer = 0x34
+	pspPrevPsp    = 0x38
+	pspVersion    = 0x40
+	pspDosCall    = 0x50 // INT 21h, RETF
+	pspFCB1       = 0x5C
+	pspFCB2       = 0x6C
+	pspTail       = 0x80
+)
+
+// Where CALL 5 reaches DOS: in the vectors of INT 30h and 31h when the
+// address wraps at 1MB, and in the HMA when A20 is on and it doesn't, as
+// with DOS loaded high.  Both jump on to the dispatcher, in the memory
+// below the first program that DOS keeps for itself.
+const (
+	call5Entry    = 0x00C0
+	call5EntryHMA = 0x1000C0
+	call5Seg      = 0x0060
+)
+
+// The CALL 5 dispatcher.  It runs the function in CL, then returns to
+// where the program called 5 from: the stack has the far return to the
+// PSP's CALL, and under that the program's near return, which is in the
+// PSP's segment.
+var call5Code = []byte{
+	0x80, 0xF9, 0x24, // CMP CL,24h
+	0x77, 0x06, // JA +6, functions past CP/M's return AL=0
+	0x88, 0xCC, // MOV AH,CL
+	0xCD, 0x21, // INT 21h
+	0xEB, 0x02, // JMP +2
+	0xB0, 0x00, // MOV AL,0
+	0x55,       // PUSH BP
+	0x89, 0xE5, // MOV BP,SP
+	0xFF, 0x76, 0x06, // PUSH [BP+6], the program's return
+	0x8F, 0x46, 0x02, // POP [BP+2], over the PSP's offset
+	0x5D,             // POP BP
+	0xCA, 0x02, 0x00, // RETF 2
+}
+
+// Installs the CALL 5 dispatcher.
+func installCall5(mu uc.Unicorn) error {
+	jmp := []byte{0xEA, 0, 0, 0, 0} // JMP FAR
+	putFarPointer(jmp[1:], cpu.SegOffset{Seg: call5Seg, Off: 0})
+	for _, addr := range []uint64{call5Entry, call5EntryHMA} {
+		if err := mu.MemWrite(addr, jmp); err != nil {
+			return err
+		}
+	}
+	return mu.MemWrite(cpu.Addr(call5Seg, 0), call5Code)
+}
+
+// Number of handles in the PSP's job file table
+const jftSize = 20
+
+// Psp is what goes in a program's Program Segment Prefix.
+type Psp struct {
+	// Segment of the PSP, and the first paragraph after the program's
+	// memory
+	Seg, End cpu.Seg
+	// PSP of the program that started this one
+	Parent cpu.Seg
+	// Environment block
+	Env cpu.Seg
+	// INT 22h, 23h and 24h when the program started, which DOS restores
+	// when it exits
+	Terminate, CtrlBreak, CritErr cpu.SegOffset
+	// System file table entry for each handle, 0FFh when closed
+	Handles [jftSize]byte
+	// Reported to the program, major version in the high byte
+	Version uint16
+	Args    []string
+}
+
+// CreatePsp lays out the 256 byte PSP.
+func CreatePsp(p *Psp) []byte {
+	psp := make([]byte, 0x100)
+	psp[pspExit], psp[pspExit+1] = 0xCD, 0x20
+	binary.LittleEndian.PutUint16(psp[pspMemEnd:], uint16(p.End))
+	// CP/M style CALL F01D:FEF0, which reaches DOS at 0:00C0 when the
+	// address wraps at 1MB, see installCall5.  Its offset doubles as the number of bytes
+	// available in the segment, which some COM files read.
+	copy(psp[pspCall5:], []byte{0x9A, 0xF0, 0xFE, 0x1D, 0xF0})
+	putFarPointer(psp[pspTerminate:], p.Terminate)
+	putFarPointer(psp[pspCtrlBreak:], p.CtrlBreak)
+	putFarPointer(psp[pspCritErr:], p.CritErr)
+	binary.LittleEndian.PutUint16(psp[pspParent:], uint16(p.Parent))
+	copy(psp[pspJFT:], p.Handles[:])
+	binary.LittleEndian.PutUint16(psp[pspEnv:], uint16(p.Env))
+	binary.LittleEndian.PutUint16(psp[pspJFTSize:], jftSize)
+	putFarPointer(psp[pspJFTPointer:], cpu.SegOffset{Seg: p.Seg, Off: pspJFT})
+	// No previous PSP, for SHARE
+	binary.LittleEndian.PutUint32(psp[pspPrevPsp:], 0xFFFFFFFF)
+	psp[pspVersion], psp[pspVersion+1] = byte(p.Version>>8), byte(p.Version)
+	copy(psp[pspDosCall:], []byte{0xCD, 0x21, 0xCB})
+
+	// The first two arguments as unopened FCBs
+	for i, off := range []int{pspFCB1, pspFCB2} {
+		fcb := blankFCB
+		if i < len(p.Args) {
+			fcb, _ = parseFCB(p.Args[i])
+		}
+		copy(psp[off:], fcb[:])
+	}
+
+	// Command tail: its length, the arguments each after a space, and a
+	// CR that isn't counted
+	tail := ""
+	for _, arg := range p.Args {
+		tail += " " + arg
+	}
+	if len(tail) > 126 {
+		tail = tail[:126]
+	}
+	psp[pspTail] = byte(len(tail))
+	copy(psp[pspTail+1:], tail)
+	psp[pspTail+1+len(tail)] = 0x0D
+
+	return psp
+}
+
+func putFarPointer(b []byte, p cpu.SegOffset) {
+	binary.LittleEndian.PutUint16(b, p.Off)
+	binary.LittleEndian.PutUint16(b[2:], uint16(p.Seg))
+}
+
+// Drive, name and extension of an FCB with no file
+var blankFCB = [12]byte{0, ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
+
+// Characters ending a filename in an FCB
+const fcbTerminators = ":.;,=+ \t/\"[]<>|"
+
+// Parses a filename into the drive, name and extension of an unopened FCB
+// as INT 21h 29h does: upper cased, padded with spaces and * filled with
+// ?.  Returns the drive letter given, 0 when there was none.
+func parseFCB(arg string) ([12]byte, byte) {
+	fcb := blankFCB
+	var letter byte
+	if len(arg) >= 2 && arg[1] == ':' && isDriveLetter(arg[0]) {
+		letter = strings.ToUpper(arg[:1])[0]
+		fcb[0] = letter - 'A' + 1
+		arg = arg[2:]
+	}
+	field := func(dst []byte) {
+		for i := 0; len(arg) > 0 && !strings.ContainsRune(fcbTerminators, rune(arg[0])); arg = arg[1:] {
+			switch {
+			case i >= len(dst):
+				// Too long, the rest is dropped
+			case arg[0] == '*':
+				for ; i < len(dst); i++ {
+					dst[i] = '?'
+				}
+			default:
+				dst[i] = strings.ToUpper(arg[:1])[0]
+				i++
+			}
+		}
+	}
+	field(fcb[1:9])
+	if len(arg) > 0 && arg[0] == '.' {
+		arg = arg[1:]
+		field(fcb[9:12])
+	}
+	return fcb, letter
+}
+
+func isDriveLetter(c byte) bool {
+	_, ok := driveNumber(c)
+	return ok
+}
@@ -0,0 +1,146 @@
+package dos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/cpu"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+func TestCreatePsp(t *testing.T) {
+	p := &Psp{
+		Seg:       0x1000,
+		End:       0x9F00,
+		Parent:    0x1000,
+		Env:       0x0FF0,
+		Terminate: cpu.SegOffset{Seg: 0x0070, Off: 0x0123},
+		Version:   0x0616,
+		Args:      []string{`a:lord*.dat`, "/n2"},
+	}
+	for h := range p.Handles {
+		p.Handles[h] = 0xFF
+	}
+	p.Handles[0], p.Handles[1] = 1, 1
+	psp := CreatePsp(p)
+
+	word := func(off int) uint16 { return binary.LittleEndian.Uint16(psp[off:]) }
+	if psp[0] != 0xCD || psp[1] != 0x20 || word(pspMemEnd) != 0x9F00 {
+		t.Errorf("header: % X", psp[:4])
+	}
+	if psp[pspCall5] != 0x9A || word(pspCall5+1) != 0xFEF0 {
+		t.Errorf("call 5: % X", psp[pspCall5:pspCall5+5])
+	}
+	if word(pspTerminate) != 0x0123 || word(pspTerminate+2) != 0x0070 {
+		t.Errorf("INT 22h: % X", psp[pspTerminate:pspTerminate+4])
+	}
+	if word(pspParent) != 0x1000 || word(pspEnv) != 0x0FF0 {
+		t.Errorf("parent %04X env %04X", word(pspParent), word(pspEnv))
+	}
+	if psp[pspJFT] != 1 || psp[pspJFT+2] != 0xFF || word(pspJFTSize) != 20 ||
+		word(pspJFTPointer) != pspJFT || word(pspJFTPointer+2) != 0x1000 {
+		t.Errorf("JFT: % X size %d at %04X:%04X", psp[pspJFT:pspJFT+20], word(pspJFTSize), word(pspJFTPointer+2), word(pspJFTPointer))
+	}
+	if psp[pspVersion] != 6 || psp[pspVersion+1] != 22 {
+		t.Errorf("version: % X", psp[pspVersion:pspVersion+2])
+	}
+	if string(psp[pspDosCall:pspDosCall+3]) != "\xCD\x21\xCB" {
+		t.Errorf("INT 21h stub: % X", psp[pspDosCall:pspDosCall+3])
+	}
+	if got := string(psp[pspFCB1 : pspFCB1+12]); got != "\x01LORD????DAT" {
+		t.Errorf("FCB 1: %q", got)
+	}
+	// A switch isn't a filename
+	if got := string(psp[pspFCB2 : pspFCB2+12]); got != "\x00           " {
+		t.Errorf("FCB 2: %q", got)
+	}
+	if psp[pspTail] != 16 || string(psp[pspTail+1:pspTail+18]) != " a:lord*.dat /n2\r" {
+		t.Errorf("tail: %d %q", psp[pspTail], psp[pspTail+1:pspTail+18])
+	}
+
+	// A long command line is cut to fit, CR and all
+	p.Args = []string{strings.Repeat("x", 200)}
+	psp = CreatePsp(p)
+	if psp[pspTail] != 126 || psp[0xFF] != 0x0D {
+		t.Errorf("long tail: length %d, last byte %02X", psp[pspTail], psp[0xFF])
+	}
+}
+
+// Returns DOS on a real CPU for running programs, skipping the test when
+// Unicorn isn't there.
+func unicornDos(t *testing.T, out io.Writer) (uc.Unicorn, *Dos) {
+	mu, err := uc.NewUnicorn(uc.ARCH_X86, uc.MODE_16)
+	if err != nil {
+		t.Skipf("Unicorn isn't available: %s", err)
+	}
+	t.Cleanup(func() { mu.Close() })
+	// With the HMA, as the emulator has
+	if err := mu.MemMap(0, 0x110000); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDos(mu, 0x100, 0x9F00, console.New(strings.NewReader(""), out))
+	if _, err := mu.HookAdd(uc.HOOK_INTR, func(mu uc.Unicorn, intno uint32) {
+		if intno == 0x21 {
+			d.Int21(mu, intno)
+		}
+	}, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	return mu, d
+}
+
+// Runs a COM file calling 5.
+func TestCall5(t *testing.T) {
+	var out bytes.Buffer
+	mu, d := unicornDos(t, &out)
+	code := []byte{
+		0xB1, 0x02, // MOV CL,2: display output
+		0xB2, 'A', // MOV DL,'A'
+		0xE8, 0xFE, 0xFE, // CALL 5
+		0xB1, 0x30, // MOV CL,30h: not a CP/M function
+		0xB0, 0xFF, // MOV AL,FFh
+		0xE8, 0xF7, 0xFE, // CALL 5
+	}
+	exe, err := ReadExe(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, err := d.Load(exe, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := cpu.Addr(cpu.Seg(seg), 0x100)
+	if err := mu.Start(start, start+uint64(len(code))); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "A" {
+		t.Errorf("output %q", out.String())
+	}
+	cs, ip := cpu.Reg16(mu, uc.X86_REG_CS), cpu.Reg16(mu, uc.X86_REG_IP)
+	if al, sp := cpu.Reg8(mu, uc.X86_REG_AL), cpu.Reg16(mu, uc.X86_REG_SP); cs != seg || ip != 0x10E || al != 0 || sp != 0xFFFE {
+		t.Errorf("ended at %04X:%04X with AL=%02X SP=%04X", cs, ip, al, sp)
+	}
+}
+
+func TestParseFCB(t *testing.T) {
+	for _, tc := range []struct {
+		arg    string
+		fcb    string
+		letter byte
+	}{
+		{"lord.exe", "\x00LORD    EXE", 0},
+		{"c:*.*", "\x03???????????", 'C'},
+		{"verylongname.text", "\x00VERYLONGTEX", 0},
+		{"1:file", "\x001       ", 0},
+		{"", "\x00           ", 0},
+	} {
+		fcb, letter := parseFCB(tc.arg)
+		if string(fcb[:len(tc.fcb)]) != tc.fcb || letter != tc.letter {
+			t.Errorf("parseFCB(%q) = %q, %q, want %q, %q", tc.arg, fcb, letter, tc.fcb, tc.letter)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package dos
+
+import "syscall"
+
+// File system magic numbers from statfs(2) for network file systems.
+var remoteFsTypes = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517B:     true, // SMB
+	0xFF534D42: true, // CIFS
+	0xFE534D42: true, // SMB2
+	0x01021997: true, // 9P
+	0x5346414F: true, // AFS
+	0x65735546: true, // FUSE, e.g. sshfs
+}
+
+// Reports whether the host directory is on a network file system.
+func isRemote(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	return remoteFsTypes[uint32(st.Type)]
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package dos
+
+// Network file systems are only detected on Linux, elsewhere drives are
+// remote when the config says so.
+func isRemote(path string) bool {
+	return false
+}
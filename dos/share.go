@@ -0,0 +1,206 @@
+package dos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DOS sharing modes, bits 4-6 of the open mode in AL.
+const (
+	shareCompat    = 0x00
+	shareDenyAll   = 0x10
+	shareDenyWrite = 0x20
+	shareDenyRead  = 0x30
+	shareDenyNone  = 0x40
+)
+
+// DOS access modes, bits 0-2 of the open mode in AL.
+const (
+	accessRead      = 0x00
+	accessWrite     = 0x01
+	accessReadWrite = 0x02
+)
+
+var (
+	ErrSharingViolation = errors.New("sharing violation")
+	ErrLockViolation    = errors.New("lock violation")
+
+	errNotWritable = errors.New("an exclusive lock needs a file the host lets us write")
+	errNotReadable = errors.New("a shared lock needs a file the host lets us read")
+)
+
+// How a file is open is published with shared host locks on single bytes
+// far past anything a DOS file can address, so that handles in this and in
+// other ivdoor processes (one per node) can check their sharing mode
+// against it.
+const shareLockBase = 1 << 62
+
+const (
+	markOpenRead = iota
+	markOpenWrite
+	markDenyRead
+	markDenyWrite
+	// Held exclusively while a handle checks and publishes its marks, so
+	// that two nodes opening at once can't both miss each other.
+	markGuard
+)
+
+// Returns the sharing mode from the DOS open mode.
+func dosShareMode(al uint8) uint8 {
+	return al & 0x70
+}
+
+// Checks access and share against every other open handle on f and, when
+// there is no conflict, publishes them for later opens to check against.
+// Compatibility mode is treated as deny none.
+func acquireShare(f *os.File, access, share uint8) (err error) {
+	switch err := waitLock(f, lockExclusive, shareLockBase+markGuard, 1); {
+	case errors.Is(err, errNotWritable):
+		// The host only lets us read the file, so there's no taking the
+		// guard.  Writers can't open it either, leaving just the race
+		// between two readers that deny reading.
+	case err != nil:
+		return err
+	default:
+		defer func() {
+			if uerr := setLock(f, lockNone, shareLockBase+markGuard, 1); err == nil {
+				err = uerr
+			}
+		}()
+	}
+
+	read := access != accessWrite
+	write := access != accessRead
+	denyRead := share == shareDenyAll || share == shareDenyRead
+	denyWrite := share == shareDenyAll || share == shareDenyWrite
+
+	conflicts := []struct {
+		want bool
+		mark int64
+	}{
+		{read, markDenyRead},
+		{write, markDenyWrite},
+		{denyRead, markOpenRead},
+		{denyWrite, markOpenWrite},
+	}
+	for _, c := range conflicts {
+		if !c.want {
+			continue
+		}
+		held, err := testLock(f, true, shareLockBase+c.mark, 1)
+		if err != nil {
+			return err
+		}
+		if held {
+			return ErrSharingViolation
+		}
+	}
+
+	marks := []struct {
+		want bool
+		mark int64
+	}{
+		{read, markOpenRead},
+		{write, markOpenWrite},
+		{denyRead, markDenyRead},
+		{denyWrite, markDenyWrite},
+	}
+	for _, m := range marks {
+		if !m.want {
+			continue
+		}
+		err := setLock(f, lockShared, shareLockBase+m.mark, 1)
+		if errors.Is(err, errNotReadable) {
+			// The host only lets us write the file, so its marks can't be
+			// published.  The open was checked against the others, but
+			// later opens won't see this one.
+			return nil
+		}
+		if errors.Is(err, ErrLockViolation) {
+			return ErrSharingViolation
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type lockRange struct {
+	Offset int64
+	Length int64
+}
+
+func (l lockRange) overlaps(offset, length int64) bool {
+	return offset < l.Offset+l.Length && l.Offset < offset+length
+}
+
+// Locks a byte range of the file for this handle (INT 21h 5C00h).  DOS
+// locks are exclusive and may not overlap another lock, even one held by
+// the same handle.
+func (f *DosFile) Lock(offset, length int64) error {
+	hf := f.hostFile()
+	if hf == nil {
+		return os.ErrInvalid
+	}
+	if length == 0 {
+		return nil
+	}
+	for _, l := range f.locks {
+		if l.overlaps(offset, length) {
+			return ErrLockViolation
+		}
+	}
+	if err := setLock(hf, lockExclusive, offset, length); err != nil {
+		return err
+	}
+	f.locks = append(f.locks, lockRange{offset, length})
+	return nil
+}
+
+// Unlocks a byte range (INT 21h 5C01h), which must exactly match a range
+// previously locked through this handle.
+func (f *DosFile) Unlock(offset, length int64) error {
+	hf := f.hostFile()
+	if hf == nil {
+		return os.ErrInvalid
+	}
+	if length == 0 {
+		return nil
+	}
+	for i, l := range f.locks {
+		if l.Offset != offset || l.Length != length {
+			continue
+		}
+		if err := setLock(hf, lockNone, offset, length); err != nil {
+			return err
+		}
+		f.locks = append(f.locks[:i], f.locks[i+1:]...)
+		return nil
+	}
+	return ErrLockViolation
+}
+
+// Returns ErrLockViolation if length bytes at the current position are
+// locked by another handle.  SHARE.EXE enforces locks on reads and writes
+// so doors rely on this instead of testing locks themselves.
+func (f *DosFile) checkLocked(write bool, length int64) error {
+	hf := f.hostFile()
+	if hf == nil || length == 0 {
+		return nil
+	}
+	pos, err := hf.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	held, err := testLock(hf, write, pos, length)
+	if err != nil {
+		return err
+	}
+	if held {
+		return fmt.Errorf("%w: %d bytes at %d", ErrLockViolation, length, pos)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package dos
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/cpu/cputest"
+)
+
+// Skips tests of two handles conflicting, which only Linux's open file
+// description locks do inside one process.
+func needOFDLocks(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skipf("handles in one process don't conflict on %s", runtime.GOOS)
+	}
+}
+
+func openShared(t *testing.T, path string, access, share uint8) (*os.File, error) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acquireShare(f, access, share); err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, nil
+}
+
+func TestShareModes(t *testing.T) {
+	needOFDLocks(t)
+	path := filepath.Join(t.TempDir(), "NODE.DAT")
+	if err := os.WriteFile(path, make([]byte, 64), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openShared(t, path, accessRead, shareDenyWrite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openShared(t, path, accessRead, shareDenyNone); err != nil {
+		t.Errorf("second reader: %v", err)
+	}
+	if _, err := openShared(t, path, accessReadWrite, shareDenyNone); !errors.Is(err, ErrSharingViolation) {
+		t.Errorf("writer against deny write: expected ErrSharingViolation, got %v", err)
+	}
+	if _, err := openShared(t, path, accessRead, shareDenyRead); !errors.Is(err, ErrSharingViolation) {
+		t.Errorf("deny read while open for reading: expected ErrSharingViolation, got %v", err)
+	}
+}
+
+func TestRecordLocks(t *testing.T) {
+	needOFDLocks(t)
+	path := filepath.Join(t.TempDir(), "PLAYERS.DAT")
+	if err := os.WriteFile(path, make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := openShared(t, path, accessReadWrite, shareDenyNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := openShared(t, path, accessReadWrite, shareDenyNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node1 := &DosFile{Path: path, Dev: NewHostFile(f1, 2, false)}
+	node2 := &DosFile{Path: path, Dev: NewHostFile(f2, 2, false)}
+
+	if err := node1.Lock(100, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := node1.Lock(120, 10); !errors.Is(err, ErrLockViolation) {
+		t.Errorf("overlapping lock on same handle: got %v", err)
+	}
+	if err := node2.Lock(149, 1); !errors.Is(err, ErrLockViolation) {
+		t.Errorf("overlapping lock from other node: got %v", err)
+	}
+	if err := node2.Lock(150, 50); err != nil {
+		t.Errorf("adjacent lock: %v", err)
+	}
+
+	if _, err := f2.Seek(110, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := node2.checkLocked(false, 4); !errors.Is(err, ErrLockViolation) {
+		t.Errorf("read of locked record: got %v", err)
+	}
+	if err := node1.Unlock(100, 10); !errors.Is(err, ErrLockViolation) {
+		t.Errorf("partial unlock: got %v", err)
+	}
+	if err := node1.Unlock(100, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := node2.checkLocked(true, 4); err != nil {
+		t.Errorf("write after unlock: %v", err)
+	}
+}
+
+// Nodes opening at once must not both get a file one of them denies to
+// the other.
+func TestShareRace(t *testing.T) {
+	needOFDLocks(t)
+	path := filepath.Join(t.TempDir(), "NODE.DAT")
+	if err := os.WriteFile(path, make([]byte, 64), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		opened int
+	)
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			switch err := acquireShare(f, accessReadWrite, shareDenyAll); {
+			case err == nil:
+				mu.Lock()
+				opened++
+				mu.Unlock()
+			case !errors.Is(err, ErrSharingViolation):
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if opened != 1 {
+		t.Errorf("%d nodes opened the file denying all", opened)
+	}
+}
+
+// A file the host only lets us write can't carry the marks, which
+// mustn't fail the open.
+func TestWriteOnlyShare(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "NODE.LOG")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := acquireShare(f, accessWrite, shareDenyWrite); err != nil {
+		t.Errorf("write only: %v", err)
+	}
+}
+
+func TestReadHandleLocks(t *testing.T) {
+	needOFDLocks(t)
+	fs, root := newTestFileSystem(t)
+	path := filepath.Join(root, "PLAYERS.DAT")
+	if err := os.WriteFile(path, make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDos(cputest.New(), 0x100, 0x9F00, console.New(strings.NewReader(""), io.Discard))
+	d.FS = fs
+	open := func() *DosFile {
+		h, _, err := d.openFile(`C:\PLAYERS.DAT`, accessRead|shareDenyNone, 0, ifExistsOpen, ifMissingFail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.files[h]
+	}
+	node1, node2 := open(), open()
+
+	// A lock through a handle only open for reading still keeps readers out
+	if err := node1.Lock(0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := node2.checkLocked(false, 10); !errors.Is(err, ErrLockViolation) {
+		t.Errorf("read of locked record: got %v", err)
+	}
+
+	// Files the host only lets us read can't be locked, rather than being
+	// locked against writers alone
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ro := &DosFile{Path: path, Dev: NewHostFile(f, 2, false)}
+	if err := ro.Lock(200, 10); dosErrno(err, errFileNotFound) != errAccessDenied {
+		t.Errorf("lock on read-only descriptor: got %v", err)
+	}
+}
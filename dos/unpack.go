@@ -0,0 +1,470 @@
+package dos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Packer is an executable compressor.  Packed programs run as they are,
+// their stub unpacking them in memory, but tools looking at the file only
+// see the stub.  LZEXE and PKLITE's large model can be undone.
+type Packer int
+
+const (
+	NotPacked Packer = iota
+	LZEXE090
+	LZEXE091
+	PKLITE
+)
+
+func (p Packer) String() string {
+	switch p {
+	case NotPacked:
+		return "not packed"
+	case LZEXE090:
+		return "LZEXE 0.90"
+	case LZEXE091:
+		return "LZEXE 0.91"
+	case PKLITE:
+		return "PKLITE"
+	}
+	return fmt.Sprintf("Packer(%d)", int(p))
+}
+
+// ErrUnsupportedPacker is returned when unpacking a program whose packer
+// is recognized but can't be undone: PKLITE with -e or the small model,
+// or a stub we don't know.
+var ErrUnsupportedPacker = errors.New("unpacking isn't supported for this packer")
+
+// PackInfo describes how an executable was packed.
+type PackInfo struct {
+	Packer Packer
+	// Version of the packer, as it names itself, when the file says
+	Version string
+	// PKLITE's -e option, which also scrambles the stub
+	Extra bool
+	// PKLITE's large model, with longer matches, for bigger programs
+	Large bool
+}
+
+func (i PackInfo) String() string {
+	s := i.Packer.String()
+	if i.Packer == PKLITE && i.Version != "" {
+		s += " " + i.Version
+	}
+	if i.Extra {
+		s += " (extra compression)"
+	}
+	return s
+}
+
+// DetectPacker looks for the marks LZEXE and PKLITE leave in the EXE
+// header of the file b.
+func DetectPacker(b []byte) PackInfo {
+	if len(b) < 0x20 || b[0] != 'M' || b[1] != 'Z' {
+		return PackInfo{}
+	}
+	switch string(b[0x1C:0x20]) {
+	case "LZ09":
+		return PackInfo{Packer: LZEXE090, Version: "0.90"}
+	case "LZ91":
+		return PackInfo{Packer: LZEXE091, Version: "0.91"}
+	}
+	// PKLITE puts its version in the word at 1Ch, with flags in the high
+	// bits, and its copyright after it
+	if bytes.HasPrefix(b[0x1E:], []byte("PKLITE")) || bytes.HasPrefix(b[0x1E:], []byte("PKlite")) {
+		v := binary.LittleEndian.Uint16(b[0x1C:])
+		return PackInfo{
+			Packer:  PKLITE,
+			Version: fmt.Sprintf("%d.%02d", v>>8&0x0F, v&0xFF),
+			Extra:   v&0x1000 != 0,
+			Large:   v&0x2000 != 0,
+		}
+	}
+	return PackInfo{}
+}
+
+// Unpack rebuilds the original EXE file from the LZEXE or PKLITE packed
+// file b, with its relocation table.  Data after the packed load module,
+// such as overlays, is kept after the unpacked one.  Files packed with
+// PKLITE's -e or small model return ErrUnsupportedPacker.
+func Unpack(b []byte) ([]byte, PackInfo, error) {
+	info := DetectPacker(b)
+	switch info.Packer {
+	case NotPacked:
+		return nil, info, errors.New("not a packed executable")
+	case LZEXE090, LZEXE091:
+		out, err := unlzexe(b, info.Packer)
+		return out, info, err
+	case PKLITE:
+		if info.Extra || !info.Large {
+			break
+		}
+		out, err := unpklite(b)
+		return out, info, err
+	}
+	return nil, info, fmt.Errorf("%s: %w", info, ErrUnsupportedPacker)
+}
+
+// Reads LZEXE's and PKLITE's compressed data: a 16 bit word of flag bits, taken from
+// the low bit up, with bytes between the words.  A new word is read as
+// soon as the last bit of the previous one is taken.
+type lzReader struct {
+	b     []byte
+	pos   int
+	bits  uint16
+	count int
+	err   error
+}
+
+var errPackedTruncated = errors.New("packed data ends early")
+
+func (r *lzReader) byte() byte {
+	if r.pos >= len(r.b) {
+		r.err = errPackedTruncated
+		return 0
+	}
+	c := r.b[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *lzReader) word() uint16 {
+	return uint16(r.byte()) | uint16(r.byte())<<8
+}
+
+func (r *lzReader) bit() uint16 {
+	b := r.bits & 1
+	if r.count--; r.count == 0 {
+		r.bits = r.word()
+		r.count = 16
+	} else {
+		r.bits >>= 1
+	}
+	return b
+}
+
+// Offsets of the relocation table from the start of the LZEXE stub
+const (
+	lzexe090Relocs = 0x19D
+	lzexe091Relocs = 0x158
+)
+
+func unlzexe(b []byte, packer Packer) ([]byte, error) {
+	exe, err := ReadExe(b)
+	if err != nil {
+		return nil, err
+	}
+	h := exe.Hdr
+	// The stub's segment starts with the original registers and sizes
+	stub := (int(h.HeaderParagraphs) + int(h.CS)) * 0x10
+	if stub+16 > len(b) {
+		return nil, errPackedTruncated
+	}
+	var inf [8]uint16
+	for i := range inf {
+		inf[i] = binary.LittleEndian.Uint16(b[stub+i*2:])
+	}
+	ip, cs, sp, ss, packedParas := inf[0], inf[1], inf[2], inf[3], inf[4]
+
+	start := (int(h.HeaderParagraphs) + int(h.CS) - int(packedParas)) * 0x10
+	if start < int(h.HeaderParagraphs)*0x10 || start > stub {
+		return nil, fmt.Errorf("LZEXE compressed data at %d is outside the load module", start)
+	}
+	image, err := lzexeDecompress(b[start:stub])
+	if err != nil {
+		return nil, err
+	}
+
+	var relocs []exeReloEntry
+	if packer == LZEXE090 {
+		relocs, err = lzexe090Relocations(b, stub+lzexe090Relocs)
+	} else {
+		relocs, err = lzexe091Relocations(b, stub+lzexe091Relocs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buildExe(image, relocs, unpackedHeader(h, image, ss, sp, cs, ip), exe.Overlay), nil
+}
+
+// The header for a program unpacked from one with header h, for buildExe:
+// the original registers, and the memory the packed program asked for.
+func unpackedHeader(h ExeHeader, image []byte, ss, sp, cs, ip uint16) ExeHeader {
+	min := int(h.loadParagraphs()) + int(h.MinExtraParagraphs) - (len(image)+0xF)/0x10
+	if min < 0 {
+		min = 0
+	}
+	if min > 0xFFFF {
+		min = 0xFFFF
+	}
+	max := int(h.MaxExtraParagraphs)
+	if max < min {
+		max = min
+	}
+	return ExeHeader{
+		MinExtraParagraphs: uint16(min),
+		MaxExtraParagraphs: uint16(max),
+		SS:                 ss,
+		SP:                 sp,
+		IP:                 ip,
+		CS:                 cs,
+	}
+}
+
+// Expands LZEXE's LZ77 compression of a load module.
+func lzexeDecompress(b []byte) ([]byte, error) {
+	r := &lzReader{b: b, count: 16}
+	r.bits = r.word()
+	var out []byte
+	for r.err == nil {
+		if r.bit() == 1 {
+			out = append(out, r.byte())
+			continue
+		}
+		var length, span int
+		if r.bit() == 0 {
+			// Two bits of length and a byte of distance back
+			length = int(r.bit()<<1|r.bit()) + 2
+			span = int(r.byte()) - 0x100
+		} else {
+			// 13 bits of distance back and 3 of length, or a byte
+			// of length when those are 0
+			lo, hi := r.byte(), r.byte()
+			span = int(int16(uint16(lo) | uint16(hi&^7)<<5 | 0xE000))
+			length = int(hi&7) + 2
+			if length == 2 {
+				switch n := r.byte(); n {
+				case 0:
+					// End of the load module
+					return out, r.err
+				case 1:
+					// Segment change, marks where the stub
+					// normalizes its pointers
+					continue
+				default:
+					length = int(n) + 1
+				}
+			}
+		}
+		if len(out)+span < 0 {
+			return nil, fmt.Errorf("LZEXE match %d bytes back at %d", -span, len(out))
+		}
+		for ; length > 0; length-- {
+			out = append(out, out[len(out)+span])
+		}
+	}
+	return nil, r.err
+}
+
+// LZEXE 0.90 relocations: for each 64K of the image, in order, a count
+// word and the offsets.
+func lzexe090Relocations(b []byte, pos int) ([]exeReloEntry, error) {
+	r := &lzReader{b: b, pos: pos}
+	var relocs []exeReloEntry
+	for seg := 0; seg <= 0xF000; seg += 0x1000 {
+		for n := r.word(); n > 0 && r.err == nil; n-- {
+			relocs = append(relocs, exeReloEntry{Offset: r.word(), Segment: uint16(seg)})
+		}
+	}
+	return relocs, r.err
+}
+
+// LZEXE 0.91 relocations: the distance of each from the previous, as a
+// byte, or a 0 byte and a word.  A 0 word moves on 0FFF0h bytes and a
+// 1 word ends the table.
+func lzexe091Relocations(b []byte, pos int) ([]exeReloEntry, error) {
+	r := &lzReader{b: b, pos: pos}
+	var relocs []exeReloEntry
+	linear := 0
+	for r.err == nil {
+		span := int(r.byte())
+		if span == 0 {
+			switch span = int(r.word()); span {
+			case 0:
+				linear += 0xFFF0
+				continue
+			case 1:
+				return relocs, r.err
+			}
+		}
+		linear += span
+		relocs = append(relocs, exeReloEntry{Offset: uint16(linear & 0xF), Segment: uint16(linear >> 4)})
+	}
+	return nil, r.err
+}
+
+// A prefix code of PKLITE's, of n bits, read from the high bit down
+type pkliteCode struct {
+	n    int
+	code uint16
+}
+
+// PKLITE's large model codes for match lengths 2 to 24, the last code
+// taking the length from the next byte
+var pkliteLengths = []pkliteCode{
+	{2, 0x2}, {2, 0x3}, {3, 0x0}, {4, 0x2}, {4, 0x3}, {4, 0x4},
+	{5, 0x0A}, {5, 0x0B}, {5, 0x0C}, {6, 0x1A}, {6, 0x1B}, {6, 0x1C},
+	{7, 0x3A}, {7, 0x3B}, {7, 0x3C}, {8, 0x7A}, {8, 0x7B}, {8, 0x7C},
+	{9, 0xFA}, {9, 0xFB}, {9, 0xFC}, {9, 0xFD}, {9, 0xFE}, {9, 0xFF},
+}
+
+// PKLITE's codes for the high byte of a match's distance
+var pkliteDistances = []pkliteCode{
+	{1, 0x1}, {4, 0x0}, {4, 0x1}, {5, 0x4}, {5, 0x5}, {5, 0x6}, {5, 0x7},
+	{6, 0x10}, {6, 0x11}, {6, 0x12}, {6, 0x13}, {6, 0x14}, {6, 0x15}, {6, 0x16}, {6, 0x17},
+	{7, 0x30}, {7, 0x31}, {7, 0x32}, {7, 0x33}, {7, 0x34}, {7, 0x35}, {7, 0x36}, {7, 0x37},
+	{7, 0x38}, {7, 0x39}, {7, 0x3A}, {7, 0x3B}, {7, 0x3C}, {7, 0x3D}, {7, 0x3E}, {7, 0x3F},
+}
+
+// Reads one of codes, returning its index.
+func (r *lzReader) code(codes []pkliteCode) int {
+	var code uint16
+	for n := 1; n <= 16 && r.err == nil; n++ {
+		code = code<<1 | r.bit()
+		for i, c := range codes {
+			if c.n == n && c.code == code {
+				return i
+			}
+		}
+	}
+	if r.err == nil {
+		r.err = errors.New("bad PKLITE code")
+	}
+	return 0
+}
+
+// Where the compressed data starts in a PKLITE load module.  The stub
+// starts by copying the decompressor, CX words from SI, out of the way,
+// and the data follows it.  SI is from the PSP, 100h before the module.
+func pkliteDataStart(module []byte) (int, bool) {
+	intro := module
+	if len(intro) > 0x60 {
+		intro = intro[:0x60]
+	}
+	copyAt := bytes.Index(intro, []byte{0xF3, 0xA5}) // REP MOVSW
+	if copyAt < 0 {
+		return 0, false
+	}
+	cx := bytes.LastIndexByte(module[:copyAt], 0xB9) // MOV CX
+	si := bytes.LastIndexByte(module[:copyAt], 0xBE) // MOV SI
+	if cx < 0 || si < 0 || cx+3 > copyAt || si+3 > copyAt {
+		return 0, false
+	}
+	start := int(binary.LittleEndian.Uint16(module[si+1:])) - 0x100 + int(binary.LittleEndian.Uint16(module[cx+1:]))*2
+	return start, start > 0 && start < len(module)
+}
+
+func unpklite(b []byte) ([]byte, error) {
+	exe, err := ReadExe(b)
+	if err != nil {
+		return nil, err
+	}
+	start, ok := pkliteDataStart(exe.Data)
+	if !ok {
+		return nil, fmt.Errorf("PKLITE stub: %w", ErrUnsupportedPacker)
+	}
+	image, r, err := pkliteDecompress(exe.Data[start:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Relocations follow the data: a count, 0 to end, then the segment
+	// and that many offsets.  The original registers come last.
+	var relocs []exeReloEntry
+	for n := r.byte(); n > 0 && r.err == nil; n = r.byte() {
+		seg := r.word()
+		for ; n > 0; n-- {
+			relocs = append(relocs, exeReloEntry{Offset: r.word(), Segment: seg})
+		}
+	}
+	ss, sp, cs, ip := r.word(), r.word(), r.word(), r.word()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return buildExe(image, relocs, unpackedHeader(exe.Hdr, image, ss, sp, cs, ip), exe.Overlay), nil
+}
+
+// Expands PKLITE's large model compression of a load module, returning
+// the reader left after it.  A 0 bit is a literal byte, a 1 a length code
+// and a distance: a code for the high byte, except for length 2, and the
+// low byte.
+func pkliteDecompress(b []byte) ([]byte, *lzReader, error) {
+	r := &lzReader{b: b, count: 16}
+	r.bits = r.word()
+	var out []byte
+	for r.err == nil {
+		if r.bit() == 0 {
+			out = append(out, r.byte())
+			continue
+		}
+		length := r.code(pkliteLengths) + 2
+		if length == len(pkliteLengths)+1 {
+			switch n := r.byte(); n {
+			case 0xFE:
+				// Segment change
+				continue
+			case 0xFF:
+				// End of the load module
+				return out, r, r.err
+			default:
+				length = int(n) + len(pkliteLengths) + 1
+			}
+		}
+		var span int
+		if length > 2 {
+			span = r.code(pkliteDistances) << 8
+		}
+		span |= int(r.byte())
+		if r.err != nil {
+			break
+		}
+		if span == 0 || span > len(out) {
+			return nil, nil, fmt.Errorf("PKLITE match %d bytes back at %d", span, len(out))
+		}
+		for ; length > 0; length-- {
+			out = append(out, out[len(out)-span])
+		}
+	}
+	return nil, nil, r.err
+}
+
+// Lays out an EXE file: a header with the relocations, padded to a
+// paragraph, the load module and anything to follow it.  h gives the
+// registers and memory, the sizes are filled in.
+func buildExe(image []byte, relocs []exeReloEntry, h ExeHeader, overlay []byte) []byte {
+	sort.SliceStable(relocs, func(i, j int) bool {
+		return int(relocs[i].Segment)*0x10+int(relocs[i].Offset) < int(relocs[j].Segment)*0x10+int(relocs[j].Offset)
+	})
+	const reloTable = 0x1C
+	headerSize := (reloTable + 4*len(relocs) + 0xF) &^ 0xF
+	size := headerSize + len(image)
+	out := make([]byte, headerSize, size+len(overlay))
+	for i, v := range []uint16{
+		0x5A4D, // MZ
+		uint16(size % 512),
+		uint16((size + 511) / 512),
+		uint16(len(relocs)),
+		uint16(headerSize / 0x10),
+		h.MinExtraParagraphs,
+		h.MaxExtraParagraphs,
+		h.SS,
+		h.SP,
+		0, // checksum
+		h.IP,
+		h.CS,
+		reloTable,
+		0, // overlay number
+	} {
+		binary.LittleEndian.PutUint16(out[i*2:], v)
+	}
+	for i, r := range relocs {
+		binary.LittleEndian.PutUint16(out[reloTable+i*4:], r.Offset)
+		binary.LittleEndian.PutUint16(out[reloTable+i*4+2:], r.Segment)
+	}
+	return append(append(out, image...), overlay...)
+}
@@ -0,0 +1,414 @@
+package dos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Writes LZEXE's bit stream, the way lzReader reads it.
+type lzWriter struct {
+	out     []byte
+	wordPos int
+	nbits   int
+}
+
+func newLZWriter() *lzWriter {
+	return &lzWriter{out: []byte{0, 0}}
+}
+
+func (w *lzWriter) bit(b int) {
+	if b != 0 {
+		w.out[w.wordPos+w.nbits/8] |= 1 << (w.nbits % 8)
+	}
+	// The reader takes the next word as soon as this one is used up
+	if w.nbits++; w.nbits == 16 {
+		w.wordPos = len(w.out)
+		w.out = append(w.out, 0, 0)
+		w.nbits = 0
+	}
+}
+
+func (w *lzWriter) byte(b ...byte) {
+	w.out = append(w.out, b...)
+}
+
+// Compresses image as LZEXE does, greedily, with a segment change mark
+// every 0x2000 bytes.
+func lzexeCompress(image []byte) []byte {
+	w := newLZWriter()
+	for i := 0; i < len(image); {
+		if i > 0 && i%0x2000 == 0 {
+			w.bit(0)
+			w.bit(1)
+			w.byte(0, 0, 1)
+		}
+		best, dist := 0, 0
+		for j := i - 1; j >= 0 && i-j <= 0x1FFF; j-- {
+			n := 0
+			for n < 256 && i+n < len(image) && image[j+n] == image[i+n] && (i+n)%0x2000 != 0 || n == 0 && i+n < len(image) && image[j] == image[i] {
+				n++
+				if (i+n)%0x2000 == 0 {
+					break
+				}
+			}
+			if n > best {
+				best, dist = n, i-j
+			}
+		}
+		switch {
+		case best >= 2 && best <= 5 && dist <= 0x100:
+			w.bit(0)
+			w.bit(0)
+			w.bit((best - 2) >> 1)
+			w.bit((best - 2) & 1)
+			w.byte(byte(0x100 - dist))
+		case best >= 3:
+			span := 0x10000 - dist
+			w.bit(0)
+			w.bit(1)
+			if best <= 9 {
+				w.byte(byte(span), byte(span>>5)&^7|byte(best-2))
+			} else {
+				w.byte(byte(span), byte(span>>5)&^7, byte(best-1))
+			}
+		default:
+			best = 1
+			w.bit(1)
+			w.byte(image[i])
+		}
+		i += best
+	}
+	w.bit(0)
+	w.bit(1)
+	w.byte(0, 0, 0)
+	return w.out
+}
+
+// Encodes relocations the way LZEXE 0.91 does.
+func lzexe091Table(relocs []exeReloEntry) []byte {
+	var t []byte
+	last := 0
+	for _, r := range relocs {
+		linear := int(r.Segment)*0x10 + int(r.Offset)
+		span := linear - last
+		for span > 0xFFFF {
+			t = append(t, 0, 0, 0)
+			span -= 0xFFF0
+		}
+		if span > 0 && span < 0x100 {
+			t = append(t, byte(span))
+		} else {
+			t = append(t, 0, byte(span), byte(span>>8))
+		}
+		last = linear
+	}
+	return append(t, 0, 1, 0)
+}
+
+// Encodes relocations the way LZEXE 0.90 does, all in the first 64K.
+func lzexe090Table(relocs []exeReloEntry) []byte {
+	t := binary.LittleEndian.AppendUint16(nil, uint16(len(relocs)))
+	for _, r := range relocs {
+		t = binary.LittleEndian.AppendUint16(t, r.Segment*0x10+r.Offset)
+	}
+	return append(t, make([]byte, 15*2)...)
+}
+
+// Packs an image the way LZEXE does: the compressed data, then the stub's
+// segment with the original registers, and the relocation table after the
+// stub's code, which isn't there.  MinAlloc leaves room to unpack into.
+func lzexePack(image []byte, relocs []exeReloEntry, h ExeHeader, version string) []byte {
+	data := lzexeCompress(image)
+	for len(data)%16 != 0 {
+		data = append(data, 0)
+	}
+	packedParas := len(data) / 16
+	stub := make([]byte, lzexe090Relocs)
+	for i, v := range []uint16{h.IP, h.CS, h.SP, h.SS, uint16(packedParas), 0x10, 0x100, 0} {
+		binary.LittleEndian.PutUint16(stub[i*2:], v)
+	}
+	if version == "LZ91" {
+		stub = append(stub[:lzexe091Relocs], lzexe091Table(relocs)...)
+	} else {
+		stub = append(stub, lzexe090Table(relocs)...)
+	}
+	module := append(data, stub...)
+	size := 32 + len(module)
+	hdr := make([]byte, 32)
+	for i, v := range []uint16{0x5A4D, uint16(size % 512), uint16((size + 511) / 512), 0, 2, uint16(len(image)/16 + 0x20), 0xFFFF, uint16(packedParas + 0x20), 0x80, 0, 0x0E, uint16(packedParas), 0x1C, 0} {
+		binary.LittleEndian.PutUint16(hdr[i*2:], v)
+	}
+	copy(hdr[0x1C:], version)
+	return append(hdr, module...)
+}
+
+// An image that compresses with every kind of match.
+func testImage() []byte {
+	var image []byte
+	for i := 0; i < 0x5000; i++ {
+		switch {
+		case i%0x900 < 0x80:
+			image = append(image, byte(i*7+i/13))
+		case i%0x900 < 0x400:
+			image = append(image, "Legend of the Red Dragon "[i%25])
+		default:
+			image = append(image, byte(i/300))
+		}
+	}
+	return image
+}
+
+func TestUnlzexe(t *testing.T) {
+	image := testImage()
+	relocs := []exeReloEntry{{Offset: 0x0003, Segment: 0}, {Offset: 0x0001, Segment: 0x0010}, {Offset: 0x000F, Segment: 0x0400}}
+	h := ExeHeader{SS: 0x0480, SP: 0x0800, IP: 0x0010, CS: 0x0001}
+	for _, version := range []string{"LZ91", "LZ09"} {
+		packed := append(lzexePack(image, relocs, h, version), "overlay"...)
+		if info := DetectPacker(packed); info.Packer == NotPacked {
+			t.Fatalf("%s not detected", version)
+		}
+		out, info, err := Unpack(packed)
+		if err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+		exe, err := ReadExe(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(exe.Data, image) {
+			t.Errorf("%s: unpacked image differs, %d bytes, want %d", info, len(exe.Data), len(image))
+		}
+		if exe.Hdr.CS != h.CS || exe.Hdr.IP != h.IP || exe.Hdr.SS != h.SS || exe.Hdr.SP != h.SP {
+			t.Errorf("%s: registers %+v", info, exe.Hdr)
+		}
+		if len(exe.Hdr.Relos) != len(relocs) {
+			t.Fatalf("%s: relocations %v", info, exe.Hdr.Relos)
+		}
+		for i, r := range exe.Hdr.Relos {
+			if int(r.Segment)*16+int(r.Offset) != int(relocs[i].Segment)*16+int(relocs[i].Offset) {
+				t.Errorf("%s: relocation %d at %04X:%04X, want %04X:%04X", info, i, r.Segment, r.Offset, relocs[i].Segment, relocs[i].Offset)
+			}
+		}
+		if string(exe.Overlay) != "overlay" {
+			t.Errorf("%s: overlay %q", info, exe.Overlay)
+		}
+		if exe.Hdr.MaxExtraParagraphs != 0xFFFF || exe.Hdr.MinExtraParagraphs == 0 {
+			t.Errorf("%s: memory %d to %d", info, exe.Hdr.MinExtraParagraphs, exe.Hdr.MaxExtraParagraphs)
+		}
+	}
+}
+
+// Data encoded by hand from the format unlzexe reads, rather than by
+// lzexeCompress: literals A and B, a short match of 4 bytes 2 back, a long
+// one of 3 bytes 6 back, and the end.
+func TestLzexeDecompressVector(t *testing.T) {
+	packed := []byte{0x93, 0x02, 'A', 'B', 0xFE, 0xFA, 0xF9, 0x00, 0x00, 0x00}
+	if out, err := lzexeDecompress(packed); err != nil || string(out) != "ABABABABA" {
+		t.Errorf("got %q, %v", out, err)
+	}
+	// Offsets 5, 15h, then past 0FFF0h with a 0 word, and the end
+	table := []byte{0x05, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00}
+	relocs, err := lzexe091Relocations(table, 0)
+	want := []exeReloEntry{{Offset: 5, Segment: 0}, {Offset: 5, Segment: 1}, {Offset: 8, Segment: 0x1000}}
+	if err != nil || !reflect.DeepEqual(relocs, want) {
+		t.Errorf("relocations %v, %v", relocs, err)
+	}
+}
+
+// Writes one of PKLITE's codes, from the high bit down.
+func (w *lzWriter) code(c pkliteCode) {
+	for i := c.n - 1; i >= 0; i-- {
+		w.bit(int(c.code>>i) & 1)
+	}
+}
+
+// Compresses image as PKLITE's large model does, greedily, with a
+// segment change mark every 0x2000 bytes.
+func pkliteCompress(image []byte) []byte {
+	w := newLZWriter()
+	long := len(pkliteLengths) - 1
+	for i := 0; i < len(image); {
+		if i > 0 && i%0x2000 == 0 {
+			w.bit(1)
+			w.code(pkliteLengths[long])
+			w.byte(0xFE)
+		}
+		best, dist := 0, 0
+		for j := i - 1; j >= 0 && i-j <= 0x1FFF; j-- {
+			n := 0
+			for n < 0xFD+long+2 && i+n < len(image) && image[j+n] == image[i+n] {
+				n++
+			}
+			if n > best && (n > 2 || i-j <= 0xFF) {
+				best, dist = n, i-j
+			}
+		}
+		if best < 2 {
+			w.bit(0)
+			w.byte(image[i])
+			i++
+			continue
+		}
+		w.bit(1)
+		if best < long+2 {
+			w.code(pkliteLengths[best-2])
+		} else {
+			w.code(pkliteLengths[long])
+			w.byte(byte(best - long - 2))
+		}
+		if best > 2 {
+			w.code(pkliteDistances[dist>>8])
+		}
+		w.byte(byte(dist))
+		i += best
+	}
+	w.bit(1)
+	w.code(pkliteLengths[long])
+	w.byte(0xFF)
+	return w.out
+}
+
+// Packs an image the way PKLITE 1.12 does with its large model: a stub
+// that copies the decompressor from 144h, the decompressor, which isn't
+// there, the compressed data, the relocations by segment and the original
+// registers.
+func pklitePack(image []byte, relocs []exeReloEntry, h ExeHeader) []byte {
+	const words = 0x50
+	stub := []byte{
+		0xB8, 0x00, 0x10, // MOV AX,1000
+		0xBA, 0x00, 0x10, // MOV DX,1000
+		0xB9, words, 0x00, // MOV CX,words
+		0x33, 0xFF, // XOR DI,DI
+		0x57,             // PUSH DI
+		0xBE, 0x44, 0x01, // MOV SI,0144
+		0xFC,       // CLD
+		0xF3, 0xA5, // REP MOVSW
+		0xCB, // RETF
+	}
+	module := append(stub, make([]byte, 0x44-len(stub)+words*2)...)
+	module = append(module, pkliteCompress(image)...)
+	bySeg := map[uint16][]uint16{}
+	var segs []uint16
+	for _, r := range relocs {
+		if bySeg[r.Segment] == nil {
+			segs = append(segs, r.Segment)
+		}
+		bySeg[r.Segment] = append(bySeg[r.Segment], r.Offset)
+	}
+	for _, seg := range segs {
+		module = append(module, byte(len(bySeg[seg])))
+		module = binary.LittleEndian.AppendUint16(module, seg)
+		for _, off := range bySeg[seg] {
+			module = binary.LittleEndian.AppendUint16(module, off)
+		}
+	}
+	module = append(module, 0)
+	for _, v := range []uint16{h.SS, h.SP, h.CS, h.IP} {
+		module = binary.LittleEndian.AppendUint16(module, v)
+	}
+	hdr := make([]byte, 0x50)
+	size := len(hdr) + len(module)
+	for i, v := range []uint16{0x5A4D, uint16(size % 512), uint16((size + 511) / 512), 0, 5, uint16(len(image)/16 + 0x20), 0xFFFF, 0xFFF0, 0xFFFE, 0, 0x100, 0xFFF0, 0x1C, 0, 0x210C} {
+		binary.LittleEndian.PutUint16(hdr[i*2:], v)
+	}
+	copy(hdr[0x1E:], "PKLITE Copr. 1990-92 PKWARE Inc. All Rights Reserved")
+	return append(hdr, module...)
+}
+
+func TestUnpklite(t *testing.T) {
+	image := testImage()
+	relocs := []exeReloEntry{{Offset: 0x0003, Segment: 0}, {Offset: 0x0011, Segment: 0}, {Offset: 0x000F, Segment: 0x0400}}
+	h := ExeHeader{SS: 0x0480, SP: 0x0800, IP: 0x0010, CS: 0x0001}
+	packed := append(pklitePack(image, relocs, h), "overlay"...)
+	out, info, err := Unpack(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Packer != PKLITE || info.Version != "1.12" || !info.Large || info.Extra {
+		t.Errorf("detected %+v", info)
+	}
+	exe, err := ReadExe(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exe.Data, image) {
+		t.Errorf("unpacked image differs, %d bytes, want %d", len(exe.Data), len(image))
+	}
+	if exe.Hdr.CS != h.CS || exe.Hdr.IP != h.IP || exe.Hdr.SS != h.SS || exe.Hdr.SP != h.SP {
+		t.Errorf("registers %+v", exe.Hdr)
+	}
+	if !reflect.DeepEqual(exe.Hdr.Relos, relocs) {
+		t.Errorf("relocations %v, want %v", exe.Hdr.Relos, relocs)
+	}
+	if string(exe.Overlay) != "overlay" {
+		t.Errorf("overlay %q", exe.Overlay)
+	}
+	if exe.Hdr.MaxExtraParagraphs != 0xFFFF || exe.Hdr.MinExtraParagraphs == 0 {
+		t.Errorf("memory %d to %d", exe.Hdr.MinExtraParagraphs, exe.Hdr.MaxExtraParagraphs)
+	}
+
+	// Cut off in the registers after the relocations
+	if _, _, err := Unpack(packed[:len(packed)-len("overlay")-2]); err == nil {
+		t.Error("unpacked without the registers")
+	}
+}
+
+// Data encoded by hand from the format pkliteDecompress reads, rather than
+// by pkliteCompress: literals A and B, a match of 4 bytes 2 back, one of 2
+// bytes 5 back, and the end.
+func TestPkliteDecompressVector(t *testing.T) {
+	packed := []byte{0xC4, 0xF5, 'A', 'B', 0x02, 0x05, 0x0F, 0x00, 0xFF, 0x00}
+	out, r, err := pkliteDecompress(packed)
+	if err != nil || string(out) != "ABABABBA" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	// The relocations follow
+	if r.pos != 9 {
+		t.Errorf("data ends at %d, want 9", r.pos)
+	}
+}
+
+func TestDetectPacker(t *testing.T) {
+	pklite := make([]byte, 0x40)
+	copy(pklite, "MZ")
+	binary.LittleEndian.PutUint16(pklite[0x1C:], 0x110F)
+	copy(pklite[0x1E:], "PKLITE Copr. 1990-92 PKWARE Inc. All Rights Reserved")
+	info := DetectPacker(pklite)
+	if info.Packer != PKLITE || info.Version != "1.15" || !info.Extra {
+		t.Errorf("PKLITE: %+v", info)
+	}
+	if _, _, err := Unpack(pklite); !errors.Is(err, ErrUnsupportedPacker) {
+		t.Errorf("unpacking PKLITE -e: %v", err)
+	}
+	// The small model
+	binary.LittleEndian.PutUint16(pklite[0x1C:], 0x010F)
+	if _, _, err := Unpack(pklite); !errors.Is(err, ErrUnsupportedPacker) {
+		t.Errorf("unpacking PKLITE's small model: %v", err)
+	}
+	if info := DetectPacker(testExe(100, 0, 0, 0xFFFF)); info.Packer != NotPacked {
+		t.Errorf("plain EXE: %+v", info)
+	}
+	if _, _, err := Unpack([]byte("\xB4\x4C\xCD\x21")); err == nil {
+		t.Error("unpacking a COM file succeeded")
+	}
+}
+
+func TestUnlzexeTruncated(t *testing.T) {
+	packed := lzexePack(testImage(), nil, ExeHeader{}, "LZ91")
+	// Cut into the compressed data, keeping the stub where the header
+	// says
+	stub := 32 + int(binary.LittleEndian.Uint16(packed[22:]))*16
+	broken := append([]byte(nil), packed...)
+	for i := 40; i < stub; i++ {
+		broken[i] = 0
+	}
+	if _, _, err := Unpack(broken); err == nil {
+		t.Error("unpacked broken data")
+	}
+	if _, _, err := Unpack(packed[:stub+8]); err == nil {
+		t.Error("unpacked without the stub's header")
+	}
+}
@@ -0,0 +1,269 @@
+// Package dropfile writes the door drop files a BBS leaves in the door's
+// directory to tell it who is calling: DOOR.SYS, DORINFO1.DEF, CHAIN.TXT
+// and DOOR32.SYS.  All of them are CR LF terminated text.
+package dropfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Info is everything the BBS tells a door about itself and the caller.
+type Info struct {
+	BBSName    string `json:"bbs_name"`
+	SysopName  string `json:"sysop_name"`
+	UserNumber int    `json:"user_number"`
+	// Real name
+	Name     string `json:"name"`
+	Alias    string `json:"alias"`
+	Location string `json:"location"`
+	Phone    string `json:"phone"`
+	// Security level
+	SecurityLevel int `json:"security_level"`
+	// Minutes left this call
+	TimeLeft int `json:"time_left"`
+	Node     int `json:"node"`
+	// Connection speed, 0 for a local session
+	Baud int `json:"baud"`
+	// COM port the caller is on, 0 for a local session
+	Port int  `json:"port"`
+	ANSI bool `json:"ansi"`
+	// Caller's terminal understands AVATAR/0+
+	Avatar bool `json:"avatar"`
+}
+
+// ReadInfo reads Info from a JSON file.
+func ReadInfo(filename string) (*Info, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return info, nil
+}
+
+func (i *Info) local() bool {
+	return i.Baud == 0
+}
+
+func (i *Info) node() int {
+	if i.Node < 1 {
+		return 1
+	}
+	return i.Node
+}
+
+func (i *Info) alias() string {
+	if i.Alias == "" {
+		return i.Name
+	}
+	return i.Alias
+}
+
+// Splits a name into first name and the rest.
+func splitName(name string) (string, string) {
+	first, last, _ := strings.Cut(strings.TrimSpace(name), " ")
+	return first, strings.TrimSpace(last)
+}
+
+func lines(l ...string) []byte {
+	var b strings.Builder
+	for _, s := range l {
+		b.WriteString(s)
+		b.WriteString("\r\n")
+	}
+	return []byte(b.String())
+}
+
+// Returns the terminal emulation as DORINFO1.DEF and DOOR32.SYS number it:
+// 0 for plain text, 1 for ANSI and 2 for AVATAR.
+func (i *Info) emulation() string {
+	switch {
+	case i.Avatar:
+		return "2"
+	case i.ANSI:
+		return "1"
+	}
+	return "0"
+}
+
+func oneZero(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// DoorSys returns the 52 line GAP DOOR.SYS.
+func DoorSys(i *Info, now time.Time) []byte {
+	graphics := "NG"
+	if i.ANSI {
+		graphics = "GR"
+	}
+	date := now.Format("01/02/06")
+	return lines(
+		fmt.Sprintf("COM%d:", i.Port),
+		fmt.Sprint(i.Baud),
+		"8",
+		fmt.Sprint(i.node()),
+		fmt.Sprint(i.Baud),
+		"Y",
+		"N",
+		"N",
+		"N",
+		i.Name,
+		i.Location,
+		i.Phone,
+		i.Phone,
+		"",
+		fmt.Sprint(i.SecurityLevel),
+		"1",
+		date,
+		fmt.Sprint(i.TimeLeft*60),
+		fmt.Sprint(i.TimeLeft),
+		graphics,
+		"24",
+		"N",
+		"",
+		"",
+		"12/31/99",
+		fmt.Sprint(i.UserNumber),
+		"Z",
+		"0",
+		"0",
+		"0",
+		"999999",
+		"01/01/80",
+		"",
+		"",
+		i.SysopName,
+		i.alias(),
+		"00:00",
+		"Y",
+		"N",
+		"Y",
+		"7",
+		"0",
+		date,
+		now.Format("15:04"),
+		now.Format("15:04"),
+		"9999",
+		"0",
+		"0",
+		"0",
+		"",
+		"0",
+		"0",
+	)
+}
+
+// DorInfo returns DORINFO1.DEF as written by RBBS-PC and QuickBBS, with
+// RemoteAccess's AVATAR graphics mode.
+func DorInfo(i *Info, now time.Time) []byte {
+	sysFirst, sysLast := splitName(i.SysopName)
+	first, last := splitName(i.Name)
+	return lines(
+		i.BBSName,
+		sysFirst,
+		sysLast,
+		fmt.Sprintf("COM%d", i.Port),
+		fmt.Sprintf("%d BAUD,N,8,1", i.Baud),
+		"0",
+		strings.ToUpper(first),
+		strings.ToUpper(last),
+		i.Location,
+		i.emulation(),
+		fmt.Sprint(i.SecurityLevel),
+		fmt.Sprint(i.TimeLeft),
+		"-1",
+	)
+}
+
+// ChainTxt returns WWIV's CHAIN.TXT.
+func ChainTxt(i *Info, now time.Time) []byte {
+	baud := "KB"
+	if !i.local() {
+		baud = fmt.Sprint(i.Baud)
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	return lines(
+		fmt.Sprint(i.UserNumber),
+		i.alias(),
+		i.Name,
+		"",
+		"0",
+		"M",
+		fmt.Sprintf("%10.2f", 0.0),
+		now.Format("01/02/06"),
+		"80",
+		"25",
+		fmt.Sprint(i.SecurityLevel),
+		"0",
+		"0",
+		oneZero(i.ANSI),
+		oneZero(!i.local()),
+		fmt.Sprintf("%10.2f", float64(i.TimeLeft*60)),
+		`C:\GFILES\`,
+		`C:\DATA\`,
+		now.Format("060102")+".LOG",
+		baud,
+		fmt.Sprint(i.Port),
+		i.BBSName,
+		i.SysopName,
+		fmt.Sprint(int(now.Sub(midnight).Seconds())),
+		"0",
+		"0",
+		"0",
+		"0",
+		"0",
+		"8N1",
+		fmt.Sprint(i.Baud),
+		fmt.Sprint(i.node()),
+	)
+}
+
+// Door32Sys returns DOOR32.SYS.
+func Door32Sys(i *Info, now time.Time) []byte {
+	comm := "0"
+	if !i.local() {
+		comm = "1"
+	}
+	return lines(
+		comm,
+		fmt.Sprint(i.Port),
+		fmt.Sprint(i.Baud),
+		i.BBSName,
+		fmt.Sprint(i.UserNumber),
+		i.Name,
+		i.alias(),
+		fmt.Sprint(i.SecurityLevel),
+		fmt.Sprint(i.TimeLeft),
+		i.emulation(),
+		fmt.Sprint(i.node()),
+	)
+}
+
+// Formats maps each drop file name to its generator.
+var Formats = map[string]func(*Info, time.Time) []byte{
+	"DOOR.SYS":     DoorSys,
+	"DORINFO1.DEF": DorInfo,
+	"CHAIN.TXT":    ChainTxt,
+	"DOOR32.SYS":   Door32Sys,
+}
+
+// WriteAll writes every drop file format into the host directory dir.
+func WriteAll(dir string, i *Info, now time.Time) error {
+	for name, format := range Formats {
+		if err := os.WriteFile(filepath.Join(dir, name), format(i, now), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package dropfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testNow  = time.Date(2023, time.March, 4, 13, 5, 0, 0, time.UTC)
+	testInfo = &Info{
+		BBSName:       "Iron Valley",
+		SysopName:     "Sam Sysop",
+		UserNumber:    7,
+		Name:          "Jane Q Caller",
+		Alias:         "Zapper",
+		Location:      "Kirkland, WA",
+		SecurityLevel: 50,
+		TimeLeft:      42,
+		Node:          3,
+		ANSI:          true,
+	}
+)
+
+func TestChainTxt(t *testing.T) {
+	want := "7\r\nZapper\r\nJane Q Caller\r\n\r\n0\r\nM\r\n      0.00\r\n03/04/23\r\n80\r\n25\r\n" +
+		"50\r\n0\r\n0\r\n1\r\n0\r\n   2520.00\r\nC:\\GFILES\\\r\nC:\\DATA\\\r\n230304.LOG\r\nKB\r\n" +
+		"0\r\nIron Valley\r\nSam Sysop\r\n47100\r\n0\r\n0\r\n0\r\n0\r\n0\r\n8N1\r\n0\r\n3\r\n"
+	if got := string(ChainTxt(testInfo, testNow)); got != want {
+		t.Errorf("CHAIN.TXT:\n%q\nwant\n%q", got, want)
+	}
+
+	// Line 32 is the node, which is 1 when there's only one
+	for node, want := range map[int]string{0: "1", 1: "1", 12: "12"} {
+		info := *testInfo
+		info.Node = node
+		if got := strings.Split(string(ChainTxt(&info, testNow)), "\r\n")[31]; got != want {
+			t.Errorf("CHAIN.TXT node %d = %q, want %q", node, got, want)
+		}
+	}
+}
+
+func TestDorInfo(t *testing.T) {
+	want := "Iron Valley\r\nSam\r\nSysop\r\nCOM0\r\n0 BAUD,N,8,1\r\n0\r\nJANE\r\nQ CALLER\r\n" +
+		"Kirkland, WA\r\n1\r\n50\r\n42\r\n-1\r\n"
+	if got := string(DorInfo(testInfo, testNow)); got != want {
+		t.Errorf("DORINFO1.DEF:\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestDoor32Sys(t *testing.T) {
+	want := "0\r\n0\r\n0\r\nIron Valley\r\n7\r\nJane Q Caller\r\nZapper\r\n50\r\n42\r\n1\r\n3\r\n"
+	if got := string(Door32Sys(testInfo, testNow)); got != want {
+		t.Errorf("DOOR32.SYS:\n%q\nwant\n%q", got, want)
+	}
+
+	avatar := *testInfo
+	avatar.Avatar = true
+	if got := strings.Split(string(Door32Sys(&avatar, testNow)), "\r\n")[9]; got != "2" {
+		t.Errorf("DOOR32.SYS emulation for AVATAR = %q", got)
+	}
+}
+
+func TestDoorSys(t *testing.T) {
+	got := strings.Split(string(DoorSys(testInfo, testNow)), "\r\n")
+	// Trailing CR LF leaves an empty element at the end
+	if len(got) != 53 || got[52] != "" {
+		t.Fatalf("DOOR.SYS has %d lines", len(got)-1)
+	}
+	checks := map[int]string{
+		1:  "COM0:",
+		4:  "3",
+		10: "Jane Q Caller",
+		15: "50",
+		18: "2520",
+		19: "42",
+		20: "GR",
+		36: "Zapper",
+	}
+	for line, want := range checks {
+		if got[line-1] != want {
+			t.Errorf("DOOR.SYS line %d = %q, want %q", line, got[line-1], want)
+		}
+	}
+}
+
+func TestWriteAll(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteAll(dir, testInfo, testNow); err != nil {
+		t.Fatal(err)
+	}
+	for name := range Formats {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"door86.org/ivdoor/dos"
+)
+
+var (
+	cmdInfo = flag.NewFlagSet("info", flag.ExitOnError)
+
+	infoJSON = cmdInfo.Bool("json", false, "print the information as JSON")
+)
+
+// Prints what's known about the program in file to w.
+func info(w io.Writer, file string, asJSON bool) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	i, err := dos.DescribeExe(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(i)
+	}
+
+	fmt.Fprintf(w, "%s: %s, %d bytes\n", file, i.Type, i.FileSize)
+	if h := i.Header; h != nil {
+		fmt.Fprintf(w, "  Header:        %d bytes (%d paragraphs)\n", i.HeaderSize, h.HeaderParagraphs)
+		fmt.Fprintf(w, "  File size:     %d blocks, %d bytes in the last\n", h.BlocksInFile, h.BytesInLastBlock)
+		fmt.Fprintf(w, "  Extra memory:  %04Xh to %04Xh paragraphs\n", h.MinExtraParagraphs, h.MaxExtraParagraphs)
+		fmt.Fprintf(w, "  Checksum:      %04Xh\n", h.Checksum)
+		fmt.Fprintf(w, "  Overlay:       %d\n", h.OverlayNumber)
+		fmt.Fprintf(w, "  Relocations:   %d at %04Xh\n", h.NumRelos, h.ReloTableOffset)
+	}
+	fmt.Fprintf(w, "  Load module:   %d bytes\n", i.LoadSize)
+	if i.OverlaySize > 0 {
+		fmt.Fprintf(w, "  Overlay data:  %d bytes after the load module\n", i.OverlaySize)
+	}
+	fmt.Fprintf(w, "  Entry point:   %s\n", i.Entry)
+	fmt.Fprintf(w, "  Stack:         %s\n", i.Stack)
+	wanted := memorySize(i.MemoryWanted)
+	if i.MemoryWanted >= 0x10000 || i.Header != nil && i.Header.MaxExtraParagraphs == 0xFFFF {
+		wanted = "all free memory"
+	}
+	if i.LoadsHigh {
+		wanted += ", loaded high"
+	}
+	fmt.Fprintf(w, "  Memory:        %s needed, %s wanted\n", memorySize(i.MemoryNeeded), wanted)
+	if i.Packer != "" {
+		fmt.Fprintf(w, "  Packed with:   %s\n", i.Packer)
+	}
+	switch {
+	case i.Compiler.Name == "":
+		fmt.Fprintf(w, "  Compiler:      unknown\n")
+	case i.Unpacked:
+		fmt.Fprintf(w, "  Compiler:      %s, once unpacked (%s)\n", i.Compiler.Name, i.Compiler.Marker)
+	default:
+		fmt.Fprintf(w, "  Compiler:      %s (%s)\n", i.Compiler.Name, i.Compiler.Marker)
+	}
+	for n := 0; n < len(i.Relocations); n += 8 {
+		end := n + 8
+		if end > len(i.Relocations) {
+			end = len(i.Relocations)
+		}
+		fmt.Fprintf(w, "    %s\n", strings.Join(i.Relocations[n:end], " "))
+	}
+	return nil
+}
+
+func memorySize(paragraphs int) string {
+	return fmt.Sprintf("%d paragraphs (%d KB)", paragraphs, (paragraphs*0x10+1023)/1024)
+}
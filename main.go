@@ -6,11 +6,28 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"door86.org/ivdoor/bios"
+	"door86.org/ivdoor/cast"
+	"door86.org/ivdoor/codepage"
+	"door86.org/ivdoor/config"
+	"door86.org/ivdoor/console"
 	"door86.org/ivdoor/core"
+	"door86.org/ivdoor/cpu"
 	"door86.org/ivdoor/dos"
+	"door86.org/ivdoor/dropfile"
+	"door86.org/ivdoor/record"
+	"door86.org/ivdoor/session"
+	"door86.org/ivdoor/sysop"
+	"door86.org/ivdoor/trace"
+	"door86.org/ivdoor/video"
+	"github.com/golang/glog"
 	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
 )
 
@@ -22,38 +39,566 @@ import (
 var (
 	cmdRun  = flag.NewFlagSet("run", flag.ExitOnError)
 	cmdInst = flag.NewFlagSet("inst", flag.ExitOnError)
+	cmdPlay = flag.NewFlagSet("replay", flag.ExitOnError)
+
+	runCaller  = cmdRun.String("caller", "", "JSON file describing the caller; drop files are written when set")
+	runDropDir = cmdRun.String("dropdir", "", "DOS directory to write drop files to (default current directory)")
+	runName    = cmdRun.String("name", "", "caller's real name for drop files")
+	runAlias   = cmdRun.String("alias", "", "caller's alias for drop files")
+	runSL      = cmdRun.Int("sl", 0, "caller's security level for drop files")
+	runTime    = cmdRun.Int("time", 0, "minutes the caller has left")
+	runNode    = cmdRun.Int("node", 0, "node number")
+	runBaud    = cmdRun.Int("baud", 0, "caller's connection speed, 0 when local")
+	runANSI    = cmdRun.Bool("ansi", false, "caller has ANSI graphics")
+	runAvatar  = cmdRun.Bool("avatar", false, "caller's terminal understands AVATAR/0+")
+	runDoorAVT = cmdRun.Bool("door-avatar", false, "door writes AVATAR codes even when the caller has no AVATAR")
+	runWarn    = cmdRun.Int("warn", 2, "minutes left at which the caller is warned")
+	runIdle    = cmdRun.Duration("idle", 0, "end the door after this long without a keystroke, 0 for no limit")
+	runEncode  = cmdRun.String("encoding", "cp437", "character set of the caller's terminal: cp437, utf8 or ascii")
+	runGrace   = cmdRun.Duration("grace", 10*time.Second, "time a door has to exit after the caller hangs up")
+	runSpy     = cmdRun.String("spy", "", "Unix socket to show the sysop the door on, or 'pty' for a pty")
+	runSpyEnc  = cmdRun.String("spy-encoding", "utf8", "character set of the sysop's terminal: cp437, utf8 or ascii")
+	runRecord  = cmdRun.String("record", "", "file to record the session to, for replay")
+	runCast    = cmdRun.String("cast", "", "file to save what the caller sees to, for playing back")
+	runCastFmt = cmdRun.String("cast-format", "", "format of -cast: asciicast or ttyrec (default from the extension)")
+	runConfig  = cmdRun.String("config", "", "config file describing the machine the door runs on")
+	runProfile = cmdRun.String("profile", "", "profile in the config file (default the program's name)")
+	runTrace   = cmdRun.String("trace", "", "file to write a JSON line to for each interrupt the door calls")
+	runTrInts  = cmdRun.String("trace-int", "", "interrupts to trace, in hex like 21,10 (default all)")
+	runTrCS    = cmdRun.String("trace-cs", "", "only trace code in these segments, in hex like 1000-1FFF")
+	runTrInst  = cmdRun.Bool("trace-inst", false, "trace every instruction as well")
+
+	playShow    = cmdPlay.Bool("show", false, "show the door's output while replaying")
+	playProgram = cmdPlay.String("program", "", "program to replay, instead of the recorded one")
+	playConfig  = cmdPlay.String("config", "", "config file the door was recorded with")
+	playProfile = cmdPlay.String("profile", "", "profile in the config file (default the program's name)")
+)
+
+// Exit status of ivdoor when the door is ended rather than exiting itself.
+const (
+	exitError    = 1
+	exitKicked   = 252
+	exitTimeUp   = 253
+	exitInactive = 254
+	exitHangup   = 255
 )
 
-func run(exe *dos.Executable, args []string) error {
+func exitStatus(err error) int {
+	switch {
+	case errors.Is(err, session.ErrTimeUp):
+		return exitTimeUp
+	case errors.Is(err, session.ErrInactive):
+		return exitInactive
+	case errors.Is(err, session.ErrCarrierLost):
+		return exitHangup
+	case errors.Is(err, session.ErrKicked):
+		return exitKicked
+	}
+	return exitError
+}
+
+// Options for a single run of a DOS program.
+type runOptions struct {
+	// Written as drop files when set
+	caller *dropfile.Info
+	// DOS directory for drop files
+	dropDir string
+	limits  session.Limits
+	// Character set of the caller's terminal
+	encoding codepage.Encoding
+	// Caller's terminal emulation
+	emulation video.Emulation
+	// The door writes AVATAR, which has to be translated when the caller
+	// doesn't have it
+	doorAvatar bool
+	// Unix socket, or "pty", for the sysop's view of the door
+	spy string
+	// Character set of the sysop's terminal
+	spyEncoding codepage.Encoding
+	// Host path of the program, for recordings
+	program string
+	// File to record the session to
+	record string
+	// Recording to replay instead of talking to a caller
+	replay *record.Player
+	// Where the caller's output goes, os.Stdout when nil
+	display io.Writer
+	// Where the caller's input comes from, os.Stdin when nil
+	input io.Reader
+	// The caller is connected over the network, so their input ending is
+	// them hanging up
+	remote bool
+	// Gets what the caller sees, as UTF-8 with ANSI codes, may be nil
+	cast io.Writer
+	// Drives, environment and devices, the defaults when nil
+	config *config.Config
+	// Runs the program under a debugger instead, when set
+	debug *debugger
+	// Traces the door's interrupt calls, may be nil
+	trace *trace.Tracer
+}
+
+// Creates a trace of the interrupts ints, all when empty, called from
+// the segments cs, all when empty, writing it to path.
+func createTrace(path, ints, cs string, instructions bool) (*trace.Tracer, error) {
+	var opts trace.Options
+	var err error
+	if opts.Interrupts, err = trace.ParseInterrupts(ints); err != nil {
+		return nil, err
+	}
+	if cs != "" {
+		if opts.CSLow, opts.CSHigh, err = trace.ParseSegments(cs); err != nil {
+			return nil, err
+		}
+	}
+	opts.Instructions = instructions
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return trace.New(f, opts), nil
+}
+
+// Reads the config file at path for program, or returns the defaults when
+// path is empty.  profile defaults to the program's name without its
+// extension, so LORD.EXE runs with the lord profile.
+func loadConfig(path, profile, program string) (*config.Config, error) {
+	if path == "" {
+		return config.Default(), nil
+	}
+	if profile == "" {
+		base := filepath.Base(program)
+		profile = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	cfg, err := config.Load(path, profile)
+	if err != nil {
+		return nil, err
+	}
+	// Logging is set up for the whole of ivdoor, unless given on the
+	// command line
+	logFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { logFlags[f.Name] = true })
+	if cfg.Given("log.verbose") && !logFlags["v"] {
+		flag.Set("v", strconv.Itoa(cfg.Verbose))
+	}
+	if cfg.Given("log.dir") && !logFlags["log_dir"] {
+		flag.Set("log_dir", cfg.LogDir)
+	}
+	return cfg, nil
+}
+
+// Reports whether the setting key from the config file applies, which it
+// does when it is in the file and the flag name overriding it wasn't given.
+func fromConfig(fs *flag.FlagSet, cfg *config.Config, name, key string) bool {
+	if !cfg.Given(key) {
+		return false
+	}
+	given := false
+	fs.Visit(func(f *flag.Flag) { given = given || f.Name == name })
+	return !given
+}
+
+// How often direct video output is sent to the caller
+const renderInterval = 50 * time.Millisecond
+
+// Builds the caller for drop files from -caller and the caller flags,
+// which override the file.  Returns nil when none were given.
+func callerInfo() (*dropfile.Info, error) {
+	info := &dropfile.Info{}
+	if *runCaller != "" {
+		i, err := dropfile.ReadInfo(*runCaller)
+		if err != nil {
+			return nil, err
+		}
+		info = i
+	}
+	overrides := map[string]func(){
+		"name":   func() { info.Name = *runName },
+		"alias":  func() { info.Alias = *runAlias },
+		"sl":     func() { info.SecurityLevel = *runSL },
+		"time":   func() { info.TimeLeft = *runTime },
+		"node":   func() { info.Node = *runNode },
+		"baud":   func() { info.Baud = *runBaud },
+		"ansi":   func() { info.ANSI = *runANSI },
+		"avatar": func() { info.Avatar = *runAvatar },
+	}
+	set := *runCaller != ""
+	cmdRun.Visit(func(f *flag.Flag) {
+		if override, ok := overrides[f.Name]; ok {
+			override()
+			set = true
+		}
+	})
+	if !set {
+		return nil, nil
+	}
+	return info, nil
+}
+
+// Runs exe and returns its return code.  A door ended because the caller
+// ran out of time, went idle or hung up returns the session error.
+func run(exe *dos.Executable, args []string, opts runOptions) (code uint8, err error) {
 	// set up unicorn instance and add hooks
 	mu, err := uc.NewUnicorn(uc.ARCH_X86, uc.MODE_16)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Create emulator
 	emu, err := core.NewEmulator(mu)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	cfg := opts.config
+	if cfg == nil {
+		cfg = config.Default()
+	}
+	emu.Verbose = cfg.Verbose
+	for name, on := range map[string]bool{"EMS": cfg.Devices.EMS, "XMS": cfg.Devices.XMS} {
+		if on {
+			return 0, fmt.Errorf("%s isn't emulated, turn it off in [devices]", name)
+		}
+	}
+	loc, err := cfg.Location()
+	if err != nil {
+		return 0, err
+	}
+	// The end of conventional memory
+	end := emu.EndSegment()
+	if cfg.Memory != 0 && cpu.Seg(cfg.Memory*1024/16) < end {
+		end = cpu.Seg(cfg.Memory * 1024 / 16)
+	}
+	if opts.emulation == video.Avatar && opts.encoding != codepage.CP437 {
+		// AVATAR codes carry binary arguments the translation would mangle
+		return 0, errors.New("AVATAR terminals need the cp437 encoding")
+	}
+	// Everything sent to the caller is also drawn on the emulated screen
+	screen := video.NewScreen()
+	display := opts.display
+	if display == nil {
+		display = os.Stdout
+	}
+	caller := codepage.NewWriter(display, opts.encoding)
+	if opts.cast != nil {
+		capture := codepage.NewWriter(opts.cast, codepage.UTF8)
+		if opts.emulation == video.Avatar {
+			// Players only know ANSI, so the screen is recorded instead
+			mirror := video.NewMirror(screen, video.NewEncoder(video.ANSI), capture, nil)
+			stop, stopped := make(chan struct{}), make(chan struct{})
+			go func() {
+				mirror.Run(renderInterval, stop)
+				close(stopped)
+			}()
+			defer func() {
+				close(stop)
+				<-stopped
+			}()
+		} else {
+			caller = io.MultiWriter(caller, capture)
+		}
+	}
+	screen.SetAvatar(opts.emulation == video.Avatar || opts.doorAvatar)
+	out := io.MultiWriter(screen, caller)
+	if opts.doorAvatar && opts.emulation != video.Avatar {
+		// The caller can't show the door's output as is, so they are sent
+		// the screen instead
+		screen.RenderAll(true)
+		out = screen
+	}
+	// A recording keeps the door's own output apart from the session's
+	conOut := out
+	input := opts.input
+	if input == nil {
+		input = os.Stdin
+	}
+	in := codepage.NewReader(input, opts.encoding)
+	var rec *record.Recorder
+	if opts.record != "" {
+		f, err := os.Create(opts.record)
+		if err != nil {
+			return 0, err
+		}
+		rec, err = record.NewRecorder(f, record.Header{
+			Program:    opts.program,
+			Args:       args,
+			Encoding:   opts.encoding.String(),
+			Emulation:  opts.emulation.String(),
+			DoorAvatar: opts.doorAvatar,
+			Caller:     opts.caller,
+			DropDir:    opts.dropDir,
+			Remote:     opts.remote,
+		})
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+		conOut = io.MultiWriter(out, rec.Output())
+		defer func() {
+			// A run that failed still leaves a recording that loads
+			if err != nil {
+				rec.End(0, err, screen.Bytes())
+			}
+		}()
+	}
+	if opts.replay != nil {
+		// All the input comes from the recording
+		r, w := io.Pipe()
+		defer w.Close()
+		in = r
+		conOut = io.MultiWriter(out, opts.replay.Output())
+	}
+	con := console.New(in, conOut)
+	if opts.remote {
+		con = console.NewRemote(in, conOut)
+	}
+	bios := bios.NewBios(mu, emu.StartSegment(), end, con, screen)
+	emu.AfterInterrupt = bios.SyncScreen
+	if cfg.Devices.UART {
+		if err := bios.AttachUART(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Sends the caller what the door draws in video memory
+	renderer := video.NewRenderer(screen, video.NewEncoder(opts.emulation), caller, con.Locked)
+	bios.SetRenderer(renderer)
+	stopRender, rendered := make(chan struct{}), make(chan struct{})
+	go func() {
+		if err := renderer.Run(renderInterval, stopRender); err != nil {
+			con.Hangup()
+		}
+		close(rendered)
+	}()
+	defer func() {
+		close(stopRender)
+		<-rendered
+	}()
+	d := dos.NewDos(mu, emu.StartSegment(), end, con)
+	for _, letter := range cfg.DriveLetters() {
+		if err := d.FS.Mount(letter, cfg.Drives[letter]); err != nil {
+			return 0, fmt.Errorf("drive %c: %w", letter, err)
+		}
+		if dr, ok := d.FS.Drive(int(letter - 'A')); ok && cfg.Remote != nil {
+			dr.Remote = cfg.Remote[letter]
+		}
+	}
+	d.Version = cfg.DosVersion
+	d.Env = cfg.Environment(os.Getenv)
+	// The program finds itself from the path after its environment, and
+	// may open itself to read its overlays
+	path := ""
+	if opts.program != "" {
+		if path, err = d.FS.ProgramPath(opts.program); err != nil {
+			return 0, err
+		}
+	}
+
+	// Everything the door sees from outside is recorded, or replayed
+	start := time.Now()
+	switch {
+	case rec != nil:
+		rec.Attach(con, emu.Interrupts)
+		emu.OnInterrupt = func(uint32) error {
+			rec.Step()
+			return nil
+		}
+		d.Now, bios.Now, d.Tap = rec.Now, rec.Now, rec
+		start = rec.Start()
+	case opts.replay != nil:
+		p := opts.replay
+		p.Attach(con, emu.Interrupts)
+		emu.OnInterrupt = func(uint32) error { return p.Step() }
+		d.Now, bios.Now, d.Tap = p.Now, p.Now, p
+		start = p.Header.Start
+	}
+	// The door's clock is in the configured time zone
+	for _, now := range []*func() time.Time{&d.Now, &bios.Now} {
+		clock := *now
+		*now = func() time.Time { return clock().In(loc) }
+	}
+
+	// A replay doesn't write to the host, the door's drop files are read
+	// from the recording
+	if opts.caller != nil && opts.replay == nil {
+		dir, err := d.FS.Resolve(opts.dropDir)
+		if err != nil {
+			return 0, fmt.Errorf("drop file directory '%s': %w", opts.dropDir, err)
+		}
+		if err := dropfile.WriteAll(dir, opts.caller, start); err != nil {
+			return 0, err
+		}
 	}
-	emu.Verbose = 4
-	bios := bios.NewBios(mu, emu.StartSegment(), emu.EndSegment())
-	d := dos.NewDos(mu, emu.StartSegment(), emu.EndSegment())
 
 	// Add bios interrupts
+	emu.Register(0x10, bios.Int10)
+	if cfg.Devices.FOSSIL {
+		emu.Register(0x14, bios.Int14)
+	}
 	emu.Register(0x1A, bios.Int1A)
 	// attach interrupts 0x20 and 0x21
 	emu.Register(0x20, d.Int20)
 	emu.Register(0x21, d.Int21)
+	if opts.trace != nil {
+		if err := opts.trace.Attach(mu, emu); err != nil {
+			return 0, err
+		}
+	}
 
-	if _, err := d.Load(exe, args); err != nil {
-		return err
+	if _, err := d.Load(exe, path, args); err != nil {
+		return 0, err
 	}
 
-	if err := emu.Start(); err != nil {
-		return err
+	s := session.New(opts.limits, con.LastInput)
+	var spy *sysop.Spy
+	if opts.spy != "" {
+		spy = sysop.New(screen, con, s, caller, video.NewEncoder(opts.emulation), renderer, opts.spyEncoding)
+		if err := listenSpy(spy, opts.spy); err != nil {
+			return 0, err
+		}
+		// Ends chat, which holds the door, before the renderer is stopped
+		defer spy.Close()
+	}
+	s.OnWarn = func(left time.Duration) {
+		msg := fmt.Sprintf("\r\n\a*** %d minute(s) left ***\r\n", int(left.Round(time.Minute).Minutes()))
+		warn := func() {
+			// Not the door's output, so it isn't recorded
+			con.Locked(func() { out.Write([]byte(msg)) })
+		}
+		switch {
+		case spy == nil:
+			warn()
+		case !spy.Notice([]byte(msg)):
+			// Chat may be starting, which would hold the console and
+			// with it the session's checks
+			go warn()
+		}
+	}
+	s.OnExpire = func(err error) {
+		glog.Infof("Ending door: %s", err)
+		if spy != nil {
+			// The door can't stop while chat holds its output
+			spy.EndChat()
+		}
+		// Wakes the door if it is waiting for a key so the emulator can stop
+		con.Stop(err)
+		mu.Stop()
 	}
+	// A replay ends where the recording did instead
+	if opts.replay == nil {
+		s.Start()
+		// A local console's input ending isn't anyone hanging up
+		if opts.remote {
+			s.WatchCarrier(con.Lost())
+		}
+	}
+	defer s.Close()
+
+	execute := emu.Start
+	if opts.debug != nil {
+		execute = func() error { return opts.debug.run(mu, emu, d) }
+	}
+	if err := execute(); err != nil {
+		return 0, err
+	}
+	ended := s.Err()
+	if ended != nil {
+		// Close the door's files as if it had exited
+		d.Terminate(0)
+	} else {
+		code, _ = d.ReturnCode()
+	}
+	if rec != nil {
+		if err := rec.End(code, ended, screen.Bytes()); err != nil {
+			glog.Warningf("Error writing recording: '%s'", err)
+		}
+	}
+	if opts.replay != nil {
+		opts.replay.Finish(code, screen.Bytes())
+	}
+	return code, ended
+}
 
+// Replays the recording in file, printing how the door's run differed.
+// Returns whether it matched.
+func replay(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	p, err := record.Load(f)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+	h := p.Header
+	program := h.Program
+	if *playProgram != "" {
+		program = *playProgram
+	}
+	exe, err := dos.ReadExeFromFile(program)
+	if err != nil {
+		return false, err
+	}
+	cfg, err := loadConfig(*playConfig, *playProfile, program)
+	if err != nil {
+		return false, err
+	}
+	encoding, err := codepage.ParseEncoding(h.Encoding)
+	if err != nil {
+		return false, err
+	}
+	emulation, err := video.ParseEmulation(h.Emulation)
+	if err != nil {
+		return false, err
+	}
+	opts := runOptions{
+		caller:     h.Caller,
+		dropDir:    h.DropDir,
+		encoding:   encoding,
+		emulation:  emulation,
+		doorAvatar: h.DoorAvatar,
+		program:    program,
+		remote:     h.Remote,
+		replay:     p,
+		display:    io.Discard,
+		config:     cfg,
+	}
+	if *playShow {
+		opts.display = os.Stdout
+	}
+	if _, err := run(exe, h.Args, opts); err != nil {
+		return false, err
+	}
+	diffs := p.Differences()
+	if len(diffs) == 0 {
+		fmt.Println("Replay matches the recording")
+		return true, nil
+	}
+	fmt.Println("Replay differs from the recording:")
+	for _, diff := range diffs {
+		fmt.Println("  " + diff)
+	}
+	return false, nil
+}
+
+// Shows the door to the sysop on a Unix socket at path, or a pty when path
+// is "pty".
+func listenSpy(spy *sysop.Spy, path string) error {
+	if path == "pty" {
+		pty, name, err := sysop.OpenPty()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Sysop view on %s\n", name)
+		go spy.Attach(pty)
+		return nil
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	// Closing the spy closes ln, which removes the socket
+	go spy.Serve(ln)
 	return nil
 }
 
@@ -84,6 +629,44 @@ ivdoor [arguments] <command> [command arguments]
 The commands are:
 	inst        Execute a string of opcodes
 	run         Execute a DOS executable (exe, com, or binary image)
+	            run [-caller file.json] [-name ..] <program> [args]
+	            writes DOOR.SYS, DORINFO1.DEF, CHAIN.TXT and DOOR32.SYS
+	            when caller information is given, and ends the door when
+	            the caller's time is up (exit status 253), they've been
+	            idle for -idle (exit status 254) or it is still running
+	            -grace after the caller hung up (exit status 255)
+	            -spy shows the door to the sysop on a Unix socket or pty,
+	            with hot keys ^A c (chat), ^A +/- (time) and ^A k (kick,
+	            exit status 252)
+	            -record writes everything the door sees to a file, for
+	            replaying it when tracking down a bug
+	            -cast saves what the caller sees as asciicast v2 or ttyrec
+	            -trace writes a JSON line for each interrupt the door
+	            calls, with its function, arguments and result, limited
+	            to -trace-int interrupts and -trace-cs segments, and for
+	            each instruction with -trace-inst
+	            -config reads the drives, environment, DOS version, memory,
+	            devices, encoding, limits and logging from an INI file,
+	            with the [section profile] sections for -profile, which
+	            defaults to the program's name; flags override the file
+	serve       Run a door for every caller connecting over telnet
+	            serve [-addr :2323] [-nodes 4] [-cast-dir dir]
+	                  [-config file] [-profile name] <program> [args]
+	replay      Run a door again against a recording and compare
+	            replay [-show] [-program file] [-config file] <recording>
+	debug       Run a program under an interactive debugger, with
+	            breakpoints, stepping and register and memory commands,
+	            or for gdb to connect to with target remote
+	            debug [-config file] [-profile name] [-gdb addr]
+	                  <program> [args]
+	info        Show a program's header, relocations, memory needs, packer
+	            and compiler
+	            info [-json] <program>
+	unpack      Undo LZEXE or PKLITE packing, to look at the program
+	            itself
+	            unpack [-o file] <program>
+	            PKLITE -e and its small model are recognized but not
+	            unpacked.  Packed doors run as they are either way
 	help        Displays help
 		
 Program arguments:
@@ -114,11 +697,154 @@ func main() {
 			fmt.Println(err)
 			return
 		}
-		err = run(exe, cmdRun.Args()[1:])
+		caller, err := callerInfo()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cfg, err := loadConfig(*runConfig, *runProfile, file)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
+		if fromConfig(cmdRun, cfg, "encoding", "console.encoding") {
+			*runEncode = cfg.Encoding
+		}
+		if fromConfig(cmdRun, cfg, "warn", "limits.warn") {
+			*runWarn = cfg.Limits.Warn
+		}
+		if fromConfig(cmdRun, cfg, "idle", "limits.idle") {
+			*runIdle = cfg.Limits.Idle
+		}
+		if fromConfig(cmdRun, cfg, "grace", "limits.grace") {
+			*runGrace = cfg.Limits.Grace
+		}
+		encoding, err := codepage.ParseEncoding(*runEncode)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		spyEncoding, err := codepage.ParseEncoding(*runSpyEnc)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		opts := runOptions{
+			caller:      caller,
+			dropDir:     *runDropDir,
+			encoding:    encoding,
+			doorAvatar:  *runDoorAVT,
+			spy:         *runSpy,
+			spyEncoding: spyEncoding,
+			program:     file,
+			record:      *runRecord,
+			config:      cfg,
+			limits: session.Limits{
+				Warn:  time.Duration(*runWarn) * time.Minute,
+				Idle:  *runIdle,
+				Grace: *runGrace,
+			},
+		}
+		if caller == nil && cfg.Given("limits.time") {
+			opts.limits.Time = time.Duration(cfg.Limits.Time) * time.Minute
+		}
+		if caller != nil {
+			opts.limits.Time = time.Duration(caller.TimeLeft) * time.Minute
+			if caller.Avatar {
+				opts.emulation = video.Avatar
+			}
+		}
+		var c *cast.Writer
+		if *runCast != "" {
+			c, err = createCast(*runCast, *runCastFmt, file)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			opts.cast = c
+		}
+		if *runTrace != "" {
+			opts.trace, err = createTrace(*runTrace, *runTrInts, *runTrCS, *runTrInst)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		code, err := run(exe, cmdRun.Args()[1:], opts)
+		if c != nil {
+			if err := c.Close(); err != nil {
+				fmt.Println(err)
+			}
+		}
+		if opts.trace != nil {
+			if err := opts.trace.Close(); err != nil {
+				fmt.Println(err)
+			}
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitStatus(err))
+		}
+		os.Exit(int(code))
+	case "replay":
+		cmdPlay.Parse(args[1:])
+		if cmdPlay.NArg() < 1 {
+			fmt.Print("ivdoor\n\nUsage: ivdoor replay <recording>.\n")
+			showHelp()
+			os.Exit(1)
+		}
+		ok, err := replay(cmdPlay.Arg(0))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitError)
+		}
+		if !ok {
+			os.Exit(exitError)
+		}
+	case "serve":
+		cmdServe.Parse(args[1:])
+		if cmdServe.NArg() < 1 {
+			fmt.Print("ivdoor\n\nUsage: ivdoor serve <program> [args].\n")
+			showHelp()
+			os.Exit(1)
+		}
+		if err := serve(cmdServe.Arg(0), cmdServe.Args()[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(exitError)
+		}
+	case "debug":
+		cmdDebug.Parse(args[1:])
+		if cmdDebug.NArg() < 1 {
+			fmt.Print("ivdoor\n\nUsage: ivdoor debug <program> [args].\n")
+			showHelp()
+			os.Exit(1)
+		}
+		if err := debugProgram(cmdDebug.Arg(0), cmdDebug.Args()[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(exitError)
+		}
+	case "info":
+		cmdInfo.Parse(args[1:])
+		if cmdInfo.NArg() < 1 {
+			fmt.Print("ivdoor\n\nUsage: ivdoor info [-json] <program>.\n")
+			showHelp()
+			os.Exit(1)
+		}
+		if err := info(os.Stdout, cmdInfo.Arg(0), *infoJSON); err != nil {
+			fmt.Println(err)
+			os.Exit(exitError)
+		}
+	case "unpack":
+		cmdUnpack.Parse(args[1:])
+		if cmdUnpack.NArg() < 1 {
+			fmt.Print("ivdoor\n\nUsage: ivdoor unpack [-o file] <program>.\n")
+			showHelp()
+			os.Exit(1)
+		}
+		if err := unpack(cmdUnpack.Arg(0), *unpackOut); err != nil {
+			fmt.Println(err)
+			os.Exit(exitError)
+		}
 	case "inst":
 		cmdInst.Parse(args[1:])
 		if cmdInst.NArg() < 1 {
@@ -138,7 +864,7 @@ func main() {
 			Hdr:    dos.ExeHeader{},
 			Data:   b,
 		}
-		err = run(exe, []string{})
+		_, err = run(exe, []string{}, runOptions{})
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -0,0 +1,489 @@
+// Package record records door sessions so that they can be replayed.
+//
+// Everything a door can see from outside the emulator is recorded: input
+// from the caller, the clock and what its calls to host files returned,
+// from opening and reading them to asking about them.  Each of
+// these is tagged with the number of interrupts the door had raised when
+// it happened, which is the same on every run of the door given the same
+// input, and replaying feeds them back at the same points.  The door's
+// console output and final screen are recorded as well, so a replay can
+// be checked against the session.  A replay doesn't touch the host's
+// files: it neither reads nor writes them.
+//
+// A recording is a JSON header line followed by one JSON event per line.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/cpu"
+	"door86.org/ivdoor/dropfile"
+	"door86.org/ivdoor/video"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Kinds of event
+const (
+	// Data arrived from the caller
+	Input = "input"
+	// The caller's input ended
+	Hangup = "hangup"
+	// The door read the clock, which said Time
+	Clock = "clock"
+	// The door made the INT 21h call Call to the host's files, which left
+	// Regs and made the memory writes Mem, failing with Err when set
+	Host = "host"
+	// The door wrote Data to the console
+	Output = "output"
+	// The door exited with Code, or was ended with Err, leaving Screen
+	End = "end"
+)
+
+// Header describes how the door was run.
+type Header struct {
+	Program    string         `json:"program"`
+	Args       []string       `json:"args,omitempty"`
+	Start      time.Time      `json:"start"`
+	Encoding   string         `json:"encoding"`
+	Emulation  string         `json:"emulation"`
+	DoorAvatar bool           `json:"door_avatar,omitempty"`
+	Caller     *dropfile.Info `json:"caller,omitempty"`
+	DropDir    string         `json:"drop_dir,omitempty"`
+	// The caller was connected over the network
+	Remote bool `json:"remote,omitempty"`
+}
+
+type Event struct {
+	// Interrupts the door had raised
+	Seq uint64 `json:"seq"`
+	// Milliseconds since the start, for people reading the recording
+	Ms   int64      `json:"ms"`
+	Kind string     `json:"kind"`
+	Data []byte     `json:"data,omitempty"`
+	Time *time.Time `json:"time,omitempty"`
+	// AX the door made a host call with
+	Call uint16            `json:"call,omitempty"`
+	Regs map[string]uint16 `json:"regs,omitempty"`
+	Mem  []Write           `json:"mem,omitempty"`
+	Err  string            `json:"err,omitempty"`
+	Code uint8             `json:"code,omitempty"`
+	// Characters and attributes, as in video memory
+	Screen []byte `json:"screen,omitempty"`
+}
+
+// Write is a write to the door's memory.
+type Write struct {
+	Addr uint32 `json:"addr"`
+	Data []byte `json:"data"`
+}
+
+// The registers a host call can change
+var hostRegs = []struct {
+	name string
+	reg  int
+}{
+	{"ax", uc.X86_REG_AX}, {"bx", uc.X86_REG_BX}, {"cx", uc.X86_REG_CX}, {"dx", uc.X86_REG_DX},
+	{"si", uc.X86_REG_SI}, {"di", uc.X86_REG_DI}, {"ds", uc.X86_REG_DS}, {"es", uc.X86_REG_ES},
+	{"flags", uc.X86_REG_FLAGS},
+}
+
+// Recorder writes a recording as the session happens.
+type Recorder struct {
+	header Header
+	// Returns the number of interrupts raised so far
+	seq func() uint64
+	con *console.Console
+
+	mu  sync.Mutex
+	w   io.WriteCloser
+	buf *bufio.Writer
+	enc *json.Encoder
+	err error
+	// End has closed the recording
+	closed bool
+}
+
+// NewRecorder starts a recording on w, which is closed by End.  h.Start is
+// set to now when zero.
+func NewRecorder(w io.WriteCloser, h Header) (*Recorder, error) {
+	if h.Start.IsZero() {
+		h.Start = time.Now()
+	}
+	buf := bufio.NewWriter(w)
+	r := &Recorder{header: h, w: w, buf: buf, enc: json.NewEncoder(buf)}
+	if err := r.enc.Encode(h); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Start returns when the session started.
+func (r *Recorder) Start() time.Time {
+	return r.header.Start
+}
+
+func (r *Recorder) record(e Event) {
+	e.Seq = r.seq()
+	e.Ms = time.Since(r.header.Start).Milliseconds()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode(e)
+	}
+}
+
+// Attach makes con hold the caller's input until Step, recording it as it
+// is let through.  seq returns the number of interrupts the door has
+// raised, typically core.Emulator.Interrupts.
+func (r *Recorder) Attach(con *console.Console, seq func() uint64) {
+	r.con = con
+	r.seq = seq
+	con.Hold(func(b []byte, err error) {
+		if len(b) > 0 {
+			r.record(Event{Kind: Input, Data: b})
+		}
+		if err != nil {
+			r.record(Event{Kind: Hangup})
+		}
+	})
+}
+
+// Step is called before each interrupt, letting through the input that
+// arrived since the last one.
+func (r *Recorder) Step() {
+	r.con.Admit()
+}
+
+// Now returns the time, recording that the door read it.
+func (r *Recorder) Now() time.Time {
+	t := time.Now()
+	r.record(Event{Kind: Clock, Time: &t})
+	return t
+}
+
+// HostCall runs call, recording the registers it leaves and the memory it
+// writes.
+func (r *Recorder) HostCall(mu uc.Unicorn, call func(mu uc.Unicorn) error) error {
+	e := Event{Kind: Host, Call: cpu.Reg16(mu, uc.X86_REG_AX), Regs: make(map[string]uint16)}
+	w := &memRecorder{Unicorn: mu}
+	err := call(w)
+	for _, r := range hostRegs {
+		e.Regs[r.name] = cpu.Reg16(mu, r.reg)
+	}
+	e.Mem = w.writes
+	if err != nil {
+		e.Err = err.Error()
+	}
+	r.record(e)
+	return err
+}
+
+// Passes memory writes on, keeping a copy.
+type memRecorder struct {
+	uc.Unicorn
+	writes []Write
+}
+
+func (m *memRecorder) MemWrite(addr uint64, data []byte) error {
+	m.writes = append(m.writes, Write{Addr: uint32(addr), Data: append([]byte(nil), data...)})
+	return m.Unicorn.MemWrite(addr, data)
+}
+
+// Output returns a writer recording the door's console output.
+func (r *Recorder) Output() io.Writer {
+	return outputRecorder{r}
+}
+
+type outputRecorder struct {
+	r *Recorder
+}
+
+func (o outputRecorder) Write(p []byte) (int, error) {
+	o.r.record(Event{Kind: Output, Data: append([]byte(nil), p...)})
+	return len(p), nil
+}
+
+// End records how the door ended, with its return code or the error it
+// was ended with, and the final screen, then closes the recording.  Only
+// the first call does, later ones return what it did.
+func (r *Recorder) End(code uint8, ended error, screen []byte) error {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return r.err
+	}
+	e := Event{Kind: End, Code: code, Screen: screen}
+	if ended != nil {
+		e.Err = ended.Error()
+	}
+	r.record(e)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.err == nil {
+		r.err = r.buf.Flush()
+	}
+	if err := r.w.Close(); r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// Player replays a recording.
+type Player struct {
+	Header Header
+	// Input and hangups, then clock reads and host calls, in order
+	input, clock, host []Event
+	output             []byte
+	end                *Event
+	// Returns the number of interrupts raised so far
+	seq func() uint64
+	con *console.Console
+
+	mu sync.Mutex
+	// Console output of the replay
+	got []byte
+	// Where the replay went differently from the recording
+	diverged []string
+	// The replay was stopped where the recording ended
+	stopped bool
+	code    uint8
+	screen  []byte
+}
+
+// Load reads a recording.
+func Load(r io.Reader) (*Player, error) {
+	dec := json.NewDecoder(r)
+	p := &Player{}
+	if err := dec.Decode(&p.Header); err != nil {
+		return nil, fmt.Errorf("reading recording header: %w", err)
+	}
+	for {
+		var e Event
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading recording: %w", err)
+		}
+		switch e.Kind {
+		case Input, Hangup:
+			p.input = append(p.input, e)
+		case Clock:
+			if e.Time == nil {
+				return nil, fmt.Errorf("clock event at %d without a time", e.Seq)
+			}
+			p.clock = append(p.clock, e)
+		case Host:
+			p.host = append(p.host, e)
+		case Output:
+			p.output = append(p.output, e.Data...)
+		case End:
+			end := e
+			p.end = &end
+		default:
+			return nil, fmt.Errorf("unknown event '%s' at %d", e.Kind, e.Seq)
+		}
+	}
+	if p.end == nil {
+		return nil, errors.New("recording has no end, the session may still have been running")
+	}
+	return p, nil
+}
+
+// Attach feeds the recorded input to con.  seq returns the number of
+// interrupts the door has raised.
+func (p *Player) Attach(con *console.Console, seq func() uint64) {
+	p.con = con
+	p.seq = seq
+}
+
+// Step is called before each interrupt, delivering the input recorded for
+// this point.  It returns an error once the door has reached the point the
+// recording ended at, which should stop it.
+func (p *Player) Step() error {
+	seq := p.seq()
+	for len(p.input) > 0 && p.input[0].Seq <= seq {
+		e := p.input[0]
+		p.input = p.input[1:]
+		if e.Kind == Hangup {
+			p.con.Hangup()
+		} else {
+			p.con.Inject(e.Data)
+		}
+	}
+	switch {
+	case seq == p.end.Seq && p.end.Err != "":
+		// The door was ended during this interrupt, likely waiting for a
+		// key
+		p.con.Stop(errors.New(p.end.Err))
+	case seq > p.end.Seq:
+		p.mu.Lock()
+		p.stopped = true
+		p.mu.Unlock()
+		if p.end.Err != "" {
+			return errors.New(p.end.Err)
+		}
+		return errors.New("door ran past the end of the recording")
+	}
+	return nil
+}
+
+func (p *Player) diverge(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.diverged = append(p.diverged, fmt.Sprintf("at interrupt %d: ", p.seq())+fmt.Sprintf(format, args...))
+}
+
+// Now returns the next recorded clock reading.
+func (p *Player) Now() time.Time {
+	if len(p.clock) == 0 {
+		p.diverge("clock read more often than recorded")
+		return p.Header.Start
+	}
+	e := p.clock[0]
+	p.clock = p.clock[1:]
+	if e.Seq != p.seq() {
+		p.diverge("clock read that was recorded at interrupt %d", e.Seq)
+	}
+	return *e.Time
+}
+
+// HostCall makes the changes recorded for the next host call instead of
+// running call, returning its recorded error.
+func (p *Player) HostCall(mu uc.Unicorn, call func(mu uc.Unicorn) error) error {
+	ax := cpu.Reg16(mu, uc.X86_REG_AX)
+	if len(p.host) == 0 {
+		p.diverge("host call %04Xh that wasn't recorded", ax)
+		return fmt.Errorf("host call %04Xh isn't in the recording", ax)
+	}
+	e := p.host[0]
+	p.host = p.host[1:]
+	if e.Call != ax {
+		p.diverge("host call %04Xh where %04Xh was made", ax, e.Call)
+	} else if e.Seq != p.seq() {
+		p.diverge("host call %04Xh that was recorded at interrupt %d", ax, e.Seq)
+	}
+	for _, r := range hostRegs {
+		if v, ok := e.Regs[r.name]; ok {
+			mu.RegWrite(r.reg, uint64(v))
+		}
+	}
+	for _, w := range e.Mem {
+		if err := mu.MemWrite(uint64(w.Addr), w.Data); err != nil {
+			return err
+		}
+	}
+	if e.Err != "" {
+		return errors.New(e.Err)
+	}
+	return nil
+}
+
+// Output returns a writer collecting the door's console output.
+func (p *Player) Output() io.Writer {
+	return outputPlayer{p}
+}
+
+type outputPlayer struct {
+	p *Player
+}
+
+func (o outputPlayer) Write(b []byte) (int, error) {
+	o.p.mu.Lock()
+	defer o.p.mu.Unlock()
+	o.p.got = append(o.p.got, b...)
+	return len(b), nil
+}
+
+// Finish records how the replayed door ended.
+func (p *Player) Finish(code uint8, screen []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.code = code
+	p.screen = screen
+}
+
+// Differences returns how the replay differed from the recording, nothing
+// when it matched.
+func (p *Player) Differences() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	diffs := append([]string(nil), p.diverged...)
+	if len(p.input) > 0 {
+		diffs = append(diffs, fmt.Sprintf("%d input event(s) weren't delivered", len(p.input)))
+	}
+	if len(p.host) > 0 {
+		diffs = append(diffs, fmt.Sprintf("%d host call(s) weren't made", len(p.host)))
+	}
+	switch {
+	case p.end.Err != "" && !p.stopped:
+		diffs = append(diffs, fmt.Sprintf("door exited with %d, the recording was ended: %s", p.code, p.end.Err))
+	case p.end.Err == "" && p.stopped:
+		diffs = append(diffs, fmt.Sprintf("door didn't exit, the recording exited with %d", p.end.Code))
+	case p.end.Err == "" && p.code != p.end.Code:
+		diffs = append(diffs, fmt.Sprintf("door exited with %d, the recording with %d", p.code, p.end.Code))
+	}
+	if d := diffOutput(p.output, p.got); d != "" {
+		diffs = append(diffs, d)
+	}
+	return append(diffs, diffScreens(p.end.Screen, p.screen)...)
+}
+
+// Describes where the replayed output first differs from the recorded.
+func diffOutput(want, got []byte) string {
+	i := 0
+	for i < len(want) && i < len(got) && want[i] == got[i] {
+		i++
+	}
+	if i == len(want) && i == len(got) {
+		return ""
+	}
+	context := func(b []byte) []byte {
+		start, end := i-20, i+20
+		if start < 0 {
+			start = 0
+		}
+		if end > len(b) {
+			end = len(b)
+		}
+		if start > end {
+			return nil
+		}
+		return b[start:end]
+	}
+	return fmt.Sprintf("output differs at byte %d of %d: recorded %q, replayed %q (%d bytes)",
+		i, len(want), context(want), context(got), len(got))
+}
+
+// Lists the rows that differ between two screens.
+func diffScreens(want, got []byte) []string {
+	const width = video.Width
+	var diffs []string
+	for row := 0; (row+1)*width*2 <= len(want) && (row+1)*width*2 <= len(got); row++ {
+		w, g := want[row*width*2:(row+1)*width*2], got[row*width*2:(row+1)*width*2]
+		if string(w) == string(g) {
+			continue
+		}
+		wc, gc := make([]byte, width), make([]byte, width)
+		for i := range wc {
+			wc[i], gc[i] = w[i*2], g[i*2]
+		}
+		if string(wc) == string(gc) {
+			diffs = append(diffs, fmt.Sprintf("screen row %d: colours differ", row+1))
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("screen row %d: recorded %q, replayed %q", row+1, wc, gc))
+	}
+	if len(want) != len(got) {
+		diffs = append(diffs, fmt.Sprintf("screen size: recorded %d bytes, replayed %d", len(want), len(got)))
+	}
+	return diffs
+}
@@ -0,0 +1,153 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/cpu/cputest"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// A door that reads the clock and a file, then echoes a line of keys,
+// raising an interrupt for each step.
+type door struct {
+	seq    uint64
+	step   func() error
+	con    *console.Console
+	out    io.Writer
+	now    func() time.Time
+	host   func(uc.Unicorn, func(uc.Unicorn) error) error
+	screen []byte
+}
+
+// Reads the file, which holds contents, with INT 21h 3Fh.
+func (d *door) read(contents string) string {
+	mu := cputest.New()
+	mu.SetRegs(map[int]uint64{uc.X86_REG_AX: 0x3F00, uc.X86_REG_FLAGS: 1})
+	d.host(mu, func(mu uc.Unicorn) error {
+		mu.MemWrite(0x10, []byte(contents))
+		mu.RegWrite(uc.X86_REG_AX, uint64(len(contents)))
+		mu.RegWrite(uc.X86_REG_FLAGS, 0)
+		return nil
+	})
+	if mu.Carry() {
+		return "failed"
+	}
+	return string(mu.Mem[0x10 : 0x10+mu.Reg(uc.X86_REG_AX)])
+}
+
+func (d *door) interrupt() error {
+	d.seq++
+	return d.step()
+}
+
+func (d *door) run(t *testing.T) (time.Time, string) {
+	d.interrupt()
+	now := d.now()
+	d.interrupt()
+	data := d.read("live contents")
+	d.out.Write([]byte("Hello " + data + "\r\n"))
+	for {
+		if err := d.interrupt(); err != nil {
+			break
+		}
+		c, err := d.con.ReadByte()
+		if err != nil || c == '\r' {
+			break
+		}
+		d.out.Write([]byte{c})
+	}
+	d.screen = []byte(strings.Repeat("x\x07", 2000))
+	return now, data
+}
+
+func (d *door) seqFunc() uint64 { return d.seq }
+
+func TestRecordReplay(t *testing.T) {
+	keys, typing := io.Pipe()
+	var out, recording bytes.Buffer
+	con := console.New(keys, &out)
+	rec, err := NewRecorder(nopCloser{&recording}, Header{Program: "DOOR.EXE", Encoding: "cp437", Emulation: "ansi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &door{con: con, out: io.MultiWriter(&out, rec.Output()), now: rec.Now, host: rec.HostCall}
+	rec.Attach(con, d.seqFunc)
+	d.step = func() error {
+		rec.Step()
+		return nil
+	}
+	go typing.Write([]byte("hi\r"))
+	recNow, recData := d.run(t)
+	if err := rec.End(0, nil, d.screen); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first end is recorded
+	if err := rec.End(1, errors.New("ended again"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Load(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Header.Program != "DOOR.EXE" || p.end.Code != 0 || p.end.Err != "" {
+		t.Errorf("header: %+v, end: %+v", p.Header, p.end)
+	}
+	replayDoor := func(live bool) *Player {
+		p, _ := Load(bytes.NewReader(recording.Bytes()))
+		nothing, _ := io.Pipe()
+		con := console.New(nothing, io.Discard)
+		d := &door{con: con, out: p.Output(), now: p.Now, host: p.HostCall}
+		if live {
+			// The file is read on the host after all, which has changed
+			d.host = func(mu uc.Unicorn, call func(uc.Unicorn) error) error {
+				call(mu)
+				mu.MemWrite(0x10, []byte("other"))
+				return mu.RegWrite(uc.X86_REG_AX, 5)
+			}
+		}
+		p.Attach(con, d.seqFunc)
+		d.step = p.Step
+		now, data := d.run(t)
+		if !live && (!now.Equal(recNow) || data != recData) {
+			t.Errorf("replay read %v %q, recorded %v %q", now, data, recNow, recData)
+		}
+		p.Finish(0, d.screen)
+		return p
+	}
+	if recData != "live contents" {
+		t.Errorf("recorded read %q", recData)
+	}
+	if diffs := replayDoor(false).Differences(); len(diffs) != 0 {
+		t.Errorf("replay differs: %q", diffs)
+	}
+
+	// The door seeing different file contents goes differently
+	diffs := replayDoor(true).Differences()
+	if len(diffs) != 2 || diffs[0] != "1 host call(s) weren't made" || !strings.Contains(diffs[1], "output differs at byte 6") {
+		t.Errorf("diverging replay: %q", diffs)
+	}
+}
+
+func TestDiffScreens(t *testing.T) {
+	want := []byte(strings.Repeat(" \x07", 2000))
+	got := append([]byte(nil), want...)
+	copy(got[160:], "a\x07b\x07")
+	got[321] = 0x1F
+	diffs := diffScreens(want, got)
+	if len(diffs) != 2 || !strings.HasPrefix(diffs[0], "screen row 2: recorded") || diffs[1] != "screen row 3: colours differ" {
+		t.Errorf("diffs: %q", diffs)
+	}
+}
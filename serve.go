@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"door86.org/ivdoor/cast"
+	"door86.org/ivdoor/codepage"
+	"door86.org/ivdoor/dos"
+	"door86.org/ivdoor/dropfile"
+	"door86.org/ivdoor/session"
+	"door86.org/ivdoor/telnet"
+	"door86.org/ivdoor/video"
+	"github.com/golang/glog"
+)
+
+var (
+	cmdServe = flag.NewFlagSet("serve", flag.ExitOnError)
+
+	serveAddr    = cmdServe.String("addr", ":2323", "address to listen for telnet callers on")
+	serveNodes   = cmdServe.Int("nodes", 4, "callers served at once")
+	serveDropDir = cmdServe.String("dropdir", "", "DOS directory for each node's drop files, %d is replaced by the node number; none are written when empty")
+	serveTime    = cmdServe.Int("time", 60, "minutes each caller has")
+	serveWarn    = cmdServe.Int("warn", 2, "minutes left at which the caller is warned")
+	serveIdle    = cmdServe.Duration("idle", 5*time.Minute, "hang up after this long without a keystroke, 0 for no limit")
+	serveGrace   = cmdServe.Duration("grace", 10*time.Second, "time a door has to exit after the caller hangs up")
+	serveEncode  = cmdServe.String("encoding", "cp437", "character set of the callers' terminals: cp437, utf8 or ascii")
+	serveCastDir = cmdServe.String("cast-dir", "", "directory to save each session to, for playing back")
+	serveCastFmt = cmdServe.String("cast-format", "asciicast", "format of the saved sessions: asciicast or ttyrec")
+	serveConfig  = cmdServe.String("config", "", "config file describing the machine the door runs on")
+	serveProfile = cmdServe.String("profile", "", "profile in the config file (default the program's name)")
+)
+
+// Creates a recording of what the caller sees at path.  format may be
+// empty to go by the extension.
+func createCast(path, format, program string) (*cast.Writer, error) {
+	f, err := cast.ParseFormat(format, path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cast.New(file, f, cast.Info{
+		Width:  video.Width,
+		Height: video.Height,
+		Title:  filepath.Base(program),
+		Term:   "ansi",
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Node numbers in use.
+type nodes struct {
+	mu   sync.Mutex
+	used []bool
+}
+
+// Returns the lowest free node number, or 0 when all are in use.
+func (n *nodes) take() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, used := range n.used {
+		if !used {
+			n.used[i] = true
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (n *nodes) free(node int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.used[node-1] = false
+}
+
+// Listens for telnet callers, running program for each of them on its
+// own node.
+func serve(program string, args []string) error {
+	exe, err := dos.ReadExeFromFile(program)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(*serveConfig, *serveProfile, program)
+	if err != nil {
+		return err
+	}
+	for _, o := range []struct {
+		name, key string
+		set       func()
+	}{
+		{"encoding", "console.encoding", func() { *serveEncode = cfg.Encoding }},
+		{"time", "limits.time", func() { *serveTime = cfg.Limits.Time }},
+		{"warn", "limits.warn", func() { *serveWarn = cfg.Limits.Warn }},
+		{"idle", "limits.idle", func() { *serveIdle = cfg.Limits.Idle }},
+		{"grace", "limits.grace", func() { *serveGrace = cfg.Limits.Grace }},
+	} {
+		if fromConfig(cmdServe, cfg, o.name, o.key) {
+			o.set()
+		}
+	}
+	encoding, err := codepage.ParseEncoding(*serveEncode)
+	if err != nil {
+		return err
+	}
+	format, err := cast.ParseFormat(*serveCastFmt, "")
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", *serveAddr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Printf("Serving %s on %s\n", program, ln.Addr())
+
+	// What every caller's run has in common
+	base := runOptions{
+		encoding: encoding,
+		program:  program,
+		config:   cfg,
+		limits: session.Limits{
+			Time:  time.Duration(*serveTime) * time.Minute,
+			Warn:  time.Duration(*serveWarn) * time.Minute,
+			Idle:  *serveIdle,
+			Grace: *serveGrace,
+		},
+	}
+	n := &nodes{used: make([]bool, *serveNodes)}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		node := n.take()
+		if node == 0 {
+			conn.Write([]byte("All nodes are busy, please call back later.\r\n"))
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer n.free(node)
+			serveCaller(conn, node, exe, args, base, format)
+		}()
+	}
+}
+
+// Runs the door for the caller on conn, with opts completed for them.
+func serveCaller(conn net.Conn, node int, exe *dos.Executable, args []string, opts runOptions, format cast.Format) {
+	defer conn.Close()
+	glog.Infof("Node %d: call from %s", node, conn.RemoteAddr())
+	t, err := telnet.New(conn)
+	if err != nil {
+		glog.Warningf("Node %d: telnet: '%s'", node, err)
+		return
+	}
+	opts.input, opts.display, opts.remote = t, t, true
+	if *serveDropDir != "" {
+		opts.dropDir = strings.ReplaceAll(*serveDropDir, "%d", strconv.Itoa(node))
+		opts.caller = &dropfile.Info{
+			Name:     "Guest",
+			Alias:    "Guest",
+			TimeLeft: *serveTime,
+			Node:     node,
+			Baud:     38400,
+			ANSI:     true,
+		}
+	}
+	if *serveCastDir != "" {
+		ext := ".cast"
+		if format == cast.Ttyrec {
+			ext = ".ttyrec"
+		}
+		name := fmt.Sprintf("node%d-%s%s", node, time.Now().Format("20060102-150405"), ext)
+		c, err := createCast(filepath.Join(*serveCastDir, name), format.String(), opts.program)
+		if err != nil {
+			glog.Warningf("Node %d: not saving session: '%s'", node, err)
+		} else {
+			opts.cast = c
+			defer func() {
+				if err := c.Close(); err != nil {
+					glog.Warningf("Node %d: error saving session: '%s'", node, err)
+				}
+			}()
+		}
+	}
+	code, err := run(exe, args, opts)
+	if err != nil {
+		glog.Infof("Node %d: door ended: %s", node, err)
+		return
+	}
+	glog.Infof("Node %d: door exited with %d", node, code)
+}
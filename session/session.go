@@ -0,0 +1,212 @@
+// Package session enforces the limits a BBS puts on a call: the time the
+// caller has left, how long they may sit idle and how long a door may keep
+// running after the caller hung up.  Doors are expected to handle all of
+// these themselves, but many don't, so the emulator has to end the door.
+package session
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTimeUp   = errors.New("time limit reached")
+	ErrInactive = errors.New("inactivity timeout")
+	// The caller hung up and the door didn't exit within the grace period
+	ErrCarrierLost = errors.New("carrier lost")
+	// The sysop threw the caller off
+	ErrKicked = errors.New("kicked by the sysop")
+)
+
+// How often the limits are checked.
+const checkInterval = time.Second
+
+type Limits struct {
+	// Time the caller has left, 0 for no limit
+	Time time.Duration
+	// Warn the caller when this much time is left, 0 to not warn
+	Warn time.Duration
+	// End the session when there has been no input for this long, 0 for
+	// no limit
+	Idle time.Duration
+	// Time a door has to save and exit after the caller hangs up
+	Grace time.Duration
+}
+
+// Session watches the limits for a single call.
+type Session struct {
+	limits Limits
+	start  time.Time
+	// Returns when the caller last pressed a key
+	lastInput func() time.Time
+
+	// Called once when the time left reaches Limits.Warn
+	OnWarn func(left time.Duration)
+	// Called once when a limit is reached, with ErrTimeUp, ErrInactive or
+	// ErrCarrierLost.  It should stop the emulator.
+	OnExpire func(err error)
+
+	mu     sync.Mutex
+	warned bool
+	// When carrier was lost, zero while the caller is connected
+	lostAt time.Time
+	err    error
+	done   chan struct{}
+	once   sync.Once
+}
+
+// New creates a session starting now.  lastInput reports when the last
+// keystroke arrived, typically console.Console.LastInput.
+func New(limits Limits, lastInput func() time.Time) *Session {
+	return &Session{
+		limits:    limits,
+		start:     time.Now(),
+		lastInput: lastInput,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start watches the limits in the background until one is reached or Close
+// is called.
+func (s *Session) Start() {
+	go func() {
+		t := time.NewTicker(checkInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case now := <-t.C:
+				if s.check(now) != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// WatchCarrier starts the grace period once lost is closed, typically
+// console.Console.Lost.
+func (s *Session) WatchCarrier(lost <-chan struct{}) {
+	go func() {
+		select {
+		case <-s.done:
+		case <-lost:
+			s.carrierLost(time.Now())
+		}
+	}()
+}
+
+func (s *Session) carrierLost(now time.Time) {
+	s.mu.Lock()
+	if s.lostAt.IsZero() {
+		s.lostAt = now
+	}
+	s.mu.Unlock()
+	// Without a grace period the door is ended right away
+	s.check(now)
+}
+
+// Close stops watching the limits.
+func (s *Session) Close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// Left returns the time the caller has left, or 0 when there's no limit.
+func (s *Session) Left(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.left(now)
+}
+
+func (s *Session) left(now time.Time) time.Duration {
+	if s.limits.Time == 0 {
+		return 0
+	}
+	left := s.limits.Time - now.Sub(s.start)
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// AddTime gives the caller d more time, or takes it away when negative.
+// It does nothing when there's no time limit.
+func (s *Session) AddTime(d time.Duration) {
+	s.mu.Lock()
+	if s.limits.Time == 0 {
+		s.mu.Unlock()
+		return
+	}
+	s.limits.Time += d
+	if s.limits.Time <= 0 {
+		// 0 would be no limit at all
+		s.limits.Time = time.Nanosecond
+	}
+	// Warn again if they get back above the warning
+	if s.left(time.Now()) > s.limits.Warn {
+		s.warned = false
+	}
+	s.mu.Unlock()
+	s.check(time.Now())
+}
+
+// End ends the session with err, unless it already has ended.
+func (s *Session) End(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	s.mu.Unlock()
+	if s.OnExpire != nil {
+		s.OnExpire(err)
+	}
+}
+
+// Err returns the limit that ended the session, or nil.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Checks the limits at now, calling the hooks as needed.  Returns the
+// error the session ended with, if it has.
+func (s *Session) check(now time.Time) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	var warn bool
+	if s.limits.Time != 0 {
+		left := s.limits.Time - now.Sub(s.start)
+		switch {
+		case left <= 0:
+			s.err = ErrTimeUp
+		case !s.warned && s.limits.Warn != 0 && left <= s.limits.Warn:
+			s.warned = true
+			warn = true
+		}
+	}
+	if s.err == nil && !s.lostAt.IsZero() && now.Sub(s.lostAt) >= s.limits.Grace {
+		s.err = ErrCarrierLost
+	}
+	// A caller who hung up isn't idle, they get the grace period instead
+	if s.err == nil && s.lostAt.IsZero() && s.limits.Idle != 0 && now.Sub(s.lastInput()) >= s.limits.Idle {
+		s.err = ErrInactive
+	}
+	err := s.err
+	s.mu.Unlock()
+
+	if warn && s.OnWarn != nil {
+		s.OnWarn(s.Left(now))
+	}
+	if err != nil && s.OnExpire != nil {
+		s.OnExpire(err)
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package session
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"door86.org/ivdoor/console"
+)
+
+func TestTimeLimit(t *testing.T) {
+	lastInput := time.Now()
+	s := New(Limits{Time: 10 * time.Minute, Warn: 2 * time.Minute}, func() time.Time { return lastInput })
+	var warnings []time.Duration
+	var expired error
+	s.OnWarn = func(left time.Duration) { warnings = append(warnings, left) }
+	s.OnExpire = func(err error) { expired = err }
+
+	if err := s.check(s.start.Add(7 * time.Minute)); err != nil {
+		t.Fatalf("7 minutes in: %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warned with %v left", warnings)
+	}
+	s.check(s.start.Add(8 * time.Minute))
+	s.check(s.start.Add(9 * time.Minute))
+	if len(warnings) != 1 || warnings[0] != 2*time.Minute {
+		t.Errorf("warnings: %v, want one at 2m", warnings)
+	}
+	if err := s.check(s.start.Add(10 * time.Minute)); err != ErrTimeUp {
+		t.Errorf("at the limit: got %v, want ErrTimeUp", err)
+	}
+	if expired != ErrTimeUp || s.Err() != ErrTimeUp {
+		t.Errorf("OnExpire got %v, Err() = %v", expired, s.Err())
+	}
+}
+
+func TestIdle(t *testing.T) {
+	lastInput := time.Now()
+	s := New(Limits{Idle: 5 * time.Minute}, func() time.Time { return lastInput })
+	calls := 0
+	s.OnExpire = func(err error) { calls++ }
+
+	if err := s.check(lastInput.Add(4 * time.Minute)); err != nil {
+		t.Fatalf("idle 4 minutes: %v", err)
+	}
+	lastInput = lastInput.Add(4 * time.Minute)
+	if err := s.check(lastInput.Add(4 * time.Minute)); err != nil {
+		t.Fatalf("keystroke should reset idle time: %v", err)
+	}
+	if err := s.check(lastInput.Add(5 * time.Minute)); err != ErrInactive {
+		t.Errorf("idle 5 minutes: got %v, want ErrInactive", err)
+	}
+	s.check(lastInput.Add(6 * time.Minute))
+	if calls != 1 {
+		t.Errorf("OnExpire called %d times", calls)
+	}
+}
+
+func TestCarrierGrace(t *testing.T) {
+	lastInput := time.Now()
+	s := New(Limits{Idle: time.Minute, Grace: 10 * time.Second}, func() time.Time { return lastInput })
+	var expired error
+	s.OnExpire = func(err error) { expired = err }
+
+	lost := lastInput.Add(5 * time.Second)
+	s.carrierLost(lost)
+	if expired != nil {
+		t.Fatalf("ended before the grace period: %v", expired)
+	}
+	if err := s.check(lost.Add(9 * time.Second)); err != nil {
+		t.Fatalf("9s after hang up: %v", err)
+	}
+	if err := s.check(lost.Add(10 * time.Second)); err != ErrCarrierLost {
+		t.Errorf("after the grace period: got %v, want ErrCarrierLost", err)
+	}
+	if expired != ErrCarrierLost {
+		t.Errorf("OnExpire got %v", expired)
+	}
+}
+
+// Only a caller on the network hangs up by their input ending, a door run
+// locally with its input at EOF keeps running.
+func TestCarrierEOF(t *testing.T) {
+	for _, remote := range []bool{false, true} {
+		con := console.New(strings.NewReader(""), io.Discard)
+		if remote {
+			con = console.NewRemote(strings.NewReader(""), io.Discard)
+		}
+		s := New(Limits{}, con.LastInput)
+		expired := make(chan error, 1)
+		s.OnExpire = func(err error) { expired <- err }
+		s.WatchCarrier(con.Lost())
+		select {
+		case err := <-expired:
+			if !remote || err != ErrCarrierLost {
+				t.Errorf("remote %v: ended with %v", remote, err)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if remote {
+				t.Error("remote caller's input ended without ending the door")
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestAddTime(t *testing.T) {
+	s := New(Limits{Time: 10 * time.Minute, Warn: 2 * time.Minute}, time.Now)
+	var warnings int
+	var expired error
+	s.OnWarn = func(time.Duration) { warnings++ }
+	s.OnExpire = func(err error) { expired = err }
+
+	s.check(s.start.Add(9 * time.Minute))
+	s.AddTime(5 * time.Minute)
+	if err := s.check(s.start.Add(12 * time.Minute)); err != nil {
+		t.Fatalf("after adding time: %v", err)
+	}
+	s.check(s.start.Add(13 * time.Minute))
+	if warnings != 2 {
+		t.Errorf("warned %d times, want again after adding time", warnings)
+	}
+
+	s.AddTime(-time.Hour)
+	if expired != ErrTimeUp {
+		t.Errorf("taking all the time away: got %v, want ErrTimeUp", expired)
+	}
+	s.End(ErrKicked)
+	if s.Err() != ErrTimeUp {
+		t.Errorf("End after expiry changed Err() to %v", s.Err())
+	}
+
+	s = New(Limits{}, time.Now)
+	s.OnExpire = func(err error) { expired = err }
+	s.AddTime(time.Minute)
+	if s.Left(time.Now()) != 0 {
+		t.Error("adding time set a limit")
+	}
+	s.End(ErrKicked)
+	if expired != ErrKicked || s.Err() != ErrKicked {
+		t.Errorf("End: OnExpire got %v, Err() = %v", expired, s.Err())
+	}
+}
@@ -0,0 +1,74 @@
+package sysop
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// OpenPty creates a pty for a sysop terminal to open, returning the master
+// side to attach and the path of the slave, for example /dev/pts/3.
+//
+// The slave is kept open and in raw mode, so that the master doesn't see
+// EOF before the sysop connects, or after they leave, and a terminal
+// program opening it doesn't have to set it up.
+func OpenPty() (io.ReadWriteCloser, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	path := fmt.Sprintf("/dev/pts/%d", n)
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	var t syscall.Termios
+	if err := ioctl(slave.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, "", err
+	}
+	// As cfmakeraw(3)
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	if err := ioctl(slave.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, "", err
+	}
+	return &ptyMaster{File: master, slave: slave}, path, nil
+}
+
+// The master side of a pty, holding the slave open.
+type ptyMaster struct {
+	*os.File
+	slave *os.File
+}
+
+func (p *ptyMaster) Close() error {
+	p.slave.Close()
+	return p.File.Close()
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sysop
+
+import (
+	"errors"
+	"io"
+)
+
+// OpenPty creates a pty for a sysop terminal to open.  Ptys are only
+// supported on Linux, elsewhere use a Unix socket.
+func OpenPty() (io.ReadWriteCloser, string, error) {
+	return nil, "", errors.New("ptys are only supported on Linux")
+}
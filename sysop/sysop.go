@@ -0,0 +1,378 @@
+// Package sysop gives the sysop a view of a running door from a second
+// terminal, connected through a Unix socket or a pty.  The sysop sees the
+// caller's screen as the emulator has it, can type to the door alongside
+// the caller and has hot keys to chat with the caller, change their time
+// and throw them off.
+//
+// Hot keys start with ^A:
+//
+//	^A c  start or end chat
+//	^A +  give the caller 5 more minutes
+//	^A -  take 5 minutes away
+//	^A k  kick the caller
+//	^A ?  list the hot keys in the sysop's title bar
+//	^A ^A send ^A to the door
+package sysop
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"door86.org/ivdoor/codepage"
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/session"
+	"door86.org/ivdoor/video"
+	"github.com/golang/glog"
+)
+
+const (
+	// Starts a hot key
+	hotKey = 0x01
+	// Time added or taken away by the time hot keys
+	timeStep = 5 * time.Minute
+	// How often changes to the screen are sent to the sysop
+	renderInterval = 50 * time.Millisecond
+)
+
+const help = "^A c chat, ^A +/- 5 minutes, ^A k kick, ^A ^A sends ^A"
+
+// Spy shows a door's screen to the sysop.
+type Spy struct {
+	screen *video.Screen
+	con    *console.Console
+	// Ended by the kick hot key and changed by the time hot keys, may be
+	// nil
+	session *session.Session
+	// The caller's terminal, without going through the screen, and what
+	// redraws the screen on it after chat
+	caller   io.Writer
+	renderer *video.Renderer
+	enc      video.Encoder
+	// Character set of the sysop's terminal
+	encoding codepage.Encoding
+
+	mu        sync.Mutex
+	viewers   map[*viewer]bool
+	listeners []net.Listener
+	// Closed to end chat, nil when not chatting
+	chat chan struct{}
+	// Messages for both sides of chat, see Notice
+	notices chan []byte
+	// Closed once the screen is back after chat
+	chatDone chan struct{}
+	closed   bool
+
+	// Serializes chat output
+	chatMu sync.Mutex
+}
+
+// New creates a spy on screen, the door's screen.  Keystrokes from the
+// sysop go to con.  caller and enc are the caller's terminal and its
+// emulation, used for chat, and renderer redraws the door's screen on it
+// once chat ends.  encoding is the sysop's character set.
+func New(screen *video.Screen, con *console.Console, s *session.Session, caller io.Writer, enc video.Encoder, renderer *video.Renderer, encoding codepage.Encoding) *Spy {
+	return &Spy{
+		screen:   screen,
+		con:      con,
+		session:  s,
+		caller:   caller,
+		renderer: renderer,
+		enc:      enc,
+		encoding: encoding,
+		viewers:  map[*viewer]bool{},
+	}
+}
+
+// A sysop terminal.
+type viewer struct {
+	rw  io.ReadWriteCloser
+	out io.Writer
+	// Serializes output to out
+	mu sync.Mutex
+	r  *video.Renderer
+	// Seen ^A, the next key is a hot key
+	hot bool
+}
+
+func (v *viewer) locked(f func()) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	f()
+}
+
+func (v *viewer) write(b []byte) {
+	v.locked(func() { v.out.Write(b) })
+}
+
+// Shows a status line in the sysop's title bar, which leaves the mirrored
+// screen alone.
+func (v *viewer) status(msg string) {
+	v.write([]byte("\x1b]0;ivdoor: " + msg + "\x07"))
+}
+
+// Serve attaches every connection accepted on ln until the spy or ln is
+// closed.
+func (s *Spy) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ln.Close()
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.Attach(conn)
+	}
+}
+
+// Attach shows the screen on rw and takes the sysop's keystrokes from it
+// until it reaches EOF or the spy is closed.  rw is closed when done.
+func (s *Spy) Attach(rw io.ReadWriteCloser) {
+	v := &viewer{rw: rw, out: codepage.NewWriter(rw, s.encoding)}
+	v.r = video.NewMirror(s.screen, video.NewEncoder(video.ANSI), v.out, v.locked)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		rw.Close()
+		return
+	}
+	s.viewers[v] = true
+	s.mu.Unlock()
+	glog.Infof("Sysop attached")
+
+	done, rendered := make(chan struct{}), make(chan struct{})
+	go func() {
+		v.r.Run(renderInterval, done)
+		close(rendered)
+	}()
+	v.status(help)
+
+	in := codepage.NewReader(rw, s.encoding)
+	b := make([]byte, 256)
+	for {
+		n, err := in.Read(b)
+		for _, key := range b[:n] {
+			s.key(v, key)
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(done)
+	<-rendered
+	s.detach(v)
+	glog.Infof("Sysop detached")
+}
+
+func (s *Spy) detach(v *viewer) {
+	s.mu.Lock()
+	delete(s.viewers, v)
+	s.mu.Unlock()
+	v.rw.Close()
+}
+
+// Close ends chat, disconnects every sysop and stops serving.
+func (s *Spy) Close() {
+	s.EndChat()
+	s.mu.Lock()
+	s.closed = true
+	viewers, listeners := s.viewers, s.listeners
+	s.viewers, s.listeners = map[*viewer]bool{}, nil
+	s.mu.Unlock()
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	for v := range viewers {
+		v.rw.Close()
+	}
+}
+
+// Handles a keystroke from the sysop.
+func (s *Spy) key(v *viewer, key byte) {
+	if v.hot {
+		v.hot = false
+		s.hotKey(v, key)
+		return
+	}
+	if key == hotKey {
+		v.hot = true
+		return
+	}
+	if s.Chatting() {
+		s.chatKeys([]byte{key})
+		return
+	}
+	s.con.Inject([]byte{key})
+}
+
+func (s *Spy) hotKey(v *viewer, key byte) {
+	switch key {
+	case 'c', 'C':
+		if s.Chatting() {
+			s.EndChat()
+		} else {
+			s.StartChat()
+		}
+	case '+', '=':
+		s.addTime(v, timeStep)
+	case '-', '_':
+		s.addTime(v, -timeStep)
+	case 'k', 'K':
+		s.Kick()
+	case hotKey:
+		s.con.Inject([]byte{hotKey})
+	default:
+		v.status(help)
+	}
+}
+
+func (s *Spy) addTime(v *viewer, d time.Duration) {
+	if s.session == nil {
+		return
+	}
+	s.session.AddTime(d)
+	left := s.session.Left(time.Now())
+	if left == 0 {
+		v.status("no time limit")
+		return
+	}
+	v.status(fmt.Sprintf("%d minute(s) left", int(left.Round(time.Minute).Minutes())))
+}
+
+// Kick hangs up on the caller and ends the door.
+func (s *Spy) Kick() {
+	glog.Infof("Sysop kicked the caller")
+	s.EndChat()
+	s.con.Hangup()
+	if s.session != nil {
+		s.session.End(session.ErrKicked)
+	}
+}
+
+// Chatting reports whether the sysop is chatting with the caller.
+func (s *Spy) Chatting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chat != nil
+}
+
+// StartChat breaks into the door for a chat between the sysop and the
+// caller.  The door is held while they chat: its output waits, and the
+// caller's keystrokes go to the chat instead.
+func (s *Spy) StartChat() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chat != nil || s.closed {
+		return
+	}
+	s.chat, s.chatDone = make(chan struct{}), make(chan struct{})
+	s.notices = make(chan []byte, 8)
+	go s.runChat(s.chat, s.chatDone, s.notices)
+}
+
+// Notice shows msg, such as a time warning, to both sides of chat, and
+// returns false when they aren't chatting.  Chat holds the console until
+// it ends, so messages from outside the door come through here instead.
+func (s *Spy) Notice(msg []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chat == nil {
+		return false
+	}
+	select {
+	case s.notices <- msg:
+	default:
+		glog.Warningf("Dropped chat notice %q", msg)
+	}
+	return true
+}
+
+// EndChat ends chat and waits for the door's screen to be redrawn.
+func (s *Spy) EndChat() {
+	s.mu.Lock()
+	chat, done := s.chat, s.chatDone
+	s.chat, s.chatDone = nil, nil
+	s.mu.Unlock()
+	if chat == nil {
+		return
+	}
+	close(chat)
+	<-done
+}
+
+func (s *Spy) runChat(chat, done chan struct{}, notices chan []byte) {
+	defer close(done)
+	glog.Infof("Sysop chat started")
+	// Holding the console's lock keeps the door's output and the renderer
+	// off the caller's screen
+	s.con.Locked(func() {
+		s.con.Divert(s.chatKeys)
+		s.chatWrite(true, []byte("*** Chat with the sysop ***\r\n\r\n"))
+		for chatting := true; chatting; {
+			select {
+			case <-chat:
+				chatting = false
+			case <-s.con.Lost():
+				chatting = false
+			case msg := <-notices:
+				s.chatWrite(false, msg)
+			}
+		}
+		s.con.Divert(nil)
+		if err := s.renderer.Repaint(); err != nil {
+			glog.Warningf("Error redrawing screen after chat: '%s'", err)
+		}
+		s.mu.Lock()
+		for v := range s.viewers {
+			v.r.Invalidate()
+		}
+		// Chat ended by the caller hanging up
+		if s.chat == chat {
+			s.chat, s.chatDone = nil, nil
+		}
+		s.mu.Unlock()
+	})
+	glog.Infof("Sysop chat ended")
+}
+
+// Echoes keys typed in chat, by either side, to both.
+func (s *Spy) chatKeys(keys []byte) {
+	var out []byte
+	for _, key := range keys {
+		switch key {
+		case '\r':
+			out = append(out, "\r\n"...)
+		case '\n':
+		case '\b', 0x7F:
+			out = append(out, "\b \b"...)
+		default:
+			out = append(out, key)
+		}
+	}
+	s.chatWrite(false, out)
+}
+
+// Writes b to both the caller and the sysop, first clearing their screens
+// when clear is set.
+func (s *Spy) chatWrite(clear bool, b []byte) {
+	s.chatMu.Lock()
+	defer s.chatMu.Unlock()
+	var callerClear, sysopClear []byte
+	if clear {
+		callerClear = s.enc.Clear(nil)
+		sysopClear = video.NewEncoder(video.ANSI).Clear(nil)
+	}
+	s.caller.Write(append(callerClear, b...))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for v := range s.viewers {
+		v.write(append(sysopClear, b...))
+	}
+}
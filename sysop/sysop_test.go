@@ -0,0 +1,182 @@
+package sysop
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"door86.org/ivdoor/codepage"
+	"door86.org/ivdoor/console"
+	"door86.org/ivdoor/session"
+	"door86.org/ivdoor/video"
+)
+
+// Collects what is written to a terminal.
+type terminal struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (t *terminal) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.Write(p)
+}
+
+func (t *terminal) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.String()
+}
+
+// Waits for cond, failing after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// Title bar status lines, which the screen doesn't understand
+var osc = regexp.MustCompile("\x1b\\][^\x07]*\x07")
+
+// Draws what the sysop was sent on a screen.
+func sysopScreen(out string) *video.Screen {
+	s := video.NewScreen()
+	s.Write([]byte(osc.ReplaceAllString(out, "")))
+	return s
+}
+
+type setup struct {
+	screen  *video.Screen
+	con     *console.Console
+	session *session.Session
+	caller  *terminal
+	// The caller's keyboard
+	keys *io.PipeWriter
+	spy  *Spy
+	// The sysop's end
+	sysop net.Conn
+	seen  *terminal
+}
+
+func newSetup(t *testing.T) *setup {
+	s := &setup{screen: video.NewScreen(), caller: &terminal{}, seen: &terminal{}}
+	var in io.Reader
+	in, s.keys = io.Pipe()
+	s.con = console.New(in, io.MultiWriter(s.screen, s.caller))
+	s.session = session.New(session.Limits{Time: 10 * time.Minute}, s.con.LastInput)
+	renderer := video.NewRenderer(s.screen, video.NewEncoder(video.ANSI), s.caller, s.con.Locked)
+	s.spy = New(s.screen, s.con, s.session, s.caller, video.NewEncoder(video.ANSI), renderer, codepage.CP437)
+	var conn net.Conn
+	conn, s.sysop = net.Pipe()
+	go s.spy.Attach(conn)
+	go io.Copy(s.seen, s.sysop)
+	t.Cleanup(func() {
+		s.spy.Close()
+		s.keys.Close()
+	})
+	return s
+}
+
+func TestMirrorAndKeys(t *testing.T) {
+	s := newSetup(t)
+	s.con.Write([]byte("\x1b[2J\x1b[5;1HWelcome"))
+	waitFor(t, "the screen to be mirrored", func() bool {
+		return strings.HasPrefix(sysopScreen(s.seen.String()).Row(4), "Welcome")
+	})
+
+	// Keys from the sysop go to the door, and don't count as the caller
+	// being active
+	last := s.con.LastInput()
+	s.sysop.Write([]byte("y\x01\x01"))
+	for _, want := range []byte{'y', 0x01} {
+		if got, err := s.con.ReadByte(); err != nil || got != want {
+			t.Errorf("door read %q, %v, want %q", got, err, want)
+		}
+	}
+	if !s.con.LastInput().Equal(last) {
+		t.Error("sysop keys counted as caller input")
+	}
+
+	s.sysop.Write([]byte("\x01+"))
+	waitFor(t, "time to be added", func() bool {
+		return s.session.Left(time.Now()) > 14*time.Minute
+	})
+	waitFor(t, "the time left to be shown", func() bool {
+		return strings.Contains(s.seen.String(), "15 minute(s) left")
+	})
+}
+
+func TestChat(t *testing.T) {
+	s := newSetup(t)
+	s.con.Write([]byte("\x1b[2J\x1b[1;1HDoor screen"))
+	s.sysop.Write([]byte("\x01c"))
+	waitFor(t, "chat to start", func() bool {
+		return strings.Contains(s.caller.String(), "Chat with the sysop")
+	})
+
+	// The door is held while they chat
+	wrote := make(chan struct{})
+	go func() {
+		s.con.Write([]byte("more"))
+		close(wrote)
+	}()
+	s.keys.Write([]byte("hi\r"))
+	s.sysop.Write([]byte("hello"))
+	waitFor(t, "chat to be echoed", func() bool {
+		return strings.Contains(s.caller.String(), "hi\r\nhello") && strings.Contains(s.seen.String(), "hi\r\nhello")
+	})
+	select {
+	case <-wrote:
+		t.Fatal("door output went through during chat")
+	default:
+	}
+	if s.con.Buffered() != 0 {
+		t.Error("caller's chat reached the door")
+	}
+	// Time warnings don't wait for chat to end
+	if !s.spy.Notice([]byte("\r\n*** 2 minute(s) left ***\r\n")) {
+		t.Error("notice not shown in chat")
+	}
+	waitFor(t, "the notice in chat", func() bool {
+		return strings.Contains(s.caller.String(), "2 minute(s) left") && strings.Contains(s.seen.String(), "2 minute(s) left")
+	})
+
+	s.sysop.Write([]byte("\x01c"))
+	<-wrote
+	waitFor(t, "chat to end", func() bool { return !s.spy.Chatting() })
+	if s.spy.Notice([]byte("after")) {
+		t.Error("notice shown in chat after it ended")
+	}
+	// Both sides get the door's screen back
+	if got := sysopScreen(s.caller.String()).Row(0); !strings.HasPrefix(got, "Door screenmore") {
+		t.Errorf("caller's row 0 after chat = %q", got)
+	}
+	waitFor(t, "the sysop's screen to be redrawn", func() bool {
+		return strings.HasPrefix(sysopScreen(s.seen.String()).Row(0), "Door screenmore")
+	})
+}
+
+func TestKick(t *testing.T) {
+	s := newSetup(t)
+	ended := make(chan error, 1)
+	s.session.OnExpire = func(err error) { ended <- err }
+	s.sysop.Write([]byte("\x01c"))
+	waitFor(t, "chat to start", s.spy.Chatting)
+	s.sysop.Write([]byte("\x01k"))
+	waitFor(t, "the caller to be kicked", func() bool { return !s.con.Carrier() })
+	if err := <-ended; err != session.ErrKicked {
+		t.Errorf("session ended with %v", err)
+	}
+	if s.spy.Chatting() {
+		t.Error("still chatting after kick")
+	}
+}
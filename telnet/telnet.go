@@ -0,0 +1,204 @@
+// Package telnet speaks enough of the telnet protocol for a BBS caller:
+// the server echoes and sends binary data, and the caller's window size is
+// picked up when their client reports it.
+package telnet
+
+import (
+	"net"
+	"sync"
+)
+
+// Telnet commands
+const (
+	cmdSE   = 240
+	cmdSB   = 250
+	cmdWILL = 251
+	cmdWONT = 252
+	cmdDO   = 253
+	cmdDONT = 254
+	cmdIAC  = 255
+)
+
+// Telnet options
+const (
+	optBinary = 0
+	optEcho   = 1
+	optSGA    = 3
+	optNAWS   = 31
+)
+
+// States of the input decoder
+const (
+	stData = iota
+	// Seen CR, a following LF or NUL is dropped
+	stCR
+	stIAC
+	// Seen IAC and WILL, WONT, DO or DONT, waiting for the option
+	stOption
+	stSB
+	stSBIAC
+)
+
+// Conn is a telnet connection.  Reads return the caller's data with the
+// telnet commands taken out, and writes escape it.
+type Conn struct {
+	net.Conn
+	// Serializes writes, replies to the caller's requests come from Read
+	wmu sync.Mutex
+
+	// Input decoder
+	state int
+	verb  byte
+	sb    []byte
+
+	mu            sync.Mutex
+	width, height int
+}
+
+// New starts telnet on c, asking the caller's client to leave echoing to
+// the server, send characters as they are typed, use binary and report its
+// window size.
+func New(c net.Conn) (*Conn, error) {
+	t := &Conn{Conn: c}
+	err := t.send(
+		cmdIAC, cmdWILL, optEcho,
+		cmdIAC, cmdWILL, optSGA,
+		cmdIAC, cmdDO, optSGA,
+		cmdIAC, cmdWILL, optBinary,
+		cmdIAC, cmdDO, optBinary,
+		cmdIAC, cmdDO, optNAWS,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Conn) send(b ...byte) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	_, err := t.Conn.Write(b)
+	return err
+}
+
+// Size returns the caller's window size, or 0, 0 when their client hasn't
+// said.
+func (t *Conn) Size() (width, height int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.width, t.height
+}
+
+// Read returns data from the caller, blocking until there is some.
+func (t *Conn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for {
+		n, err := t.Conn.Read(buf)
+		out := t.decode(p[:0], buf[:n])
+		if len(out) > 0 || err != nil {
+			return len(out), err
+		}
+	}
+}
+
+// Appends the data in b to out, handling the commands.  out has room for
+// all of b.
+func (t *Conn) decode(out, b []byte) []byte {
+	for _, c := range b {
+		switch t.state {
+		case stData, stCR:
+			cr := t.state == stCR
+			t.state = stData
+			switch {
+			case c == cmdIAC:
+				t.state = stIAC
+			case cr && (c == '\n' || c == 0):
+				// End of line is CR LF or CR NUL, the door just wants CR
+			case c == '\r':
+				t.state = stCR
+				out = append(out, c)
+			default:
+				out = append(out, c)
+			}
+		case stIAC:
+			t.state = stData
+			switch c {
+			case cmdIAC:
+				out = append(out, cmdIAC)
+			case cmdWILL, cmdWONT, cmdDO, cmdDONT:
+				t.verb = c
+				t.state = stOption
+			case cmdSB:
+				t.sb = t.sb[:0]
+				t.state = stSB
+			}
+		case stOption:
+			t.state = stData
+			t.option(t.verb, c)
+		case stSB:
+			if c == cmdIAC {
+				t.state = stSBIAC
+			} else {
+				t.sb = append(t.sb, c)
+			}
+		case stSBIAC:
+			switch c {
+			case cmdSE:
+				t.state = stData
+				t.subnegotiation(t.sb)
+			case cmdIAC:
+				t.sb = append(t.sb, cmdIAC)
+				t.state = stSB
+			default:
+				// Broken subnegotiation, give up on it
+				t.state = stData
+			}
+		}
+	}
+	return out
+}
+
+// Refuses options that weren't asked for.  Replies to the options asked
+// for in New aren't answered, which would start a loop.
+func (t *Conn) option(verb, opt byte) {
+	switch verb {
+	case cmdDO:
+		switch opt {
+		case optEcho, optSGA, optBinary:
+		default:
+			t.send(cmdIAC, cmdWONT, opt)
+		}
+	case cmdWILL:
+		switch opt {
+		case optSGA, optBinary, optNAWS:
+		default:
+			t.send(cmdIAC, cmdDONT, opt)
+		}
+	}
+}
+
+func (t *Conn) subnegotiation(sb []byte) {
+	if len(sb) == 5 && sb[0] == optNAWS {
+		t.mu.Lock()
+		t.width = int(sb[1])<<8 | int(sb[2])
+		t.height = int(sb[3])<<8 | int(sb[4])
+		t.mu.Unlock()
+	}
+}
+
+// Write sends p to the caller, doubling IAC bytes.
+func (t *Conn) Write(p []byte) (int, error) {
+	b := make([]byte, 0, len(p))
+	for _, c := range p {
+		if c == cmdIAC {
+			b = append(b, cmdIAC)
+		}
+		b = append(b, c)
+	}
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if _, err := t.Conn.Write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,66 @@
+package telnet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	negotiation := make(chan []byte)
+	go func() {
+		b := make([]byte, 18)
+		io.ReadFull(client, b)
+		negotiation <- b
+	}()
+	c, err := New(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := <-negotiation; !bytes.Contains(b, []byte{cmdIAC, cmdWILL, optEcho}) || !bytes.Contains(b, []byte{cmdIAC, cmdDO, optNAWS}) {
+		t.Errorf("negotiation % X", b)
+	}
+
+	// The client agrees, asks for something unsupported, reports its size
+	// and types, with an escaped 0xFF and CR LF
+	replies := make(chan []byte)
+	go func() {
+		client.Write([]byte{
+			cmdIAC, cmdDO, optEcho,
+			cmdIAC, cmdDO, 5,
+			cmdIAC, cmdSB, optNAWS, 0, 132, 0, 43, cmdIAC, cmdSE,
+			'h', 'i', cmdIAC, cmdIAC, '\r', '\n', 'x', '\r', 0,
+		})
+		b := make([]byte, 3)
+		io.ReadFull(client, b)
+		replies <- b
+	}()
+	var got []byte
+	buf := make([]byte, 64)
+	for len(got) < 5 {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if want := []byte{'h', 'i', 0xFF, '\r', 'x', '\r'}; !bytes.HasPrefix(want, got) || len(got) < 5 {
+		t.Errorf("read % X, want % X", got, want)
+	}
+	if b := <-replies; !bytes.Equal(b, []byte{cmdIAC, cmdWONT, 5}) {
+		t.Errorf("reply % X", b)
+	}
+	if w, h := c.Size(); w != 132 || h != 43 {
+		t.Errorf("size %dx%d", w, h)
+	}
+
+	go c.Write([]byte{'a', 0xFF})
+	b := make([]byte, 3)
+	io.ReadFull(client, b)
+	if !bytes.Equal(b, []byte{'a', cmdIAC, cmdIAC}) {
+		t.Errorf("wrote % X", b)
+	}
+}
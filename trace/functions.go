@@ -0,0 +1,366 @@
+package trace
+
+import (
+	"fmt"
+
+	"door86.org/ivdoor/cpu"
+	"door86.org/ivdoor/dos"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+// Values decoded from the registers or memory
+type values = map[string]interface{}
+
+// A DOS or BIOS function, selected by AH.
+type function struct {
+	name string
+	// Names by subfunction in AL, added to name
+	sub map[uint8]string
+	// Decode the arguments before the call, and the results after it
+	args, result func(mu uc.Unicorn) values
+	// Failures set the carry flag with the DOS error in AX
+	carry bool
+}
+
+// An interrupt, and its functions by AH when it has any.
+type interrupt struct {
+	name  string
+	funcs map[uint8]function
+}
+
+// Returns the function for interrupt num called with ax, which is named
+// by its AH when it isn't known.
+func lookup(num uint8, ax uint16) function {
+	i, ok := interrupts[num]
+	if !ok {
+		return function{name: fmt.Sprintf("AH=%02Xh", ax>>8)}
+	}
+	if i.funcs == nil {
+		return function{name: i.name}
+	}
+	f, ok := i.funcs[uint8(ax>>8)]
+	if !ok {
+		return function{name: fmt.Sprintf("%s AH=%02Xh", i.name, ax>>8)}
+	}
+	if sub, ok := f.sub[uint8(ax)]; ok {
+		f.name += ": " + sub
+	} else if f.sub != nil {
+		f.name += fmt.Sprintf(": AL=%02Xh", uint8(ax))
+	}
+	return f
+}
+
+func reg8(mu uc.Unicorn, reg int) int {
+	return int(cpu.Reg8(mu, reg))
+}
+
+func reg16(mu uc.Unicorn, reg int) int {
+	return int(cpu.Reg16(mu, reg))
+}
+
+func hex8(mu uc.Unicorn, reg int) string {
+	return fmt.Sprintf("%02X", cpu.Reg8(mu, reg))
+}
+
+func hex16(mu uc.Unicorn, reg int) string {
+	return fmt.Sprintf("%04X", cpu.Reg16(mu, reg))
+}
+
+// seg:off from two registers
+func pointer(mu uc.Unicorn, seg, off int) string {
+	return fmt.Sprintf("%04X:%04X", cpu.Reg16(mu, seg), cpu.Reg16(mu, off))
+}
+
+// A character, in hex unless it is printable ASCII
+func char(c uint8) string {
+	if c >= ' ' && c < 0x7F {
+		return string(rune(c))
+	}
+	return fmt.Sprintf("%02Xh", c)
+}
+
+// The ASCIIZ string at seg:off
+func asciiz(mu uc.Unicorn, seg, off int) string {
+	s, err := dos.GetString(mu, cpu.SReg16(mu, seg), cpu.Reg16(mu, off))
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+// The file named at DS:DX
+func fileArg(mu uc.Unicorn) values {
+	return values{"file": asciiz(mu, uc.X86_REG_DS, uc.X86_REG_DX)}
+}
+
+func handleArg(mu uc.Unicorn) values {
+	return values{"handle": reg16(mu, uc.X86_REG_BX)}
+}
+
+func handleResult(mu uc.Unicorn) values {
+	return values{"handle": reg16(mu, uc.X86_REG_AX)}
+}
+
+func charResult(mu uc.Unicorn) values {
+	return values{"char": char(cpu.Reg8(mu, uc.X86_REG_AL))}
+}
+
+var interrupts = map[uint8]interrupt{
+	0x10: {"video", int10},
+	0x14: {"serial", int14},
+	0x16: {"keyboard", int16},
+	0x1A: {"clock", int1A},
+	0x20: {"terminate", nil},
+	0x21: {"DOS", int21},
+	0x28: {"DOS idle", nil},
+	0x2F: {"multiplex", nil},
+	0x33: {"mouse", nil},
+}
+
+var int21 = map[uint8]function{
+	0x00: {name: "terminate"},
+	0x01: {name: "read key with echo", result: charResult},
+	0x02: {name: "write char", args: func(mu uc.Unicorn) values {
+		return values{"char": char(cpu.Reg8(mu, uc.X86_REG_DL))}
+	}},
+	0x06: {name: "direct console I/O", args: func(mu uc.Unicorn) values {
+		if dl := cpu.Reg8(mu, uc.X86_REG_DL); dl != 0xFF {
+			return values{"char": char(dl)}
+		}
+		return nil
+	}, result: func(mu uc.Unicorn) values {
+		if cpu.Reg16(mu, uc.X86_REG_FLAGS)&0x40 != 0 {
+			return nil
+		}
+		return charResult(mu)
+	}},
+	0x07: {name: "direct input", result: charResult},
+	0x08: {name: "read key", result: charResult},
+	0x09: {name: "write string", args: func(mu uc.Unicorn) values {
+		s, _ := dos.GetStringDollarSign(mu, cpu.SReg16(mu, uc.X86_REG_DS), cpu.Reg16(mu, uc.X86_REG_DX))
+		return values{"text": s}
+	}},
+	0x0A: {name: "buffered input", result: func(mu uc.Unicorn) values {
+		ds, dx := cpu.SReg16(mu, uc.X86_REG_DS), cpu.Reg16(mu, uc.X86_REG_DX)
+		n, err := cpu.Mem8(mu, cpu.Addr(ds, dx+1))
+		if err != nil {
+			return nil
+		}
+		line, _ := cpu.Mem(mu, ds, dx+2, uint64(n))
+		return values{"line": string(line)}
+	}},
+	0x0B: {name: "input status", result: func(mu uc.Unicorn) values {
+		return values{"ready": cpu.Reg8(mu, uc.X86_REG_AL) != 0}
+	}},
+	0x0E: {name: "select drive", args: func(mu uc.Unicorn) values {
+		return values{"drive": string(rune('A' + cpu.Reg8(mu, uc.X86_REG_DL)))}
+	}},
+	0x19: {name: "get current drive"},
+	0x1A: {name: "set DTA", args: func(mu uc.Unicorn) values {
+		return values{"dta": pointer(mu, uc.X86_REG_DS, uc.X86_REG_DX)}
+	}},
+	0x25: {name: "set vector", args: func(mu uc.Unicorn) values {
+		return values{"int": hex8(mu, uc.X86_REG_AL), "vector": pointer(mu, uc.X86_REG_DS, uc.X86_REG_DX)}
+	}},
+	0x2A: {name: "get date", result: func(mu uc.Unicorn) values {
+		return values{"date": fmt.Sprintf("%04d-%02d-%02d", cpu.Reg16(mu, uc.X86_REG_CX), cpu.Reg8(mu, uc.X86_REG_DH), cpu.Reg8(mu, uc.X86_REG_DL))}
+	}},
+	0x2C: {name: "get time", result: func(mu uc.Unicorn) values {
+		return values{"time": fmt.Sprintf("%02d:%02d:%02d.%02d", cpu.Reg8(mu, uc.X86_REG_CH), cpu.Reg8(mu, uc.X86_REG_CL), cpu.Reg8(mu, uc.X86_REG_DH), cpu.Reg8(mu, uc.X86_REG_DL))}
+	}},
+	0x2F: {name: "get DTA"},
+	0x30: {name: "get version", result: func(mu uc.Unicorn) values {
+		return values{"version": fmt.Sprintf("%d.%02d", cpu.Reg8(mu, uc.X86_REG_AL), cpu.Reg8(mu, uc.X86_REG_AH))}
+	}},
+	0x35: {name: "get vector", args: func(mu uc.Unicorn) values {
+		return values{"int": hex8(mu, uc.X86_REG_AL)}
+	}},
+	0x36: {name: "get free space"},
+	0x39: {name: "make directory", args: fileArg, carry: true},
+	0x3A: {name: "remove directory", args: fileArg, carry: true},
+	0x3B: {name: "change directory", args: fileArg, carry: true},
+	0x3C: {name: "create file", args: func(mu uc.Unicorn) values {
+		v := fileArg(mu)
+		v["attributes"] = hex16(mu, uc.X86_REG_CX)
+		return v
+	}, result: handleResult, carry: true},
+	0x3D: {name: "open file", args: func(mu uc.Unicorn) values {
+		v := fileArg(mu)
+		v["mode"] = hex8(mu, uc.X86_REG_AL)
+		return v
+	}, result: handleResult, carry: true},
+	0x3E: {name: "close file", args: handleArg, carry: true},
+	0x3F: {name: "read", args: func(mu uc.Unicorn) values {
+		return values{"handle": reg16(mu, uc.X86_REG_BX), "count": reg16(mu, uc.X86_REG_CX), "buffer": pointer(mu, uc.X86_REG_DS, uc.X86_REG_DX)}
+	}, result: func(mu uc.Unicorn) values {
+		return values{"read": reg16(mu, uc.X86_REG_AX)}
+	}, carry: true},
+	0x40: {name: "write", args: func(mu uc.Unicorn) values {
+		return values{"handle": reg16(mu, uc.X86_REG_BX), "count": reg16(mu, uc.X86_REG_CX), "buffer": pointer(mu, uc.X86_REG_DS, uc.X86_REG_DX)}
+	}, result: func(mu uc.Unicorn) values {
+		return values{"written": reg16(mu, uc.X86_REG_AX)}
+	}, carry: true},
+	0x41: {name: "delete file", args: fileArg, carry: true},
+	0x42: {name: "seek", args: func(mu uc.Unicorn) values {
+		origin := map[uint8]string{0: "start", 1: "current", 2: "end"}[cpu.Reg8(mu, uc.X86_REG_AL)]
+		offset := int32(uint32(cpu.Reg16(mu, uc.X86_REG_CX))<<16 | uint32(cpu.Reg16(mu, uc.X86_REG_DX)))
+		return values{"handle": reg16(mu, uc.X86_REG_BX), "origin": origin, "offset": offset}
+	}, result: func(mu uc.Unicorn) values {
+		return values{"position": uint32(cpu.Reg16(mu, uc.X86_REG_DX))<<16 | uint32(cpu.Reg16(mu, uc.X86_REG_AX))}
+	}, carry: true},
+	0x43: {name: "file attributes", sub: map[uint8]string{0: "get", 1: "set"}, args: func(mu uc.Unicorn) values {
+		v := fileArg(mu)
+		if cpu.Reg8(mu, uc.X86_REG_AL) == 1 {
+			v["attributes"] = hex16(mu, uc.X86_REG_CX)
+		}
+		return v
+	}, result: func(mu uc.Unicorn) values {
+		return values{"attributes": hex16(mu, uc.X86_REG_CX)}
+	}, carry: true},
+	0x44: {name: "ioctl", sub: map[uint8]string{
+		0x00: "get device information", 0x01: "set device information",
+		0x06: "input status", 0x07: "output status",
+		0x08: "is drive removable", 0x09: "is drive remote", 0x0A: "is handle remote",
+		0x0E: "get drive map", 0x0F: "set drive map",
+	}, args: func(mu uc.Unicorn) values {
+		switch cpu.Reg8(mu, uc.X86_REG_AL) {
+		case 0x08, 0x09, 0x0E, 0x0F:
+			return values{"drive": reg8(mu, uc.X86_REG_BL)}
+		}
+		return handleArg(mu)
+	}, result: func(mu uc.Unicorn) values {
+		return values{"ax": hex16(mu, uc.X86_REG_AX), "dx": hex16(mu, uc.X86_REG_DX)}
+	}, carry: true},
+	0x45: {name: "duplicate handle", args: handleArg, result: handleResult, carry: true},
+	0x46: {name: "force duplicate handle", args: func(mu uc.Unicorn) values {
+		return values{"handle": reg16(mu, uc.X86_REG_BX), "to": reg16(mu, uc.X86_REG_CX)}
+	}, carry: true},
+	0x47: {name: "get current directory", carry: true},
+	0x48: {name: "allocate memory", args: func(mu uc.Unicorn) values {
+		return values{"paragraphs": reg16(mu, uc.X86_REG_BX)}
+	}, result: func(mu uc.Unicorn) values {
+		return values{"segment": hex16(mu, uc.X86_REG_AX)}
+	}, carry: true},
+	0x49: {name: "free memory", args: func(mu uc.Unicorn) values {
+		return values{"segment": hex16(mu, uc.X86_REG_ES)}
+	}, carry: true},
+	0x4A: {name: "resize memory", args: func(mu uc.Unicorn) values {
+		return values{"segment": hex16(mu, uc.X86_REG_ES), "paragraphs": reg16(mu, uc.X86_REG_BX)}
+	}, result: func(mu uc.Unicorn) values {
+		return values{"paragraphs": reg16(mu, uc.X86_REG_BX)}
+	}, carry: true},
+	0x4B: {name: "exec", sub: map[uint8]string{0: "load and run", 1: "load", 3: "load overlay"}, args: fileArg, carry: true},
+	0x4C: {name: "exit", args: func(mu uc.Unicorn) values {
+		return values{"code": reg8(mu, uc.X86_REG_AL)}
+	}},
+	0x4D: {name: "get return code"},
+	0x4E: {name: "find first", args: func(mu uc.Unicorn) values {
+		return values{"pattern": asciiz(mu, uc.X86_REG_DS, uc.X86_REG_DX), "attributes": hex16(mu, uc.X86_REG_CX)}
+	}, carry: true},
+	0x4F: {name: "find next", carry: true},
+	0x56: {name: "rename", args: func(mu uc.Unicorn) values {
+		return values{"file": asciiz(mu, uc.X86_REG_DS, uc.X86_REG_DX), "to": asciiz(mu, uc.X86_REG_ES, uc.X86_REG_DI)}
+	}, carry: true},
+	0x57: {name: "file time", sub: map[uint8]string{0: "get", 1: "set"}, args: handleArg, carry: true},
+	0x59: {name: "get extended error"},
+	0x5C: {name: "lock", sub: map[uint8]string{0: "lock", 1: "unlock"}, args: func(mu uc.Unicorn) values {
+		return values{
+			"handle": reg16(mu, uc.X86_REG_BX),
+			"offset": uint32(cpu.Reg16(mu, uc.X86_REG_CX))<<16 | uint32(cpu.Reg16(mu, uc.X86_REG_DX)),
+			"length": uint32(cpu.Reg16(mu, uc.X86_REG_SI))<<16 | uint32(cpu.Reg16(mu, uc.X86_REG_DI)),
+		}
+	}, carry: true},
+	0x62: {name: "get PSP"},
+	0x6C: {name: "extended open", args: func(mu uc.Unicorn) values {
+		return values{"file": asciiz(mu, uc.X86_REG_DS, uc.X86_REG_SI), "mode": hex8(mu, uc.X86_REG_BL), "action": hex16(mu, uc.X86_REG_DX)}
+	}, result: func(mu uc.Unicorn) values {
+		return values{"handle": reg16(mu, uc.X86_REG_AX), "action": reg16(mu, uc.X86_REG_CX)}
+	}, carry: true},
+}
+
+// Cursor position in DH and DL
+func cursor(mu uc.Unicorn) values {
+	return values{"row": reg8(mu, uc.X86_REG_DH), "column": reg8(mu, uc.X86_REG_DL)}
+}
+
+// Scrolled window, CH,CL to DH,DL
+func window(mu uc.Unicorn) values {
+	return values{
+		"lines": reg8(mu, uc.X86_REG_AL), "attribute": hex8(mu, uc.X86_REG_BH),
+		"top": reg8(mu, uc.X86_REG_CH), "left": reg8(mu, uc.X86_REG_CL),
+		"bottom": reg8(mu, uc.X86_REG_DH), "right": reg8(mu, uc.X86_REG_DL),
+	}
+}
+
+var int10 = map[uint8]function{
+	0x00: {name: "set video mode", args: func(mu uc.Unicorn) values {
+		return values{"mode": hex8(mu, uc.X86_REG_AL)}
+	}},
+	0x01: {name: "set cursor shape"},
+	0x02: {name: "set cursor position", args: cursor},
+	0x03: {name: "get cursor position", result: cursor},
+	0x05: {name: "select page"},
+	0x06: {name: "scroll up", args: window},
+	0x07: {name: "scroll down", args: window},
+	0x08: {name: "read char and attribute", result: func(mu uc.Unicorn) values {
+		return values{"char": char(cpu.Reg8(mu, uc.X86_REG_AL)), "attribute": hex8(mu, uc.X86_REG_AH)}
+	}},
+	0x09: {name: "write char and attribute", args: func(mu uc.Unicorn) values {
+		return values{"char": char(cpu.Reg8(mu, uc.X86_REG_AL)), "attribute": hex8(mu, uc.X86_REG_BL), "count": reg16(mu, uc.X86_REG_CX)}
+	}},
+	0x0A: {name: "write char", args: func(mu uc.Unicorn) values {
+		return values{"char": char(cpu.Reg8(mu, uc.X86_REG_AL)), "count": reg16(mu, uc.X86_REG_CX)}
+	}},
+	0x0E: {name: "teletype output", args: func(mu uc.Unicorn) values {
+		return values{"char": char(cpu.Reg8(mu, uc.X86_REG_AL))}
+	}},
+	0x0F: {name: "get video mode", result: func(mu uc.Unicorn) values {
+		return values{"mode": hex8(mu, uc.X86_REG_AL), "columns": reg8(mu, uc.X86_REG_AH)}
+	}},
+	0x10: {name: "palette"},
+	0x11: {name: "character generator"},
+	0x12: {name: "alternate select"},
+	0x1A: {name: "display combination"},
+}
+
+// FOSSIL functions, of which 00h to 03h are the BIOS's own
+var int14 = map[uint8]function{
+	0x00: {name: "initialize port"},
+	0x01: {name: "send char", args: func(mu uc.Unicorn) values {
+		return values{"char": char(cpu.Reg8(mu, uc.X86_REG_AL))}
+	}},
+	0x02: {name: "receive char", result: charResult},
+	0x03: {name: "port status"},
+	0x04: {name: "initialize driver"},
+	0x05: {name: "deinitialize driver"},
+	0x08: {name: "flush output"},
+	0x09: {name: "purge output"},
+	0x0A: {name: "purge input"},
+	0x0B: {name: "send char without waiting"},
+	0x0C: {name: "peek input"},
+	0x18: {name: "read block"},
+	0x19: {name: "write block"},
+	0x1B: {name: "driver information"},
+}
+
+func keyResult(mu uc.Unicorn) values {
+	return values{"key": hex16(mu, uc.X86_REG_AX)}
+}
+
+var int16 = map[uint8]function{
+	0x00: {name: "read key", result: keyResult},
+	0x01: {name: "key status"},
+	0x02: {name: "shift flags"},
+	0x10: {name: "read extended key", result: keyResult},
+	0x11: {name: "extended key status"},
+	0x12: {name: "extended shift flags"},
+}
+
+var int1A = map[uint8]function{
+	0x00: {name: "read clock", result: func(mu uc.Unicorn) values {
+		return values{"ticks": uint32(cpu.Reg16(mu, uc.X86_REG_CX))<<16 | uint32(cpu.Reg16(mu, uc.X86_REG_DX))}
+	}},
+	0x01: {name: "set clock"},
+	0x02: {name: "read RTC time"},
+	0x04: {name: "read RTC date"},
+}
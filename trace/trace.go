@@ -0,0 +1,282 @@
+// Package trace writes what a door did as JSON lines, to read through
+// instead of stepping through the door in the debugger.
+//
+// There is a record for each interrupt the door raises, with its function
+// decoded from AH and AL, the arguments it was called with, such as file
+// names and handles, and what it returned.  There can be a record for each
+// instruction as well.  Both can be limited to some interrupts and to code
+// in some segments.
+package trace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"door86.org/ivdoor/core"
+	"door86.org/ivdoor/cpu"
+	"door86.org/ivdoor/dos"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// Kinds of record
+const (
+	// The door raised interrupt Int
+	Interrupt = "int"
+	// The door ran the instruction Inst
+	Instruction = "inst"
+)
+
+// Record is a line of the trace.
+type Record struct {
+	// Interrupts the door had raised, counting this one, as in recordings
+	Seq  uint64 `json:"seq"`
+	Kind string `json:"kind"`
+	// CS:IP of the instruction
+	At string `json:"at"`
+	// The interrupt in hex and the name of the function called
+	Int  string `json:"int,omitempty"`
+	Func string `json:"func,omitempty"`
+	// What the function was called with, and what it returned
+	Args   map[string]interface{} `json:"args,omitempty"`
+	Result map[string]interface{} `json:"result,omitempty"`
+	// The door handles the interrupt itself, so there's no result
+	Guest bool `json:"guest,omitempty"`
+	// The function failed with the DOS error in AX
+	Carry bool   `json:"carry,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Why the emulator's handler failed
+	Message string `json:"message,omitempty"`
+	// The instruction's bytes in hex, and disassembled
+	Code string `json:"code,omitempty"`
+	Inst string `json:"inst,omitempty"`
+	// Registers before the interrupt or instruction
+	Regs *Regs `json:"regs,omitempty"`
+}
+
+// Regs are the registers, in hex.
+type Regs struct {
+	AX    string `json:"ax"`
+	BX    string `json:"bx"`
+	CX    string `json:"cx"`
+	DX    string `json:"dx"`
+	SI    string `json:"si"`
+	DI    string `json:"di"`
+	BP    string `json:"bp"`
+	SP    string `json:"sp"`
+	DS    string `json:"ds"`
+	ES    string `json:"es"`
+	SS    string `json:"ss"`
+	Flags string `json:"flags"`
+}
+
+func regs(mu uc.Unicorn) *Regs {
+	r := func(reg int) string { return fmt.Sprintf("%04X", cpu.Reg16(mu, reg)) }
+	return &Regs{
+		AX: r(uc.X86_REG_AX), BX: r(uc.X86_REG_BX), CX: r(uc.X86_REG_CX), DX: r(uc.X86_REG_DX),
+		SI: r(uc.X86_REG_SI), DI: r(uc.X86_REG_DI), BP: r(uc.X86_REG_BP), SP: r(uc.X86_REG_SP),
+		DS: r(uc.X86_REG_DS), ES: r(uc.X86_REG_ES), SS: r(uc.X86_REG_SS), Flags: r(uc.X86_REG_FLAGS),
+	}
+}
+
+// Options are what to trace.
+type Options struct {
+	// Interrupts to trace, every one when empty
+	Interrupts []uint8
+	// Only trace code with CS from CSLow to CSHigh, unless CSHigh is 0
+	CSLow, CSHigh cpu.Seg
+	// Write a record for every instruction too
+	Instructions bool
+}
+
+// Tracer writes a trace as the door runs.
+type Tracer struct {
+	opts Options
+	ints map[uint8]bool
+	// Returns the number of interrupts raised so far
+	seq func() uint64
+
+	w   io.WriteCloser
+	buf *bufio.Writer
+	enc *json.Encoder
+	err error
+}
+
+// New starts a trace on w, which is closed by Close.
+func New(w io.WriteCloser, opts Options) *Tracer {
+	buf := bufio.NewWriter(w)
+	t := &Tracer{opts: opts, w: w, buf: buf, enc: json.NewEncoder(buf)}
+	if len(opts.Interrupts) > 0 {
+		t.ints = make(map[uint8]bool)
+		for _, n := range opts.Interrupts {
+			t.ints[n] = true
+		}
+	}
+	return t
+}
+
+// Attach traces the interrupts handled by emu, and the instructions mu
+// runs when they are traced.  Only the segments traced are hooked.
+func (t *Tracer) Attach(mu uc.Unicorn, emu *core.Emulator) error {
+	t.seq = emu.Interrupts
+	emu.TraceInterrupt = func(num uint32, handle func() error) error {
+		return t.interrupt(mu, num, handle)
+	}
+	if !t.opts.Instructions {
+		return nil
+	}
+	begin, end := uint64(1), uint64(0)
+	if t.opts.CSHigh != 0 {
+		begin, end = cpu.Addr(t.opts.CSLow, 0), cpu.Addr(t.opts.CSHigh, 0xFFFF)
+	}
+	_, err := mu.HookAdd(uc.HOOK_CODE, func(mu uc.Unicorn, addr uint64, size uint32) {
+		t.instruction(mu, addr, size)
+	}, begin, end)
+	return err
+}
+
+// Whether code in cs is traced.
+func (t *Tracer) inSegments(cs cpu.Seg) bool {
+	return t.opts.CSHigh == 0 || cs >= t.opts.CSLow && cs <= t.opts.CSHigh
+}
+
+func (t *Tracer) write(r Record) {
+	if t.seq != nil {
+		r.Seq = t.seq()
+	}
+	if t.err == nil {
+		t.err = t.enc.Encode(r)
+	}
+}
+
+// Traces interrupt num around handle, which handles it.
+func (t *Tracer) interrupt(mu uc.Unicorn, num uint32, handle func() error) error {
+	cs := cpu.SReg16(mu, uc.X86_REG_CS)
+	ip := cpu.Reg16(mu, uc.X86_REG_IP)
+	if t.ints != nil && !t.ints[uint8(num)] || !t.inSegments(cs) {
+		return handle()
+	}
+	f := lookup(uint8(num), cpu.Reg16(mu, uc.X86_REG_AX))
+	r := Record{
+		Kind: Interrupt,
+		At:   fmt.Sprintf("%04X:%04X", cs, intAt(mu, cs, ip, uint8(num))),
+		Int:  fmt.Sprintf("%02X", num),
+		Func: f.name,
+		Regs: regs(mu),
+	}
+	if f.args != nil {
+		r.Args = f.args(mu)
+	}
+	err := handle()
+	if err != nil {
+		r.Message = err.Error()
+	}
+	switch {
+	case cpu.SReg16(mu, uc.X86_REG_CS) != cs || cpu.Reg16(mu, uc.X86_REG_IP) != ip:
+		// Jumped to the door's handler
+		r.Guest = true
+	case f.carry && cpu.Reg16(mu, uc.X86_REG_FLAGS)&1 != 0:
+		r.Carry = true
+		r.Error = dos.ErrorName(cpu.Reg16(mu, uc.X86_REG_AX))
+	case f.result != nil:
+		r.Result = f.result(mu)
+	}
+	t.write(r)
+	return err
+}
+
+// Finds the INT instruction before ip, which is where the interrupt hook
+// finds it.
+func intAt(mu uc.Unicorn, cs cpu.Seg, ip uint16, num uint8) uint16 {
+	if ip < 2 {
+		return ip
+	}
+	if b, err := cpu.Mem(mu, cs, ip-2, 2); err == nil && b[0] == 0xCD && b[1] == num {
+		return ip - 2
+	}
+	return ip
+}
+
+func (t *Tracer) instruction(mu uc.Unicorn, addr uint64, size uint32) {
+	cs := cpu.SReg16(mu, uc.X86_REG_CS)
+	if !t.inSegments(cs) {
+		// Hooked by another segment overlapping those traced
+		return
+	}
+	mem, err := mu.MemRead(addr, uint64(size))
+	if err != nil {
+		return
+	}
+	r := Record{
+		Kind: Instruction,
+		At:   fmt.Sprintf("%04X:%04X", cs, uint16(addr-cpu.Addr(cs, 0))),
+		Code: hex.EncodeToString(mem),
+		Inst: "???",
+		Regs: regs(mu),
+	}
+	if inst, err := x86asm.Decode(mem, 16); err == nil {
+		r.Inst = x86asm.IntelSyntax(inst, addr-cpu.Addr(cs, 0), nil)
+	}
+	t.write(r)
+}
+
+// Close writes out the rest of the trace and closes it, returning the
+// first error writing it.
+func (t *Tracer) Close() error {
+	if t.err == nil {
+		t.err = t.buf.Flush()
+	}
+	if err := t.w.Close(); t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+// ParseInterrupts parses a list of interrupts in hex, like "21,10".
+func ParseInterrupts(s string) ([]uint8, error) {
+	var ints []uint8
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(strings.ToLower(f), "h"), 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad interrupt '%s'", f)
+		}
+		ints = append(ints, uint8(n))
+	}
+	return ints, nil
+}
+
+// ParseSegments parses a segment or a range of them in hex, like "1000"
+// or "1000-1FFF".
+func ParseSegments(s string) (cpu.Seg, cpu.Seg, error) {
+	parse := func(f string) (cpu.Seg, error) {
+		n, err := strconv.ParseUint(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(f)), "h"), 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("bad segment '%s'", f)
+		}
+		return cpu.Seg(n), nil
+	}
+	from, to, ranged := strings.Cut(s, "-")
+	low, err := parse(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	high := low
+	if ranged {
+		if high, err = parse(to); err != nil {
+			return 0, 0, err
+		}
+	}
+	if high < low || high == 0 {
+		return 0, 0, fmt.Errorf("bad segment range '%s'", s)
+	}
+	return low, high, nil
+}
@@ -0,0 +1,138 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"door86.org/ivdoor/cpu"
+	"door86.org/ivdoor/cpu/cputest"
+	uc "github.com/unicorn-engine/unicorn/bindings/go/unicorn"
+)
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestLookup(t *testing.T) {
+	for _, tc := range []struct {
+		num  uint8
+		ax   uint16
+		name string
+	}{
+		{0x21, 0x3D02, "open file"},
+		{0x21, 0x4400, "ioctl: get device information"},
+		{0x21, 0x4420, "ioctl: AL=20h"},
+		{0x21, 0xFF00, "DOS AH=FFh"},
+		{0x10, 0x0E41, "teletype output"},
+		{0x20, 0x0000, "terminate"},
+		{0x60, 0x1234, "AH=12h"},
+	} {
+		if f := lookup(tc.num, tc.ax); f.name != tc.name {
+			t.Errorf("INT %02Xh AX=%04X is %q, want %q", tc.num, tc.ax, f.name, tc.name)
+		}
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	f := cputest.New()
+	f.RegWrite(uc.X86_REG_CS, 0x1000)
+	f.RegWrite(uc.X86_REG_DS, 0x2000)
+	var out bytes.Buffer
+	tr := New(nopCloser{&out}, Options{Interrupts: []uint8{0x21}, CSLow: 0x1000, CSHigh: 0x1FFF})
+	seq := uint64(0)
+	tr.seq = func() uint64 { return seq }
+	copy(f.Mem[0x10100:], []byte{0xCD, 0x21})
+	copy(f.Mem[0x20010:], "DATA.DAT\x00")
+	copy(f.Mem[0x20020:], "Hi$")
+
+	call := func(num uint32, ax, dx uint16, handle func() error) {
+		seq++
+		f.RegWrite(uc.X86_REG_IP, 0x0102)
+		f.RegWrite(uc.X86_REG_AX, uint64(ax))
+		f.RegWrite(uc.X86_REG_DX, uint64(dx))
+		tr.interrupt(f, num, handle)
+	}
+	// Opened as handle 5
+	call(0x21, 0x3D02, 0x0010, func() error {
+		f.RegWrite(uc.X86_REG_AX, 5)
+		f.RegWrite(uc.X86_REG_FLAGS, 0)
+		return nil
+	})
+	// Not found
+	call(0x21, 0x3D00, 0x0010, func() error {
+		f.RegWrite(uc.X86_REG_AX, 2)
+		f.RegWrite(uc.X86_REG_FLAGS, 1)
+		return errors.New("open file failed: 'DATA.DAT'")
+	})
+	// The door's own handler
+	call(0x21, 0x0900, 0x0020, func() error {
+		f.RegWrite(uc.X86_REG_CS, 0x3000)
+		return nil
+	})
+	f.RegWrite(uc.X86_REG_CS, 0x1000)
+	// Not traced
+	call(0x10, 0x0E41, 0, func() error { return nil })
+	f.RegWrite(uc.X86_REG_CS, 0x0F00)
+	call(0x21, 0x3E00, 0, func() error { return nil })
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Record{
+		{Seq: 1, Kind: Interrupt, At: "1000:0100", Int: "21", Func: "open file",
+			Args:   map[string]interface{}{"file": "DATA.DAT", "mode": "02"},
+			Result: map[string]interface{}{"handle": 5.0}},
+		{Seq: 2, Kind: Interrupt, At: "1000:0100", Int: "21", Func: "open file",
+			Args:  map[string]interface{}{"file": "DATA.DAT", "mode": "00"},
+			Carry: true, Error: "file not found", Message: "open file failed: 'DATA.DAT'"},
+		{Seq: 3, Kind: Interrupt, At: "1000:0100", Int: "21", Func: "write string",
+			Args: map[string]interface{}{"text": "Hi"}, Guest: true},
+	}
+	var got []Record
+	s := bufio.NewScanner(&out)
+	for s.Scan() {
+		var r Record
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("%s: %s", s.Bytes(), err)
+		}
+		if r.Regs == nil {
+			t.Errorf("%d: no registers", r.Seq)
+		}
+		r.Regs = nil
+		got = append(got, r)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("trace\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	ints, err := ParseInterrupts("21, 10h,1A")
+	if err != nil || !reflect.DeepEqual(ints, []uint8{0x21, 0x10, 0x1A}) {
+		t.Errorf("ParseInterrupts = %v, %v", ints, err)
+	}
+	if _, err := ParseInterrupts("21,100"); err == nil {
+		t.Error("parsed interrupt 100h")
+	}
+	for _, tc := range []struct {
+		s         string
+		low, high cpu.Seg
+		ok        bool
+	}{
+		{"1000", 0x1000, 0x1000, true},
+		{"1000-1fff", 0x1000, 0x1FFF, true},
+		{"2000-1000", 0, 0, false},
+		{"0", 0, 0, false},
+		{"x", 0, 0, false},
+	} {
+		low, high, err := ParseSegments(tc.s)
+		if (err == nil) != tc.ok || low != tc.low || high != tc.high {
+			t.Errorf("ParseSegments(%q) = %04X, %04X, %v", tc.s, low, high, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"door86.org/ivdoor/dos"
+)
+
+var (
+	cmdUnpack = flag.NewFlagSet("unpack", flag.ExitOnError)
+
+	unpackOut = cmdUnpack.String("o", "", "file to write the unpacked program to (default name.unp.exe next to it)")
+)
+
+// Where the unpacked copy of program goes by default: FOO.EXE becomes
+// FOO.UNP.EXE.
+func unpackedName(program string) string {
+	ext := filepath.Ext(program)
+	unp := ".unp"
+	if strings.ToUpper(ext) == ext {
+		unp = ".UNP"
+	}
+	return strings.TrimSuffix(program, ext) + unp + ext
+}
+
+// Writes the unpacked program in file to out.
+func unpack(file, out string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	unpacked, info, err := dos.Unpack(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if out == "" {
+		out = unpackedName(file)
+	}
+	if err := os.WriteFile(out, unpacked, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s, unpacked %d bytes to %s\n", file, info, len(unpacked), out)
+	return nil
+}
@@ -0,0 +1,222 @@
+package video
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parser states
+const (
+	ansiText = iota
+	// Seen ESC
+	ansiEsc
+	// Inside ESC [, collecting parameters
+	ansiCSI
+)
+
+type ansiState struct {
+	state int
+	// Parameters collected so far, including '=' and '?' prefixes
+	params []byte
+	// Inside a quoted string, which keyboard reassignment uses
+	quoted bool
+}
+
+// ANSI colour numbers to PC attribute colours, which have blue and red the
+// other way round.
+var ansiToPC = [8]byte{0, 4, 2, 6, 1, 5, 3, 7}
+
+// Write displays p as ANSI.SYS would: escape sequences move the cursor,
+// set colours and clear the screen, everything else goes through the
+// teletype.  Keyboard reassignment (ESC [ ... p) is ignored, and so is the
+// cursor position report, which the caller's own terminal answers.  AVATAR
+// codes are interpreted too when turned on with SetAvatar.
+func (s *Screen) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writing = true
+	for _, b := range p {
+		if s.avatar && s.avatarByte(b) {
+			continue
+		}
+		s.ansiByte(b)
+	}
+	s.writing = false
+	return len(p), nil
+}
+
+func (s *Screen) ansiByte(b byte) {
+	a := &s.ansi
+	switch a.state {
+	case ansiText:
+		if b == 0x1B {
+			a.state = ansiEsc
+			return
+		}
+		s.put(b)
+	case ansiEsc:
+		if b == '[' {
+			a.state = ansiCSI
+			a.params = a.params[:0]
+			a.quoted = false
+			return
+		}
+		// Not a sequence ANSI.SYS knows, display it
+		a.state = ansiText
+		s.put(0x1B)
+		s.put(b)
+	case ansiCSI:
+		if b == '"' {
+			a.quoted = !a.quoted
+		}
+		if !a.quoted && b >= 0x40 && b <= 0x7E {
+			a.state = ansiText
+			s.csi(b, string(a.params))
+			return
+		}
+		a.params = append(a.params, b)
+	}
+}
+
+// Parses the ; separated numbers, missing ones are -1.
+func parseParams(p string) []int {
+	if p == "" {
+		return nil
+	}
+	var n []int
+	for _, f := range strings.Split(p, ";") {
+		v, err := strconv.Atoi(f)
+		if err != nil {
+			v = -1
+		}
+		n = append(n, v)
+	}
+	return n
+}
+
+func param(n []int, i, def int) int {
+	if i >= len(n) || n[i] < 0 {
+		return def
+	}
+	return n[i]
+}
+
+func (s *Screen) csi(final byte, params string) {
+	private := strings.HasPrefix(params, "=") || strings.HasPrefix(params, "?")
+	if private {
+		params = params[1:]
+	}
+	n := parseParams(params)
+	switch final {
+	case 'A':
+		s.y = clamp(s.y-count(n), 0, Height-1)
+	case 'B':
+		s.y = clamp(s.y+count(n), 0, Height-1)
+	case 'C':
+		s.x = clamp(s.x+count(n), 0, Width-1)
+	case 'D':
+		s.x = clamp(s.x-count(n), 0, Width-1)
+	case 'H', 'f':
+		s.y = clamp(param(n, 0, 1)-1, 0, Height-1)
+		s.x = clamp(param(n, 1, 1)-1, 0, Width-1)
+	case 'J':
+		switch param(n, 0, 0) {
+		case 0:
+			s.clear(s.y, s.x, s.y, Width-1)
+			if s.y < Height-1 {
+				s.clear(s.y+1, 0, Height-1, Width-1)
+			}
+		case 1:
+			if s.y > 0 {
+				s.clear(0, 0, s.y-1, Width-1)
+			}
+			s.clear(s.y, 0, s.y, s.x)
+		case 2:
+			// ANSI.SYS also homes the cursor
+			s.clear(0, 0, Height-1, Width-1)
+			s.x, s.y = 0, 0
+		}
+	case 'K':
+		switch param(n, 0, 0) {
+		case 0:
+			s.clear(s.y, s.x, s.y, Width-1)
+		case 1:
+			s.clear(s.y, 0, s.y, s.x)
+		case 2:
+			s.clear(s.y, 0, s.y, Width-1)
+		}
+	case 'm':
+		if len(n) == 0 {
+			n = []int{0}
+		}
+		for _, v := range n {
+			s.sgr(v)
+		}
+	case 's':
+		s.savedX, s.savedY = s.x, s.y
+	case 'u':
+		s.x, s.y = s.savedX, s.savedY
+	case 'h', 'l':
+		// Mode 7 is line wrap, the rest are video modes
+		if param(n, 0, -1) == 7 {
+			s.wrap = final == 'h'
+		} else if final == 'h' && private {
+			s.clear(0, 0, Height-1, Width-1)
+			s.x, s.y = 0, 0
+		}
+	case 'n', 'p':
+		// Cursor position report and keyboard reassignment
+	}
+}
+
+// Returns the count for the cursor movements, where 0 also means 1.
+func count(n []int) int {
+	if c := param(n, 0, 1); c > 0 {
+		return c
+	}
+	return 1
+}
+
+// Applies one SGR parameter to the current attribute.
+func (s *Screen) sgr(v int) {
+	switch {
+	case v == 0:
+		s.attr = DefaultAttr
+	case v == 1:
+		s.attr |= 0x08
+	case v == 5:
+		s.attr |= 0x80
+	case v == 7:
+		// Reverse swaps foreground and background colours
+		s.attr = s.attr&0x88 | s.attr&0x07<<4 | s.attr>>4&0x07
+	case v == 8:
+		// Concealed, foreground the same as the background
+		s.attr = s.attr&0xF0 | s.attr>>4&0x07
+	case v >= 30 && v <= 37:
+		s.attr = s.attr&^0x07 | ansiToPC[v-30]
+	case v >= 40 && v <= 47:
+		s.attr = s.attr&^0x70 | ansiToPC[v-40]<<4
+	}
+}
+
+// SGR returns the escape sequence selecting the PC attribute attr.
+func SGR(attr byte) string {
+	var b strings.Builder
+	b.WriteString("\x1b[0")
+	if attr&0x08 != 0 {
+		b.WriteString(";1")
+	}
+	if attr&0x80 != 0 {
+		b.WriteString(";5")
+	}
+	// The PC colour order is its own inverse
+	fmt.Fprintf(&b, ";%d;%dm", 30+ansiToPC[attr&0x07], 40+ansiToPC[attr>>4&0x07])
+	return b.String()
+}
+
+// CUP returns the escape sequence moving the cursor to column x, row y,
+// counting from 0.
+func CUP(x, y int) string {
+	return fmt.Sprintf("\x1b[%d;%dH", y+1, x+1)
+}
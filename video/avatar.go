@@ -0,0 +1,163 @@
+package video
+
+// AVATAR/0 and AVT/0+ control codes.
+const (
+	avtClear  = 0x0C // ^L clear screen
+	avtCmd    = 0x16 // ^V starts a command
+	avtRepeat = 0x19 // ^Y ch n repeats a character
+)
+
+// AVATAR commands following ^V
+const (
+	avtAttr       = 0x01
+	avtBlink      = 0x02
+	avtUp         = 0x03
+	avtDown       = 0x04
+	avtLeft       = 0x05
+	avtRight      = 0x06
+	avtClearEOL   = 0x07
+	avtGoto       = 0x08
+	avtInsert     = 0x09
+	avtScrollUp   = 0x0A
+	avtScrollDown = 0x0B
+	avtClearArea  = 0x0C
+	avtFillArea   = 0x0D
+	avtDeleteChar = 0x0E
+	avtPattern    = 0x19
+)
+
+// Attribute set by ^L
+const avtClearAttr = 0x03
+
+// SetAvatar turns interpreting AVATAR/0+ codes in Write on or off.  ANSI
+// sequences are interpreted either way.
+func (s *Screen) SetAvatar(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.avatar = on
+	s.avt = s.avt[:0]
+}
+
+// Returns the length of the AVATAR code started in avt, or 0 when more is
+// needed to tell.
+func avatarLen(avt []byte) int {
+	switch avt[0] {
+	case avtClear:
+		return 1
+	case avtRepeat:
+		return 3
+	}
+	if len(avt) < 2 {
+		return 0
+	}
+	switch avt[1] {
+	case avtAttr:
+		return 3
+	case avtGoto:
+		return 4
+	case avtScrollUp, avtScrollDown:
+		return 7
+	case avtClearArea:
+		return 5
+	case avtFillArea:
+		return 6
+	case avtPattern:
+		// ^V ^Y n <n bytes> count
+		if len(avt) < 3 {
+			return 0
+		}
+		return 4 + int(avt[2])
+	}
+	return 2
+}
+
+// Handles b if it is part of an AVATAR code, returning false otherwise.
+func (s *Screen) avatarByte(b byte) bool {
+	if len(s.avt) == 0 {
+		if s.ansi.state != ansiText || (b != avtClear && b != avtCmd && b != avtRepeat) {
+			return false
+		}
+	}
+	s.avt = append(s.avt, b)
+	if n := avatarLen(s.avt); n != 0 && len(s.avt) == n {
+		s.avatarCode(s.avt)
+		s.avt = s.avt[:0]
+	}
+	return true
+}
+
+func (s *Screen) avatarCode(avt []byte) {
+	switch avt[0] {
+	case avtClear:
+		s.attr = avtClearAttr
+		s.clear(0, 0, Height-1, Width-1)
+		s.x, s.y = 0, 0
+		return
+	case avtRepeat:
+		for i := 0; i < int(avt[2]); i++ {
+			s.put(avt[1])
+		}
+		return
+	}
+	args := avt[2:]
+	switch avt[1] {
+	case avtAttr:
+		s.attr = args[0] & 0x7F
+	case avtBlink:
+		s.attr |= 0x80
+	case avtUp:
+		s.y = clamp(s.y-1, 0, Height-1)
+	case avtDown:
+		s.y = clamp(s.y+1, 0, Height-1)
+	case avtLeft:
+		s.x = clamp(s.x-1, 0, Width-1)
+	case avtRight:
+		s.x = clamp(s.x+1, 0, Width-1)
+	case avtClearEOL:
+		s.clear(s.y, s.x, s.y, Width-1)
+	case avtGoto:
+		s.y = clamp(int(args[0])-1, 0, Height-1)
+		s.x = clamp(int(args[1])-1, 0, Width-1)
+	case avtScrollUp, avtScrollDown:
+		// n top left bottom right, counting from 1
+		n := int(args[0])
+		if avt[1] == avtScrollDown {
+			n = -n
+		}
+		s.scroll(int(args[1])-1, int(args[2])-1, int(args[3])-1, int(args[4])-1, n, s.attr)
+	case avtClearArea:
+		// attr lines columns, from the cursor
+		s.attr = args[0] & 0x7F
+		s.fill(int(args[1]), int(args[2]), ' ', s.attr)
+	case avtFillArea:
+		// attr char lines columns, from the cursor
+		s.attr = args[0] & 0x7F
+		s.fill(int(args[2]), int(args[3]), args[1], s.attr)
+	case avtDeleteChar:
+		for x := s.x; x < Width-1; x++ {
+			o := offset(x+1, s.y)
+			s.set(x, s.y, s.cells[o], s.cells[o+1])
+		}
+		s.set(Width-1, s.y, ' ', s.attr)
+	case avtPattern:
+		n := int(args[0])
+		pattern, count := args[1:1+n], int(args[1+n])
+		for i := 0; i < count; i++ {
+			for _, b := range pattern {
+				s.put(b)
+			}
+		}
+	case avtInsert:
+		// Insert mode isn't supported, characters always overwrite
+	}
+}
+
+// Fills lines by columns cells from the cursor with ch in attr, leaving
+// the cursor where it is.
+func (s *Screen) fill(lines, columns int, ch, attr byte) {
+	for y := s.y; y < s.y+lines && y < Height; y++ {
+		for x := s.x; x < s.x+columns && x < Width; x++ {
+			s.set(x, y, ch, attr)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package video
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Emulation is the kind of terminal the caller has.
+type Emulation int
+
+const (
+	ANSI Emulation = iota
+	Avatar
+)
+
+func (e Emulation) String() string {
+	switch e {
+	case ANSI:
+		return "ansi"
+	case Avatar:
+		return "avatar"
+	}
+	return fmt.Sprintf("Emulation(%d)", int(e))
+}
+
+// ParseEmulation parses a terminal emulation name, ansi or avatar.
+func ParseEmulation(name string) (Emulation, error) {
+	switch strings.ToLower(name) {
+	case "ansi", "":
+		return ANSI, nil
+	case "avatar", "avt", "avt/0+":
+		return Avatar, nil
+	}
+	return ANSI, fmt.Errorf("unknown terminal emulation: '%s'", name)
+}
+
+// Encoder produces the terminal codes for drawing a screen.
+type Encoder interface {
+	// Goto moves the cursor to column x, row y, counting from 0
+	Goto(b []byte, x, y int) []byte
+	// Attr selects the PC attribute attr
+	Attr(b []byte, attr byte) []byte
+	// Chars draws ch n times at the cursor
+	Chars(b []byte, ch byte, n int) []byte
+	// Clear clears the screen
+	Clear(b []byte) []byte
+}
+
+// NewEncoder returns the encoder for the terminal emulation e.
+func NewEncoder(e Emulation) Encoder {
+	if e == Avatar {
+		return avatarEncoder{}
+	}
+	return ansiEncoder{}
+}
+
+type ansiEncoder struct{}
+
+func (ansiEncoder) Goto(b []byte, x, y int) []byte {
+	return append(b, CUP(x, y)...)
+}
+
+func (ansiEncoder) Attr(b []byte, attr byte) []byte {
+	return append(b, SGR(attr)...)
+}
+
+func (ansiEncoder) Clear(b []byte) []byte {
+	return append(b, "\x1b[0m\x1b[2J\x1b[H"...)
+}
+
+// Control characters the terminal would act on, which may be any of them
+// or DEL, are drawn as blanks.
+func (ansiEncoder) Chars(b []byte, ch byte, n int) []byte {
+	if ch < 0x20 || ch == 0x7F {
+		ch = ' '
+	}
+	for i := 0; i < n; i++ {
+		b = append(b, ch)
+	}
+	return b
+}
+
+type avatarEncoder struct{}
+
+func (avatarEncoder) Goto(b []byte, x, y int) []byte {
+	return append(b, avtCmd, avtGoto, byte(y+1), byte(x+1))
+}
+
+func (avatarEncoder) Attr(b []byte, attr byte) []byte {
+	b = append(b, avtCmd, avtAttr, attr&0x7F)
+	if attr&0x80 != 0 {
+		b = append(b, avtCmd, avtBlink)
+	}
+	return b
+}
+
+func (avatarEncoder) Clear(b []byte) []byte {
+	return append(b, avtClear)
+}
+
+// Runs of three or more use ^Y, as do the characters that would otherwise
+// start an AVATAR code.
+func (avatarEncoder) Chars(b []byte, ch byte, n int) []byte {
+	special := ch == avtClear || ch == avtCmd || ch == avtRepeat
+	for n > 0 {
+		if n < 3 && !special {
+			for ; n > 0; n-- {
+				b = append(b, ch)
+			}
+			break
+		}
+		c := n
+		if c > 255 {
+			c = 255
+		}
+		b = append(b, avtRepeat, ch, byte(c))
+		n -= c
+	}
+	return b
+}
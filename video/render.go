@@ -0,0 +1,165 @@
+package video
+
+import (
+	"io"
+	"time"
+)
+
+// Renderer sends the caller the parts of the screen they haven't seen:
+// what the guest drew in video memory or through the BIOS, or everything
+// when the screen is set to RenderAll.
+//
+// A mirror renderer instead keeps its own copy of what it has sent, and
+// sends every change to the screen.  That's how the screen is shown to
+// anyone other than the caller.
+type Renderer struct {
+	s   *Screen
+	enc Encoder
+	w   io.Writer
+	// Runs its argument so that it can't interleave with console output,
+	// typically console.Console.Locked
+	lock func(func())
+	// Cursor position last sent to the caller
+	x, y int
+	// What a mirror has sent, nil for the caller's renderer
+	shadow []byte
+	// Clear and draw the whole screen next time, guarded by the screen's
+	// lock
+	full bool
+}
+
+// NewRenderer returns a renderer drawing s on w with enc.  lock may be nil
+// when nothing else writes to w.
+func NewRenderer(s *Screen, enc Encoder, w io.Writer, lock func(func())) *Renderer {
+	if lock == nil {
+		lock = func(f func()) { f() }
+	}
+	return &Renderer{s: s, enc: enc, w: w, lock: lock, x: -1}
+}
+
+// NewMirror returns a renderer sending every change to s to w, starting
+// with the whole screen.
+func NewMirror(s *Screen, enc Encoder, w io.Writer, lock func(func())) *Renderer {
+	r := NewRenderer(s, enc, w, lock)
+	r.shadow = make([]byte, Size)
+	r.full = true
+	return r
+}
+
+// Invalidate makes the next flush clear and draw the whole screen, for
+// when something else has drawn over it.
+func (r *Renderer) Invalidate() {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.full = true
+}
+
+// Repaint clears and draws the whole screen now.  It doesn't take the
+// lock, so it's for use while holding it.
+func (r *Renderer) Repaint() error {
+	r.Invalidate()
+	_, err := r.w.Write(r.render())
+	return err
+}
+
+// Flush sends the caller everything they haven't seen yet.
+func (r *Renderer) Flush() error {
+	var err error
+	r.lock(func() {
+		if b := r.render(); len(b) > 0 {
+			_, err = r.w.Write(b)
+		}
+	})
+	return err
+}
+
+// Run flushes every interval until done is closed or a write fails.
+func (r *Renderer) Run(interval time.Duration, done <-chan struct{}) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return r.Flush()
+		case <-t.C:
+			if err := r.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Whether cell i has to be sent.  The bottom right cell never is.
+func (r *Renderer) changed(i int) bool {
+	if i == Width*Height-1 {
+		return false
+	}
+	if r.full {
+		return true
+	}
+	if r.shadow != nil {
+		o := i * 2
+		return r.s.cells[o] != r.shadow[o] || r.s.cells[o+1] != r.shadow[o+1]
+	}
+	return r.s.stale[i]
+}
+
+func (r *Renderer) sent(i int) {
+	if r.shadow != nil {
+		copy(r.shadow[i*2:i*2+2], r.s.cells[i*2:i*2+2])
+		return
+	}
+	r.s.stale[i] = false
+}
+
+// Returns the output drawing the changed cells, then putting the cursor
+// and attribute back where the screen has them.  The bottom right cell is
+// never drawn since that would scroll most terminals.
+func (r *Renderer) render() []byte {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b []byte
+	if r.full {
+		b = r.enc.Clear(b)
+	}
+	attr := -1
+	for y := 0; y < Height; y++ {
+		for x := 0; x < Width; {
+			if !r.changed(y*Width + x) {
+				x++
+				continue
+			}
+			b = r.enc.Goto(b, x, y)
+			for x < Width && r.changed(y*Width+x) {
+				o := offset(x, y)
+				ch, a := s.cells[o], s.cells[o+1]
+				if int(a) != attr {
+					b = r.enc.Attr(b, a)
+					attr = int(a)
+				}
+				// Run of the same character in the same colour
+				n := 0
+				for x < Width && r.changed(y*Width+x) && s.cells[offset(x, y)] == ch && s.cells[offset(x, y)+1] == a {
+					r.sent(y*Width + x)
+					n++
+					x++
+				}
+				b = r.enc.Chars(b, ch, n)
+			}
+		}
+	}
+	r.full = false
+	if len(b) > 0 {
+		b = r.enc.Attr(b, s.attr)
+	}
+	// Console output moves the caller's cursor itself, unless it only goes
+	// to the screen
+	track := s.renderAll || r.shadow != nil
+	if len(b) > 0 || (track && (s.x != r.x || s.y != r.y)) {
+		b = r.enc.Goto(b, s.x, s.y)
+		r.x, r.y = s.x, s.y
+	}
+	return b
+}
@@ -0,0 +1,323 @@
+// Package video keeps the emulated text screen: an 80x25 colour text mode
+// laid out as in video memory at B800h, with character and attribute bytes
+// for each cell.
+package video
+
+import "sync"
+
+const (
+	Width  = 80
+	Height = 25
+	// Bytes of video memory used by the screen
+	Size = Width * Height * 2
+	// Segment of the text mode video memory
+	Segment = 0xB800
+	// Light grey on black, what DOS starts with
+	DefaultAttr = 0x07
+)
+
+// Screen is the emulated text screen.  Output to the console is written to
+// it through the ANSI.SYS interpreter in Write, and the BIOS reads and
+// updates it for INT 10h.
+type Screen struct {
+	mu    sync.Mutex
+	cells [Size]byte
+	x, y  int
+	attr  byte
+	// Wrap to the next line at the end of a line, ESC [ 7 h
+	wrap           bool
+	savedX, savedY int
+
+	// ANSI.SYS parser state
+	ansi ansiState
+	// Interpret AVATAR codes, and the one being collected
+	avatar bool
+	avt    []byte
+
+	// Cells the caller hasn't seen, drawn by the guest in video memory or
+	// through the BIOS rather than sent as console output
+	stale [Width * Height]bool
+	// In Write, console output the caller sees as well
+	writing bool
+	// Console output doesn't reach the caller, so everything is stale
+	renderAll bool
+
+	// Range of cells changed since the last flush, as offsets into cells
+	dirtyLo, dirtyHi int
+	// Called with changes to copy them into video memory
+	sync func(offset int, b []byte)
+	// Called when the cursor has moved
+	syncCursor   func(x, y int)
+	syncX, syncY int
+}
+
+// NewScreen returns a blank screen with the cursor at the top left.
+func NewScreen() *Screen {
+	s := &Screen{attr: DefaultAttr, wrap: true, dirtyLo: Size}
+	s.clear(0, 0, Height-1, Width-1)
+	// The caller's terminal is taken to start out blank as well
+	s.stale = [Width * Height]bool{}
+	return s
+}
+
+// SetSync sets the functions Sync calls with the changes to the screen and
+// the cursor's moves, so they can be copied into video memory and the BIOS
+// data area.  The next Sync has the whole screen and the cursor.
+func (s *Screen) SetSync(cells func(offset int, b []byte), cursor func(x, y int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sync = cells
+	s.syncCursor = cursor
+	s.markDirty(0, Size)
+	s.syncX = -1
+}
+
+// Sync calls the functions set by SetSync with what changed since it was
+// last called.  The screen is written from other goroutines, such as
+// sysop chat, while the emulator runs, so this lets video memory be
+// updated on the emulator's own.
+func (s *Screen) Sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+}
+
+// Poke stores b at offset in the screen without calling the sync function,
+// for writes the guest made to video memory itself.
+func (s *Screen) Poke(offset int, b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range b {
+		o := offset + i
+		if o < 0 || o >= Size {
+			return
+		}
+		if s.cells[o] != v {
+			s.cells[o] = v
+			s.stale[o/2] = true
+		}
+	}
+}
+
+// RenderAll marks every change as unseen by the caller, for when console
+// output only goes to the screen and a Renderer sends it to the caller.
+func (s *Screen) RenderAll(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renderAll = on
+}
+
+// Bytes returns a copy of the screen in video memory layout.
+func (s *Screen) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := make([]byte, Size)
+	copy(b, s.cells[:])
+	return b
+}
+
+// Cell returns the character and attribute at column x, row y.
+func (s *Screen) Cell(x, y int) (byte, byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := offset(x, y)
+	return s.cells[o], s.cells[o+1]
+}
+
+// Row returns the characters on row y.
+func (s *Screen) Row(y int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := make([]byte, Width)
+	for x := range b {
+		b[x] = s.cells[offset(x, y)]
+	}
+	return string(b)
+}
+
+// Cursor returns the cursor column and row, from 0.
+func (s *Screen) Cursor() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.x, s.y
+}
+
+// Attr returns the attribute used for new characters.
+func (s *Screen) Attr() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attr
+}
+
+// SetCells sets n cells starting at column x, row y to ch in attr without
+// moving the cursor, as INT 10h 09h does.
+func (s *Screen) SetCells(x, y, n int, ch, attr byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for o := offset(x, y); n > 0 && o < Size; o += 2 {
+		s.set(o/2%Width, o/2/Width, ch, attr)
+		n--
+	}
+}
+
+// SetChars sets n cells starting at column x, row y to ch keeping their
+// attributes, as INT 10h 0Ah does.
+func (s *Screen) SetChars(x, y, n int, ch byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for o := offset(x, y); n > 0 && o < Size; o += 2 {
+		s.set(o/2%Width, o/2/Width, ch, s.cells[o+1])
+		n--
+	}
+}
+
+// Scroll scrolls the window from top, left to bottom, right by n lines, up
+// when n is positive and down when negative, filling the lines scrolled in
+// with attr.  n == 0 clears the window as INT 10h 06h does.
+func (s *Screen) Scroll(top, left, bottom, right, n int, attr byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scroll(top, left, bottom, right, n, attr)
+}
+
+func offset(x, y int) int {
+	return (y*Width + x) * 2
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func (s *Screen) markDirty(lo, hi int) {
+	if lo < s.dirtyLo {
+		s.dirtyLo = lo
+	}
+	if hi > s.dirtyHi {
+		s.dirtyHi = hi
+	}
+}
+
+func (s *Screen) flush() {
+	if s.syncCursor != nil && (s.x != s.syncX || s.y != s.syncY) {
+		s.syncCursor(s.x, s.y)
+		s.syncX, s.syncY = s.x, s.y
+	}
+	if s.dirtyLo >= s.dirtyHi {
+		return
+	}
+	if s.sync != nil {
+		s.sync(s.dirtyLo, s.cells[s.dirtyLo:s.dirtyHi])
+	}
+	s.dirtyLo, s.dirtyHi = Size, 0
+}
+
+// Whether a change now is one the caller hasn't seen.
+func (s *Screen) unseen() bool {
+	return !s.writing || s.renderAll
+}
+
+func (s *Screen) set(x, y int, ch, attr byte) {
+	o := offset(x, y)
+	s.cells[o] = ch
+	s.cells[o+1] = attr
+	s.stale[o/2] = s.unseen()
+	s.markDirty(o, o+2)
+}
+
+// Fills the rectangle with blanks in the current attribute.
+func (s *Screen) clear(top, left, bottom, right int) {
+	for y := top; y <= bottom; y++ {
+		for x := left; x <= right; x++ {
+			s.set(x, y, ' ', s.attr)
+		}
+	}
+}
+
+func (s *Screen) scroll(top, left, bottom, right, n int, attr byte) {
+	top, bottom = clamp(top, 0, Height-1), clamp(bottom, 0, Height-1)
+	left, right = clamp(left, 0, Width-1), clamp(right, 0, Width-1)
+	if top > bottom || left > right {
+		return
+	}
+	rows := bottom - top + 1
+	if n == 0 || n >= rows || -n >= rows {
+		n = rows
+	}
+	copyRow := func(dst, src int) {
+		copy(s.cells[offset(left, dst):offset(right, dst)+2], s.cells[offset(left, src):offset(right, src)+2])
+		copy(s.stale[dst*Width+left:dst*Width+right+1], s.stale[src*Width+left:src*Width+right+1])
+	}
+	if n > 0 {
+		for y := top; y+n <= bottom; y++ {
+			copyRow(y, y+n)
+		}
+		for y := bottom - n + 1; y <= bottom; y++ {
+			for x := left; x <= right; x++ {
+				s.set(x, y, ' ', attr)
+			}
+		}
+	} else {
+		n = -n
+		for y := bottom; y-n >= top; y-- {
+			copyRow(y, y-n)
+		}
+		for y := top; y < top+n; y++ {
+			for x := left; x <= right; x++ {
+				s.set(x, y, ' ', attr)
+			}
+		}
+	}
+	s.markDirty(offset(left, top), offset(right, bottom)+2)
+	// The caller's terminal scrolls along with console output, but nothing
+	// else scrolls the window for them
+	if s.unseen() {
+		for y := top; y <= bottom; y++ {
+			for x := left; x <= right; x++ {
+				s.stale[y*Width+x] = true
+			}
+		}
+	}
+}
+
+func (s *Screen) lineFeed() {
+	if s.y < Height-1 {
+		s.y++
+		return
+	}
+	s.scroll(0, 0, Height-1, Width-1, 1, s.attr)
+}
+
+// Displays b at the cursor as the BIOS teletype does: BEL, BS, TAB, LF and
+// CR move the cursor, everything else is drawn.
+func (s *Screen) put(b byte) {
+	switch b {
+	case 0x07:
+	case 0x08:
+		if s.x > 0 {
+			s.x--
+		}
+	case 0x09:
+		s.x = clamp((s.x+8)&^7, 0, Width-1)
+	case 0x0A:
+		s.lineFeed()
+	case 0x0D:
+		s.x = 0
+	default:
+		s.set(s.x, s.y, b, s.attr)
+		s.x++
+		if s.x == Width {
+			if s.wrap {
+				s.x = 0
+				s.lineFeed()
+			} else {
+				s.x = Width - 1
+			}
+		}
+	}
+}
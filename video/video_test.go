@@ -0,0 +1,215 @@
+package video
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTeletype(t *testing.T) {
+	s := NewScreen()
+	s.Write([]byte("Hello\r\nWorld\b\bx"))
+	if got := strings.TrimRight(s.Row(0), " "); got != "Hello" {
+		t.Errorf("row 0 = %q", got)
+	}
+	if got := strings.TrimRight(s.Row(1), " "); got != "Worxd" {
+		t.Errorf("row 1 = %q", got)
+	}
+	if x, y := s.Cursor(); x != 4 || y != 1 {
+		t.Errorf("cursor at %d,%d", x, y)
+	}
+
+	// Writing past the bottom scrolls
+	s.Write([]byte("\x1b[25;1Hlast\r\n"))
+	if got := strings.TrimRight(s.Row(23), " "); got != "last" {
+		t.Errorf("row 23 after scroll = %q", got)
+	}
+	if got := strings.TrimRight(s.Row(0), " "); got != "Worxd" {
+		t.Errorf("row 0 after scroll = %q", got)
+	}
+}
+
+func TestANSI(t *testing.T) {
+	s := NewScreen()
+	s.Write([]byte("\x1b[2J\x1b[5;10H\x1b[1;33;44mX\x1b[0m"))
+	if ch, attr := s.Cell(9, 4); ch != 'X' || attr != 0x1E {
+		t.Errorf("cell 9,4 = %q 0x%02X, want 'X' 0x1E", ch, attr)
+	}
+	if attr := s.Attr(); attr != DefaultAttr {
+		t.Errorf("attr after reset = 0x%02X", attr)
+	}
+
+	s.Write([]byte("\x1b[s\x1b[3A\x1b[2Cab\x1b[u"))
+	if x, y := s.Cursor(); x != 10 || y != 4 {
+		t.Errorf("cursor after restore at %d,%d", x, y)
+	}
+	if got := s.Row(1)[12:14]; got != "ab" {
+		t.Errorf("row 1 = %q", got)
+	}
+
+	// Erase to end of line, and keyboard reassignment is swallowed
+	s.Write([]byte("\x1b[2;1H\x1b[K\x1b[0;68;\"dir\";13p"))
+	if got := strings.TrimSpace(s.Row(1)); got != "" {
+		t.Errorf("row 1 after erase = %q", got)
+	}
+	if x, y := s.Cursor(); x != 0 || y != 1 {
+		t.Errorf("cursor at %d,%d", x, y)
+	}
+}
+
+func TestSGRRoundTrip(t *testing.T) {
+	for _, attr := range []byte{0x07, 0x1E, 0x4F, 0xCE, 0x70} {
+		s := NewScreen()
+		s.Write([]byte(SGR(attr)))
+		if got := s.Attr(); got != attr {
+			t.Errorf("SGR(0x%02X) gives 0x%02X", attr, got)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	s := NewScreen()
+	mem := make([]byte, Size)
+	var cx, cy int
+	s.SetSync(func(off int, b []byte) { copy(mem[off:], b) }, func(x, y int) { cx, cy = x, y })
+	s.Sync()
+	if mem[0] != ' ' || mem[1] != DefaultAttr {
+		t.Fatalf("initial sync: % X", mem[:2])
+	}
+	s.Write([]byte("\x1b[2;3H\x1b[31mA"))
+	// Only copied when the emulator syncs
+	if o := offset(2, 1); mem[o] != ' ' {
+		t.Errorf("video memory at 2,1 written before Sync: % X", mem[o:o+2])
+	}
+	s.Sync()
+	if o := offset(2, 1); mem[o] != 'A' || mem[o+1] != 0x04 {
+		t.Errorf("video memory at 2,1 = % X", mem[o:o+2])
+	}
+	if cx != 3 || cy != 1 {
+		t.Errorf("synced cursor at %d,%d", cx, cy)
+	}
+}
+
+func TestAvatar(t *testing.T) {
+	s := NewScreen()
+	s.SetAvatar(true)
+	// Clear, goto 3,5, bright white on blue, "ab", then ten '='
+	s.Write([]byte("\x0c\x16\x08\x03\x05\x16\x01\x1fab\x19=\x0a"))
+	if got := s.Row(2)[4:16]; got != "ab==========" {
+		t.Errorf("row 2 = %q", got)
+	}
+	if _, attr := s.Cell(4, 2); attr != 0x1F {
+		t.Errorf("attr = 0x%02X", attr)
+	}
+	if x, y := s.Cursor(); x != 16 || y != 2 {
+		t.Errorf("cursor at %d,%d", x, y)
+	}
+	// ANSI still works alongside, and ^V ^Y repeats a pattern
+	s.Write([]byte("\x1b[1;1H\x16\x19\x02-+\x03"))
+	if got := s.Row(0)[:7]; got != "-+-+-+ " {
+		t.Errorf("row 0 = %q", got)
+	}
+
+	// Without AVATAR the codes are just characters
+	s = NewScreen()
+	s.Write([]byte("\x19=\x03"))
+	if got := s.Row(0)[:3]; got != "\x19=\x03" {
+		t.Errorf("row 0 = %q", got)
+	}
+}
+
+func TestAvatarEncoder(t *testing.T) {
+	enc := NewEncoder(Avatar)
+	b := enc.Goto(nil, 9, 4)
+	b = enc.Attr(b, 0x9E)
+	b = enc.Chars(b, '-', 300)
+	b = enc.Chars(b, avtCmd, 1)
+	want := "\x16\x08\x05\x0a\x16\x01\x1e\x16\x02\x19-\xff\x19-\x2d\x19\x16\x01"
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+func TestANSIEncoderControls(t *testing.T) {
+	enc := NewEncoder(ANSI)
+	var b []byte
+	// SO switches a VT terminal to its other character set
+	for _, ch := range []byte{0x0E, 0x0F, 0x0B, 0x01, 0x1F, 0x7F, 0x1B} {
+		b = enc.Chars(b, ch, 1)
+	}
+	b = enc.Chars(b, 0x80, 2)
+	if want := "       \x80\x80"; string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+// Drawing what a renderer sends on another screen must give the same
+// screen, for both encoders.
+func TestRenderer(t *testing.T) {
+	for _, e := range []Emulation{ANSI, Avatar} {
+		s := NewScreen()
+		s.Write([]byte("\x1b[1;1H\x1b[1;32mhi\x1b[0m\x1b[10;10H"))
+		var out strings.Builder
+		r := NewRenderer(s, NewEncoder(e), &out, nil)
+		if r.Flush(); out.Len() != 0 {
+			t.Errorf("%s: console output rendered again: %q", e, out.String())
+		}
+
+		// The guest writes directly to video memory
+		s.Poke(offset(5, 3), []byte{'X', 0x4E, 'Y', 0x4E})
+		s.SetCells(0, 24, 80, '#', 0x02)
+		r.Flush()
+
+		caller := NewScreen()
+		caller.SetAvatar(e == Avatar)
+		caller.Write([]byte(SGR(0x0A) + "hi" + SGR(0x07)))
+		caller.Write([]byte(out.String()))
+		if got := caller.Row(3)[5:7]; got != "XY" {
+			t.Errorf("%s: rendered row 3 = %q", e, got)
+		}
+		if _, attr := caller.Cell(6, 3); attr != 0x4E {
+			t.Errorf("%s: rendered attr = 0x%02X", e, attr)
+		}
+		if got := caller.Row(24); got != strings.Repeat("#", 79)+" " {
+			t.Errorf("%s: rendered row 24 = %q", e, got)
+		}
+		if x, y := caller.Cursor(); x != 9 || y != 9 {
+			t.Errorf("%s: cursor at %d,%d", e, x, y)
+		}
+		if attr := caller.Attr(); attr != DefaultAttr {
+			t.Errorf("%s: attr left at 0x%02X", e, attr)
+		}
+	}
+}
+
+// A mirror sends the whole screen first, then every change, including
+// what the caller's renderer doesn't send again.
+func TestMirror(t *testing.T) {
+	s := NewScreen()
+	s.Write([]byte("\x1b[3;5H\x1b[1;36mhello\x1b[0m"))
+	var out strings.Builder
+	m := NewMirror(s, NewEncoder(ANSI), &out, nil)
+	m.Flush()
+	sysop := NewScreen()
+	sysop.Write([]byte("garbage"))
+	sysop.Write([]byte(out.String()))
+	if got := sysop.Row(2)[4:9]; got != "hello" {
+		t.Errorf("mirrored row 2 = %q", got)
+	}
+	if got := strings.TrimSpace(sysop.Row(0)); got != "" {
+		t.Errorf("mirrored row 0 = %q", got)
+	}
+
+	out.Reset()
+	if m.Flush(); out.Len() != 0 {
+		t.Errorf("unchanged screen sent %q", out.String())
+	}
+	s.Write([]byte("\r\nthere"))
+	m.Flush()
+	sysop.Write([]byte(out.String()))
+	if got := sysop.Row(3)[:5]; got != "there" {
+		t.Errorf("mirrored row 3 = %q", got)
+	}
+	if x, y := sysop.Cursor(); x != 5 || y != 3 {
+		t.Errorf("mirrored cursor at %d,%d", x, y)
+	}
+}